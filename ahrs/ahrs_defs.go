@@ -9,7 +9,7 @@ import (
 
 const (
 	Pi              = math.Pi
-	G               = 32.1740 / 1.687810 // G is the acceleration due to gravity, kt/s
+	G               = GravityFtPerS2 / FtPerKt // G is the acceleration due to gravity in kt/s, since speeds are in kt
 	Small           = 1e-9
 	Big             = 1e9
 	Deg             = Pi / 180
@@ -17,6 +17,38 @@ const (
 	Invalid float64 = 3276.7     // 2**15-1
 )
 
+// Units used inside the package: speeds are in kt, accelerations in multiples of gravity (multiply by G for kt/s),
+// attitude angles in radians, gyro rates in °/s, magnetic fields in µT, altitudes in ft and times in s.
+// Use the conversions below at the edges of the package.
+// The filters only tie speeds to accelerations through gravity, so they run with speeds in m/s just as well
+// given SetGravity(GravityMps2); pressure altitude is still integrated from the vertical speed taken in kt.
+const (
+	FtPerKt        = 1.687810      // FtPerKt is feet per second per knot
+	MpsPerKt       = 1852.0 / 3600 // MpsPerKt is meters per second per knot, exactly
+	GravityFtPerS2 = 32.1740       // GravityFtPerS2 is standard gravity in ft/s²
+	GravityMps2    = 9.80665       // GravityMps2 is standard gravity in m/s², exactly
+)
+
+// KtToMps converts a speed from knots to meters per second.
+func KtToMps(kt float64) float64 {
+	return kt * MpsPerKt
+}
+
+// MpsToKt converts a speed from meters per second to knots.
+func MpsToKt(mps float64) float64 {
+	return mps / MpsPerKt
+}
+
+// KtToFpm converts a speed from knots to feet per minute, as for vertical speed.
+func KtToFpm(kt float64) float64 {
+	return kt * FtPerKt * 60
+}
+
+// FpmToKt converts a speed from feet per minute to knots.
+func FpmToKt(fpm float64) float64 {
+	return fpm / 60 / FtPerKt
+}
+
 // AHRSProvider defines an AHRS (Kalman or other) algorithm, such as ahrs_kalman, ahrs_simple, etc.
 type AHRSProvider interface {
 	// RollPitchHeading returns the current attitude values as estimated by the Kalman algorithm.
@@ -52,6 +84,19 @@ type AHRSProvider interface {
 	GetLogMap() map[string]interface{}
 }
 
+// Estimator is a streaming attitude estimator, stepped forward in time by Predict and corrected by Update,
+// so that application code can swap one algorithm for another.  KalmanState and MahonyState implement it;
+// their AHRSProvider Compute does both for a single measurement.
+type Estimator interface {
+	// Predict steps the estimate forward to time t, in s; ok reports whether it was moved.
+	Predict(t float64) (ok bool)
+	// Update corrects the estimate with the measurement m; gated reports which measurement blocks,
+	// indexed by BlockU etc., were rejected.
+	Update(m *Measurement) (gated [6]bool)
+	// RollPitchHeading returns the current attitude estimate, in radians.
+	RollPitchHeading() (roll float64, pitch float64, heading float64)
+}
+
 // Measurement holds the measurements used for updating the Kalman filter:
 // true airspeed, groundspeed, accelerations, gyro rates, magnetometer, time;
 // along with variance accumulators and uncertainty matrix.
@@ -59,16 +104,20 @@ type AHRSProvider interface {
 // until appropriate sensors are working.
 type Measurement struct { // Order here also defines order in the matrices below
 	UValid, WValid, SValid, MValid bool // Do we have valid airspeed, GPS, accel/gyro, and magnetometer readings?
-	// U, W, A, B, M
+	PValid                         bool // Do we have a valid pressure altitude?
+	// U, W, A, B, M, P
 	U1, U2, U3 float64 // Vector of measured airspeed, kt, aircraft (accelerated) frame
-	W1, W2, W3 float64 // Vector of GPS speed in N/S, E/W and U/D directions, kt, latlong axes, earth (inertial) frame
+	W1, W2, W3 float64 // Vector of GPS speed in E/W, N/S and U/D directions, kt, latlong axes, earth (inertial) frame
 	A1, A2, A3 float64 // Vector holding accelerometer readings, G, aircraft (accelerated) frame
 	B1, B2, B3 float64 // Vector of gyro rates in roll, pitch, heading axes, °/s, aircraft (accelerated) frame
 	M1, M2, M3 float64 // Vector of magnetometer readings, µT, aircraft (accelerated) frame
+	P          float64 // Pressure altitude, ft
 	TW, TU, T  float64 // Timestamp of GPS, airspeed and sensor readings
 	//TODO westphae: track separate measurement timestamps for Gyro/Accel, Magnetometer, GPS, Baro
 
-	Accums [15]func(float64) (float64, float64, float64) // Accumulators to track means & variances of all variables
+	DW1, DW2, DW3 float64 // GPS-reported speed accuracy (standard deviation) per axis, kt; 0 if not reported
+
+	Accums [16]func(float64) (float64, float64, float64) // Accumulators to track means & variances of all variables
 
 	M *matrix.DenseMatrix // Measurement noise covariance
 }
@@ -95,10 +144,36 @@ func NewMeasurement() (m *Measurement) {
 	m.Accums[12] = NewVarianceAccumulator(0, 80, MMDecay) // 70 typical from sensor
 	m.Accums[13] = NewVarianceAccumulator(0, 80, MMDecay)
 	m.Accums[14] = NewVarianceAccumulator(0, 80, MMDecay)
+	m.Accums[15] = NewVarianceAccumulator(0, 25, MMDecay)
 
 	return
 }
 
+// NewGPSMeasurement returns a pointer to an AHRS Measurement holding a GPS velocity,
+// given as groundspeed and vertical speed in kt and true track in degrees.
+func NewGPSMeasurement(groundspeedKt, trackDeg, verticalSpeedKt float64) (m *Measurement) {
+	m = NewMeasurement()
+	m.SetGPS(groundspeedKt, trackDeg, verticalSpeedKt)
+	return
+}
+
+// GPSFix is a GPS velocity fix, as taken by KalmanState.Step.
+type GPSFix struct {
+	GroundspeedKt   float64 // Groundspeed, kt
+	TrackDeg        float64 // True track, °
+	VerticalSpeedKt float64 // Vertical speed, up positive, kt
+	T               float64 // Time of the fix, s
+}
+
+// SetGPS fills in the earth-frame GPS velocity W1 (east), W2 (north), W3 (up) of the Measurement
+// from groundspeed and vertical speed in kt and true track in degrees, and marks it valid.
+func (m *Measurement) SetGPS(groundspeedKt, trackDeg, verticalSpeedKt float64) {
+	m.W1 = groundspeedKt * math.Sin(trackDeg*Deg)
+	m.W2 = groundspeedKt * math.Cos(trackDeg*Deg)
+	m.W3 = verticalSpeedKt
+	m.WValid = true
+}
+
 // Regularize ensures that roll, pitch, and heading are in the correct ranges.
 // All in radians.
 func Regularize(roll, pitch, heading float64) (float64, float64, float64) {
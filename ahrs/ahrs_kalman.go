@@ -3,13 +3,89 @@
 package ahrs
 
 import (
+	"fmt"
 	"github.com/skelterjohn/go.matrix"
 	"log"
 	"math"
 )
 
+const (
+	innovationGateDefault      = 3.0  // Sensible default for the innovation gate, sigmas per dimension
+	magDisturbance             = 0.15 // Fractional deviation from the reference field strength beyond which the mag is disturbed
+	complementaryGain          = 0.05 // Fraction of the attitude error corrected per step by the fallback complementary filter
+	divergenceThresholdDefault = 16.0 // Sensible default for the average normalized innovation squared per dimension of a diverged filter
+	divergenceWindowDefault    = 2.0  // Sensible default for how long the filter must look diverged before it's re-initialized, s
+	nisSmoothing               = 0.1  // Fraction of each new normalized innovation squared taken into its running average
+	unitTolerance              = 1e-6 // Deviation from unit norm beyond which the quaternions are renormalized before predicting
+)
+
+// Measurement blocks which can be individually gated in Update, indexing its result.
+const (
+	BlockU = iota // Airspeed U1, U2, U3
+	BlockW        // GPS speed W1, W2, W3
+	BlockA        // Accelerometer A1, A2, A3
+	BlockB        // Gyro B1, B2, B3
+	BlockM        // Magnetometer M1, M2, M3
+	BlockP        // Pressure altitude P
+)
+
+// blockRows holds the first and last+1 rows of each measurement block in the measurement vector.
+var blockRows = [...][2]int{{0, 3}, {3, 6}, {6, 9}, {9, 12}, {12, 15}, {15, 16}}
+
 type KalmanState struct {
 	State
+	gate             float64             // Innovation gate, sigmas per dimension, beyond which a measurement block is rejected
+	processNoise     []float64           // Process noise standard deviations per s, nil for the defaults
+	measurementNoise []float64           // Measurement noise standard deviations, nil for the defaults
+	magRef           float64             // Reference strength of the local magnetic field, µT, 0 until known
+	condition        float64             // Conditioning of the innovation covariance at the last Update, see ConditionNumber
+	r                *matrix.DenseMatrix // Measurement noise covariance built at the last Update, before innovation gating
+	step             *Measurement        // Measurement reused by Step, so its variance accumulators settle
+
+	divergenceThreshold float64 // Average normalized innovation squared per dimension beyond which the filter is diverging
+	divergenceWindow    float64 // How long the filter must be diverging before it's re-initialized, s
+	nisAvg              float64 // Running average of the largest normalized innovation squared per dimension of the attitude blocks used
+	diverging           bool    // Whether nisAvg is beyond divergenceThreshold
+	divergingSince      float64 // Time nisAvg went beyond divergenceThreshold
+
+	// OnCondition, if set, is called by Update with the conditioning of the innovation covariance
+	// before it is inverted, so that monitoring code can reset the filter before the inversion fails.
+	OnCondition func(condition float64)
+
+	// OnReinitialize, if set, is called by Update when the filter has diverged and has been re-initialized
+	// from the measurement at time t, with the running average normalized innovation squared nis that tripped it
+	// (infinite if the state itself went non-finite).
+	OnReinitialize func(t, nis float64)
+}
+
+// defaultMeasurementNoise holds the fixed measurement noise standard deviations used in Update.
+// Zero means the variance is estimated from the measurements themselves.
+var defaultMeasurementNoise = []float64{
+	0, 1, 1, // U*3: U2, U3 are just here to bias toward coordinated flight
+	0, 0, 0, // W*3
+	0, 0, 0, // A*3
+	0, 0, 0, // B*3
+	0, 0, 0, // M*3
+	0,       // P
+}
+
+// defaultProcessNoise returns the diagonal of state process uncertainties per s.
+// Tuning these is more important than tuning the initial state uncertainties.
+func defaultProcessNoise() []float64 {
+	tt := math.Sqrt(60.0*60.0) // One-hour time constant for drift of biases V, C, F, D, L
+	return []float64{
+		1, 0.1, 0.1,                                // U*3
+		0.2, 0.1, 0.2,                              // Z*3
+		0.02, 0.02, 0.02, 0.02,                     // E*4
+		1, 1, 1,                                    // H*3
+		100, 100, 100,                              // N*3
+		5/tt, 5/tt, 5/tt,                           // V*3
+		0.01/tt, 0.01/tt, 0.01/tt,                  // C*3
+		0.0001/tt, 0.0001/tt, 0.0001/tt, 0.0001/tt, // F*4
+		0.1/tt, 0.1/tt, 0.1/tt,                     // D*3
+		0.1/tt, 0.1/tt, 0.1/tt,                     // L*3
+		1,                                          // Alt
+	}
 }
 
 func (s *KalmanState) CalcRollPitchHeadingUncertainty() (droll float64, dpitch float64, dheading float64) {
@@ -32,14 +108,17 @@ func (s *KalmanState) GetStateMap() (dat *map[string]float64) {
 // Initialize the state at the start of the Kalman filter, based on current measurements
 func InitializeKalman(m *Measurement) (s *KalmanState) {
 	s = new(KalmanState)
+	s.gate = innovationGateDefault
+	s.divergenceThreshold = divergenceThresholdDefault
+	s.divergenceWindow = divergenceWindowDefault
 	s.init(m)
 	return
 }
 
 func (s *KalmanState) init(m *Measurement) {
-	// Diagonal matrix of initial state uncertainties, will be squared into covariance below
+	// Diagonal matrix of initial state uncertainties, squared into covariance
 	// Specifics here aren't too important--it will change very quickly
-	s.M = matrix.Diagonal([]float64{
+	s.M = squaredDiagonal(s.M, []float64{
 		50, 5, 5,                   // U*3
 		0.4, 0.2, 0.5,              // Z*3
 		0.5, 0.5, 0.5, 0.5,         // E*4
@@ -50,25 +129,15 @@ func (s *KalmanState) init(m *Measurement) {
 		0.002, 0.002, 0.002, 0.002, // F*4
 		0.1, 0.1, 0.1,              // D*4
 		10, 10, 10,                 // L*4
+		1000,                       // Alt
 	})
-	s.M = matrix.Product(s.M, s.M)
 
-	// Diagonal matrix of state process uncertainties per s, will be squared into covariance below
-	// Tuning these is more important
-	tt := math.Sqrt(60.0*60.0) // One-hour time constant for drift of biases V, C, F, D, L
-	s.N = matrix.Diagonal([]float64{
-		1, 0.1, 0.1,                                // U*3
-		0.2, 0.1, 0.2,                              // Z*3
-		0.02, 0.02, 0.02, 0.02,                     // E*4
-		1, 1, 1,                                    // H*3
-		100, 100, 100,                              // N*3
-		5/tt, 5/tt, 5/tt,                           // V*3
-		0.01/tt, 0.01/tt, 0.01/tt,                  // C*3
-		0.0001/tt, 0.0001/tt, 0.0001/tt, 0.0001/tt, // F*4
-		0.1/tt, 0.1/tt, 0.1/tt,                     // D*3
-		0.1/tt, 0.1/tt, 0.1/tt,                     // L*3
-	})
-	s.N = matrix.Product(s.N, s.N)
+	// Diagonal matrix of state process uncertainties per s, squared into covariance
+	noise := s.processNoise
+	if noise == nil {
+		noise = defaultProcessNoise()
+	}
+	s.N = squaredDiagonal(s.N, noise)
 
 	//TODO westphae: for now just treat the case !m.UValid; if we have U, we can do a lot more!
 
@@ -99,7 +168,19 @@ func (s *KalmanState) init(m *Measurement) {
 
 	s.normalize()
 
+	// Best guess at initial roll and pitch is from the accelerometer's gravity vector, keeping the heading
+	if m.SValid {
+		a1, a2, a3 := s.rotateByF(m.A1-s.C1, m.A2-s.C2, m.A3-s.C3, true)
+		roll, pitch, _ := FromQuaternion(QuaternionAToB(-a1, -a2, -a3, 0, 0, 1))
+		_, _, heading := FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll, pitch, heading)
+		s.normalize()
+	}
+
 	if m.MValid { //TODO westphae: could do more here to get a better Fn since we know N points north
+		if s.magRef == 0 {
+			s.magRef = math.Sqrt(m.M1*m.M1 + m.M2*m.M2 + m.M3*m.M3)
+		}
 		s.N1 = m.M1*s.e11 + m.M2*s.e12 + m.M3*s.e13
 		s.N2 = m.M1*s.e21 + m.M2*s.e22 + m.M3*s.e23
 		s.N3 = m.M1*s.e31 + m.M2*s.e32 + m.M3*s.e33
@@ -112,15 +193,74 @@ func (s *KalmanState) init(m *Measurement) {
 		s.M.Set(31, 31, Big)
 	}
 
+	if m.PValid {
+		s.Alt = m.P
+		s.M.Set(32, 32, 10*10) // Our estimate of altitude is much better
+	}
+
 	return
 }
 
+// Reinitialize re-seeds the state and its covariance in place from a fresh measurement m, as InitializeKalman
+// would, while keeping the existing matrix allocations and the noise and gate settings.
+// Use it to recover when the estimate has obviously gone bad, e.g. after a gross divergence or a GPS outage.
+// (Reset only flags the generic State for initialization on the next Compute.)
+// Update calls it itself when the filter has diverged, see SetConfig.
+func (s *KalmanState) Reinitialize(m *Measurement) {
+	s.State = State{M: s.M, N: s.N, aNorm: s.aNorm, declination: s.declination,
+		gravity: s.gravity, logMap: s.logMap}
+	s.nisAvg, s.diverging = 0, false
+	s.init(m)
+}
+
+// squaredDiagonal returns the covariance matrix with diagonal diag squared, reusing mat if it has the right size.
+func squaredDiagonal(mat *matrix.DenseMatrix, diag []float64) *matrix.DenseMatrix {
+	n := len(diag)
+	if mat == nil || mat.Rows() != n || mat.Cols() != n {
+		mat = matrix.Zeros(n, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			mat.Set(i, j, 0)
+		}
+		mat.Set(i, i, diag[i]*diag[i])
+	}
+	return mat
+}
+
 // Compute runs first the prediction and then the update phases of the Kalman filter
 func (s *KalmanState) Compute(m *Measurement) {
 	s.Predict(m.T)
 	s.Update(m)
 }
 
+// Step runs the filter on a set of raw sensor samples taken at time t, as Compute does on a Measurement:
+// gyro rates in °/s, accelerations in G and the magnetic field in µT, all sensor frame, and a GPS fix if there is one.
+// A zero mag, which no real field gives, means there's no magnetometer reading.
+// The samples go into a Measurement kept from step to step, so that the variances estimated from them settle;
+// gated reports which measurement blocks were rejected, as for Update.
+func (s *KalmanState) Step(gyro, accel, mag [3]float64, gps *GPSFix, t float64) (gated [6]bool) {
+	if s.step == nil {
+		s.step = NewMeasurement()
+	}
+	m := s.step
+
+	m.SValid = true
+	m.A1, m.A2, m.A3 = accel[0], accel[1], accel[2]
+	m.B1, m.B2, m.B3 = gyro[0], gyro[1], gyro[2]
+	m.MValid = mag != [3]float64{}
+	m.M1, m.M2, m.M3 = mag[0], mag[1], mag[2]
+	m.WValid = false
+	if gps != nil {
+		m.SetGPS(gps.GroundspeedKt, gps.TrackDeg, gps.VerticalSpeedKt)
+		m.TW = gps.T
+	}
+	m.T = t
+
+	s.Predict(t)
+	return s.Update(m)
+}
+
 // Valid applies some heuristics to detect whether the computed state is valid or not
 func (s *KalmanState) Valid() (ok bool) {
 	ok = true
@@ -148,14 +288,23 @@ func (s *KalmanState) Valid() (ok bool) {
 	return ok
 }
 
-// Predict performs the prediction phase of the Kalman filter
-func (s *KalmanState) Predict(t float64) {
-	f := s.calcJacobianState(t)
+// Predict performs the prediction phase of the Kalman filter.
+// If t isn't after the state's time, as with a repeated timestamp or a clock going backwards,
+// the prediction is skipped and only the state's time is set to t; ok reports whether the prediction was made.
+func (s *KalmanState) Predict(t float64) (ok bool) {
 	dt := t - s.T
+	if dt < minDT {
+		s.T = t
+		return false
+	}
+	f := s.calcJacobianState(t)
+	g := s.Gravity()
+
+	s.Alt += dt*s.VerticalSpeed()*FtPerKt
 
-	s.U1 += dt*s.Z1*G
-	s.U2 += dt*s.Z2*G
-	s.U3 += dt*s.Z3*G
+	s.U1 += dt*s.Z1*g
+	s.U2 += dt*s.Z2*g
+	s.U3 += dt*s.Z3*g
 
 	s.E0 += 0.5*dt*(-s.H1*s.E1 - s.H2*s.E2 - s.H3*s.E3)*Deg
 	s.E1 += 0.5*dt*(+s.H1*s.E0 + s.H2*s.E3 - s.H3*s.E2)*Deg
@@ -168,21 +317,125 @@ func (s *KalmanState) Predict(t float64) {
 	s.T = t
 
 	s.M = matrix.Sum(matrix.Product(f, matrix.Product(s.M, f.Transpose())), matrix.Scaled(s.N, dt))
+	return true
+}
+
+// SetConfig lets the user alter some of the configuration settings:
+// the innovation gate, "innovationGate", in sigmas per dimension, and when the filter is taken to have diverged
+// and is re-initialized: when the running average normalized innovation squared per dimension of the worst attitude
+// block stays beyond "divergenceThreshold" for longer than "divergenceWindow", s.
+// Missing or non-positive values get sensible defaults.
+func (s *KalmanState) SetConfig(configMap map[string]float64) {
+	if v, ok := configMap["innovationGate"]; ok {
+		s.gate = v
+	}
+	if s.gate <= 0 {
+		s.gate = innovationGateDefault
+	}
+	if v, ok := configMap["divergenceThreshold"]; ok {
+		s.divergenceThreshold = v
+	}
+	if s.divergenceThreshold <= 0 {
+		s.divergenceThreshold = divergenceThresholdDefault
+	}
+	if v, ok := configMap["divergenceWindow"]; ok {
+		s.divergenceWindow = v
+	}
+	if s.divergenceWindow <= 0 {
+		s.divergenceWindow = divergenceWindowDefault
+	}
+}
+
+// SetProcessNoise sets the standard deviations of the state process noise per s, one for each of the 33 state
+// variables in the order of State (U, Z, E, H, N, V, C, F, D, L, Alt).
+func (s *KalmanState) SetProcessNoise(diag []float64) error {
+	if len(diag) != 33 {
+		return fmt.Errorf("Error: process noise needs 33 values, got %d", len(diag))
+	}
+	s.processNoise = append([]float64(nil), diag...)
+	s.N = squaredDiagonal(s.N, s.processNoise)
+	return nil
+}
+
+// SetMeasurementNoise sets the standard deviations of the measurement noise, one for each of the 16 measurement
+// variables in the order of Measurement (U, W, A, B, M, P).
+// A zero value means the variance is estimated from the measurements themselves, or that the variable isn't used
+// for U2 and U3 which aren't measured.
+func (s *KalmanState) SetMeasurementNoise(diag []float64) error {
+	if len(diag) != 16 {
+		return fmt.Errorf("Error: measurement noise needs 16 values, got %d", len(diag))
+	}
+	s.measurementNoise = append([]float64(nil), diag...)
+	return nil
+}
+
+// measurementVariance returns the variance to use for measurement variable i,
+// the configured fixed noise if there is one or else the estimate v.
+func (s *KalmanState) measurementVariance(i int, v float64) float64 {
+	noise := s.measurementNoise
+	if noise == nil {
+		noise = defaultMeasurementNoise
+	}
+	if noise[i] > 0 {
+		return noise[i]*noise[i]
+	}
+	return v
+}
+
+// SetMagReference sets the reference strength of the local magnetic field in µT, against which magnetometer
+// readings are checked for disturbance.  Otherwise it is learned from the measurement at initialization.
+func (s *KalmanState) SetMagReference(b float64) {
+	s.magRef = b
+}
+
+// magDisturbed reports whether the strength of the measured magnetic field deviates from the reference
+// by more than the magDisturbance fraction, as it does near metal structure or electrical loads.
+func (s *KalmanState) magDisturbed(m *Measurement) bool {
+	if s.magRef <= 0 {
+		return false
+	}
+	b := math.Sqrt(m.M1*m.M1 + m.M2*m.M2 + m.M3*m.M3)
+	return math.Abs(b-s.magRef) > magDisturbance*s.magRef
+}
+
+// reportedVariance returns the variance corresponding to a sensor-reported accuracy (standard deviation) acc,
+// or v if no accuracy was reported.
+func reportedVariance(acc, v float64) float64 {
+	if acc > 0 {
+		return acc * acc
+	}
+	return v
 }
 
-// Update applies the Kalman filter corrections given the measurements
-func (s *KalmanState) Update(m *Measurement) {
+// Update applies the Kalman filter corrections given the measurements.
+// A measurement block whose normalized innovation squared y^T S^-1 y exceeds the innovation gate
+// is rejected as an outlier and not applied, as is a disturbed magnetometer;
+// gated reports which blocks were rejected, indexed by BlockU etc.
+// A state which has gone non-finite is re-initialized from m rather than updated.
+// The measurement noise covariance is built afresh from m.M each step; m itself is left untouched,
+// so the same Measurement can be reused from step to step.
+func (s *KalmanState) Update(m *Measurement) (gated [6]bool) {
 	z := s.PredictMeasurement()
+	if !z.SValid {
+		log.Println("AHRS: Kalman state isn't finite, reinitializing")
+		s.Reinitialize(m)
+		if s.OnReinitialize != nil {
+			s.OnReinitialize(m.T, math.Inf(1))
+		}
+		return
+	}
 
 	//TODO westphae: for testing, if no GPS, we're probably inside at a desk - assume zero groundspeed
 	if !m.WValid {
-		m.W1 = 0
-		m.W2 = 0
-		m.W3 = 0
-		m.WValid = true
+		mm := *m
+		mm.W1 = 0
+		mm.W2 = 0
+		mm.W3 = 0
+		mm.WValid = true
+		m = &mm
 	}
 
-	y := matrix.Zeros(15, 1)
+	y := matrix.Zeros(16, 1)
 	y.Set( 0, 0, m.U1 - z.U1)
 	y.Set( 1, 0, m.U2 - z.U2)
 	y.Set( 2, 0, m.U3 - z.U3)
@@ -198,52 +451,63 @@ func (s *KalmanState) Update(m *Measurement) {
 	y.Set(12, 0, m.M1 - z.M1)
 	y.Set(13, 0, m.M2 - z.M2)
 	y.Set(14, 0, m.M3 - z.M3)
+	y.Set(15, 0, m.P - z.P)
 
 	h := s.calcJacobianMeasurement()
 
+	// The measurement noise r extends that of m with the pressure altitude row; m.M is shared with the other
+	// algorithms and the caller, so it's only read here
+	r := matrix.Zeros(16, 16)
+	for i := 0; i < 15; i++ {
+		for j := 0; j < 15; j++ {
+			r.Set(i, j, m.M.Get(i, j))
+		}
+	}
+
 	var v float64
 	// U, W, A, B, M
 	if m.UValid {
 		_, _, v = m.Accums[0](m.U1)
-		m.M.Set(0, 0, v)
+		r.Set(0, 0, s.measurementVariance(0, v))
 	} else {
 		y.Set(0, 0, 0)
-		m.M.Set(0, 0, Big)
+		r.Set(0, 0, Big)
 	}
 	// U2, U3 are just here to bias toward coordinated flight
 	//TODO westphae: not sure I really want these to not be BIG
-	m.M.Set(1, 1, 1)
-	m.M.Set(2, 2, 1)
+	r.Set(1, 1, s.measurementVariance(1, Big))
+	r.Set(2, 2, s.measurementVariance(2, Big))
 
 	if m.WValid {
+		// Trust the GPS's own accuracy estimate when it reports one
 		_, _, v = m.Accums[3](m.W1)
-		m.M.Set(3, 3, v)
+		r.Set(3, 3, reportedVariance(m.DW1, s.measurementVariance(3, v)))
 		_, _, v = m.Accums[4](m.W2)
-		m.M.Set(4, 4, v)
+		r.Set(4, 4, reportedVariance(m.DW2, s.measurementVariance(4, v)))
 		_, _, v = m.Accums[5](m.W3)
-		m.M.Set(5, 5, v)
+		r.Set(5, 5, reportedVariance(m.DW3, s.measurementVariance(5, v)))
 	} else {
 		y.Set(3, 0, 0)
 		y.Set(4, 0, 0)
 		y.Set(5, 0, 0)
-		m.M.Set(3, 3, Big)
-		m.M.Set(4, 4, Big)
-		m.M.Set(5, 5, Big)
+		r.Set(3, 3, Big)
+		r.Set(4, 4, Big)
+		r.Set(5, 5, Big)
 	}
 
 	if m.SValid {
 		_, _, v = m.Accums[6](m.A1)
-		m.M.Set(6, 6, v)
+		r.Set(6, 6, s.measurementVariance(6, v))
 		_, _, v = m.Accums[7](m.A2)
-		m.M.Set(7, 7, v)
+		r.Set(7, 7, s.measurementVariance(7, v))
 		_, _, v = m.Accums[8](m.A3)
-		m.M.Set(8, 8, v)
+		r.Set(8, 8, s.measurementVariance(8, v))
 		_, _, v = m.Accums[9](m.B1)
-		m.M.Set(9, 9, v)
+		r.Set(9, 9, s.measurementVariance(9, v))
 		_, _, v = m.Accums[10](m.B2)
-		m.M.Set(10, 10, v)
+		r.Set(10, 10, s.measurementVariance(10, v))
 		_, _, v = m.Accums[11](m.B3)
-		m.M.Set(11, 11, v)
+		r.Set(11, 11, s.measurementVariance(11, v))
 	} else {
 		y.Set( 6, 0, 0)
 		y.Set( 7, 0, 0)
@@ -251,35 +515,84 @@ func (s *KalmanState) Update(m *Measurement) {
 		y.Set( 9, 0, 0)
 		y.Set(10, 0, 0)
 		y.Set(11, 0, 0)
-		m.M.Set( 6,  6, Big)
-		m.M.Set( 7,  7, Big)
-		m.M.Set( 8,  8, Big)
-		m.M.Set( 9,  9, Big)
-		m.M.Set(10, 10, Big)
-		m.M.Set(11, 11, Big)
+		r.Set( 6,  6, Big)
+		r.Set( 7,  7, Big)
+		r.Set( 8,  8, Big)
+		r.Set( 9,  9, Big)
+		r.Set(10, 10, Big)
+		r.Set(11, 11, Big)
 	}
 
-	if m.MValid {
+	// A disturbed magnetometer is ignored for this step, and reported as gated
+	gated[BlockM] = m.MValid && s.magDisturbed(m)
+	if m.MValid && !gated[BlockM] {
 		_, _, v = m.Accums[12](m.M1)
-		m.M.Set(12, 12, v)
+		r.Set(12, 12, s.measurementVariance(12, v))
 		_, _, v = m.Accums[13](m.M2)
-		m.M.Set(13, 13, v)
+		r.Set(13, 13, s.measurementVariance(13, v))
 		_, _, v = m.Accums[14](m.M3)
-		m.M.Set(14, 14, v)
+		r.Set(14, 14, s.measurementVariance(14, v))
 	} else {
 		y.Set(12, 0, 0)
 		y.Set(13, 0, 0)
 		y.Set(14, 0, 0)
-		m.M.Set(12, 12, Big)
-		m.M.Set(13, 13, Big)
-		m.M.Set(14, 14, Big)
+		r.Set(12, 12, Big)
+		r.Set(13, 13, Big)
+		r.Set(14, 14, Big)
+	}
+
+	if m.PValid {
+		_, _, v = m.Accums[15](m.P)
+		r.Set(15, 15, s.measurementVariance(15, v))
+	} else {
+		y.Set(15, 0, 0)
+		r.Set(15, 15, Big)
+	}
+	s.r = r.Copy()
+
+	ss := matrix.Sum(matrix.Product(h, matrix.Product(s.M, h.Transpose())), r)
+
+	// Innovations that stay implausibly large, before any are gated, mean the filter has diverged
+	if s.checkDivergence(m.T, y, ss, r) {
+		log.Printf("AHRS: Kalman filter diverged (normalized innovation %g per dimension for %g s), reinitializing\n",
+			s.nisAvg, m.T-s.divergingSince)
+		nis := s.nisAvg
+		s.Reinitialize(m)
+		if s.OnReinitialize != nil {
+			s.OnReinitialize(m.T, nis)
+		}
+		return
+	}
+
+	gate := s.gate
+	if gate <= 0 {
+		gate = innovationGateDefault
+	}
+	var anyGated bool
+	for b, rows := range blockRows {
+		if innovationExceeds(y, ss, rows[0], rows[1], gate) {
+			gated[b], anyGated = true, true
+			for i := rows[0]; i < rows[1]; i++ {
+				y.Set(i, 0, 0)
+				r.Set(i, i, Big)
+			}
+		}
+	}
+	if anyGated {
+		ss = matrix.Sum(matrix.Product(h, matrix.Product(s.M, h.Transpose())), r)
 	}
 
-	ss := matrix.Sum(matrix.Product(h, matrix.Product(s.M, h.Transpose())), m.M)
+	s.condition = conditionNumber(ss, r)
+	if s.OnCondition != nil {
+		s.OnCondition(s.condition)
+	}
 
 	m2, err := ss.Inverse()
 	if err != nil {
-		log.Println("AHRS: Can't invert Kalman gain matrix")
+		log.Printf("AHRS: Can't invert Kalman gain matrix (condition %g), falling back to complementary filter\n", s.condition)
+		s.complementaryCorrection(m)
+		s.T = m.T
+		s.normalize()
 		return
 	}
 	kk := matrix.Product(s.M, matrix.Product(h.Transpose(), m2))
@@ -316,14 +629,123 @@ func (s *KalmanState) Update(m *Measurement) {
 	s.L1 += su.Get(29, 0)
 	s.L2 += su.Get(30, 0)
 	s.L3 += su.Get(31, 0)
+	s.Alt += su.Get(32, 0)
 	s.T = m.T
-	s.M = matrix.Product(matrix.Difference(matrix.Eye(32), matrix.Product(kk, h)), s.M)
+	// Joseph form keeps M symmetric and positive semidefinite, unlike the shortcut (I-KH)M
+	ikh := matrix.Difference(matrix.Eye(33), matrix.Product(kk, h))
+	s.M = matrix.Sum(matrix.Product(ikh, matrix.Product(s.M, ikh.Transpose())),
+		matrix.Product(kk, matrix.Product(r, kk.Transpose())))
 	s.normalize()
+	return
+}
+
+// ConditionNumber returns the conditioning of the innovation covariance at the last Update,
+// as the ratio of its largest to smallest diagonal element over the measurements used.
+// This is a cheap proxy for the condition number: it grows as the filter degrades toward a singular covariance.
+func (s *KalmanState) ConditionNumber() float64 {
+	return s.condition
 }
 
+// conditionNumber returns the ratio of the largest to the smallest diagonal element of ss,
+// ignoring the rows whose measurement noise r is Big, i.e. the measurements not being used.
+func conditionNumber(ss, r *matrix.DenseMatrix) float64 {
+	dMin, dMax := math.Inf(1), 0.0
+	for i := 0; i < ss.Rows(); i++ {
+		if r.Get(i, i) >= Big {
+			continue
+		}
+		d := math.Abs(ss.Get(i, i))
+		dMin = math.Min(dMin, d)
+		dMax = math.Max(dMax, d)
+	}
+	if dMax == 0 {
+		return 1
+	}
+	return dMax / dMin
+}
+
+// complementaryCorrection nudges the attitude E toward the roll and pitch given by the accelerometer's gravity
+// vector and the heading given by the magnetometer, as a simple complementary filter would.
+// It keeps the estimate sane while the Kalman update can't be made.
+func (s *KalmanState) complementaryCorrection(m *Measurement) {
+	h1, h2, h3 := s.attitudeError(m, m.MValid && !s.magDisturbed(m))
+	s.E0, s.E1, s.E2, s.E3 = QuaternionRotate(s.E0, s.E1, s.E2, s.E3,
+		complementaryGain*h1, complementaryGain*h2, complementaryGain*h3)
+}
+
+// checkDivergence takes the largest normalized innovation squared per dimension of the measurement blocks
+// in use at time t that bear on the attitude into its running average, and reports whether that has stayed beyond
+// the divergence threshold for longer than the divergence window.
+// Airspeed and pressure altitude don't depend on the attitude re-initialization re-seeds, so a stuck airspeed
+// or altimeter is left to the innovation gate rather than resetting the whole filter.
+func (s *KalmanState) checkDivergence(t float64, y, ss, r *matrix.DenseMatrix) bool {
+	var nis float64
+	var used bool
+	for b, rows := range blockRows {
+		if b == BlockU || b == BlockP || r.Get(rows[0], rows[0]) >= Big {
+			continue
+		}
+		if v, ok := normalizedInnovation(y, ss, rows[0], rows[1]); ok {
+			nis = math.Max(nis, v/float64(rows[1]-rows[0]))
+			used = true
+		}
+	}
+	if !used {
+		return false
+	}
+
+	s.nisAvg += nisSmoothing * (nis - s.nisAvg)
+	if s.nisAvg <= s.divergenceThreshold || s.divergenceThreshold <= 0 {
+		s.diverging = false
+		return false
+	}
+	if !s.diverging {
+		s.diverging, s.divergingSince = true, t
+	}
+	return t-s.divergingSince > s.divergenceWindow
+}
+
+// innovationExceeds reports whether the normalized innovation squared of measurement components i0..i1-1,
+// using the corresponding block of the innovation covariance ss, exceeds gate sigmas per dimension.
+func innovationExceeds(y, ss *matrix.DenseMatrix, i0, i1 int, gate float64) bool {
+	nis, ok := normalizedInnovation(y, ss, i0, i1)
+	return ok && nis > float64(i1-i0)*gate*gate
+}
+
+// normalizedInnovation returns the normalized innovation squared y^T S^-1 y of measurement components i0..i1-1,
+// using the corresponding block of the innovation covariance ss; ok is false if that block can't be inverted.
+func normalizedInnovation(y, ss *matrix.DenseMatrix, i0, i1 int) (nis float64, ok bool) {
+	n := i1 - i0
+	yb := matrix.Zeros(n, 1)
+	sb := matrix.Zeros(n, n)
+	for i := 0; i < n; i++ {
+		yb.Set(i, 0, y.Get(i0+i, 0))
+		for j := 0; j < n; j++ {
+			sb.Set(i, j, ss.Get(i0+i, i0+j))
+		}
+	}
+	sbi, err := sb.Inverse()
+	if err != nil {
+		return 0, false
+	}
+	return matrix.Product(yb.Transpose(), matrix.Product(sbi, yb)).Get(0, 0), true
+}
+
+// PredictMeasurement returns the measurement expected from the current state.
+// Quaternions which have drifted from unit norm are renormalized first; if the state isn't finite,
+// as after a failed update, the prediction is an empty measurement with no valid flags set.
 func (s *KalmanState) PredictMeasurement() (m *Measurement) {
 	m = NewMeasurement()
 
+	ee := s.E0*s.E0 + s.E1*s.E1 + s.E2*s.E2 + s.E3*s.E3
+	ff := s.F0*s.F0 + s.F1*s.F1 + s.F2*s.F2 + s.F3*s.F3
+	if math.Abs(ee-1) > unitTolerance || math.Abs(ff-1) > unitTolerance {
+		s.normalize()
+	}
+	if !s.finite() {
+		return
+	}
+
 	m.UValid = true
 	m.U1 = s.U1
 	m.U2 = s.U2
@@ -339,9 +761,7 @@ func (s *KalmanState) PredictMeasurement() (m *Measurement) {
 	h1 := s.H1*s.e11 + s.H2*s.e21 + s.H3*s.e31
 	h2 := s.H1*s.e12 + s.H2*s.e22 + s.H3*s.e32
 	h3 := s.H1*s.e13 + s.H2*s.e23 + s.H3*s.e33
-	a1 := -s.Z1 + (h3*s.U2 - h2*s.U3)*Deg/G - s.e31
-	a2 := -s.Z2 + (h1*s.U3 - h3*s.U1)*Deg/G - s.e32
-	a3 := -s.Z3 + (h2*s.U1 - h1*s.U2)*Deg/G - s.e33
+	a1, a2, a3 := s.aircraftAccel()
 
 	m.A1 = s.f11*a1 + s.f12*a2 + s.f13*a3 + s.C1
 	m.A2 = s.f21*a1 + s.f22*a2 + s.f23*a3 + s.C2
@@ -359,24 +779,56 @@ func (s *KalmanState) PredictMeasurement() (m *Measurement) {
 	m.M2 = s.f21*m1 + s.f22*m2 + s.f23*m3
 	m.M3 = s.f31*m1 + s.f32*m2 + s.f33*m3
 
+	m.PValid = true
+	m.P = s.Alt
+
 	m.T = s.T
 
 	return
 }
 
+// finite reports whether all the state variables are finite.
+func (s *KalmanState) finite() bool {
+	for _, v := range []float64{
+		s.U1, s.U2, s.U3, s.Z1, s.Z2, s.Z3, s.E0, s.E1, s.E2, s.E3, s.H1, s.H2, s.H3, s.N1, s.N2, s.N3,
+		s.V1, s.V2, s.V3, s.C1, s.C2, s.C3, s.F0, s.F1, s.F2, s.F3, s.D1, s.D2, s.D3, s.L1, s.L2, s.L3, s.Alt,
+	} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *KalmanState) calcJacobianState(t float64) (jac *matrix.DenseMatrix) {
 	dt := t-s.T
+	g := s.Gravity()
 
-	jac = matrix.Eye(32)
+	jac = matrix.Eye(33)
 	// U*3, Z*3, E*4, H*3, N*3,
-	// V*3, C*3, F*4, D*3, L*3
+	// V*3, C*3, F*4, D*3, L*3, Alt
+
+	//s.U1 += dt*s.Z1*g
+	jac.Set(0, 3, dt*g)                // U1/Z1
+	//s.U2 += dt*s.Z2*g
+	jac.Set(1, 4, dt*g)                // U2/Z2
+	//s.U3 += dt*s.Z3*g
+	jac.Set(2, 5, dt*g)                // U3/Z3
 
-	//s.U1 += dt*s.Z1*G
-	jac.Set(0, 3, dt*G)                // U1/Z1
-	//s.U2 += dt*s.Z2*G
-	jac.Set(1, 4, dt*G)                // U2/Z2
-	//s.U3 += dt*s.Z3*G
-	jac.Set(2, 5, dt*G)                // U3/Z3
+	//s.Alt += dt*(s.e31*s.U1 + s.e32*s.U2 + s.e33*s.U3 + s.V3)*FtPerKt
+	w3 := s.e31*s.U1 + s.e32*s.U2 + s.e33*s.U3
+	jac.Set(32, 0, dt*s.e31*FtPerKt)  // Alt/U1
+	jac.Set(32, 1, dt*s.e32*FtPerKt)  // Alt/U2
+	jac.Set(32, 2, dt*s.e33*FtPerKt)  // Alt/U3
+	jac.Set(32, 6, dt*FtPerKt*(       // Alt/E0
+		2*(-s.E2*s.U1 + s.E1*s.U2 + s.E0*s.U3) - 2*w3*s.E0))
+	jac.Set(32, 7, dt*FtPerKt*(       // Alt/E1
+		2*(+s.E3*s.U1 + s.E0*s.U2 - s.E1*s.U3) - 2*w3*s.E1))
+	jac.Set(32, 8, dt*FtPerKt*(       // Alt/E2
+		2*(-s.E0*s.U1 + s.E3*s.U2 - s.E2*s.U3) - 2*w3*s.E2))
+	jac.Set(32, 9, dt*FtPerKt*(       // Alt/E3
+		2*(+s.E1*s.U1 + s.E2*s.U2 + s.E3*s.U3) - 2*w3*s.E3))
+	jac.Set(32, 18, dt*FtPerKt)       // Alt/V3
 
 	//s.E0 += 0.5*dt*(-s.H1*s.E1 - s.H2*s.E2 - s.H3*s.E3)*Deg
 	jac.Set(6,  7, -0.5*dt*s.H1*Deg)  // E0/E1
@@ -414,11 +866,15 @@ func (s *KalmanState) calcJacobianState(t float64) (jac *matrix.DenseMatrix) {
 }
 
 func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
+	g := s.Gravity()
 
-	jac = matrix.Zeros(15, 32)
+	jac = matrix.Zeros(16, 33)
 	// U*3, Z*3, E*4, H*3, N*3,
-	// V*3, C*3, F*4, D*3, L*3
-	// U*3, W*3, A*3, B*3, M*3
+	// V*3, C*3, F*4, D*3, L*3, Alt
+	// U*3, W*3, A*3, B*3, M*3, P
+
+	//m.P = s.Alt
+	jac.Set(15, 32, 1)                                            // P/Alt
 
 	//m.U1 = s.U1
 	jac.Set(0, 0, 1)                                              // U1/U1
@@ -493,51 +949,51 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 	h1 := s.H1*s.e11 + s.H2*s.e21 + s.H3*s.e31
 	h2 := s.H1*s.e12 + s.H2*s.e22 + s.H3*s.e32
 	h3 := s.H1*s.e13 + s.H2*s.e23 + s.H3*s.e33
-	a1 := -s.Z1 + (h3*s.U2 - h2*s.U3)*Deg/G - s.e31
-	a2 := -s.Z2 + (h1*s.U3 - h3*s.U1)*Deg/G - s.e32
-	a3 := -s.Z3 + (h2*s.U1 - h1*s.U2)*Deg/G - s.e33
+	a1 := -s.Z1 + (h3*s.U2 - h2*s.U3)*Deg/g - s.e31
+	a2 := -s.Z2 + (h1*s.U3 - h3*s.U1)*Deg/g - s.e32
+	a3 := -s.Z3 + (h2*s.U1 - h1*s.U2)*Deg/g - s.e33
 
 	ae1 := s.f11*(a1+s.Z1) + s.f12*(a2+s.Z2) + s.f13*(a3+s.Z3)
 	af1 := s.f11*a1 + s.f12*a2 + s.f13*a3
-	jac.Set(6, 0, (s.f13*h2 - s.f12*h3)*Deg/G)                    // A1/U1
-	jac.Set(6, 1, (s.f11*h3 - s.f13*h1)*Deg/G)                    // A1/U2
-	jac.Set(6, 2, (s.f12*h1 - s.f11*h2)*Deg/G)                    // A1/U3
+	jac.Set(6, 0, (s.f13*h2 - s.f12*h3)*Deg/g)                    // A1/U1
+	jac.Set(6, 1, (s.f11*h3 - s.f13*h1)*Deg/g)                    // A1/U2
+	jac.Set(6, 2, (s.f12*h1 - s.f11*h2)*Deg/g)                    // A1/U3
 	jac.Set(6, 3, -s.f11)                                         // A1/Z1
 	jac.Set(6, 4, -s.f12)                                         // A1/Z2
 	jac.Set(6, 5, -s.f13)                                         // A1/Z3
-	jac.Set(6, 6, 2*Deg/G*(                                       // A1/E0
+	jac.Set(6, 6, 2*Deg/g*(                                       // A1/E0
 		s.f11*(s.H1*( s.E2*s.U2 + s.E3*s.U3) + s.H2*(-s.E1*s.U2 - s.E0*s.U3) + s.H3*( s.E0*s.U2 - s.E1*s.U3)) +
 		s.f12*(s.H1*( s.E0*s.U3 - s.E2*s.U1) + s.H2*( s.E3*s.U3 + s.E1*s.U1) + s.H3*(-s.E2*s.U3 - s.E0*s.U1)) +
 		s.f13*(s.H1*(-s.E3*s.U1 - s.E0*s.U2) + s.H2*( s.E0*s.U1 - s.E3*s.U2) + s.H3*( s.E1*s.U1 + s.E2*s.U2)) ) -
 		2* ae1 *s.E0 -
 		2*(s.f11*(-s.E2) + s.f12*( s.E1) + s.f13*( s.E0)) )
-	jac.Set(6, 7, 2*Deg/G*(                                       // A1/E1
+	jac.Set(6, 7, 2*Deg/g*(                                       // A1/E1
 		s.f11*(s.H1*( s.E3*s.U2 - s.E2*s.U3) + s.H2*(-s.E0*s.U2 + s.E1*s.U3) + s.H3*(-s.E1*s.U2 - s.E0*s.U3)) +
 		s.f12*(s.H1*( s.E1*s.U3 - s.E3*s.U1) + s.H2*( s.E2*s.U3 + s.E0*s.U1) + s.H3*( s.E3*s.U3 + s.E1*s.U1)) +
 		s.f13*(s.H1*( s.E2*s.U1 - s.E1*s.U2) + s.H2*(-s.E1*s.U1 - s.E2*s.U2) + s.H3*( s.E0*s.U1 - s.E3*s.U2)) ) -
 		2* ae1 *s.E1 -
 		2*(s.f11*( s.E3) + s.f12*( s.E0) + s.f13*(-s.E1)) )
-	jac.Set(6, 8, 2*Deg/G*(                                       // A1/E2
+	jac.Set(6, 8, 2*Deg/g*(                                       // A1/E2
 		s.f11*(s.H1*( s.E0*s.U2 - s.E1*s.U3) + s.H2*( s.E3*s.U2 - s.E2*s.U3) + s.H3*(-s.E2*s.U2 - s.E3*s.U3)) +
 		s.f12*(s.H1*(-s.E2*s.U3 - s.E0*s.U1) + s.H2*( s.E1*s.U3 - s.E3*s.U1) + s.H3*(-s.E0*s.U3 + s.E2*s.U1)) +
 		s.f13*(s.H1*( s.E1*s.U1 + s.E2*s.U2) + s.H2*( s.E2*s.U1 - s.E1*s.U2) + s.H3*( s.E3*s.U1 + s.E0*s.U2)) ) -
 		2* ae1 *s.E2 -
 		2*(s.f11*(-s.E0) + s.f12*( s.E3) + s.f13*(-s.E2)) )
-	jac.Set(6, 9, 2*Deg/G*(                                       // A1/E3
+	jac.Set(6, 9, 2*Deg/g*(                                       // A1/E3
 		s.f11*(s.H1*( s.E1*s.U2 + s.E0*s.U3) + s.H2*( s.E2*s.U2 + s.E3*s.U3) + s.H3*( s.E3*s.U2 - s.E2*s.U3)) +
 		s.f12*(s.H1*(-s.E3*s.U3 - s.E1*s.U1) + s.H2*( s.E0*s.U3 - s.E2*s.U1) + s.H3*( s.E1*s.U3 - s.E3*s.U1)) +
 		s.f13*(s.H1*(-s.E0*s.U1 + s.E3*s.U2) + s.H2*(-s.E3*s.U1 - s.E0*s.U2) + s.H3*( s.E2*s.U1 - s.E1*s.U2)) ) -
 		2* ae1 *s.E3 -
 		2*(s.f11*( s.E1) + s.f12*( s.E2) + s.f13*( s.E3)) )
-	jac.Set(6, 10, Deg/G*(                                      // A1/H1
+	jac.Set(6, 10, Deg/g*(                                      // A1/H1
 		s.f11*(s.U2*s.e13 - s.U3*s.e12) +
 		s.f12*(s.U3*s.e11 - s.U1*s.e13) +
 		s.f13*(s.U1*s.e12 - s.U2*s.e11) ))
-	jac.Set(6, 11, Deg/G*(                                      // A1/H2
+	jac.Set(6, 11, Deg/g*(                                      // A1/H2
 		s.f11*(s.U2*s.e23 - s.U3*s.e22) +
 		s.f12*(s.U3*s.e21 - s.U1*s.e23) +
 		s.f13*(s.U1*s.e22 - s.U2*s.e21) ))
-	jac.Set(6, 12, Deg/G*(                                      // A1/H3
+	jac.Set(6, 12, Deg/g*(                                      // A1/H3
 		s.f11*(s.U2*s.e33 - s.U3*s.e32) +
 		s.f12*(s.U3*s.e31 - s.U1*s.e33) +
 		s.f13*(s.U1*s.e32 - s.U2*s.e31) ))
@@ -557,45 +1013,45 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 
 	aa2 := s.f21*(a1+s.Z1) + s.f22*(a2+s.Z2) + s.f23*(a3+s.Z3)
 	af2 := s.f21*a1 + s.f22*a2 + s.f23*a3
-	jac.Set(7, 0, (h2*s.f23 - h3*s.f22)*Deg/G)                    // A2/U1
-	jac.Set(7, 1, (h3*s.f21 - h1*s.f23)*Deg/G)                    // A2/U2
-	jac.Set(7, 2, (h1*s.f22 - h2*s.f21)*Deg/G)                    // A2/U3
+	jac.Set(7, 0, (h2*s.f23 - h3*s.f22)*Deg/g)                    // A2/U1
+	jac.Set(7, 1, (h3*s.f21 - h1*s.f23)*Deg/g)                    // A2/U2
+	jac.Set(7, 2, (h1*s.f22 - h2*s.f21)*Deg/g)                    // A2/U3
 	jac.Set(7, 3, -s.f21)                                         // A2/Z1
 	jac.Set(7, 4, -s.f22)                                         // A2/Z2
 	jac.Set(7, 5, -s.f23)                                         // A2/Z3
-	jac.Set(7, 6, 2*Deg/G*(                                       // A2/E0
+	jac.Set(7, 6, 2*Deg/g*(                                       // A2/E0
 		s.f21*(s.H1*( s.E2*s.U2 + s.E3*s.U3) + s.H2*(-s.E1*s.U2 - s.E0*s.U3) + s.H3*( s.E0*s.U2 - s.E1*s.U3)) +
 		s.f22*(s.H1*( s.E0*s.U3 - s.E2*s.U1) + s.H2*( s.E3*s.U3 + s.E1*s.U1) + s.H3*(-s.E2*s.U3 - s.E0*s.U1)) +
 		s.f23*(s.H1*(-s.E3*s.U1 - s.E0*s.U2) + s.H2*( s.E0*s.U1 - s.E3*s.U2) + s.H3*( s.E1*s.U1 + s.E2*s.U2)) ) -
 		2*aa2*s.E0 -
 		2*(s.f21*(-s.E2) + s.f22*( s.E1) + s.f23*( s.E0)) )
-	jac.Set(7, 7, 2*Deg/G*(                                       // A2/E1
+	jac.Set(7, 7, 2*Deg/g*(                                       // A2/E1
 		s.f21*(s.H1*( s.E3*s.U2 - s.E2*s.U3) + s.H2*(-s.E0*s.U2 + s.E1*s.U3) + s.H3*(-s.E1*s.U2 - s.E0*s.U3)) +
 		s.f22*(s.H1*( s.E1*s.U3 - s.E3*s.U1) + s.H2*( s.E2*s.U3 + s.E0*s.U1) + s.H3*( s.E3*s.U3 + s.E1*s.U1)) +
 		s.f23*(s.H1*( s.E2*s.U1 - s.E1*s.U2) + s.H2*(-s.E1*s.U1 - s.E2*s.U2) + s.H3*( s.E0*s.U1 - s.E3*s.U2)) ) -
 		2*aa2*s.E1 -
 		2*(s.f21*( s.E3) + s.f22*( s.E0) + s.f23*(-s.E1)) )
-	jac.Set(7, 8, 2*Deg/G*(                                       // A2/E2
+	jac.Set(7, 8, 2*Deg/g*(                                       // A2/E2
 		s.f21*(s.H1*( s.E0*s.U2 - s.E1*s.U3) + s.H2*( s.E3*s.U2 - s.E2*s.U3) + s.H3*(-s.E2*s.U2 - s.E3*s.U3)) +
 		s.f22*(s.H1*(-s.E2*s.U3 - s.E0*s.U1) + s.H2*( s.E1*s.U3 - s.E3*s.U1) + s.H3*(-s.E0*s.U3 + s.E2*s.U1)) +
 		s.f23*(s.H1*( s.E1*s.U1 + s.E2*s.U2) + s.H2*( s.E2*s.U1 - s.E1*s.U2) + s.H3*( s.E3*s.U1 + s.E0*s.U2)) ) -
 		2*aa2*s.E2 -
 		2*(s.f21*(-s.E0) + s.f22*( s.E3) + s.f23*(-s.E2)) )
-	jac.Set(7, 9, 2*Deg/G*(                                       // A2/E3
+	jac.Set(7, 9, 2*Deg/g*(                                       // A2/E3
 		s.f21*(s.H1*( s.E1*s.U2 + s.E0*s.U3) + s.H2*( s.E2*s.U2 + s.E3*s.U3) + s.H3*( s.E3*s.U2 - s.E2*s.U3)) +
 		s.f22*(s.H1*(-s.E3*s.U3 - s.E1*s.U1) + s.H2*( s.E0*s.U3 - s.E2*s.U1) + s.H3*( s.E1*s.U3 - s.E3*s.U1)) +
 		s.f23*(s.H1*(-s.E0*s.U1 + s.E3*s.U2) + s.H2*(-s.E3*s.U1 - s.E0*s.U2) + s.H3*( s.E2*s.U1 - s.E1*s.U2)) ) -
 		2*aa2*s.E3 -
 		2*(s.f21*( s.E1) + s.f22*( s.E2) + s.f23*( s.E3)) )
-	jac.Set(7, 10, Deg/G*(                                      // A2/H1
+	jac.Set(7, 10, Deg/g*(                                      // A2/H1
 		s.f21*(s.U2*s.e13 - s.U3*s.e12) +
 		s.f22*(s.U3*s.e11 - s.U1*s.e13) +
 		s.f23*(s.U1*s.e12 - s.U2*s.e11) ))
-	jac.Set(7, 11, Deg/G*(                                      // A2/H2
+	jac.Set(7, 11, Deg/g*(                                      // A2/H2
 		s.f21*(s.U2*s.e23 - s.U3*s.e22) +
 		s.f22*(s.U3*s.e21 - s.U1*s.e23) +
 		s.f23*(s.U1*s.e22 - s.U2*s.e21) ))
-	jac.Set(7, 12, Deg/G*(                                      // A2/H3
+	jac.Set(7, 12, Deg/g*(                                      // A2/H3
 		s.f21*(s.U2*s.e33 - s.U3*s.e32) +
 		s.f22*(s.U3*s.e31 - s.U1*s.e33) +
 		s.f23*(s.U1*s.e32 - s.U2*s.e31) ))
@@ -615,45 +1071,45 @@ func (s *KalmanState) calcJacobianMeasurement() (jac *matrix.DenseMatrix) {
 
 	aa3 := s.f31*(a1+s.Z1) + s.f32*(a2+s.Z2) + s.f33*(a3+s.Z3)
 	af3 := s.f31*a1 + s.f32*a2 + s.f33*a3
-	jac.Set(8, 0, (h2*s.f33 - h3*s.f32)*Deg/G)                    // A3/U1
-	jac.Set(8, 1, (h3*s.f31 - h1*s.f33)*Deg/G)                    // A3/U2
-	jac.Set(8, 2, (h1*s.f32 - h2*s.f31)*Deg/G)                    // A3/U3
+	jac.Set(8, 0, (h2*s.f33 - h3*s.f32)*Deg/g)                    // A3/U1
+	jac.Set(8, 1, (h3*s.f31 - h1*s.f33)*Deg/g)                    // A3/U2
+	jac.Set(8, 2, (h1*s.f32 - h2*s.f31)*Deg/g)                    // A3/U3
 	jac.Set(8, 3, -s.f31)                                         // A3/Z1
 	jac.Set(8, 4, -s.f32)                                         // A3/Z2
 	jac.Set(8, 5, -s.f33)                                         // A3/Z3
-	jac.Set(8, 6, 2*Deg/G*(                                       // A3/E0
+	jac.Set(8, 6, 2*Deg/g*(                                       // A3/E0
 		s.f31*(s.H1*( s.E2*s.U2 + s.E3*s.U3) + s.H2*(-s.E1*s.U2 - s.E0*s.U3) + s.H3*( s.E0*s.U2 - s.E1*s.U3)) +
 		s.f32*(s.H1*( s.E0*s.U3 - s.E2*s.U1) + s.H2*( s.E3*s.U3 + s.E1*s.U1) + s.H3*(-s.E2*s.U3 - s.E0*s.U1)) +
 		s.f33*(s.H1*(-s.E3*s.U1 - s.E0*s.U2) + s.H2*( s.E0*s.U1 - s.E3*s.U2) + s.H3*( s.E1*s.U1 + s.E2*s.U2)) ) -
 		2*aa3*s.E0 -
 		2*(s.f31*(-s.E2) + s.f32*( s.E1) + s.f33*( s.E0)) )
-	jac.Set(8, 7, 2*Deg/G*(                                       // A3/E1
+	jac.Set(8, 7, 2*Deg/g*(                                       // A3/E1
 		s.f31*(s.H1*( s.E3*s.U2 - s.E2*s.U3) + s.H2*(-s.E0*s.U2 + s.E1*s.U3) + s.H3*(-s.E1*s.U2 - s.E0*s.U3)) +
 		s.f32*(s.H1*( s.E1*s.U3 - s.E3*s.U1) + s.H2*( s.E2*s.U3 + s.E0*s.U1) + s.H3*( s.E3*s.U3 + s.E1*s.U1)) +
 		s.f33*(s.H1*( s.E2*s.U1 - s.E1*s.U2) + s.H2*(-s.E1*s.U1 - s.E2*s.U2) + s.H3*( s.E0*s.U1 - s.E3*s.U2)) ) -
 		2*aa3*s.E1 -
 		2*(s.f31*( s.E3) + s.f32*( s.E0) + s.f33*(-s.E1)) )
-	jac.Set(8, 8, 2*Deg/G*(                                       // A3/E2
+	jac.Set(8, 8, 2*Deg/g*(                                       // A3/E2
 		s.f31*(s.H1*( s.E0*s.U2 - s.E1*s.U3) + s.H2*( s.E3*s.U2 - s.E2*s.U3) + s.H3*(-s.E2*s.U2 - s.E3*s.U3)) +
 		s.f32*(s.H1*(-s.E2*s.U3 - s.E0*s.U1) + s.H2*( s.E1*s.U3 - s.E3*s.U1) + s.H3*(-s.E0*s.U3 + s.E2*s.U1)) +
 		s.f33*(s.H1*( s.E1*s.U1 + s.E2*s.U2) + s.H2*( s.E2*s.U1 - s.E1*s.U2) + s.H3*( s.E3*s.U1 + s.E0*s.U2)) ) -
 		2*aa3*s.E2 -
 		2*(s.f31*(-s.E0) + s.f32*( s.E3) + s.f33*(-s.E2)) )
-	jac.Set(8, 9, 2*Deg/G*(                                       // A3/E3
+	jac.Set(8, 9, 2*Deg/g*(                                       // A3/E3
 		s.f31*(s.H1*( s.E1*s.U2 + s.E0*s.U3) + s.H2*( s.E2*s.U2 + s.E3*s.U3) + s.H3*( s.E3*s.U2 - s.E2*s.U3)) +
 		s.f32*(s.H1*(-s.E3*s.U3 - s.E1*s.U1) + s.H2*( s.E0*s.U3 - s.E2*s.U1) + s.H3*( s.E1*s.U3 - s.E3*s.U1)) +
 		s.f33*(s.H1*(-s.E0*s.U1 + s.E3*s.U2) + s.H2*(-s.E3*s.U1 - s.E0*s.U2) + s.H3*( s.E2*s.U1 - s.E1*s.U2)) ) -
 		2*aa3*s.E3 -
 		2*(s.f31*( s.E1) + s.f32*( s.E2) + s.f33*( s.E3)) )
-	jac.Set(8, 10, Deg/G*(                                      // A3/H1
+	jac.Set(8, 10, Deg/g*(                                      // A3/H1
 		s.f31*(s.U2*s.e13 - s.U3*s.e12) +
 		s.f32*(s.U3*s.e11 - s.U1*s.e13) +
 		s.f33*(s.U1*s.e12 - s.U2*s.e11) ))
-	jac.Set(8, 11, Deg/G*(                                      // A3/H2
+	jac.Set(8, 11, Deg/g*(                                      // A3/H2
 		s.f31*(s.U2*s.e23 - s.U3*s.e22) +
 		s.f32*(s.U3*s.e21 - s.U1*s.e23) +
 		s.f33*(s.U1*s.e22 - s.U2*s.e21) ))
-	jac.Set(8, 12, Deg/G*(                                      // A3/H3
+	jac.Set(8, 12, Deg/g*(                                      // A3/H3
 		s.f31*(s.U2*s.e33 - s.U3*s.e32) +
 		s.f32*(s.U3*s.e31 - s.U1*s.e33) +
 		s.f33*(s.U1*s.e32 - s.U2*s.e31) ))
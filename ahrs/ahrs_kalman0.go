@@ -192,7 +192,10 @@ func (s *Kalman0State) update(m *Measurement) {
 	s.H1 += su.Get(10, 0)
 	s.D1 += su.Get(26, 0)
 	s.T = m.T
-	s.M = matrix.Product(matrix.Difference(matrix.Eye(32), matrix.Product(s.kk, s.h)), s.M)
+	// Joseph form keeps M symmetric and positive semidefinite, unlike the shortcut (I-KH)M
+	ikh := matrix.Difference(matrix.Eye(32), matrix.Product(s.kk, s.h))
+	s.M = matrix.Sum(matrix.Product(ikh, matrix.Product(s.M, ikh.Transpose())),
+		matrix.Product(s.kk, matrix.Product(m.M, s.kk.Transpose())))
 	s.normalize()
 }
 
@@ -0,0 +1,189 @@
+/*
+The Mahony AHRS algorithm is a nonlinear complementary filter on the attitude quaternion.
+The gyro rates are integrated directly, and are corrected by a proportional-integral feedback
+of the error between the up direction given by the accelerometer and the estimated up direction,
+and between the horizontal direction of the magnetometer and of the reference magnetic field.
+The integral term estimates the gyro bias.
+
+It is much cheaper than the Kalman filter, with no matrices to invert, and so suits small targets
+and serves as a cross-check on the Kalman filter.  It doesn't use the GPS or airspeed, so it
+can't correct for the aircraft's own accelerations, e.g. in a sustained turn.
+
+Reference: R. Mahony, T. Hamel, J.-M. Pflimlin, "Nonlinear Complementary Filters on the Special
+Orthogonal Group", IEEE Trans. Automatic Control, 2008.
+*/
+package ahrs
+
+import (
+	"log"
+	"math"
+
+	"github.com/skelterjohn/go.matrix"
+)
+
+const (
+	mahonyKpDefault = 1.0  // Sensible default for the proportional gain, rad/s per rad of attitude error
+	mahonyKiDefault = 0.02 // Sensible default for the integral gain, rad/s² per rad of attitude error
+)
+
+type MahonyState struct {
+	State
+	kp, ki     float64 // Proportional and integral feedback gains
+	i1, i2, i3 float64 // Integral of the attitude error, aircraft frame, rad/s
+	h1, h2, h3 float64 // Attitude error at the last measurement, aircraft frame, rad
+	b1, b2, b3 float64 // Gyro rates at the last measurement, aircraft frame, °/s; State.H holds them in earth frame
+}
+
+// NewMahonyAHRS returns a new Mahony AHRS object.
+// Its attitude is initialized from the first measurement.
+func NewMahonyAHRS() (s *MahonyState) {
+	s = new(MahonyState)
+	s.needsInitialization = true
+	s.aNorm = 1
+	s.E0 = 1 // Initial guess is East
+	s.F0 = 1 // Initial guess is that it's oriented pointing forward and level
+	s.normalize()
+	// M stays nil: the Mahony filter keeps no covariance, so its uncertainties are unknown rather than zero
+	s.N = matrix.Zeros(32, 32)
+	s.kp = mahonyKpDefault
+	s.ki = mahonyKiDefault
+	s.logMap = make(map[string]interface{})
+	s.updateLogMap(NewMeasurement(), s.logMap)
+	return
+}
+
+// init sets the attitude from the accelerometer's gravity vector and the magnetometer,
+// and takes the reference magnetic field N to be the current field, pointing north.
+func (s *MahonyState) init(m *Measurement) {
+	s.State.init(m)
+	s.i1, s.i2, s.i3 = 0, 0, 0
+	s.h1, s.h2, s.h3 = 0, 0, 0
+	s.b1, s.b2, s.b3 = s.rotateByF(m.B1-s.D1, m.B2-s.D2, m.B3-s.D3, true)
+	s.N1, s.N2, s.N3 = 0, 0, 0
+
+	var roll, pitch, heading float64
+	if m.SValid {
+		a1, a2, a3 := s.rotateByF(m.A1-s.C1, m.A2-s.C2, m.A3-s.C3, true)
+		roll, pitch, _ = FromQuaternion(QuaternionAToB(-a1, -a2, -a3, 0, 0, 1))
+	}
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll, pitch, 0)
+	s.normalize()
+
+	if m.MValid {
+		b1, b2, b3 := s.rotateByF(m.M1, m.M2, m.M3, true)
+		b1, b2, b3 = s.rotateByE(b1-s.L1, b2-s.L2, b3-s.L3, false)
+		heading = -math.Atan2(b1, b2)
+		s.N1, s.N2, s.N3 = 0, math.Hypot(b1, b2), b3
+	}
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(roll, pitch, heading)
+	s.normalize()
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	s.H1, s.H2, s.H3 = s.rotateByE(s.b1, s.b2, s.b3, false)
+
+	s.updateLogMap(m, s.logMap)
+}
+
+// Compute performs the Mahony AHRS computations.
+func (s *MahonyState) Compute(m *Measurement) {
+	if s.needsInitialization {
+		s.init(m)
+		return
+	}
+	dt := m.T - s.T
+	if dt < minDT {
+		return
+	}
+	if dt > maxDT {
+		log.Printf("AHRS Info: Reinitializing at %f\n", m.T)
+		s.init(m)
+		return
+	}
+
+	s.correct(m)
+	s.Predict(m.T)
+	s.updateLogMap(m, s.logMap)
+}
+
+// Predict integrates the gyro rates of the last measurement, with the feedback of its attitude error,
+// forward to time t; ok reports whether the attitude was moved.
+func (s *MahonyState) Predict(t float64) (ok bool) {
+	dt := t - s.T
+	if s.needsInitialization || dt < minDT {
+		return false
+	}
+
+	s.i1 += s.ki * s.h1 * dt
+	s.i2 += s.ki * s.h2 * dt
+	s.i3 += s.ki * s.h3 * dt
+
+	s.E0, s.E1, s.E2, s.E3 = QuaternionRotate(s.E0, s.E1, s.E2, s.E3,
+		(s.b1*Deg+s.kp*s.h1+s.i1)*dt,
+		(s.b2*Deg+s.kp*s.h2+s.i2)*dt,
+		(s.b3*Deg+s.kp*s.h3+s.i3)*dt,
+	)
+	s.normalize()
+	s.roll, s.pitch, s.heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
+	s.H1, s.H2, s.H3 = s.rotateByE(s.b1, s.b2, s.b3, false)
+
+	// The heading is referenced to the magnetic field, so it is the magnetic heading
+	s.headingMag = s.heading
+	s.turnRate += slowSmoothConst * (-s.H3*Deg - s.turnRate)
+
+	s.T = t
+	return true
+}
+
+// Update takes the gyro rates and the attitude error from measurement m, to be applied by the next Predict,
+// initializing the attitude from it first if needed.  The Mahony filter rejects no measurements,
+// so gated is always empty.
+func (s *MahonyState) Update(m *Measurement) (gated [6]bool) {
+	if s.needsInitialization {
+		s.init(m)
+		return
+	}
+	s.correct(m)
+	s.updateLogMap(m, s.logMap)
+	return
+}
+
+// correct sets the gyro rates and the attitude error from measurement m, and smooths the slip/skid and G load.
+func (s *MahonyState) correct(m *Measurement) {
+	// Gyro rates, aircraft frame, and earth frame at the current attitude
+	s.b1, s.b2, s.b3 = s.rotateByF(m.B1-s.D1, m.B2-s.D2, m.B3-s.D3, true)
+	s.H1, s.H2, s.H3 = s.rotateByE(s.b1, s.b2, s.b3, false)
+
+	s.h1, s.h2, s.h3 = s.attitudeError(m, m.MValid)
+
+	// Update Slip/Skid and GLoad
+	_, a2, a3 := s.rotateByF(m.A1-s.C1, m.A2-s.C2, m.A3-s.C3, true)
+	s.slipSkid += slowSmoothConst * (math.Atan2(a2, -a3) - s.slipSkid)
+	s.gLoad += slowSmoothConst * (-a3/s.aNorm - s.gLoad)
+}
+
+// GetGyroBias returns the gyro bias estimated by the integral feedback, aircraft frame, °/s.
+func (s *MahonyState) GetGyroBias() (d1, d2, d3 float64) {
+	return -s.i1 / Deg, -s.i2 / Deg, -s.i3 / Deg
+}
+
+// SetConfig lets the user alter the feedback gains "kp" and "ki".
+func (s *MahonyState) SetConfig(configMap map[string]float64) {
+	if v, ok := configMap["kp"]; ok {
+		s.kp = v
+	}
+	if v, ok := configMap["ki"]; ok {
+		s.ki = v
+	}
+	if s.kp <= 0 || s.ki < 0 {
+		// This doesn't make sense, means user hasn't set correctly.
+		// Set sensible defaults.
+		s.kp = mahonyKpDefault
+		s.ki = mahonyKiDefault
+	}
+}
+
+func (s *MahonyState) updateLogMap(m *Measurement, p map[string]interface{}) {
+	s.State.updateLogMap(m, p)
+	p["I1"] = s.i1 / Deg
+	p["I2"] = s.i2 / Deg
+	p["I3"] = s.i3 / Deg
+}
@@ -157,9 +157,9 @@ func (s *SimpleState) Compute(m *Measurement) {
 		}
 		ve = [3]float64{m.W1, m.W2, m.W3} // Instantaneous groundspeed in earth frame
 		// Instantaneous acceleration in earth frame based on change in GPS groundspeed
-		ae[0] -= (m.W1 - s.w1) / dtw / G
-		ae[1] -= (m.W2 - s.w2) / dtw / G
-		ae[2] -= (m.W3 - s.w3) / dtw / G
+		ae[0] -= (m.W1 - s.w1) / dtw / s.Gravity()
+		ae[1] -= (m.W2 - s.w2) / dtw / s.Gravity()
+		ae[2] -= (m.W3 - s.w3) / dtw / s.Gravity()
 	}
 
 	ha, err := MakeUnitVector([3]float64{s.Z1, s.Z2, s.Z3})
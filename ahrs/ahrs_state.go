@@ -1,6 +1,8 @@
 package ahrs
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
 
 	"github.com/skelterjohn/go.matrix"
@@ -23,12 +25,14 @@ type State struct {
 	D1, D2, D3     float64 // Bias vector for gyro rates, sensor frame, °/s
 	L1, L2, L3     float64 // Bias vector for magnetometer direction, sensor frame, µT
 
+	Alt float64 // Pressure altitude, ft
+
 	T float64 // Time when state last updated
 
 	M *matrix.DenseMatrix // Covariance matrix of state uncertainty, same order as above vars:
 	N *matrix.DenseMatrix // Covariance matrix of state noise per unit time
 	// U, Z, E, H, N,
-	// V, C, F, D, L
+	// V, C, F, D, L, (Alt)
 
 	e11, e12, e13 float64 // cached earth-aircraft rotation matrix
 	e21, e22, e23 float64
@@ -45,10 +49,13 @@ type State struct {
 	turnRate             float64                // turn rate, Rad/s (smoothed)
 	needsInitialization  bool                   // Rather than computing, initialize
 	aNorm                float64                // Normalization constant by which to scale measured accelerations
+	declination          float64                // Magnetic declination, east positive, Rad
+	gravity              float64                // Acceleration due to gravity, speed units per s, 0 for G
 	logMap               map[string]interface{} // Map only for analysis/debugging
 }
 
-// RollPitchHeading returns the current attitude values as estimated by the Kalman algorithm.
+// RollPitchHeading returns the current attitude values as estimated by the Kalman algorithm, in radians.
+// See FromQuaternion for the sign and zero conventions; CalcRollPitchHeading returns the same in degrees.
 func (s *State) RollPitchHeading() (roll float64, pitch float64, heading float64) {
 	roll, pitch, heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
 	return
@@ -61,6 +68,75 @@ func (s *State) RollPitchHeadingUncertainty() (droll float64, dpitch float64, dh
 	return
 }
 
+// RollPitchHeadingStdDev returns the standard deviations of the roll, pitch and heading estimates, in degrees,
+// propagating the full covariance of the quaternion E through the Jacobian of the Tait-Bryan angles.
+// They are NaN if there's no covariance of E, as for the Mahony filter.
+func (s *State) RollPitchHeadingStdDev() (droll float64, dpitch float64, dheading float64) {
+	if s.M == nil || s.M.Rows() <= 9 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	jac := EulerJacobian(s.E0, s.E1, s.E2, s.E3)
+	var v [3]float64
+	for k := 0; k < 3; k++ {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				v[k] += jac[k][i] * s.M.Get(6+i, 6+j) * jac[k][j]
+			}
+		}
+	}
+	return math.Sqrt(v[0]) / Deg, math.Sqrt(v[1]) / Deg, math.Sqrt(v[2]) / Deg
+}
+
+// Uncertainties holds the standard deviations of the state estimates, taken from the diagonal of the
+// covariance matrix M, in the units of the corresponding State fields.
+type Uncertainties struct {
+	Airspeed             [3]float64 // U, kt
+	AirspeedRate         [3]float64 // Z, G
+	Attitude             [4]float64 // E, the quaternion rotating aircraft frame to earth frame
+	Roll, Pitch, Heading float64    // From the covariance of E, °
+	GyroRate             [3]float64 // H, °/s
+	MagField             [3]float64 // N, µT
+	Wind                 [3]float64 // V, kt
+	AccelBias            [3]float64 // C, G
+	SensorAttitude       [4]float64 // F, the quaternion rotating aircraft frame to sensor frame
+	GyroBias             [3]float64 // D, °/s
+	MagBias              [3]float64 // L, µT
+	Alt                  float64    // ft
+}
+
+// Uncertainties returns the standard deviations of the state estimates.
+// Those the covariance matrix M doesn't cover, e.g. for an algorithm without one, are NaN.
+func (s *State) Uncertainties() (u Uncertainties) {
+	i := 0
+	next := func() float64 {
+		defer func() { i++ }()
+		if s.M == nil || i >= s.M.Rows() {
+			return math.NaN()
+		}
+		return math.Sqrt(math.Abs(s.M.Get(i, i)))
+	}
+	fill := func(v []float64) {
+		for j := range v {
+			v[j] = next()
+		}
+	}
+
+	fill(u.Airspeed[:])
+	fill(u.AirspeedRate[:])
+	fill(u.Attitude[:])
+	fill(u.GyroRate[:])
+	fill(u.MagField[:])
+	fill(u.Wind[:])
+	fill(u.AccelBias[:])
+	fill(u.SensorAttitude[:])
+	fill(u.GyroBias[:])
+	fill(u.MagBias[:])
+	u.Alt = next()
+
+	u.Roll, u.Pitch, u.Heading = s.RollPitchHeadingStdDev()
+	return
+}
+
 // MagHeading returns the magnetic heading in degrees.
 func (s *State) MagHeading() (hdg float64) {
 	return s.headingMag / Deg
@@ -81,6 +157,140 @@ func (s *State) GLoad() (gLoad float64) {
 	return s.gLoad
 }
 
+// SetDeclination sets the local magnetic declination, or variation, in degrees, east positive:
+// the angle from true north clockwise to magnetic north, so that true heading = magnetic heading + declination.
+func (s *State) SetDeclination(declination float64) {
+	s.declination = declination * Deg
+}
+
+// Declination returns the magnetic declination set by SetDeclination, in degrees, east positive.
+func (s *State) Declination() (declination float64) {
+	return s.declination / Deg
+}
+
+// SetGravity sets the acceleration due to gravity in the units of speed used, per s: G for speeds in kt,
+// the default, or GravityMps2 for speeds in m/s.  Accelerations remain in multiples of it.
+func (s *State) SetGravity(g float64) {
+	s.gravity = g
+}
+
+// Gravity returns the acceleration due to gravity set by SetGravity, in the units of speed used per s.
+func (s *State) Gravity() (g float64) {
+	if s.gravity <= 0 {
+		return G
+	}
+	return s.gravity
+}
+
+// TrueHeading returns the true heading in degrees, in [0, 360).
+// The earth frame of the state is only tied to north through the magnetic field N: its heading, from E,
+// is magnetic as long as N points along the frame's north axis, and drifts to true as GPS tracks pull it there,
+// with N then pointing at the declination.  Either way, the magnetic heading is the heading less the direction
+// of N, and the declination set by SetDeclination is added to that.
+func (s *State) TrueHeading() (heading float64) {
+	_, _, heading = s.RollPitchHeading()
+	return s.toTrue(heading)
+}
+
+// toTrue converts a direction measured clockwise from the earth frame's north axis, in radians,
+// to degrees true in [0, 360), as described for TrueHeading.
+func (s *State) toTrue(dir float64) float64 {
+	dir += s.declination - math.Atan2(s.N1, s.N2)
+	for dir < 0 {
+		dir += 2 * Pi
+	}
+	for dir >= 2*Pi {
+		dir -= 2 * Pi
+	}
+	return dir / Deg
+}
+
+// CalmWind is the wind speed, kt, below which Wind reports no direction.
+const CalmWind = 0.5
+
+// Wind returns the horizontal wind speed in knots and the direction it blows from in degrees true, in [0, 360),
+// as pilots expect it.  The wind V is the velocity of the air over the ground in the earth frame (V1 east, V2 north),
+// so it blows from the opposite direction.  Below CalmWind the direction is meaningless and 0 is returned for it.
+func (s *State) Wind() (speedKt, fromDeg float64) {
+	speedKt = math.Hypot(s.V1, s.V2)
+	if speedKt < CalmWind {
+		return speedKt, 0
+	}
+	return speedKt, s.toTrue(math.Atan2(-s.V1, -s.V2))
+}
+
+// StandardRate is the rate of a standard-rate turn, 360° in two minutes, °/s.
+const StandardRate = 3.0
+
+// TurnRate returns the rate of turn about the earth vertical in degrees per second, positive turning right,
+// so that a standard-rate turn reads StandardRate.  The rotation rate H is kept in the earth frame,
+// the aircraft-frame gyro rates h rotated by the attitude quaternion E, H = E*h*E⁻¹,
+// so its vertical component H3 is already the turn rate, counterclockwise looking down.
+// Unlike RateOfTurn, it isn't smoothed.
+func (s *State) TurnRate() (rate float64) {
+	return -s.H3
+}
+
+// Inclinometer returns the slip/skid angle in degrees, as the ball of a mechanical inclinometer would show it,
+// with the same sign as SlipSkid.  Unlike SlipSkid, which smooths the measured accelerations, it comes from the
+// state: the ball sits along the specific force felt in the aircraft, whose lateral and vertical components are
+//
+//	a2 = -Z2 + (h1*U3 - h3*U1)*Deg/G - e32
+//	a3 = -Z3 + (h2*U1 - h1*U2)*Deg/G - e33
+//
+// where h is the rotation rate H in the aircraft frame and e32, e33 the aircraft-frame components of up,
+// so e32 = sin(roll)*cos(pitch) is the pull of gravity toward the low wing.  In a coordinated turn,
+// the centripetal term h3*U1 balances it and the ball is centered; U2 (sideslip) and Z2 move it off center.
+func (s *State) Inclinometer() (ball float64) {
+	_, a2, a3 := s.aircraftAccel()
+	return math.Atan2(a2, -a3) / Deg
+}
+
+// aircraftAccel returns the acceleration, including pseudoforces from the aircraft's rotation, that an
+// accelerometer aligned with the aircraft frame would measure, in G.
+func (s *State) aircraftAccel() (a1, a2, a3 float64) {
+	h1 := s.H1*s.e11 + s.H2*s.e21 + s.H3*s.e31
+	h2 := s.H1*s.e12 + s.H2*s.e22 + s.H3*s.e32
+	h3 := s.H1*s.e13 + s.H2*s.e23 + s.H3*s.e33
+	g := s.Gravity()
+	a1 = -s.Z1 + (h3*s.U2-h2*s.U3)*Deg/g - s.e31
+	a2 = -s.Z2 + (h1*s.U3-h3*s.U1)*Deg/g - s.e32
+	a3 = -s.Z3 + (h2*s.U1-h1*s.U2)*Deg/g - s.e33
+	return
+}
+
+// Altitude returns the pressure altitude in feet.
+func (s *State) Altitude() (alt float64) {
+	return s.Alt
+}
+
+// VerticalSpeed returns the vertical speed over the ground in knots, positive up:
+// the earth-frame vertical component of the airspeed U plus the vertical wind V3.
+// This is the rate at which Predict integrates the altitude, and what the GPS W3 measures.
+// Use KtToFpm for a VSI.
+func (s *State) VerticalSpeed() (vs float64) {
+	return s.e31*s.U1 + s.e32*s.U2 + s.e33*s.U3 + s.V3
+}
+
+// Airspeed returns the true airspeed in knots, the magnitude of the airspeed U.
+// U is the aircraft's velocity through the air in the aircraft frame: U1 along the nose, U2 toward the left wing
+// and U3 up, so in steady flight U1 carries nearly all of it.
+func (s *State) Airspeed() (tas float64) {
+	return math.Sqrt(s.U1*s.U1 + s.U2*s.U2 + s.U3*s.U3)
+}
+
+// AirflowAngles returns the angle of attack and the sideslip angle in degrees, from the direction of the airspeed U
+// in the aircraft frame.  The angle of attack is positive when the aircraft moves below the line of its nose
+// (U3 negative), measured in the plane of symmetry; the sideslip is positive when it moves toward its right wing
+// (U2 negative), so that the relative wind comes from the right.  Both are 0 when the airspeed is 0.
+func (s *State) AirflowAngles() (alpha, beta float64) {
+	tas := s.Airspeed()
+	if tas == 0 {
+		return 0, 0
+	}
+	return math.Atan2(-s.U3, s.U1) / Deg, math.Asin(-s.U2/tas) / Deg
+}
+
 // SetSensorQuaternion changes the AHRS algorithm's sensor quaternion F.
 func (s *State) SetSensorQuaternion(f *[4]float64) {
 	s.F0 = f[0]
@@ -165,6 +375,25 @@ func (s *State) GetState() *State {
 	return s
 }
 
+// Copy returns a deep copy of the State, with its own copies of the M and N matrices and the log map,
+// so that the copy and the original can be updated independently.
+func (s *State) Copy() *State {
+	c := *s
+	if s.M != nil {
+		c.M = s.M.Copy()
+	}
+	if s.N != nil {
+		c.N = s.N.Copy()
+	}
+	if s.logMap != nil {
+		c.logMap = make(map[string]interface{}, len(s.logMap))
+		for k, v := range s.logMap {
+			c.logMap[k] = v
+		}
+	}
+	return &c
+}
+
 // GetLogMap returns a map providing current state and measurement values for analysis
 func (s *State) GetLogMap() (p map[string]interface{}) {
 	return s.logMap
@@ -306,9 +535,144 @@ func (s *State) rotateByF(a1, a2, a3 float64, inverse bool) (z1, z2, z3 float64)
 	return
 }
 
-// RollPitchHeading returns the current roll, pitch and heading estimates
-// for the State, in degrees
+// attitudeError returns the small rotation, aircraft frame, rad, that would bring the attitude E into line with
+// the up direction given by the accelerometer's gravity vector and, if useMag, with the heading given by the
+// magnetometer and the reference field N.  The accelerometer is ignored when it is far from 1G.
+func (s *State) attitudeError(m *Measurement, useMag bool) (h1, h2, h3 float64) {
+	p1, p2, p3 := s.rotateByE(0, 0, 1, true) // Estimated up direction, aircraft frame
+
+	if m.SValid {
+		a1, a2, a3 := s.rotateByF(m.A1-s.C1, m.A2-s.C2, m.A3-s.C3, true)
+		// Only trust the gravity vector when not accelerating much
+		if aa := math.Sqrt(a1*a1 + a2*a2 + a3*a3); math.Abs(aa-1) < 0.2 {
+			u1, u2, u3 := -a1/aa, -a2/aa, -a3/aa // Measured up direction, aircraft frame
+			h1 += u2*p3 - u3*p2
+			h2 += u3*p1 - u1*p3
+			h3 += u1*p2 - u2*p1
+		}
+	}
+
+	if useMag && (s.N1 != 0 || s.N2 != 0) {
+		b1, b2, b3 := s.rotateByF(m.M1, m.M2, m.M3, true)
+		b1, b2, _ = s.rotateByE(b1-s.L1, b2-s.L2, b3-s.L3, false)
+		// Heading error is the angle about the vertical from the measured to the reference field
+		dpsi := math.Atan2(b1*s.N2-b2*s.N1, b1*s.N1+b2*s.N2)
+		h1 += dpsi * p1
+		h2 += dpsi * p2
+		h3 += dpsi * p3
+	}
+	return
+}
+
+// CalcRollPitchHeading returns the current roll, pitch and heading estimates
+// for the State, in degrees, with the conventions of FromQuaternion:
+// positive roll is right wing down, positive pitch is nose up, and heading is clockwise from north, 0 to 360.
 func (s *State) CalcRollPitchHeading() (roll float64, pitch float64, heading float64) {
 	roll, pitch, heading = FromQuaternion(s.E0, s.E1, s.E2, s.E3)
 	return roll / Deg, pitch / Deg, heading / Deg
 }
+
+// stateJSON is the stable serialized form of a State: the primary state variables and both matrices.
+type stateJSON struct {
+	U1, U2, U3     float64
+	Z1, Z2, Z3     float64
+	E0, E1, E2, E3 float64
+	H1, H2, H3     float64
+	N1, N2, N3     float64
+
+	V1, V2, V3     float64
+	C1, C2, C3     float64
+	F0, F1, F2, F3 float64
+	D1, D2, D3     float64
+	L1, L2, L3     float64
+
+	Alt float64
+
+	T float64
+
+	M [][]float64 `json:",omitempty"`
+	N [][]float64 `json:",omitempty"`
+}
+
+// MarshalJSON encodes the primary state variables and the M and N matrices (as arrays of rows) of the State.
+// The cached rotation matrices and smoothed outputs are not included.
+func (s *State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(stateJSON{
+		s.U1, s.U2, s.U3,
+		s.Z1, s.Z2, s.Z3,
+		s.E0, s.E1, s.E2, s.E3,
+		s.H1, s.H2, s.H3,
+		s.N1, s.N2, s.N3,
+		s.V1, s.V2, s.V3,
+		s.C1, s.C2, s.C3,
+		s.F0, s.F1, s.F2, s.F3,
+		s.D1, s.D2, s.D3,
+		s.L1, s.L2, s.L3,
+		s.Alt,
+		s.T,
+		matrixToRows(s.M),
+		matrixToRows(s.N),
+	})
+}
+
+// UnmarshalJSON decodes a State encoded by MarshalJSON, reconstructing the cached rotation matrices.
+func (s *State) UnmarshalJSON(data []byte) (err error) {
+	var j stateJSON
+	if err = json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if s.M, err = rowsToMatrix(j.M); err != nil {
+		return err
+	}
+	if s.N, err = rowsToMatrix(j.N); err != nil {
+		return err
+	}
+
+	s.U1, s.U2, s.U3 = j.U1, j.U2, j.U3
+	s.Z1, s.Z2, s.Z3 = j.Z1, j.Z2, j.Z3
+	s.E0, s.E1, s.E2, s.E3 = j.E0, j.E1, j.E2, j.E3
+	s.H1, s.H2, s.H3 = j.H1, j.H2, j.H3
+	s.N1, s.N2, s.N3 = j.N1, j.N2, j.N3
+	s.V1, s.V2, s.V3 = j.V1, j.V2, j.V3
+	s.C1, s.C2, s.C3 = j.C1, j.C2, j.C3
+	s.F0, s.F1, s.F2, s.F3 = j.F0, j.F1, j.F2, j.F3
+	s.D1, s.D2, s.D3 = j.D1, j.D2, j.D3
+	s.L1, s.L2, s.L3 = j.L1, j.L2, j.L3
+	s.Alt = j.Alt
+	s.T = j.T
+
+	s.normalize()
+	return nil
+}
+
+// matrixToRows returns the elements of mat as an array of rows, or nil if mat is nil.
+func matrixToRows(mat *matrix.DenseMatrix) (rows [][]float64) {
+	if mat == nil {
+		return nil
+	}
+	rows = make([][]float64, mat.Rows())
+	for i := range rows {
+		rows[i] = make([]float64, mat.Cols())
+		for j := range rows[i] {
+			rows[i][j] = mat.Get(i, j)
+		}
+	}
+	return rows
+}
+
+// rowsToMatrix builds a matrix from an array of rows, or returns nil if there are none.
+func rowsToMatrix(rows [][]float64) (mat *matrix.DenseMatrix, err error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	mat = matrix.Zeros(len(rows), len(rows[0]))
+	for i, row := range rows {
+		if len(row) != len(rows[0]) {
+			return nil, fmt.Errorf("Error: matrix row %d has %d elements, expected %d", i, len(row), len(rows[0]))
+		}
+		for j, v := range row {
+			mat.Set(i, j, v)
+		}
+	}
+	return mat, nil
+}
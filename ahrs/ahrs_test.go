@@ -1,16 +1,21 @@
 package ahrs
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/skelterjohn/go.matrix"
+	"github.com/westphae/quaternion"
 	"log"
 	"math"
 	"math/rand"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
 func createRandomState() (s *KalmanState) {
-	s = &KalmanState{State{
+	s = &KalmanState{State: State{
 		U1: rand.Float64()*100 + 15,
 		U2: rand.Float64()*10 - 5,
 		U3: rand.Float64()*10 - 5,
@@ -46,8 +51,8 @@ func createRandomState() (s *KalmanState) {
 		L3: rand.Float64()*1 - 0.5,
 
 		T: 10,
-		M: matrix.Zeros(32, 32),
-		N: matrix.Zeros(32, 32),
+		M: matrix.Zeros(33, 33),
+		N: matrix.Zeros(33, 33),
 	}}
 
 	s.normalize()
@@ -89,6 +94,7 @@ func stateMap(s *KalmanState) map[int]*float64 {
 		29: &s.L1,
 		30: &s.L2,
 		31: &s.L3,
+		32: &s.Alt,
 	}
 }
 
@@ -109,6 +115,7 @@ func measMap(m *Measurement) map[int]*float64 {
 		12: &m.M1,
 		13: &m.M2,
 		14: &m.M3,
+		15: &m.P,
 	}
 }
 
@@ -123,9 +130,9 @@ func TestJacobianMeasurement(t *testing.T) {
 
 		h := s.calcJacobianMeasurement()
 
-		for i := 0; i < 32; i++ {
+		for i := 0; i < 33; i++ {
 			//TODO westphae: don't skip these after working out Jacobian for magnetometer
-			if (i >= 12 && i <= 14) || (i >= 29) {
+			if (i >= 12 && i <= 14) || (i >= 29 && i <= 31) {
 				continue
 			}
 			*(smap[i]) += Small
@@ -135,7 +142,10 @@ func TestJacobianMeasurement(t *testing.T) {
 			s.calcRotationMatrices()
 			mmmap := measMap(mm)
 			//TODO westphae: indices all the way up to 15 after working out Jacobian for magnetometer
-			for j := 0; j < 12; j++ {
+			for j := 0; j < 16; j++ {
+				if j >= 12 && j <= 14 {
+					continue
+				}
 				dM := (*(mmmap[j]) - *(mmap[j])) / Small
 				if math.Abs(dM-h.Get(j, i)) > 1e-4 {
 					log.Printf("Error in index %2d,%2d: Calc %6f, Jacobian was %6f\n", j, i, dM, h.Get(j, i))
@@ -386,3 +396,1132 @@ func TestMakeHardSoftRotationMatrix(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRotationMatrices(t *testing.T) {
+	rand.Seed(time.Now().Unix())
+
+	for i := 0; i < 100; i++ {
+		s := createRandomState()
+		a1, a2, a3 := rand.Float64()*2-1, rand.Float64()*2-1, rand.Float64()*2-1
+
+		// X_e = E*X_a*conj(E)
+		e := quaternion.Quaternion{W: s.E0, X: s.E1, Y: s.E2, Z: s.E3}
+		v := quaternion.Prod(e, quaternion.Quaternion{X: a1, Y: a2, Z: a3}, quaternion.Conj(e))
+		z1, z2, z3 := s.rotateByE(a1, a2, a3, false)
+		if math.Abs(z1-v.X)+math.Abs(z2-v.Y)+math.Abs(z3-v.Z) > Small {
+			log.Println("Error: rotateByE doesn't match quaternion rotation")
+			log.Printf("q: %3f %3f %3f\n", v.X, v.Y, v.Z)
+			log.Printf("e: %3f %3f %3f\n", z1, z2, z3)
+			t.Fail()
+		}
+		z1, z2, z3 = s.rotateByE(z1, z2, z3, true)
+		if math.Abs(z1-a1)+math.Abs(z2-a2)+math.Abs(z3-a3) > Small {
+			log.Println("Error: inverse rotateByE doesn't return the original vector")
+			t.Fail()
+		}
+
+		// X_s = F*X_a*conj(F)
+		f := quaternion.Quaternion{W: s.F0, X: s.F1, Y: s.F2, Z: s.F3}
+		v = quaternion.Prod(f, quaternion.Quaternion{X: a1, Y: a2, Z: a3}, quaternion.Conj(f))
+		z1, z2, z3 = s.rotateByF(a1, a2, a3, false)
+		if math.Abs(z1-v.X)+math.Abs(z2-v.Y)+math.Abs(z3-v.Z) > Small {
+			log.Println("Error: rotateByF doesn't match quaternion rotation")
+			log.Printf("q: %3f %3f %3f\n", v.X, v.Y, v.Z)
+			log.Printf("f: %3f %3f %3f\n", z1, z2, z3)
+			t.Fail()
+		}
+	}
+}
+
+func TestCovarianceStability(t *testing.T) {
+	const (
+		dt = 0.05
+		n  = 5000
+	)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	rand.Seed(time.Now().Unix())
+
+	// Steady level flight heading east, measurements synthesized from the true state plus noise
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	s := InitializeKalman(truth.PredictMeasurement())
+
+	for i := 1; i <= n; i++ {
+		truth.T = float64(i) * dt
+		m := truth.PredictMeasurement()
+		m.UValid = false
+		m.W1 += rand.NormFloat64() * 0.5
+		m.W2 += rand.NormFloat64() * 0.5
+		m.W3 += rand.NormFloat64() * 0.5
+		m.A1 += rand.NormFloat64() * 0.01
+		m.A2 += rand.NormFloat64() * 0.01
+		m.A3 += rand.NormFloat64() * 0.01
+		m.B1 += rand.NormFloat64() * 0.1
+		m.B2 += rand.NormFloat64() * 0.1
+		m.B3 += rand.NormFloat64() * 0.1
+		m.M1 += rand.NormFloat64() * 0.5
+		m.M2 += rand.NormFloat64() * 0.5
+		m.M3 += rand.NormFloat64() * 0.5
+		s.Compute(m)
+
+		if strings.Contains(buf.String(), "Can't invert") {
+			t.Fatalf("Kalman gain matrix not invertible at step %d", i)
+		}
+		for j := 0; j < 33; j++ {
+			if v := s.M.Get(j, j); v < 0 || math.IsNaN(v) {
+				t.Fatalf("covariance diagonal %d is %g at step %d", j, v, i)
+			}
+			for k := 0; k < j; k++ {
+				if d := s.M.Get(j, k) - s.M.Get(k, j); math.Abs(d) > 1e-6*(1+math.Abs(s.M.Get(j, k))) {
+					t.Fatalf("covariance not symmetric at %d,%d by %g at step %d", j, k, d, i)
+				}
+			}
+		}
+	}
+}
+
+func TestInnovationGating(t *testing.T) {
+	rand.Seed(time.Now().Unix())
+
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	s := InitializeKalman(truth.PredictMeasurement())
+
+	// As in the simulator, the same Measurement is reused so its variance accumulators settle
+	m := NewMeasurement()
+	measure := func(i int) {
+		truth.T = float64(i) * 0.05
+		z := truth.PredictMeasurement()
+		m.WValid, m.SValid, m.MValid = true, true, true
+		m.W1, m.W2, m.W3 = z.W1+rand.NormFloat64()*0.1, z.W2+rand.NormFloat64()*0.1, z.W3
+		m.A1, m.A2, m.A3 = z.A1+rand.NormFloat64()*0.01, z.A2, z.A3
+		m.B1, m.B2, m.B3 = z.B1+rand.NormFloat64()*0.1, z.B2, z.B3
+		m.M1, m.M2, m.M3 = z.M1+rand.NormFloat64()*0.1, z.M2, z.M3
+		m.T = z.T
+	}
+
+	var gated [6]bool
+	for i := 1; i <= 500; i++ {
+		measure(i)
+		s.Predict(m.T)
+		gated = s.Update(m)
+	}
+	if gated[BlockW] {
+		t.Error("nominal GPS measurement was gated")
+	}
+
+	// A bad GPS fix should be rejected without moving the airspeed or wind estimates
+	u1, v1 := s.U1, s.V1
+	measure(501)
+	m.W1 += 60
+	s.Predict(m.T)
+	gated = s.Update(m)
+	if !gated[BlockW] {
+		t.Error("GPS outlier was not gated")
+	}
+	if math.Abs(s.U1-u1) > 1 || math.Abs(s.V1-v1) > 1 {
+		t.Errorf("GPS outlier moved the state: U1 %.2f -> %.2f, V1 %.2f -> %.2f", u1, s.U1, v1, s.V1)
+	}
+
+	// A tighter or looser gate can be configured
+	s.SetConfig(map[string]float64{"innovationGate": 1000})
+	measure(502)
+	m.W1 += 60
+	s.Predict(m.T)
+	if gated = s.Update(m); gated[BlockW] {
+		t.Error("GPS outlier gated despite a wide gate")
+	}
+}
+
+func TestNoiseSetters(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+	s := InitializeKalman(m)
+
+	if err := s.SetProcessNoise(make([]float64, 32)); err == nil {
+		t.Error("SetProcessNoise accepted 32 values")
+	}
+	if err := s.SetMeasurementNoise(make([]float64, 15)); err == nil {
+		t.Error("SetMeasurementNoise accepted 15 values")
+	}
+
+	// Defaults are unchanged
+	if v := s.N.Get(13, 13); math.Abs(v-100*100) > Small {
+		t.Errorf("default process noise N1 was %g", v)
+	}
+	s.Predict(0.05)
+	s.Update(m)
+	if v := s.r.Get(1, 1); v != 1 {
+		t.Errorf("default measurement noise U2 was %g", v)
+	}
+
+	pn := defaultProcessNoise()
+	pn[13] = 2
+	if err := s.SetProcessNoise(pn); err != nil {
+		t.Error(err)
+	}
+	if v := s.N.Get(13, 13); math.Abs(v-4) > Small {
+		t.Errorf("process noise N1 was %g, expected 4", v)
+	}
+
+	mn := make([]float64, 16)
+	mn[3] = 0.5
+	if err := s.SetMeasurementNoise(mn); err != nil {
+		t.Error(err)
+	}
+	m.T = 0.1
+	s.Predict(m.T)
+	s.Update(m)
+	if v := s.r.Get(3, 3); math.Abs(v-0.25) > Small {
+		t.Errorf("measurement noise W1 was %g, expected 0.25", v)
+	}
+	if v := s.r.Get(1, 1); v != Big {
+		t.Errorf("measurement noise U2 was %g, expected unused", v)
+	}
+}
+
+func TestReinitialize(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+
+	s := createRandomState()
+	s.M = matrix.Scaled(matrix.Eye(33), -1)
+	s.N = matrix.Eye(33)
+	mm, nn := s.M, s.N
+	s.Reinitialize(m)
+	if s.M != mm || s.N != nn {
+		t.Error("Reinitialize allocated new matrices")
+	}
+
+	fresh := InitializeKalman(m)
+	smap, fmap := stateMap(s), stateMap(fresh)
+	for i := range smap {
+		if *smap[i] != *fmap[i] {
+			t.Errorf("state %d was %g after Reinitialize, %g when initialized", i, *smap[i], *fmap[i])
+		}
+	}
+	for i := 0; i < 33; i++ {
+		for j := 0; j < 33; j++ {
+			if s.M.Get(i, j) != fresh.M.Get(i, j) || s.N.Get(i, j) != fresh.N.Get(i, j) {
+				t.Fatalf("covariance %d,%d differs after Reinitialize", i, j)
+			}
+		}
+	}
+}
+
+func TestUpdateLeavesMeasurement(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+	m.UValid, m.WValid = false, false // Blocks which Update would disable
+	m.T = 0.05
+	w1, w2, w3 := m.W1, m.W2, m.W3
+
+	// Fixed noise, so that the measurement's own variance accumulators don't come into it
+	mn := make([]float64, 16)
+	for i := range mn {
+		mn[i] = 1
+	}
+
+	var results [2]*KalmanState
+	for i := range results {
+		s := InitializeKalman(m)
+		if err := s.SetMeasurementNoise(mn); err != nil {
+			t.Fatal(err)
+		}
+		s.Predict(m.T)
+		s.Update(m)
+		results[i] = s
+	}
+
+	if m.UValid || m.WValid || m.W1 != w1 || m.W2 != w2 || m.W3 != w3 {
+		t.Error("Update changed the measurement")
+	}
+	for i := 0; i < 15; i++ {
+		if v := m.M.Get(i, i); v != Big {
+			t.Errorf("measurement noise %d was changed to %g", i, v)
+		}
+	}
+	smap0, smap1 := stateMap(results[0]), stateMap(results[1])
+	for i := range smap0 {
+		if *smap0[i] != *smap1[i] {
+			t.Errorf("state %d was %g after the first Update, %g after the second", i, *smap0[i], *smap1[i])
+		}
+	}
+}
+
+func TestPredictNonFinite(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+	s := InitializeKalman(m)
+
+	// A drifted quaternion is renormalized rather than trusted
+	s.E0 *= 1.1
+	if z := s.PredictMeasurement(); math.Abs(z.W1-m.W1) > Tolerance || math.Abs(s.E0-1) > Tolerance {
+		t.Errorf("predicted W1 %.2f from an unnormalized quaternion, expected %.2f", z.W1, m.W1)
+	}
+
+	s.E1 = math.NaN()
+	z := s.PredictMeasurement()
+	if z.UValid || z.WValid || z.SValid || z.MValid || z.PValid {
+		t.Error("prediction from a non-finite state was marked valid")
+	}
+
+	var reinit bool
+	s.OnReinitialize = func(_, _ float64) { reinit = true }
+	m.T = 0.05
+	s.Update(m)
+	if !reinit || !s.finite() {
+		t.Error("non-finite state wasn't reinitialized")
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	rand.Seed(time.Now().Unix())
+
+	s := createRandomState()
+	for i := 0; i < 33; i++ {
+		for j := 0; j < 33; j++ {
+			s.M.Set(i, j, rand.Float64())
+			s.N.Set(i, j, rand.Float64())
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(KalmanState)
+	if err := json.Unmarshal(data, r); err != nil {
+		t.Fatal(err)
+	}
+
+	smap, rmap := stateMap(s), stateMap(r)
+	for i := range smap {
+		if math.Abs(*smap[i]-*rmap[i]) > Small {
+			t.Errorf("state %d was %g after round trip, expected %g", i, *rmap[i], *smap[i])
+		}
+	}
+	if r.T != s.T {
+		t.Errorf("T was %g after round trip, expected %g", r.T, s.T)
+	}
+	for i := 0; i < 33; i++ {
+		for j := 0; j < 33; j++ {
+			if r.M.Get(i, j) != s.M.Get(i, j) || r.N.Get(i, j) != s.N.Get(i, j) {
+				t.Fatalf("matrices differ at %d,%d after round trip", i, j)
+			}
+		}
+	}
+	if math.Abs(r.e12-s.e12)+math.Abs(r.f21-s.f21)+math.Abs(r.e33-s.e33) > Small {
+		t.Error("rotation matrices not reconstructed after round trip")
+	}
+
+	if err := json.Unmarshal([]byte(`{"M": [[1, 2], [3]]}`), r); err == nil {
+		t.Error("ragged matrix was accepted")
+	}
+}
+
+func TestCalcRollPitchHeading(t *testing.T) {
+	d := 5 * Deg
+	for _, c := range []struct {
+		name                 string
+		e0, e1, e2, e3       float64
+		roll, pitch, heading float64
+	}{
+		{"level east", 1, 0, 0, 0, 0, 0, 90},
+		{"right roll", math.Cos(d), math.Sin(d), 0, 0, 10, 0, 90},
+		{"nose up", math.Cos(-d), 0, math.Sin(-d), 0, 0, 10, 90},
+		{"left turn", math.Cos(d), 0, 0, math.Sin(d), 0, 0, 80},
+		{"north", math.Cos(45 * Deg), 0, 0, math.Sin(45 * Deg), 0, 0, 0},
+	} {
+		s := &State{E0: c.e0, E1: c.e1, E2: c.e2, E3: c.e3}
+		roll, pitch, heading := s.CalcRollPitchHeading()
+		if heading > 359.9 {
+			heading -= 360
+		}
+		if math.Abs(roll-c.roll)+math.Abs(pitch-c.pitch)+math.Abs(heading-c.heading) > Tolerance {
+			t.Errorf("%s: got roll %.2f, pitch %.2f, heading %.2f, expected %.2f, %.2f, %.2f",
+				c.name, roll, pitch, heading, c.roll, c.pitch, c.heading)
+		}
+	}
+}
+
+func TestPressureAltitude(t *testing.T) {
+	rand.Seed(time.Now().Unix())
+
+	// Climbing at 500 ft/min with the nose pitched up, wind calm
+	const climb = 500.0 / 60 / FtPerKt // kt
+	pitch := math.Asin(climb / 100)
+	truth := &KalmanState{State: State{U1: 100, E0: math.Cos(-pitch / 2), E2: math.Sin(-pitch / 2), F0: 1,
+		N1: 20, N3: -40, Alt: 1000}}
+	truth.normalize()
+
+	m := NewMeasurement()
+	measure := func(i int) {
+		truth.T = float64(i) * 0.05
+		truth.Alt = 1000 + truth.T*climb*FtPerKt
+		z := truth.PredictMeasurement()
+		m.WValid, m.SValid, m.MValid, m.PValid = true, true, true, true
+		m.W1, m.W2, m.W3 = z.W1, z.W2, z.W3
+		m.A1, m.A2, m.A3 = z.A1, z.A2, z.A3
+		m.B1, m.B2, m.B3 = z.B1, z.B2, z.B3
+		m.M1, m.M2, m.M3 = z.M1, z.M2, z.M3
+		m.P = z.P + rand.NormFloat64()*5
+		m.T = z.T
+	}
+
+	measure(0)
+	s := InitializeKalman(m)
+	if math.Abs(s.Alt-1000) > 20 {
+		t.Errorf("initial altitude was %.1f, expected 1000", s.Alt)
+	}
+
+	for i := 1; i <= 1200; i++ {
+		measure(i)
+		s.Compute(m)
+	}
+	if math.Abs(s.Alt-truth.Alt) > 20 {
+		t.Errorf("altitude was %.1f after a minute's climb, expected %.1f", s.Alt, truth.Alt)
+	}
+	if v := s.M.Get(32, 32); v <= 0 || v > 100 {
+		t.Errorf("altitude variance was %g", v)
+	}
+}
+
+func TestNewGPSMeasurement(t *testing.T) {
+	for _, c := range []struct {
+		gs, trk, vs float64
+		w1, w2, w3  float64
+	}{
+		{100, 0, 0, 0, 100, 0},
+		{100, 90, 5, 100, 0, 5},
+		{100, 180, -5, 0, -100, -5},
+		{100, 270, 0, -100, 0, 0},
+	} {
+		m := NewGPSMeasurement(c.gs, c.trk, c.vs)
+		if !m.WValid {
+			t.Error("GPS measurement not marked valid")
+		}
+		if math.Abs(m.W1-c.w1)+math.Abs(m.W2-c.w2)+math.Abs(m.W3-c.w3) > Tolerance {
+			t.Errorf("track %.0f: got W %.2f, %.2f, %.2f, expected %.2f, %.2f, %.2f",
+				c.trk, m.W1, m.W2, m.W3, c.w1, c.w2, c.w3)
+		}
+	}
+
+	// A filter initialized from a GPS track points along it
+	m := NewGPSMeasurement(100, 30, 0)
+	s := InitializeKalman(m)
+	if _, _, heading := s.CalcRollPitchHeading(); math.Abs(heading-30) > 0.1 {
+		t.Errorf("heading was %.1f after initializing from track 30", heading)
+	}
+}
+
+func TestInitializeFromAccel(t *testing.T) {
+	r, p, y := 20*Deg, 10*Deg, 30*Deg
+	e0, e1, e2, e3 := ToQuaternion(r, p, y)
+	truth := &KalmanState{State: State{U1: 100, E0: e0, E1: e1, E2: e2, E3: e3, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+
+	// Roll and pitch come from gravity, heading from the GPS track
+	s := InitializeKalman(m)
+	roll, pitch, heading := s.RollPitchHeading()
+	if math.Abs(roll-r)+math.Abs(pitch-p)+math.Abs(AngleDiff(heading, y)) > Tolerance {
+		t.Errorf("initialized to roll %.1f, pitch %.1f, heading %.1f, expected %.1f, %.1f, %.1f",
+			roll/Deg, pitch/Deg, heading/Deg, r/Deg, p/Deg, y/Deg)
+	}
+
+	// Without the accelerometer it's level
+	m.SValid = false
+	s = InitializeKalman(m)
+	if roll, pitch, _ = s.RollPitchHeading(); math.Abs(roll)+math.Abs(pitch) > Tolerance {
+		t.Errorf("initialized to roll %.1f, pitch %.1f without the accelerometer, expected level", roll/Deg, pitch/Deg)
+	}
+}
+
+func TestStep(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	z := truth.PredictMeasurement()
+	s, ref := InitializeKalman(z), InitializeKalman(z)
+
+	// Stepping with raw samples is the same as predicting and updating with the Measurement they make
+	m := NewMeasurement()
+	for i := 1; i <= 20; i++ {
+		tt := float64(i) * 0.05
+		var gps *GPSFix
+		if i%2 == 0 {
+			gps = &GPSFix{GroundspeedKt: 100, TrackDeg: 90, T: tt}
+		}
+		s.Step([3]float64{z.B1, z.B2, z.B3}, [3]float64{z.A1, z.A2, z.A3}, [3]float64{}, gps, tt)
+
+		m.SValid, m.MValid, m.WValid = true, false, gps != nil
+		m.A1, m.A2, m.A3 = z.A1, z.A2, z.A3
+		m.B1, m.B2, m.B3 = z.B1, z.B2, z.B3
+		if gps != nil {
+			m.SetGPS(100, 90, 0)
+		}
+		m.T = tt
+		ref.Predict(tt)
+		ref.Update(m)
+	}
+	smap, rmap := stateMap(s), stateMap(ref)
+	for i := range smap {
+		if *smap[i] != *rmap[i] {
+			t.Errorf("state %d was %g after Step, %g after Predict and Update", i, *smap[i], *rmap[i])
+		}
+	}
+}
+
+func TestPredictNonPositiveDt(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+	m.T = 10
+	s := InitializeKalman(m)
+	s.Z1 = 0.1 // Something to extrapolate
+
+	if !s.Predict(10.05) {
+		t.Error("Predict skipped a forward step")
+	}
+	u1, m00 := s.U1, s.M.Get(0, 0)
+
+	for _, t1 := range []float64{10.05, 10.0, 5} {
+		if s.Predict(t1) {
+			t.Errorf("Predict from %.2f to %.2f wasn't skipped", s.T, t1)
+		}
+		if s.T != t1 {
+			t.Errorf("T was %.2f after skipped Predict, expected %.2f", s.T, t1)
+		}
+		if s.U1 != u1 || s.M.Get(0, 0) != m00 {
+			t.Errorf("state changed by skipped Predict to %.2f", t1)
+		}
+		for i := 0; i < 33; i++ {
+			if s.M.Get(i, i) < 0 {
+				t.Errorf("covariance diagonal %d negative after Predict to %.2f", i, t1)
+			}
+		}
+	}
+
+	if !s.Predict(5.05) || s.U1 == u1 {
+		t.Error("Predict didn't resume after time went backwards")
+	}
+}
+
+func TestReportedGPSAccuracy(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+	s := InitializeKalman(m)
+
+	m.T = 0.05
+	s.Predict(m.T)
+	s.Update(m)
+	v := s.r.Get(4, 4)
+
+	m.DW1, m.DW2, m.DW3 = 3, 0, 0.5
+	m.T = 0.1
+	s.Predict(m.T)
+	s.Update(m)
+	if g := s.r.Get(3, 3); math.Abs(g-9) > Small {
+		t.Errorf("W1 variance was %g with a reported accuracy of 3 kt", g)
+	}
+	if g := s.r.Get(5, 5); math.Abs(g-0.25) > Small {
+		t.Errorf("W3 variance was %g with a reported accuracy of 0.5 kt", g)
+	}
+	if g := s.r.Get(4, 4); g == 0 || math.Abs(g-v) > 1 {
+		t.Errorf("W2 variance was %g without a reported accuracy, expected about %g", g, v)
+	}
+}
+
+func TestStateCopy(t *testing.T) {
+	rand.Seed(time.Now().Unix())
+
+	s := createRandomState()
+	s.M.Set(1, 2, 3)
+	s.N.Set(2, 1, 4)
+	u1, e12 := s.U1, s.e12
+
+	c := (&s.State).Copy()
+	if c.U1 != u1 || c.e12 != e12 || c.M.Get(1, 2) != 3 || c.N.Get(2, 1) != 4 {
+		t.Fatal("copy doesn't match the original")
+	}
+
+	c.U1 += 10
+	c.E1 += 0.5
+	c.normalize()
+	c.M.Set(1, 2, 5)
+	c.N.Set(2, 1, 6)
+	if s.U1 != u1 || s.e12 != e12 {
+		t.Error("changing the copy changed the original's state")
+	}
+	if s.M.Get(1, 2) != 3 || s.N.Get(2, 1) != 4 {
+		t.Error("changing the copy's matrices changed the original's")
+	}
+}
+
+func TestMagDisturbance(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+	s := InitializeKalman(m)
+	if math.Abs(s.magRef-math.Hypot(20, 40)) > Tolerance {
+		t.Errorf("reference field learned as %.2f µT, expected %.2f", s.magRef, math.Hypot(20, 40))
+	}
+
+	m.T = 0.05
+	s.Predict(m.T)
+	if gated := s.Update(m); gated[BlockM] {
+		t.Error("undisturbed magnetometer was gated")
+	}
+
+	m.M1, m.M2, m.M3 = 1.5*m.M1, 1.5*m.M2, 1.5*m.M3
+	m.T = 0.1
+	s.Predict(m.T)
+	if gated := s.Update(m); !gated[BlockM] {
+		t.Error("disturbed magnetometer was not gated")
+	}
+	if v := s.r.Get(12, 12); v != Big {
+		t.Errorf("disturbed magnetometer variance was %g", v)
+	}
+
+	// The new field strength is accepted once it's the reference
+	s.SetMagReference(1.5 * math.Hypot(20, 40))
+	m.T = 0.15
+	s.Predict(m.T)
+	if s.Update(m); s.r.Get(12, 12) == Big {
+		t.Error("magnetometer matching the new reference was treated as disturbed")
+	}
+}
+
+func TestComplementaryCorrection(t *testing.T) {
+	// Climbing right turn to the north-west
+	r, p, y := 20*Deg, 5*Deg, 300*Deg
+	e0, e1, e2, e3 := ToQuaternion(r, p, y)
+	truth := &KalmanState{State: State{U1: 100, E0: e0, E1: e1, E2: e2, E3: e3, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+
+	// Start well off in roll, pitch and heading
+	e0, e1, e2, e3 = ToQuaternion(r-15*Deg, p+10*Deg, y+30*Deg)
+	s := &KalmanState{State: State{U1: 100, E0: e0, E1: e1, E2: e2, E3: e3, F0: 1, N1: 20, N3: -40}}
+	s.normalize()
+
+	for i := 0; i < 500; i++ {
+		s.complementaryCorrection(m)
+		s.normalize()
+	}
+
+	roll, pitch, heading := s.CalcRollPitchHeading()
+	if math.Abs(roll-r/Deg)+math.Abs(pitch-p/Deg)+math.Abs(heading-y/Deg) > 0.1 {
+		t.Errorf("complementary filter converged to roll %.1f, pitch %.1f, heading %.1f, expected %.1f, %.1f, %.1f",
+			roll, pitch, heading, r/Deg, p/Deg, y/Deg)
+	}
+}
+
+func TestMahony(t *testing.T) {
+	// Level-ish, heading north-west, with the magnetic field pointing north
+	r, p, y := 10*Deg, -5*Deg, 300*Deg
+	e0, e1, e2, e3 := ToQuaternion(r, p, y)
+	truth := &KalmanState{State: State{E0: e0, E1: e1, E2: e2, E3: e3, F0: 1, N2: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+
+	s := NewMahonyAHRS()
+	s.Compute(m)
+	roll, pitch, heading := s.CalcRollPitchHeading()
+	if math.Abs(roll-r/Deg)+math.Abs(pitch-p/Deg)+math.Abs(heading-y/Deg) > 0.01 {
+		t.Errorf("Mahony initialized to roll %.1f, pitch %.1f, heading %.1f, expected %.1f, %.1f, %.1f",
+			roll, pitch, heading, r/Deg, p/Deg, y/Deg)
+	}
+
+	// A gyro bias should be learned by the integral term while the attitude holds
+	m.B1 += 1
+	m.B2 -= 0.5
+	for i := 1; i <= 30000; i++ {
+		m.T = float64(i) / 50
+		s.Compute(m)
+	}
+	roll, pitch, heading = s.CalcRollPitchHeading()
+	if math.Abs(roll-r/Deg)+math.Abs(pitch-p/Deg)+math.Abs(heading-y/Deg) > 0.1 {
+		t.Errorf("Mahony drifted to roll %.1f, pitch %.1f, heading %.1f, expected %.1f, %.1f, %.1f",
+			roll, pitch, heading, r/Deg, p/Deg, y/Deg)
+	}
+	if d1, d2, d3 := s.GetGyroBias(); math.Abs(d1-1)+math.Abs(d2+0.5)+math.Abs(d3) > 0.01 {
+		t.Errorf("Mahony estimated gyro bias %.3f, %.3f, %.3f, expected 1, -0.5, 0", d1, d2, d3)
+	}
+	if gLoad := s.GLoad(); math.Abs(gLoad-math.Cos(r)*math.Cos(p)) > 0.001 {
+		t.Errorf("Mahony GLoad %.3f, expected %.3f", gLoad, math.Cos(r)*math.Cos(p))
+	}
+}
+
+func TestMahonyTurn(t *testing.T) {
+	// Banked 30° in a standard rate turn to the right, without a magnetometer
+	r := 30 * Deg
+	e0, e1, e2, e3 := ToQuaternion(r, 0, 0)
+	truth := &KalmanState{State: State{E0: e0, E1: e1, E2: e2, E3: e3, F0: 1, H3: -StandardRate}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+	m.MValid = false
+
+	s := NewMahonyAHRS()
+	for i := 0; i <= 500; i++ {
+		m.T = float64(i) / 50
+		s.Compute(m)
+	}
+
+	// H is earth frame, as for the Kalman filter, so the turn rate is about the vertical, not the yaw axis
+	if rate := s.TurnRate(); math.Abs(rate-StandardRate) > 0.01 {
+		t.Errorf("Mahony turn rate was %.3f °/s, expected %.3f", rate, StandardRate)
+	}
+	if rate := s.RateOfTurn(); math.Abs(rate-StandardRate) > 0.1 {
+		t.Errorf("Mahony smoothed rate of turn was %.3f °/s, expected %.3f", rate, StandardRate)
+	}
+	if roll, _, _ := s.RollPitchHeading(); math.Abs(roll-r) > 0.1*Deg {
+		t.Errorf("Mahony roll was %.2f, expected %.2f", roll/Deg, r/Deg)
+	}
+
+	// It keeps no covariance, so its uncertainties are unknown
+	if u := s.Uncertainties(); !math.IsNaN(u.Roll) || !math.IsNaN(u.Wind[0]) {
+		t.Errorf("Mahony reported uncertainties %+v, expected NaN", u)
+	}
+}
+
+func TestEstimator(t *testing.T) {
+	// Climbing nose up 5°, heading east, with the magnetic field pointing east
+	p := 5 * Deg
+	e0, e1, e2, e3 := ToQuaternion(0, p, 90*Deg)
+	truth := &KalmanState{State: State{U1: 100, E0: e0, E1: e1, E2: e2, E3: e3, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	measure := func(ti float64) *Measurement {
+		truth.T = ti
+		truth.Alt = truth.VerticalSpeed() * FtPerKt * ti
+		return truth.PredictMeasurement()
+	}
+
+	k := InitializeKalman(measure(0))
+	mn := make([]float64, 16)
+	for i := range mn {
+		mn[i] = 0.5
+	}
+	if err := k.SetMeasurementNoise(mn); err != nil {
+		t.Fatal(err)
+	}
+	k.OnReinitialize = func(tr, nis float64) {
+		t.Errorf("Kalman filter was reinitialized at %f s (nis %f)", tr, nis)
+	}
+
+	for _, c := range []struct {
+		name string
+		e    Estimator
+		tol  float64
+	}{
+		{"Kalman", k, 2},
+		{"Mahony", NewMahonyAHRS(), 0.5},
+	} {
+		c.e.Update(measure(0))
+		for i := 1; i <= 1000; i++ {
+			m := measure(float64(i) * 0.05)
+			c.e.Predict(m.T)
+			c.e.Update(m)
+		}
+		roll, pitch, _ := c.e.RollPitchHeading()
+		if math.Abs(roll)/Deg > c.tol || math.Abs(pitch-p)/Deg > c.tol {
+			t.Errorf("%s estimated roll %.1f, pitch %.1f, expected 0, %.1f", c.name, roll/Deg, pitch/Deg, p/Deg)
+		}
+	}
+}
+
+func TestConditionNumber(t *testing.T) {
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	m := truth.PredictMeasurement()
+	s := InitializeKalman(m)
+
+	var reported []float64
+	s.OnCondition = func(c float64) { reported = append(reported, c) }
+
+	s.Predict(0.05)
+	s.Update(m)
+	if len(reported) != 1 {
+		t.Fatalf("OnCondition was called %d times, expected once", len(reported))
+	}
+	c := s.ConditionNumber()
+	if c != reported[0] {
+		t.Errorf("ConditionNumber %g differs from the reported %g", c, reported[0])
+	}
+	if c < 1 || math.IsInf(c, 0) || math.IsNaN(c) {
+		t.Errorf("condition number %g of a healthy filter isn't finite and at least 1", c)
+	}
+
+	// Rows of unused measurements don't count
+	ss := matrix.Diagonal([]float64{4, 0.01, Big + 1})
+	r := matrix.Diagonal([]float64{1, 0.01, Big})
+	if c := conditionNumber(ss, r); math.Abs(c-400) > Small {
+		t.Errorf("condition number was %g, expected 400", c)
+	}
+}
+
+func TestGravity(t *testing.T) {
+	rand.Seed(time.Now().Unix())
+
+	kt := createRandomState()
+	if g := kt.Gravity(); g != G {
+		t.Errorf("default gravity was %g, expected %g", g, G)
+	}
+
+	// The same flight in m/s feels the same accelerations
+	si := &KalmanState{State: kt.State}
+	si.SetGravity(GravityMps2)
+	si.U1, si.U2, si.U3 = KtToMps(kt.U1), KtToMps(kt.U2), KtToMps(kt.U3)
+	k1, k2, k3 := kt.aircraftAccel()
+	s1, s2, s3 := si.aircraftAccel()
+	if math.Abs(k1-s1)+math.Abs(k2-s2)+math.Abs(k3-s3) > Tolerance {
+		t.Errorf("accelerations were %.4f, %.4f, %.4f in m/s, %.4f, %.4f, %.4f in kt", s1, s2, s3, k1, k2, k3)
+	}
+
+	// The accelerometer Jacobian follows the gravity used
+	m := si.PredictMeasurement()
+	h := si.calcJacobianMeasurement()
+	smap := stateMap(si)
+	for i := 0; i < 3; i++ {
+		*smap[i] += Small
+		mm := si.PredictMeasurement()
+		*smap[i] -= Small
+		for j, d := range []float64{mm.A1 - m.A1, mm.A2 - m.A2, mm.A3 - m.A3} {
+			if dA := d / Small; math.Abs(dA-h.Get(6+j, i)) > 1e-4 {
+				t.Errorf("A%d/U%d was %g, Jacobian was %g", j+1, i+1, dA, h.Get(6+j, i))
+			}
+		}
+	}
+}
+
+func TestUnitConversions(t *testing.T) {
+	if v := KtToMps(1); math.Abs(v-0.514444) > 1e-6 {
+		t.Errorf("1 kt was %f m/s, expected 0.514444", v)
+	}
+	if v := KtToFpm(1); math.Abs(v-101.2686) > 1e-3 {
+		t.Errorf("1 kt was %f ft/min, expected 101.2686", v)
+	}
+	// G in kt/s is 9.80665 m/s² within the precision of the ft/s² figure
+	if v := KtToMps(G); math.Abs(v-9.80665) > 1e-3 {
+		t.Errorf("G was %f m/s², expected 9.80665", v)
+	}
+	for _, v := range []float64{-100, 0, 0.5, 120} {
+		if r := MpsToKt(KtToMps(v)); math.Abs(r-v) > Small {
+			t.Errorf("kt to m/s and back gave %f, expected %f", r, v)
+		}
+		if r := FpmToKt(KtToFpm(v)); math.Abs(r-v) > Small {
+			t.Errorf("kt to ft/min and back gave %f, expected %f", r, v)
+		}
+	}
+}
+
+func TestSetMPU9250(t *testing.T) {
+	// Level and at rest, heading north, with the magnetic field pointing north and down
+	e0, e1, e2, e3 := ToQuaternion(0, 0, 0)
+	truth := &KalmanState{State: State{E0: e0, E1: e1, E2: e2, E3: e3, F0: 1, N2: 20, N3: -40}}
+	truth.normalize()
+	mt := truth.PredictMeasurement()
+
+	// The MPU9250 reads +1G up, and the AK8963 has x and y swapped and z reversed
+	m := NewMeasurement()
+	m.SetMPU9250(1.5, [3]float64{0, 0, 0}, [3]float64{0, 0, 1}, [3]float64{0, 20, 40}, true)
+	if !m.SValid || !m.MValid || m.T != 1.5 {
+		t.Errorf("SetMPU9250 gave SValid %t, MValid %t, T %f", m.SValid, m.MValid, m.T)
+	}
+	for i, v := range [][2]float64{
+		{m.A1, mt.A1}, {m.A2, mt.A2}, {m.A3, mt.A3},
+		{m.B1, mt.B1}, {m.B2, mt.B2}, {m.B3, mt.B3},
+		{m.M1, mt.M1}, {m.M2, mt.M2}, {m.M3, mt.M3},
+	} {
+		if math.Abs(v[0]-v[1]) > 1e-6 {
+			t.Errorf("SetMPU9250 component %d was %f, expected %f", i, v[0], v[1])
+		}
+	}
+
+	m.SetMPU9250(1.6, [3]float64{1, 2, 3}, [3]float64{0, 0, 1}, [3]float64{}, false)
+	if m.MValid || m.B1 != 1 || m.B2 != 2 || m.B3 != 3 {
+		t.Errorf("SetMPU9250 without mag gave MValid %t, gyro %f, %f, %f", m.MValid, m.B1, m.B2, m.B3)
+	}
+}
+
+func TestVerticalSpeed(t *testing.T) {
+	// Climbing at 10° pitch at 100 kt into a 2 kt updraft
+	m := NewMeasurement()
+	m.SValid, m.A3 = true, -1
+	s := InitializeKalman(m)
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(0, 10*Deg, 0)
+	s.normalize()
+	s.U1, s.U2, s.U3 = 100, 0, 0
+	s.V3 = 2
+	s.Alt = 1000
+
+	vs := 100*math.Sin(10*Deg) + 2
+	if math.Abs(s.VerticalSpeed()-vs) > 1e-6 {
+		t.Errorf("VerticalSpeed was %f kt, expected %f", s.VerticalSpeed(), vs)
+	}
+
+	s.Predict(s.T + 0.1)
+	if alt := 1000 + 0.1*vs*FtPerKt; math.Abs(s.Altitude()-alt) > 1e-6 {
+		t.Errorf("Altitude after Predict was %f ft, expected %f", s.Altitude(), alt)
+	}
+}
+
+func TestAirspeed(t *testing.T) {
+	s := new(State)
+	if alpha, beta := s.AirflowAngles(); s.Airspeed() != 0 || alpha != 0 || beta != 0 {
+		t.Errorf("no airspeed gave %f kt at %f°, %f°", s.Airspeed(), alpha, beta)
+	}
+
+	// 100 kt, 5° angle of attack, 2° sideslip from the right
+	tas := 100.0
+	s.U1 = tas * math.Cos(2*Deg) * math.Cos(5*Deg)
+	s.U2 = -tas * math.Sin(2*Deg)
+	s.U3 = -tas * math.Cos(2*Deg) * math.Sin(5*Deg)
+	if math.Abs(s.Airspeed()-tas) > 1e-9 {
+		t.Errorf("Airspeed was %f kt, expected %f", s.Airspeed(), tas)
+	}
+	if alpha, beta := s.AirflowAngles(); math.Abs(alpha-5) > 1e-9 || math.Abs(beta-2) > 1e-9 {
+		t.Errorf("AirflowAngles gave %f°, %f°, expected 5°, 2°", alpha, beta)
+	}
+}
+
+func TestInclinometer(t *testing.T) {
+	m := NewMeasurement()
+	m.SValid, m.A3 = true, -1
+	s := InitializeKalman(m)
+
+	// Level, straight flight: ball centered
+	s.U1, s.U2, s.U3 = 100, 0, 0
+	if ball := s.Inclinometer(); math.Abs(ball) > 1e-6 {
+		t.Errorf("level flight gave ball %f°", ball)
+	}
+
+	// Banked 30° without turning: ball toward the low wing, as the accelerometers would show it
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(30*Deg, 0, 0)
+	s.normalize()
+	mp := s.PredictMeasurement()
+	if ball, want := s.Inclinometer(), math.Atan2(mp.A2, -mp.A3)/Deg; math.Abs(ball) < 10 || math.Abs(ball-want) > 1e-6 {
+		t.Errorf("banked without turning gave ball %f°, expected %f°", ball, want)
+	}
+
+	// Coordinated turn at 30° bank: the turn rate g*tan(bank)/U centers the ball
+	s.H3 = -G * math.Tan(30*Deg) / s.U1 / Deg
+	if ball := s.Inclinometer(); math.Abs(ball) > 1e-6 {
+		s.H3 = -s.H3
+		t.Errorf("coordinated turn gave ball %f°, %f° turning the other way", ball, s.Inclinometer())
+	}
+}
+
+func TestTurnRate(t *testing.T) {
+	// A standard-rate turn to the right at 25° bank: the gyros see it split between the yaw and pitch axes
+	s := &KalmanState{State: State{F0: 1, H3: -StandardRate}}
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(25*Deg, 0, 0)
+	s.normalize()
+	m := s.PredictMeasurement()
+	if math.Abs(m.B2) < 0.5 || math.Abs(m.B3) < 0.5 {
+		t.Errorf("banked turn gave gyro rates %f, %f, %f", m.B1, m.B2, m.B3)
+	}
+
+	// Projecting those gyro rates onto the earth vertical at the same attitude gives back the standard rate
+	g := &State{E0: s.E0, E1: s.E1, E2: s.E2, E3: s.E3, F0: 1}
+	g.normalize()
+	h1, h2, h3 := g.rotateByF(m.B1, m.B2, m.B3, true)
+	g.H1, g.H2, g.H3 = g.rotateByE(h1, h2, h3, false)
+	if rate := g.TurnRate(); math.Abs(rate-StandardRate) > 1e-9 {
+		t.Errorf("TurnRate from gyro rates %f, %f, %f was %f°/s, expected %f", m.B1, m.B2, m.B3, rate, StandardRate)
+	}
+}
+
+func TestTrueHeading(t *testing.T) {
+	for _, c := range []struct {
+		heading, nDir, declination, want float64 // °
+	}{
+		{30, 0, 10, 40},   // Frame aligned with magnetic north
+		{40, 10, 10, 40},  // Frame aligned with true north, field pointing at the declination
+		{355, 0, 10, 5},   // Wrapping past north
+		{10, 0, -15, 355}, // West declination
+	} {
+		s := &State{N1: 20 * math.Sin(c.nDir*Deg), N2: 20 * math.Cos(c.nDir*Deg), N3: -40}
+		s.E0, s.E1, s.E2, s.E3 = ToQuaternion(0, 0, c.heading*Deg)
+		s.SetDeclination(c.declination)
+		if math.Abs(s.Declination()-c.declination) > 1e-9 {
+			t.Errorf("Declination was %f, expected %f", s.Declination(), c.declination)
+		}
+		if h := s.TrueHeading(); math.Abs(AngleDiff(h*Deg, c.want*Deg)) > 1e-6 {
+			t.Errorf("heading %f with field at %f and declination %f gave true heading %f, expected %f",
+				c.heading, c.nDir, c.declination, h, c.want)
+		}
+	}
+}
+
+func TestWind(t *testing.T) {
+	for _, c := range []struct {
+		v1, v2, declination float64 // kt, kt, °
+		speed, from         float64 // kt, °
+	}{
+		{0, -20, 0, 20, 0},  // Blowing south, from the north
+		{-10, 0, 0, 10, 90}, // Blowing west, from the east
+		{10, 10, 0, math.Sqrt(200), 225},
+		{0, -20, 10, 20, 10},              // From magnetic north with 10° east declination
+		{0.2, 0.2, 0, math.Sqrt(0.08), 0}, // Calm
+	} {
+		s := &State{V1: c.v1, V2: c.v2, V3: 3, N2: 20, N3: -40}
+		s.SetDeclination(c.declination)
+		speed, from := s.Wind()
+		if math.Abs(speed-c.speed) > 1e-9 || math.Abs(AngleDiff(from*Deg, c.from*Deg)) > 1e-6 || from < 0 || from >= 360 {
+			t.Errorf("wind %f, %f gave %f kt from %f°, expected %f kt from %f°", c.v1, c.v2, speed, from, c.speed, c.from)
+		}
+	}
+}
+
+func TestDivergenceReinitialize(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	rand.Seed(time.Now().Unix())
+
+	// Steady level flight heading east, measurements synthesized from the true state plus noise
+	truth := &KalmanState{State: State{U1: 100, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	measure := func(i int) *Measurement {
+		truth.T = float64(i) * 0.05
+		m := truth.PredictMeasurement()
+		m.UValid = false
+		m.W1 += rand.NormFloat64() * 0.5
+		m.W2 += rand.NormFloat64() * 0.5
+		m.A1 += rand.NormFloat64() * 0.01
+		m.A2 += rand.NormFloat64() * 0.01
+		m.A3 += rand.NormFloat64() * 0.01
+		m.B1 += rand.NormFloat64() * 0.1
+		m.B2 += rand.NormFloat64() * 0.1
+		m.B3 += rand.NormFloat64() * 0.1
+		m.M1 += rand.NormFloat64() * 0.5
+		m.M2 += rand.NormFloat64() * 0.5
+		m.M3 += rand.NormFloat64() * 0.5
+		return m
+	}
+
+	s := InitializeKalman(measure(0))
+	var tReinit []float64
+	s.OnReinitialize = func(t, nis float64) { tReinit = append(tReinit, t) }
+
+	const upset = 400 // Step at which the estimate is upset
+	for i := 1; i <= 800; i++ {
+		if i == upset {
+			// A gross upset: the estimate is suddenly rolled 90° and turned 90° away from the truth
+			s.E0, s.E1, s.E2, s.E3 = ToQuaternion(90*Deg, 0, 180*Deg)
+			s.normalize()
+		}
+		s.Compute(measure(i))
+	}
+
+	if len(tReinit) == 0 {
+		t.Fatalf("filter wasn't reinitialized after the upset; log:\n%s", buf.String())
+	}
+	if tReinit[0] < upset*0.05 {
+		t.Errorf("filter was reinitialized at %f s, before the upset at %f s", tReinit[0], upset*0.05)
+	}
+	if tReinit[0] > upset*0.05+divergenceWindowDefault+2 {
+		t.Errorf("filter took until %f s to reinitialize after the upset at %f s", tReinit[0], upset*0.05)
+	}
+	roll, pitch, heading := s.RollPitchHeading()
+	roll0, pitch0, heading0 := truth.RollPitchHeading()
+	if math.Abs(AngleDiff(roll, roll0)) > 5*Deg || math.Abs(AngleDiff(pitch, pitch0)) > 5*Deg ||
+		math.Abs(AngleDiff(heading, heading0)) > 10*Deg {
+		t.Errorf("after recovery, attitude was %f, %f, %f, expected %f, %f, %f",
+			roll/Deg, pitch/Deg, heading/Deg, roll0/Deg, pitch0/Deg, heading0/Deg)
+	}
+}
+
+func TestDivergenceStuckSensor(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	rand.Seed(time.Now().Unix())
+
+	// Level flight heading east in rising air, while the pressure altitude is stuck at its first reading
+	truth := &KalmanState{State: State{U1: 100, V3: 10, E0: 1, F0: 1, N1: 20, N3: -40}}
+	truth.normalize()
+	measure := func(i int) *Measurement {
+		truth.T = float64(i) * 0.05
+		truth.Alt = truth.V3 * FtPerKt * truth.T
+		m := truth.PredictMeasurement()
+		m.UValid = false
+		m.P = 0
+		m.W1 += rand.NormFloat64() * 0.5
+		m.W2 += rand.NormFloat64() * 0.5
+		m.A1 += rand.NormFloat64() * 0.01
+		m.A2 += rand.NormFloat64() * 0.01
+		m.A3 += rand.NormFloat64() * 0.01
+		m.B1 += rand.NormFloat64() * 0.1
+		m.B2 += rand.NormFloat64() * 0.1
+		m.B3 += rand.NormFloat64() * 0.1
+		m.M1 += rand.NormFloat64() * 0.5
+		m.M2 += rand.NormFloat64() * 0.5
+		m.M3 += rand.NormFloat64() * 0.5
+		return m
+	}
+
+	s := InitializeKalman(measure(0))
+	s.OnReinitialize = func(tr, nis float64) {
+		t.Errorf("filter was reinitialized at %f s (nis %f) for a single stuck sensor", tr, nis)
+	}
+	var gated [6]bool
+	for i := 1; i <= 1000; i++ {
+		m := measure(i)
+		s.Predict(m.T)
+		gated = s.Update(m)
+	}
+
+	if !gated[BlockP] {
+		t.Error("stuck pressure altitude wasn't gated")
+	}
+	roll, pitch, heading := s.RollPitchHeading()
+	if math.Abs(roll) > 5*Deg || math.Abs(pitch) > 5*Deg || math.Abs(AngleDiff(heading, 90*Deg)) > 10*Deg {
+		t.Errorf("attitude was %f, %f, %f, expected level heading east", roll/Deg, pitch/Deg, heading/Deg)
+	}
+}
+
+func TestUncertainties(t *testing.T) {
+	d := make([]float64, 33)
+	for i := range d {
+		d[i] = float64((i + 1) * (i + 1))
+	}
+	s := State{E0: 1, M: matrix.Diagonal(d)}
+
+	u := s.Uncertainties()
+	for _, c := range []struct {
+		name string
+		v    float64
+		exp  float64
+	}{
+		{"Airspeed[0]", u.Airspeed[0], 1}, {"AirspeedRate[2]", u.AirspeedRate[2], 6},
+		{"Attitude[0]", u.Attitude[0], 7}, {"GyroRate[0]", u.GyroRate[0], 11},
+		{"MagField[2]", u.MagField[2], 16}, {"Wind[0]", u.Wind[0], 17},
+		{"AccelBias[1]", u.AccelBias[1], 21}, {"SensorAttitude[3]", u.SensorAttitude[3], 26},
+		{"GyroBias[0]", u.GyroBias[0], 27}, {"MagBias[2]", u.MagBias[2], 32}, {"Alt", u.Alt, 33},
+	} {
+		if c.v != c.exp {
+			t.Errorf("%s was %g, expected %g", c.name, c.v, c.exp)
+		}
+	}
+	if r, p, h := s.RollPitchHeadingStdDev(); u.Roll != r || u.Pitch != p || u.Heading != h {
+		t.Errorf("roll, pitch, heading were %g, %g, %g, expected %g, %g, %g", u.Roll, u.Pitch, u.Heading, r, p, h)
+	}
+
+	// Without a covariance there's nothing to report
+	if u := new(State).Uncertainties(); !math.IsNaN(u.Wind[0]) || !math.IsNaN(u.Roll) {
+		t.Errorf("expected NaN uncertainties without a covariance, got %+v", u)
+	}
+}
@@ -0,0 +1,58 @@
+package ahrs
+
+import "math"
+
+// The filters work in an east-north-up (ENU) earth frame and a nose-left wing-up (FLU) aircraft frame,
+// as described on State.  Many avionics stacks and the World Magnetic Model use a north-east-down (NED) earth frame
+// and a nose-right wing-down (FRD) aircraft frame instead.  Use the conversions below at the edges of the package,
+// as for units: e.g. NEDToENU for GPS velocities or a WMM field, and QuaternionENUToNED for the attitude.
+// Roll, pitch and heading mean the same in both conventions, so RollPitchHeading needs no conversion.
+
+// NEDToENU converts a vector from north, east, down components to east, north, up components.
+func NEDToENU(n, e, d float64) (east, north, up float64) {
+	return e, n, -d
+}
+
+// ENUToNED converts a vector from east, north, up components to north, east, down components.
+func ENUToNED(e, n, u float64) (north, east, down float64) {
+	return n, e, -u
+}
+
+// FRDToFLU converts an aircraft-frame vector from nose, right wing, down components
+// to nose, left wing, up components.  The conversion is its own inverse.
+func FRDToFLU(x, y, z float64) (float64, float64, float64) {
+	return x, -y, -z
+}
+
+// QuaternionNEDToENU converts a quaternion rotating the FRD aircraft frame to the NED earth frame,
+// as from the usual aerospace yaw-pitch-roll convention, to the equivalent quaternion rotating
+// the FLU aircraft frame to the ENU earth frame, as used for State.E.
+func QuaternionNEDToENU(q0, q1, q2, q3 float64) (e0, e1, e2, e3 float64) {
+	r := 1 / math.Sqrt2
+	return r * (q0 + q3), r * (q1 + q2), r * (q1 - q2), r * (q0 - q3)
+}
+
+// QuaternionENUToNED converts a quaternion rotating the FLU aircraft frame to the ENU earth frame, as State.E,
+// to the equivalent quaternion rotating the FRD aircraft frame to the NED earth frame.
+func QuaternionENUToNED(e0, e1, e2, e3 float64) (q0, q1, q2, q3 float64) {
+	r := 1 / math.Sqrt2
+	return r * (e0 + e3), r * (e1 + e2), r * (e1 - e2), r * (e0 - e3)
+}
+
+// ToQuaternionNED calculates the quaternion rotating the FRD aircraft frame to the NED earth frame
+// for roll phi, pitch theta and heading psi in radians, with the same meanings as for ToQuaternion.
+func ToQuaternionNED(phi, theta, psi float64) (q0, q1, q2, q3 float64) {
+	return QuaternionENUToNED(ToQuaternion(phi, theta, psi))
+}
+
+// QuaternionNED returns the attitude estimate as a quaternion rotating the FRD aircraft frame to the NED earth frame.
+func (s *State) QuaternionNED() (q0, q1, q2, q3 float64) {
+	return QuaternionENUToNED(s.E0, s.E1, s.E2, s.E3)
+}
+
+// SetGPSNED fills in the earth-frame GPS velocity of the Measurement from its north, east and down
+// components in kt, and marks it valid.
+func (m *Measurement) SetGPSNED(vn, ve, vd float64) {
+	m.W1, m.W2, m.W3 = NEDToENU(vn, ve, vd)
+	m.WValid = true
+}
@@ -0,0 +1,24 @@
+package ahrs
+
+// SetMPU9250 fills in the accel/gyro and magnetometer readings of the Measurement from an MPU9250 reading,
+// as in the Gyro, Accel and Mag of an mpu9250.Reading, taken at time t, s, and marks them valid;
+// the magnetometer only if magValid, as it may lag or fail separately.
+//
+// The gyro rates stay in °/s and the magnetometer in µT, as the filter expects.
+// The conventions differ in two ways, handled here:
+//   - the MPU9250 accelerometer measures the specific force, +1G up when at rest, whereas the filter
+//     measures the acceleration due to gravity, -1G up when at rest, so the accelerometer is negated;
+//   - the AK8963 magnetometer's x and y axes are swapped relative to the accel/gyro, and its z axis is reversed,
+//     so it is mapped onto the accel/gyro axes, which define the sensor frame.
+func (m *Measurement) SetMPU9250(t float64, gyro, accel, mag [3]float64, magValid bool) {
+	m.B1, m.B2, m.B3 = gyro[0], gyro[1], gyro[2]
+	m.A1, m.A2, m.A3 = -accel[0], -accel[1], -accel[2]
+	m.SValid = true
+
+	m.MValid = magValid
+	if magValid {
+		m.M1, m.M2, m.M3 = mag[1], mag[0], -mag[2]
+	}
+
+	m.T = t
+}
@@ -23,8 +23,39 @@ func ToQuaternion(phi, theta, psi float64) (float64, float64, float64, float64)
 	return q0, q1, q2, q3
 }
 
+// ToQuaternionRate calculates the rate of change of the 0,1,2,3 components of the rotation quaternion
+// given by ToQuaternion for the Tait-Bryan angles phi, theta, psi changing at rates dphi, dtheta, dpsi,
+// by the chain rule through ToQuaternion.
+func ToQuaternionRate(phi, theta, psi, dphi, dtheta, dpsi float64) (float64, float64, float64, float64) {
+	theta, dtheta = -theta, -dtheta // As in ToQuaternion
+	psi, dpsi = math.Pi/2-psi, -dpsi
+	cphi := math.Cos(phi / 2)
+	sphi := math.Sin(phi / 2)
+	ctheta := math.Cos(theta / 2)
+	stheta := math.Sin(theta / 2)
+	cpsi := math.Cos(psi / 2)
+	spsi := math.Sin(psi / 2)
+
+	// Each half-angle sine and cosine changes at half the rate of its angle
+	dcphi, dsphi := -sphi*dphi/2, cphi*dphi/2
+	dctheta, dstheta := -stheta*dtheta/2, ctheta*dtheta/2
+	dcpsi, dspsi := -spsi*dpsi/2, cpsi*dpsi/2
+
+	dq0 := dcphi*ctheta*cpsi + cphi*dctheta*cpsi + cphi*ctheta*dcpsi +
+		dsphi*stheta*spsi + sphi*dstheta*spsi + sphi*stheta*dspsi
+	dq1 := dsphi*ctheta*cpsi + sphi*dctheta*cpsi + sphi*ctheta*dcpsi -
+		dcphi*stheta*spsi - cphi*dstheta*spsi - cphi*stheta*dspsi
+	dq2 := dcphi*stheta*cpsi + cphi*dstheta*cpsi + cphi*stheta*dcpsi +
+		dsphi*ctheta*spsi + sphi*dctheta*spsi + sphi*ctheta*dspsi
+	dq3 := dcphi*ctheta*spsi + cphi*dctheta*spsi + cphi*ctheta*dspsi -
+		dsphi*stheta*cpsi - sphi*dstheta*cpsi - sphi*stheta*dcpsi
+	return dq0, dq1, dq2, dq3
+}
+
 // FromQuaternion calculates the Tait-Bryan angles phi, theta, psi corresponding to
-// the quaternion
+// the quaternion rotating the aircraft frame to the earth frame, in radians:
+// phi is roll, positive for right wing down; theta is pitch, positive for nose up;
+// psi is heading, clockwise from north (psi=0) in [0, 2*Pi), so the identity quaternion points east.
 func FromQuaternion(q0, q1, q2, q3 float64) (phi float64, theta float64, psi float64) {
 	phi = math.Atan2(2*(q0*q1+q2*q3), (q0*q0 - q1*q1 - q2*q2 + q3*q3))
 
@@ -73,6 +104,46 @@ func VarFromQuaternion(q0, q1, q2, q3, dq0, dq1, dq2, dq3 float64) (float64, flo
 		(dpsidq0*dq0 + dpsidq1*dq1 + dpsidq2*dq2 + dpsidq3*dq3)
 }
 
+// EulerJacobian returns the partial derivatives of the Tait-Bryan angles phi, theta, psi, as computed by
+// FromQuaternion, with respect to the quaternion components q0, q1, q2, q3: jac[i][j] is d(angle i)/dqj.
+func EulerJacobian(q0, q1, q2, q3 float64) (jac [3][4]float64) {
+	var qq, rr, denom float64
+
+	// phi = atan2(rr, qq)
+	rr = 2 * (q0*q1 + q2*q3)
+	qq = q0*q0 - q1*q1 - q2*q2 + q3*q3
+	denom = rr*rr + qq*qq
+	jac[0] = [4]float64{
+		(2*q1*qq - 2*q0*rr) / denom,
+		(2*q0*qq + 2*q1*rr) / denom,
+		(2*q3*qq + 2*q2*rr) / denom,
+		(2*q2*qq - 2*q3*rr) / denom,
+	}
+
+	// theta = asin(-rr/qq)
+	rr = 2 * (q0*q2 - q1*q3)
+	qq = q0*q0 + q1*q1 + q2*q2 + q3*q3
+	denom = qq * math.Sqrt(qq*qq-rr*rr)
+	jac[1] = [4]float64{
+		(2*q0*rr - 2*q2*qq) / denom,
+		(2*q1*rr + 2*q3*qq) / denom,
+		(2*q2*rr - 2*q0*qq) / denom,
+		(2*q3*rr + 2*q1*qq) / denom,
+	}
+
+	// psi = Pi/2 - atan2(rr, qq)
+	rr = 2 * (q0*q3 + q1*q2)
+	qq = q0*q0 + q1*q1 - q2*q2 - q3*q3
+	denom = rr*rr + qq*qq
+	jac[2] = [4]float64{
+		(-2*q3*qq + 2*q0*rr) / denom,
+		(-2*q2*qq + 2*q1*rr) / denom,
+		(-2*q1*qq - 2*q2*rr) / denom,
+		(-2*q0*qq - 2*q3*rr) / denom,
+	}
+	return
+}
+
 // QuaternionAToB constructs a quaternion Q such that QAQ* = B for arbitrary vectors A and B
 func QuaternionAToB(a1, a2, a3, b1, b2, b3 float64) (q0, q1, q2, q3 float64) {
 	aa := math.Sqrt(a1*a1 + a2*a2 + a3*a3)
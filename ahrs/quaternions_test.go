@@ -5,6 +5,7 @@ import (
 	"math"
 	"testing"
 
+	"github.com/skelterjohn/go.matrix"
 	"github.com/westphae/quaternion"
 	"math/rand"
 )
@@ -374,3 +375,121 @@ func TestSmallCompositions(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestEulerJacobian(t *testing.T) {
+	const dq = 1e-6
+	for n := 0; n < 100; n++ {
+		q := quaternion.Unit(quaternion.Quaternion{W: rand.Float64()*2 - 1, X: rand.Float64()*2 - 1,
+			Y: rand.Float64()*2 - 1, Z: rand.Float64()*2 - 1})
+		qs := [4]float64{q.W, q.X, q.Y, q.Z}
+		jac := EulerJacobian(qs[0], qs[1], qs[2], qs[3])
+		for j := 0; j < 4; j++ {
+			qp, qm := qs, qs
+			qp[j] += dq
+			qm[j] -= dq
+			p1, t1, s1 := FromQuaternion(qp[0], qp[1], qp[2], qp[3])
+			p0, t0, s0 := FromQuaternion(qm[0], qm[1], qm[2], qm[3])
+			calc := [3]float64{p1 - p0, t1 - t0, s1 - s0}
+			for i := 0; i < 3; i++ {
+				if calc[i] > Pi {
+					calc[i] -= 2 * Pi
+				} else if calc[i] < -Pi {
+					calc[i] += 2 * Pi
+				}
+				if d := calc[i]/(2*dq) - jac[i][j]; math.Abs(d) > Tolerance*(1+math.Abs(jac[i][j])) {
+					t.Errorf("q=%v: d(angle %d)/dq%d was %f, expected %f", qs, i, j, jac[i][j], calc[i]/(2*dq))
+				}
+			}
+		}
+	}
+}
+
+func TestRollPitchHeadingStdDev(t *testing.T) {
+	// Level, pointing east: a small rotation about the nose only shows up in roll
+	s := &State{E0: 1, M: matrix.Zeros(32, 32)}
+	s.M.Set(7, 7, (0.5*Deg)*(0.5*Deg))
+	droll, dpitch, dheading := s.RollPitchHeadingStdDev()
+	if math.Abs(droll-1) > Tolerance || dpitch > Tolerance || dheading > Tolerance {
+		t.Errorf("got stdev roll %f, pitch %f, heading %f, expected 1, 0, 0", droll, dpitch, dheading)
+	}
+
+	// Perfectly correlated uncertainty in E0 and E3 along E doesn't change the attitude
+	s = &State{E0: c30, E3: c60, M: matrix.Zeros(32, 32)}
+	s.M.Set(6, 6, c30*c30*0.01)
+	s.M.Set(6, 9, c30*c60*0.01)
+	s.M.Set(9, 6, c30*c60*0.01)
+	s.M.Set(9, 9, c60*c60*0.01)
+	if _, _, dheading = s.RollPitchHeadingStdDev(); dheading > Tolerance {
+		t.Errorf("got stdev heading %f for a change in E's magnitude only", dheading)
+	}
+}
+
+func TestToQuaternionRate(t *testing.T) {
+	const h = 1e-6
+	for i := 0; i < 100; i++ {
+		phi, theta, psi := (rand.Float64()-0.5)*Pi, (rand.Float64()-0.5)*Pi/2, rand.Float64()*2*Pi
+		dphi, dtheta, dpsi := rand.NormFloat64(), rand.NormFloat64(), rand.NormFloat64()
+
+		q0, q1, q2, q3 := ToQuaternion(phi, theta, psi)
+		p0, p1, p2, p3 := ToQuaternion(phi+dphi*h, theta+dtheta*h, psi+dpsi*h)
+		dq0, dq1, dq2, dq3 := ToQuaternionRate(phi, theta, psi, dphi, dtheta, dpsi)
+		for j, d := range [][2]float64{{dq0, (p0 - q0) / h}, {dq1, (p1 - q1) / h}, {dq2, (p2 - q2) / h}, {dq3, (p3 - q3) / h}} {
+			if notSmall(d[0] - d[1]) {
+				t.Errorf("ToQuaternionRate component %d was %f, finite difference %f", j, d[0], d[1])
+			}
+		}
+	}
+}
+
+func TestNEDConversions(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		phi, theta, psi := (rand.Float64()-0.5)*Pi, (rand.Float64()-0.5)*Pi/2, rand.Float64()*2*Pi
+
+		// The usual aerospace yaw-pitch-roll quaternion from FRD to NED
+		cr, sr := math.Cos(phi/2), math.Sin(phi/2)
+		cp, sp := math.Cos(theta/2), math.Sin(theta/2)
+		cy, sy := math.Cos(psi/2), math.Sin(psi/2)
+		n0, n1, n2, n3 := cr*cp*cy+sr*sp*sy, sr*cp*cy-cr*sp*sy, cr*sp*cy+sr*cp*sy, cr*cp*sy-sr*sp*cy
+
+		q0, q1, q2, q3 := ToQuaternionNED(phi, theta, psi)
+		q0, q1, q2, q3 = QuaternionSign(q0, q1, q2, q3, n0, n1, n2, n3)
+		if notSmall(q0-n0) || notSmall(q1-n1) || notSmall(q2-n2) || notSmall(q3-n3) {
+			t.Errorf("NED quaternion for %f, %f, %f was %f, %f, %f, %f, expected %f, %f, %f, %f",
+				phi, theta, psi, q0, q1, q2, q3, n0, n1, n2, n3)
+		}
+
+		// Round trip through the ENU quaternion
+		e0, e1, e2, e3 := QuaternionNEDToENU(n0, n1, n2, n3)
+		if phiOut, thetaOut, psiOut := FromQuaternion(e0, e1, e2, e3); notSmall(phi-phiOut) ||
+			notSmall(theta-thetaOut) || notSmall(math.Remainder(psi-psiOut, 2*Pi)) {
+			t.Errorf("%f, %f, %f came back as %f, %f, %f", phi, theta, psi, phiOut, thetaOut, psiOut)
+		}
+		if r0, r1, r2, r3 := QuaternionENUToNED(e0, e1, e2, e3); notSmall(r0-n0) || notSmall(r1-n1) ||
+			notSmall(r2-n2) || notSmall(r3-n3) {
+			t.Errorf("NED quaternion %f, %f, %f, %f came back as %f, %f, %f, %f", n0, n1, n2, n3, r0, r1, r2, r3)
+		}
+	}
+
+	// Heading east, pitched up 30°: the nose points the same way in both frames
+	s := new(State)
+	s.E0, s.E1, s.E2, s.E3 = ToQuaternion(0, Pi/6, Pi/2)
+	re := QuaternionToRotationMatrix(s.E0, s.E1, s.E2, s.E3)
+	rn := QuaternionToRotationMatrix(s.QuaternionNED())
+	if n, e, d := ENUToNED(re[0][0], re[1][0], re[2][0]); notSmall(n-rn[0][0]) || notSmall(e-rn[1][0]) ||
+		notSmall(d-rn[2][0]) || notSmall(e-c30) || notSmall(d+c60) {
+		t.Errorf("nose was %f, %f, %f in ENU and %f, %f, %f in NED", re[0][0], re[1][0], re[2][0],
+			rn[0][0], rn[1][0], rn[2][0])
+	}
+	// and the right wing is opposite the left wing
+	if n, e, d := ENUToNED(-re[0][1], -re[1][1], -re[2][1]); notSmall(n-rn[0][1]) || notSmall(e-rn[1][1]) ||
+		notSmall(d-rn[2][1]) {
+		t.Errorf("right wing was %f, %f, %f in NED, expected %f, %f, %f", rn[0][1], rn[1][1], rn[2][1], n, e, d)
+	}
+
+	// GPS velocities
+	m, mn := NewGPSMeasurement(120, 30, 5), NewMeasurement()
+	mn.SetGPSNED(120*c30, 120*c60, -5)
+	if !mn.WValid || notSmall(m.W1-mn.W1) || notSmall(m.W2-mn.W2) || notSmall(m.W3-mn.W3) {
+		t.Errorf("NED GPS velocity gave %f, %f, %f, expected %f, %f, %f", mn.W1, mn.W2, mn.W3, m.W1, m.W2, m.W3)
+	}
+}
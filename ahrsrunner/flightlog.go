@@ -0,0 +1,260 @@
+package ahrsrunner
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../ahrs"
+	"../mpu9250"
+)
+
+const flightLogBuffer = 1024 // Rows the FlightLog can queue before dropping them
+
+// FlightLog writes rows of float64s to CSV files in the background, so that logging never blocks the caller.
+// The files are rotated when they exceed a size or an age; each starts with the header, so that each can be
+// read on its own, e.g. by the simulator's -replay.
+//
+// The files are named after path with a sequence number before the extension:
+// flight.csv is written as flight-001.csv, flight-002.csv, ...
+type FlightLog struct {
+	path    string
+	header  []string
+	maxSize int64         // Rotate after this many bytes; 0 for no limit
+	maxAge  time.Duration // Rotate after this long; 0 for no limit
+
+	rows chan []float64
+	done chan struct{}
+
+	mu      sync.Mutex
+	dropped int // Rows dropped because the queue was full
+	err     error
+
+	// Used only by the background writer
+	f      *os.File
+	w      *bufio.Writer
+	seq    int
+	size   int64
+	opened time.Time
+	buf    []byte
+}
+
+// NewFlightLog creates the first file of a FlightLog at path with the columns header, rotating it after
+// maxSize bytes or maxAge, whichever comes first; zero means no limit.
+func NewFlightLog(path string, header []string, maxSize int64, maxAge time.Duration) (l *FlightLog, err error) {
+	l = new(FlightLog)
+	l.path = path
+	l.header = header
+	l.maxSize = maxSize
+	l.maxAge = maxAge
+	if err = l.rotate(); err != nil {
+		return nil, err
+	}
+	l.rows = make(chan []float64, flightLogBuffer)
+	l.done = make(chan struct{})
+	go l.run()
+	return
+}
+
+// Log queues a row for writing without blocking.  If the queue is full, the row is dropped and counted.
+func (l *FlightLog) Log(row []float64) {
+	select {
+	case l.rows <- row:
+	default:
+		l.mu.Lock()
+		l.dropped++
+		l.mu.Unlock()
+	}
+}
+
+// Dropped returns the number of rows dropped so far because the writer couldn't keep up.
+func (l *FlightLog) Dropped() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// Close writes the queued rows and closes the current file, returning the first write error, if any.
+// Log must not be called after Close.
+func (l *FlightLog) Close() error {
+	close(l.rows)
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *FlightLog) run() {
+	defer close(l.done)
+	for row := range l.rows {
+		if (l.maxSize > 0 && l.size >= l.maxSize) || (l.maxAge > 0 && time.Since(l.opened) >= l.maxAge) {
+			if err := l.rotate(); err != nil {
+				l.setErr(err)
+			}
+		}
+		if l.w == nil {
+			continue
+		}
+		l.buf = l.buf[:0]
+		for i, v := range row {
+			if i > 0 {
+				l.buf = append(l.buf, ',')
+			}
+			l.buf = strconv.AppendFloat(l.buf, v, 'f', 6, 64)
+		}
+		l.buf = append(l.buf, '\n')
+		n, err := l.w.Write(l.buf)
+		l.size += int64(n)
+		if err != nil {
+			l.setErr(err)
+		}
+	}
+	l.setErr(l.closeFile())
+}
+
+// rotate closes the current file, if any, and starts the next one with the header.
+func (l *FlightLog) rotate() (err error) {
+	if err = l.closeFile(); err != nil {
+		return
+	}
+	l.seq++
+	ext := filepath.Ext(l.path)
+	fn := fmt.Sprintf("%s-%03d%s", strings.TrimSuffix(l.path, ext), l.seq, ext)
+	if l.f, err = os.Create(fn); err != nil {
+		return
+	}
+	log.Printf("AHRS Runner: logging to %s\n", fn)
+	l.w = bufio.NewWriter(l.f)
+	n, err := fmt.Fprint(l.w, strings.Join(l.header, ","), "\n")
+	l.size = int64(n)
+	l.opened = time.Now()
+	return
+}
+
+func (l *FlightLog) closeFile() (err error) {
+	if l.f == nil {
+		return
+	}
+	err = l.w.Flush()
+	if errClose := l.f.Close(); err == nil {
+		err = errClose
+	}
+	l.f, l.w = nil, nil
+	return
+}
+
+// setErr records the first error, and logs them all.
+func (l *FlightLog) setErr(err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("AHRS Runner: flight log error: %s\n", err)
+	l.mu.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.mu.Unlock()
+}
+
+// flightLogColumn is a column of a Runner's flight log, with how to get its value from a filter step:
+// the raw reading d, the Measurement m made from it and the resulting state s.
+type flightLogColumn struct {
+	name string
+	val  func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64
+}
+
+// flightLogColumns are the columns a Runner logs.  The measurement columns are named as in the ahrs log map,
+// which is what the simulator's -replay reads.
+var flightLogColumns = []flightLogColumn{
+	{"T", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.T }},
+	{"Gyro1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Gyro[0] }},
+	{"Gyro2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Gyro[1] }},
+	{"Gyro3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Gyro[2] }},
+	{"Accel1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Accel[0] }},
+	{"Accel2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Accel[1] }},
+	{"Accel3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Accel[2] }},
+	{"Mag1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Mag[0] }},
+	{"Mag2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Mag[1] }},
+	{"Mag3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return d.Mag[2] }},
+	{"A1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.A1 }},
+	{"A2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.A2 }},
+	{"A3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.A3 }},
+	{"B1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.B1 }},
+	{"B2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.B2 }},
+	{"B3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.B3 }},
+	{"M1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.M1 }},
+	{"M2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.M2 }},
+	{"M3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.M3 }},
+	{"MValid", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 {
+		return boolToFloat(m.MValid)
+	}},
+	{"TW", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.TW }},
+	{"W1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.W1 }},
+	{"W2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.W2 }},
+	{"W3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return m.W3 }},
+	{"WValid", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 {
+		return boolToFloat(m.WValid)
+	}},
+	{"E0", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.E0 }},
+	{"E1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.E1 }},
+	{"E2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.E2 }},
+	{"E3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.E3 }},
+	{"U1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.U1 }},
+	{"U2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.U2 }},
+	{"U3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.U3 }},
+	{"V1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.V1 }},
+	{"V2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.V2 }},
+	{"V3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.V3 }},
+	{"C1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.C1 }},
+	{"C2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.C2 }},
+	{"C3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.C3 }},
+	{"D1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.D1 }},
+	{"D2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.D2 }},
+	{"D3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.D3 }},
+	{"L1", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.L1 }},
+	{"L2", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.L2 }},
+	{"L3", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.L3 }},
+	{"RollStdDev", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 {
+		droll, _, _ := s.RollPitchHeadingStdDev()
+		return droll
+	}},
+	{"PitchStdDev", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 {
+		_, dpitch, _ := s.RollPitchHeadingStdDev()
+		return dpitch
+	}},
+	{"HeadingStdDev", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 {
+		_, _, dheading := s.RollPitchHeadingStdDev()
+		return dheading
+	}},
+	{"Condition", func(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) float64 { return s.ConditionNumber() }},
+}
+
+// FlightLogHeader returns the columns of the rows a Runner writes to its FlightLog.
+func FlightLogHeader() (header []string) {
+	header = make([]string, len(flightLogColumns))
+	for i, c := range flightLogColumns {
+		header[i] = c.name
+	}
+	return
+}
+
+func flightLogRow(d *mpu9250.Reading, m *ahrs.Measurement, s *ahrs.KalmanState) (row []float64) {
+	row = make([]float64, len(flightLogColumns))
+	for i, c := range flightLogColumns {
+		row[i] = c.val(d, m, s)
+	}
+	return
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+/*
+Package ahrsrunner ties the MPU9250 driver to the ahrs Kalman filter at runtime:
+it reads the sensors periodically, runs the filter on each reading and keeps the latest attitude.
+*/
+package ahrsrunner
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"../ahrs"
+	"../mpu9250"
+)
+
+// SensorReader is the source of sensor readings for a Runner, such as an *mpu9250.MPU9250.
+// ReadStruct should block until a reading is available.
+type SensorReader interface {
+	ReadStruct() mpu9250.Reading
+}
+
+// Runner runs the Kalman filter on readings from an MPU9250 every period.
+type Runner struct {
+	mpu    SensorReader
+	period time.Duration
+	s      *ahrs.KalmanState
+	m      *ahrs.Measurement
+	t0     time.Time  // Time of the first reading; filter times are seconds since t0
+	log    *FlightLog // If set, a row is logged for each filter step on a good reading
+
+	mu                   sync.Mutex
+	roll, pitch, heading float64 // Latest attitude, °
+	nReads, nErrs        int     // Readings taken and readings whose accel/gyro failed
+	cStop, cDone         chan struct{}
+}
+
+// NewRunner returns a Runner for the sensors mpu, reading them every period.  Call Start to start it.
+func NewRunner(mpu SensorReader, period time.Duration) (r *Runner) {
+	r = new(Runner)
+	r.mpu = mpu
+	r.period = period
+	r.m = ahrs.NewMeasurement()
+	r.roll, r.pitch, r.heading = ahrs.Invalid, ahrs.Invalid, ahrs.Invalid
+	return
+}
+
+// SetFlightLog makes the Runner log each filter step to l, which should have the columns of FlightLogHeader;
+// nil stops logging.  The caller still owns l and should close it after Stop.
+func (r *Runner) SetFlightLog(l *FlightLog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log = l
+}
+
+// Start starts reading the sensors and running the filter in the background.
+func (r *Runner) Start() {
+	r.cStop = make(chan struct{})
+	r.cDone = make(chan struct{})
+	go r.run()
+}
+
+// Stop stops the Runner and waits for its last filter step to finish.
+func (r *Runner) Stop() {
+	close(r.cStop)
+	<-r.cDone
+}
+
+func (r *Runner) run() {
+	defer close(r.cDone)
+	ticker := time.NewTicker(r.period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.cStop:
+			return
+		case <-ticker.C:
+		}
+		r.step(r.mpu.ReadStruct())
+	}
+}
+
+// step runs the filter on a single sensor reading d.
+// If the accel/gyro reading failed, the Update is skipped and the filter only predicts to the reading's time,
+// if it has one, and nothing is logged, as there's no measurement to log; if just the magnetometer failed,
+// the Update is made without it.
+func (r *Runner) step(d mpu9250.Reading) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nReads++
+
+	if d.GAErr != nil {
+		r.nErrs++
+		log.Printf("AHRS Runner: skipping update, accel/gyro error: %s\n", d.GAErr)
+		if r.s != nil && !d.T.IsZero() {
+			r.s.Predict(d.T.Sub(r.t0).Seconds())
+			r.updateAttitude()
+		}
+		return
+	}
+
+	if r.s == nil {
+		r.t0 = d.T
+	}
+	r.m.SetMPU9250(d.T.Sub(r.t0).Seconds(), d.Gyro, d.Accel, d.Mag, d.MagErr == nil)
+
+	if r.s == nil {
+		r.s = ahrs.InitializeKalman(r.m)
+	} else {
+		r.s.Predict(r.m.T)
+		r.s.Update(r.m)
+	}
+	r.updateAttitude()
+	r.logStep(&d)
+}
+
+func (r *Runner) logStep(d *mpu9250.Reading) {
+	if r.log != nil {
+		r.log.Log(flightLogRow(d, r.m, r.s))
+	}
+}
+
+func (r *Runner) updateAttitude() {
+	r.roll, r.pitch, r.heading = r.s.CalcRollPitchHeading()
+}
+
+// RollPitchHeading returns the latest attitude, in degrees, with the conventions of ahrs.FromQuaternion.
+// They are ahrs.Invalid until the first good reading.
+func (r *Runner) RollPitchHeading() (roll, pitch, heading float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.roll, r.pitch, r.heading
+}
+
+// State returns a copy of the filter's latest state, or nil before the first good reading.
+func (r *Runner) State() *ahrs.State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.s == nil {
+		return nil
+	}
+	return r.s.State.Copy()
+}
+
+// Errors returns the number of readings taken and of those whose accel/gyro failed.
+func (r *Runner) Errors() (nReads, nErrs int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nReads, r.nErrs
+}
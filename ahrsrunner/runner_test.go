@@ -0,0 +1,142 @@
+package ahrsrunner
+
+import (
+	"encoding/csv"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../ahrs"
+	"../mpu9250"
+)
+
+// fakeMPU returns level, stationary readings a millisecond apart, with the field pointing north and down.
+type fakeMPU struct {
+	t time.Time
+}
+
+func (f *fakeMPU) ReadStruct() mpu9250.Reading {
+	f.t = f.t.Add(time.Millisecond)
+	return mpu9250.Reading{T: f.t, Accel: [3]float64{0, 0, 1}, Mag: [3]float64{0, 20, 40}}
+}
+
+func TestRunnerStep(t *testing.T) {
+	f := &fakeMPU{t: time.Now()}
+	r := NewRunner(f, time.Millisecond)
+
+	if roll, _, _ := r.RollPitchHeading(); roll != ahrs.Invalid {
+		t.Errorf("roll before the first reading was %f, expected Invalid", roll)
+	}
+	if r.State() != nil {
+		t.Error("State before the first reading wasn't nil")
+	}
+
+	for i := 0; i < 100; i++ {
+		d := f.ReadStruct()
+		if i == 50 {
+			d.GAErr = errors.New("bus error")
+		}
+		r.step(d)
+	}
+
+	if n, nErr := r.Errors(); n != 100 || nErr != 1 {
+		t.Errorf("Errors gave %d readings, %d errors; expected 100, 1", n, nErr)
+	}
+	roll, pitch, _ := r.RollPitchHeading()
+	if math.Abs(roll) > 1 || math.Abs(pitch) > 1 {
+		t.Errorf("level readings gave roll %f, pitch %f", roll, pitch)
+	}
+	if r.State() == nil {
+		t.Error("State after readings was nil")
+	}
+}
+
+func TestRunnerStepErrorTime(t *testing.T) {
+	f := &fakeMPU{t: time.Now()}
+	r := NewRunner(f, time.Millisecond)
+	t0 := f.t.Add(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		r.step(f.ReadStruct())
+	}
+
+	// A failed reading predicts to its own time, not to when the Runner got to it
+	d := f.ReadStruct()
+	d.GAErr = errors.New("bus error")
+	r.step(d)
+	if tr, exp := r.State().T, d.T.Sub(t0).Seconds(); math.Abs(tr-exp) > 1e-9 {
+		t.Errorf("failed reading predicted to %f s, expected %f s", tr, exp)
+	}
+
+	// and one without a time doesn't predict at all
+	tr := r.State().T
+	r.step(mpu9250.Reading{GAErr: errors.New("bus error")})
+	if r.State().T != tr {
+		t.Errorf("failed reading without a time predicted from %f s to %f s", tr, r.State().T)
+	}
+}
+
+func TestRunnerStartStop(t *testing.T) {
+	r := NewRunner(&fakeMPU{t: time.Now()}, time.Millisecond)
+	r.Start()
+	time.Sleep(50 * time.Millisecond)
+	r.Stop()
+	if n, _ := r.Errors(); n == 0 {
+		t.Error("Runner took no readings")
+	}
+}
+
+func TestFlightLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flightlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewFlightLog(filepath.Join(dir, "flight.csv"), FlightLogHeader(), 4096, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMPU{t: time.Now()}
+	r := NewRunner(f, time.Millisecond)
+	r.SetFlightLog(l)
+	for i := 0; i < 100; i++ {
+		r.step(f.ReadStruct())
+	}
+	// Failed readings have no measurement to log
+	for i := 0; i < 10; i++ {
+		d := f.ReadStruct()
+		d.GAErr = errors.New("bus error")
+		r.step(d)
+	}
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "flight-*.csv"))
+	if len(files) < 2 {
+		t.Fatalf("expected the log to rotate, got files %v", files)
+	}
+	var rows int
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(recs[0], ",") != strings.Join(FlightLogHeader(), ",") {
+			t.Errorf("%s has header %v", fn, recs[0])
+		}
+		rows += len(recs) - 1
+	}
+	if rows+l.Dropped() != 100 {
+		t.Errorf("logged %d rows and dropped %d, expected 100", rows, l.Dropped())
+	}
+}
@@ -0,0 +1,132 @@
+package ahrsweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Attitude is the JSON message an AttitudeStream pushes to its clients, enough to drive an instrument panel.
+type Attitude struct {
+	T                    float64 // Time of the estimate, s
+	Roll, Pitch, Heading float64 // °
+	Airspeed             float64 // kt
+}
+
+// AttitudeStream pushes the current Attitude to every connected browser at a fixed rate over a WebSocket.
+// It polls its source rather than being fed by the estimator, so that the estimator never waits on it;
+// a client that can't keep up is disconnected rather than holding up the others.
+type AttitudeStream struct {
+	source func() Attitude
+	period time.Duration
+
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+}
+
+// streamClient is a browser watching an AttitudeStream.
+type streamClient struct {
+	socket *websocket.Conn
+	send   chan []byte
+}
+
+// NewAttitudeStream returns an AttitudeStream pushing source() rate times per second,
+// e.g. with source reading ahrsrunner.Runner.RollPitchHeading.  Call Run to start it.
+// It returns an error if rate isn't a positive number of times per second, at most one per nanosecond.
+func NewAttitudeStream(source func() Attitude, rate float64) (*AttitudeStream, error) {
+	if !(rate > 0) || rate > float64(time.Second) {
+		return nil, fmt.Errorf("AHRSWeb: attitude stream rate %g isn't between 0 and %d per second", rate, time.Second)
+	}
+	return &AttitudeStream{
+		source:  source,
+		period:  time.Duration(float64(time.Second) / rate),
+		clients: make(map[*streamClient]bool),
+	}, nil
+}
+
+// Run pushes the attitude to the clients until stop is closed.
+func (a *AttitudeStream) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(a.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			a.mu.Lock()
+			for c := range a.clients {
+				a.drop(c)
+			}
+			a.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		msg, err := json.Marshal(a.source())
+		if err != nil {
+			log.Println("AHRSWeb: Error marshalling attitude:", err)
+			continue
+		}
+		a.mu.Lock()
+		for c := range a.clients {
+			select {
+			case c.send <- msg:
+			default:
+				log.Println("AHRSWeb: Dropping slow attitude client")
+				a.drop(c)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// drop disconnects c; a.mu must be held.
+func (a *AttitudeStream) drop(c *streamClient) {
+	if a.clients[c] {
+		delete(a.clients, c)
+		close(c.send)
+	}
+}
+
+// Clients returns the number of connected clients.
+func (a *AttitudeStream) Clients() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.clients)
+}
+
+// ServeHTTP upgrades the request to a WebSocket and streams the attitude to it until it closes or is dropped.
+func (a *AttitudeStream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	socket, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("AHRSWeb: Error upgrading attitude stream:", err)
+		return
+	}
+	c := &streamClient{socket: socket, send: make(chan []byte, messageBufferSize)}
+	a.mu.Lock()
+	a.clients[c] = true
+	a.mu.Unlock()
+
+	go c.write()
+	// Browsers send nothing, but reading notices when they close
+	for {
+		if _, _, err := socket.ReadMessage(); err != nil {
+			break
+		}
+	}
+	a.mu.Lock()
+	a.drop(c)
+	a.mu.Unlock()
+}
+
+func (c *streamClient) write() {
+	defer c.socket.Close()
+	for msg := range c.send {
+		if err := c.socket.WriteMessage(websocket.TextMessage, msg); err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package ahrsweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// smallBufferListener shrinks the send buffer of each connection it accepts, so that writes to a client
+// which doesn't read block after a few messages rather than a few megabytes.
+type smallBufferListener struct {
+	net.Listener
+}
+
+func (l smallBufferListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetWriteBuffer(1024)
+	}
+	return c, err
+}
+
+// waitFor polls cond until it holds, failing the test with msg if it doesn't within a few seconds.
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+	}
+}
+
+func TestNewAttitudeStreamRate(t *testing.T) {
+	for _, rate := range []float64{0, -1, 2e9} {
+		if _, err := NewAttitudeStream(func() Attitude { return Attitude{} }, rate); err == nil {
+			t.Errorf("expected an error for rate %g", rate)
+		}
+	}
+}
+
+func TestAttitudeStream(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	exp := Attitude{T: 1, Roll: 10, Pitch: -5, Heading: 90, Airspeed: 100}
+	a, err := NewAttitudeStream(func() Attitude { return exp }, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := make(chan struct{}, 3) // ServeHTTP returns once its client is gone
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a.ServeHTTP(w, req)
+		dropped <- struct{}{}
+	}))
+	srv.Listener = smallBufferListener{srv.Listener}
+	srv.Start()
+	defer srv.Close()
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		a.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// Two clients read every message
+	var counts [2]int64
+	for i := range counts {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go func(n *int64) {
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				var att Attitude
+				if err := json.Unmarshal(msg, &att); err != nil || att != exp {
+					t.Errorf("received %s, expected %v", msg, exp)
+				}
+				atomic.AddInt64(n, 1)
+			}
+		}(&counts[i])
+	}
+	received := func(n int64) func() bool {
+		return func() bool { return atomic.LoadInt64(&counts[0]) > n && atomic.LoadInt64(&counts[1]) > n }
+	}
+	waitFor(t, received(0), "clients received no attitude")
+
+	// and one that never reads, with a small receive buffer, is dropped
+	dialer := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		c, err := net.Dial(network, addr)
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetReadBuffer(1024)
+		}
+		return c, err
+	}}
+	slow, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	select {
+	case <-dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client wasn't dropped")
+	}
+	if n := a.Clients(); n != 2 {
+		t.Errorf("expected the 2 reading clients to stay connected, got %d clients", n)
+	}
+
+	// without holding up the others
+	n := atomic.LoadInt64(&counts[0])
+	if n2 := atomic.LoadInt64(&counts[1]); n2 > n {
+		n = n2
+	}
+	waitFor(t, received(n+10), "clients stopped receiving after the slow client was dropped")
+}
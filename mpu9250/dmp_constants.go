@@ -54,6 +54,7 @@ const (
 	MPUREG_I2C_MST_STATUS     = 0x36
 	MPUREG_INT_PIN_CFG        = 0x37
 	MPUREG_INT_ENABLE         = 0x38
+	MPUREG_INT_STATUS         = 0x3A
 	MPUREG_ACCEL_XOUT_H       = 0x3B
 	MPUREG_ACCEL_XOUT_L       = 0x3C
 	MPUREG_ACCEL_YOUT_H       = 0x3D
@@ -174,20 +175,44 @@ const (
 
 	// Misc
 	READ_FLAG = 0x80
-	MPU_BANK_SIZE = 0xFF
+	MPU_BANK_SIZE = 0x100 // Bytes per DMP memory bank
+	MPU_MEM_CHUNK = 16 // Most bytes of DMP memory written or read in one bus transaction
 	CFG_MOTION_BIAS = 0x4B8 // Enable/disable gyro bias compensation
 	BIT_FIFO_SIZE_1024 = 0x40 // FIFO buffer size
+	BIT_FIFO_EN = 0x40 // USER_CTRL: enable FIFO operations
+	BIT_FIFO_RST = 0x04 // USER_CTRL: reset FIFO buffer
+	BIT_FIFO_OFLOW_INT = 0x10 // INT_STATUS: FIFO overflowed
+	BITS_FIFO_GYRO = 0x70 // FIFO_EN: write gyro x, y, z to FIFO
+	BITS_FIFO_ACCEL = 0x08 // FIFO_EN: write accel x, y, z to FIFO
+	BIT_CYCLE = 0x20 // PWR_MGMT_1: cycle between sleep and taking a single accel sample
+	BITS_DISABLE_GYRO = 0x07 // PWR_MGMT_2: disable gyro x, y, z
+	BIT_WOM_EN = 0x40 // INT_ENABLE: enable wake on motion interrupt
+	BIT_WOM_INT = 0x40 // INT_STATUS: wake on motion interrupt occurred
+	BITS_ACCEL_INTEL = 0xC0 // MOT_DETECT_CTRL: enable accel hardware intelligence, compare to previous sample
+	BITS_A_DLPF_CFG_184HZ = 0x01 // ACCEL_CONFIG_2: accel LPF setting for wake on motion
+	LP_ACCEL_ODR_MAX = 0x0B // LP_ACCEL_ODR: highest low-power accel output rate, 500Hz
+	WHOAMI_MPU9250 = 0x71 // WHO_AM_I values of supported parts
+	WHOAMI_MPU9255 = 0x73
+	WHOAMI_MPU6500 = 0x70 // No magnetometer
+	WHOAMI_MPU6050 = 0x68 // No magnetometer, accel offsets at XA_OFFS_H etc. and no ACCEL_CONFIG_2
 	BIT_AUX_IF_EN uint8 = 0x20
 	BIT_BYPASS_EN = 0x02
 	AKM_POWER_DOWN = 0x00
 	BIT_I2C_READ = 0x80
 	BIT_SLAVE_EN = 0x80
 	AKM_SINGLE_MEASUREMENT = 0x01
-	INV_CLK_PLL = 0x01
+	AKM_CONTINUOUS_100HZ_16BIT = 0x16 // CNTL1: continuous measurement mode 2, 16-bit output
+	AKM_CONTINUOUS_100HZ = 0x06 // CNTL1: continuous measurement mode 2
+	AKM_BIT_16 = 0x10 // CNTL1: 16-bit rather than 14-bit output
+	AKM_SOFT_RESET = 0x01 // CNTL2: reset all registers to their defaults
+	INV_CLK_INTERNAL = 0x00 // PWR_MGMT_1: internal 20MHz oscillator
+	INV_CLK_PLL = 0x01 // PWR_MGMT_1: gyro PLL if ready, else internal oscillator
+	BIT_RAW_RDY_INT = 0x01 // INT_STATUS: new sensor data ready
 	AK89xx_FSR = 9830
 	AKM_DATA_READY = 0x01
 	AKM_DATA_OVERRUN = 0x02
 	AKM_OVERFLOW = 0x80
+	AKM_ST2_HOFL = 0x08 // ST2: magnetic sensor overflow
 
 
 	/* = ---- Sensitivity --------------------------------------------------------- */
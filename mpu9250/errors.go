@@ -0,0 +1,17 @@
+package mpu9250
+
+import "errors"
+
+// Errors returned by the driver wrap one of these, so that callers can tell the kinds of failure apart with
+// errors.Is rather than by matching the message.  Bus errors also wrap the underlying error from the bus.
+var (
+	ErrBusRead        = errors.New("MPU9250 Error: bus read failed")
+	ErrBusWrite       = errors.New("MPU9250 Error: bus write failed")
+	ErrWhoAmI         = errors.New("MPU9250 Error: unsupported WHO_AM_I")
+	ErrInvalidSetting = errors.New("MPU9250 Error: invalid setting")
+	ErrCalibration    = errors.New("MPU9250 Error: calibration readings unusable")
+	ErrNoData         = errors.New("MPU9250 Warning: no new sensor values")
+	ErrOverflow       = errors.New("MPU9250 Warning: data overflow")
+	ErrFrozen         = errors.New("MPU9250 Error: sensor frozen")
+	ErrNotRunning     = errors.New("MPU9250 Error: not reading the MPU9250")
+)
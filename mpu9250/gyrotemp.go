@@ -0,0 +1,101 @@
+package mpu9250
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const minGyroTempSpan = 2.0 // Smallest temperature range over which a GyroTempModel may be fitted, °C
+
+/*
+GyroTempModel is a linear model of the gyro bias as a function of the chip temperature:
+the bias on each axis at temperature T is Bias + Slope*(T-T0).
+It is fitted once by FitGyroTempModel, saved with Save, and on later runs loaded with LoadGyroTempModel
+and handed to SetGyroTempModel, which subtracts it from every gyro reading using the live temperature.
+*/
+type GyroTempModel struct {
+	T0    float64    // Reference temperature, °C
+	Bias  [3]float64 // Gyro bias at T0, °/s
+	Slope [3]float64 // Change in gyro bias per degree, °/s/°C
+}
+
+// At returns the modeled gyro bias at temperature temp, °C.
+func (g *GyroTempModel) At(temp float64) (bias [3]float64) {
+	for i := range bias {
+		bias[i] = g.Bias[i] + g.Slope[i]*(temp-g.T0)
+	}
+	return
+}
+
+/*
+FitGyroTempModel fits a GyroTempModel by least squares to readings taken with the MPU9250 held still while its
+temperature changes, e.g. averages read from CAvg every few seconds as the board warms up after power-on.
+The readings should be taken with no GyroTempModel set, so that they show the whole bias.
+It returns an error if the readings don't cover at least a couple of degrees, since then the slope is meaningless.
+*/
+func FitGyroTempModel(readings []*MPUData) (*GyroTempModel, error) {
+	var (
+		n, st, stt float64
+		sg, stg    [3]float64
+		tLo, tHi   float64
+	)
+	for _, d := range readings {
+		if d == nil || d.GAError != nil {
+			continue
+		}
+		if n == 0 || d.Temp < tLo {
+			tLo = d.Temp
+		}
+		if n == 0 || d.Temp > tHi {
+			tHi = d.Temp
+		}
+		n++
+		st += d.Temp
+		stt += d.Temp * d.Temp
+		for i, g := range [3]float64{d.G1, d.G2, d.G3} {
+			sg[i] += g
+			stg[i] += d.Temp * g
+		}
+	}
+	if tHi-tLo < minGyroTempSpan {
+		return nil, fmt.Errorf("%w: gyro temperature readings only span %.1f°C", ErrCalibration, tHi-tLo)
+	}
+
+	// Center on the mean temperature, where the bias is best determined.
+	g := &GyroTempModel{T0: st / n}
+	for i := range sg {
+		g.Bias[i] = sg[i] / n
+		g.Slope[i] = (stg[i] - st*sg[i]/n) / (stt - st*st/n)
+	}
+	return g, nil
+}
+
+// Save writes the GyroTempModel to w as JSON.
+func (g *GyroTempModel) Save(w io.Writer) error {
+	return json.NewEncoder(w).Encode(g)
+}
+
+// LoadGyroTempModel reads a GyroTempModel written by Save.
+func LoadGyroTempModel(r io.Reader) (*GyroTempModel, error) {
+	g := new(GyroTempModel)
+	if err := json.NewDecoder(r).Decode(g); err != nil {
+		return nil, fmt.Errorf("MPU9250 Error: couldn't read gyro temperature model: %w", err)
+	}
+	return g, nil
+}
+
+// SetGyroTempModel sets the model of the gyro bias subtracted from each gyro reading at the live temperature,
+// in addition to the bias set by SetBias.  Passing nil removes it.
+func (mpu *MPU9250) SetGyroTempModel(g *GyroTempModel) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.gyroTemp = g
+}
+
+// GetGyroTempModel returns the model of the gyro bias currently applied, or nil if there is none.
+func (mpu *MPU9250) GetGyroTempModel() *GyroTempModel {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.gyroTemp
+}
@@ -0,0 +1,35 @@
+package mpu9250
+
+import "math"
+
+/*
+TiltCompensatedHeading computes the magnetic heading in degrees, 0 to 360, from a single set of accelerometer and
+magnetometer readings as returned by the MPU9250 (e.g. MPUData A1..A3 and M1..M3), independently of any filter.
+The heading is that of the accelerometer x axis, with the chip's z axis up when level.
+The magnetometer readings are in the AK8963's own axes, which are aligned to the accelerometer's here.
+
+The gravity vector is used to level the magnetometer vector, so the result is only meaningful when the chip isn't
+accelerating.  It is useful as a fallback and for checking the magnetometer calibration.
+*/
+func TiltCompensatedHeading(a1, a2, a3, m1, m2, m3 float64) float64 {
+	// AK8963 x and y axes are swapped relative to the accelerometer and its z axis is reversed.
+	m1, m2, m3 = m2, m1, -m3
+
+	// When not accelerating, the accelerometer measures the up direction.
+	na := math.Sqrt(a1*a1 + a2*a2 + a3*a3)
+	u1, u2, u3 := a1/na, a2/na, a3/na
+
+	// Horizontal components of the magnetic field (magnetic north) and of the x axis (forward).
+	mu := m1*u1 + m2*u2 + m3*u3
+	h1, h2, h3 := m1-mu*u1, m2-mu*u2, m3-mu*u3
+	f1, f2, f3 := 1-u1*u1, -u1*u2, -u1*u3
+
+	// Heading is the angle clockwise, looking down, from magnetic north to forward.
+	sin := (f2*h3-f3*h2)*u1 + (f3*h1-f1*h3)*u2 + (f1*h2-f2*h1)*u3
+	cos := h1*f1 + h2*f2 + h3*f3
+	hdg := math.Atan2(sin, cos) * 180 / math.Pi
+	if hdg < 0 {
+		hdg += 360
+	}
+	return hdg
+}
@@ -4,10 +4,13 @@ package mpu9250
 // Also referenced https://github.com/brianc118/MPU9250/blob/master/MPU9250.cpp
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"sync"
 	"time"
 
 	"../embd"
@@ -16,10 +19,19 @@ import (
 )
 
 const (
-	bufSize  = 250 // Size of buffer storing instantaneous sensor values
-	scaleMag = 9830.0 / 65536
+	bufSize       = 250 // Size of buffer storing instantaneous sensor values
+	scaleMag      = 9830.0 / 65536
+	fifoFrameSize = 12   // Bytes per accel+gyro sample in the FIFO
+	fifoMaxCount  = 512  // FIFO buffer size, bytes
+	errBufSize    = 16   // Size of buffer storing sensor errors
+	minSampleRate = 4    // Slowest sample rate, Hz: 1kHz / (1 + largest divider, 255)
+	maxSampleRate = 1000 // Fastest sample rate, Hz: 1kHz with divider 0
 )
 
+const clockTimeout = 100 * time.Millisecond // How long to wait for the clock to settle and data to be ready
+
+const accelCalTolerance = 0.2 // How far six-position accel calibration readings may be from ±1G
+
 // MPUData contains all the values measured by an MPU9250.
 type MPUData struct {
 	G1, G2, G3        float64
@@ -29,545 +41,1692 @@ type MPUData struct {
 	GAError, MagError error
 	N, NM             int
 	T, TM             time.Time
+	T0                time.Time // Time of the first accel/gyro sample averaged; T is the time of the last
 	DT, DTM           time.Duration
 }
 
+// Reading holds an average of all nine sensor axes, as returned by ReadStruct.
+type Reading struct {
+	T             time.Time  // Time of the last gyro/accel sample averaged
+	Gyro          [3]float64 // °/s
+	Accel         [3]float64 // G
+	Mag           [3]float64 // uT
+	GAErr, MagErr error
+}
+
+// SensorError describes an error encountered by the background reader while reading one of the MPU9250's sensors.
+type SensorError struct {
+	Sensor string // Which sensor: "gyro/accel", "temperature", "FIFO" or "magnetometer"
+	Err    error  // The underlying error, usually from the bus
+}
+
+func (e *SensorError) Error() string {
+	return fmt.Sprintf("MPU9250 Warning: error reading %s: %s", e.Sensor, e.Err)
+}
+
+func (e *SensorError) Unwrap() error {
+	return e.Err
+}
+
+// Stats counts what the background reader has done since the averages were last read, e.g. by CAvg or ReadStruct.
+// Overruns that are a sizable fraction of Samples mean the sample rate is faster than the bus can keep up with.
+type Stats struct {
+	Samples    int            // Accel/gyro samples averaged
+	MagSamples int            // Magnetometer samples averaged
+	Overruns   int            // Read triggers missed because the previous read hadn't finished
+	Errors     map[string]int // Failed reads by sensor, as in SensorError
+}
+
+// Config describes the active sensor settings of an MPU9250.
+type Config struct {
+	WhoAmI     byte // WHO_AM_I value identifying the part
+	GyroRange  int  // Gyro full-scale range, °/s
+	AccelRange int  // Accel full-scale range, G
+	SampleRate int  // Sample rate for sensor readings, Hz
+	GyroLPF    int  // Gyro digital low pass filter bandwidth, Hz
+	AccelLPF   int  // Accel digital low pass filter bandwidth, Hz
+	MagEnabled bool // Whether the magnetometer is being read
+	MagBits    int  // Magnetometer output resolution, bits
+}
+
+// rawData holds the raw accumulated sensor counts since the accumulators were last reset.
+type rawData struct {
+	n                      int
+	g1, g2, g3, a1, a2, a3 int64
+	t                      int64
+	err                    error
+}
+
 /*
 MPU9250 represents an InvenSense MPU9250 9DoF chip.
 All communication is via channels.
 */
 type MPU9250 struct {
-	i2cbus                embd.I2CBus
-	scaleGyro, scaleAccel float64         // Max sensor reading for value 2**15-1
-	sampleRate            int             // Sample rate for sensor readings, Hz
-	enableMag             bool            // Read the magnetometer?
-	mcal1, mcal2, mcal3   float64         // Hardware magnetometer calibration values, uT
-	a01, a02, a03         float64         // Hardware accelerometer calibration values, G
-	g01, g02, g03         float64         // Hardware gyro calibration values, °/s
-	C                     <-chan *MPUData // Current instantaneous sensor values
-	CAvg                  <-chan *MPUData // Average sensor values (since CAvg last read)
-	CBuf                  <-chan *MPUData // Buffer of instantaneous sensor values
-	cClose                chan bool       // Turn off MPU polling
+	bus                   transport               // I2C or SPI communication with the chip
+	mu                    sync.Mutex              // Protects the scales and sensitivities, which may change while reading
+	scaleGyro, scaleAccel float64                 // Max sensor reading for value 2**15-1
+	sensGyro, sensAccel   int                     // Full-scale range of gyro (°/s) and accel (G)
+	sampleRate            int                     // Sample rate for sensor readings, Hz
+	smplrtDiv             byte                    // Sample rate divider written to SMPLRT_DIV
+	gyroLPF, accelLPF     int                     // Digital low pass filter bandwidths of gyro and accel, Hz
+	enableMag             bool                    // Read the magnetometer?
+	magBits               int                     // Magnetometer output resolution, 14 or 16 bits
+	trimMean              bool                    // Drop the extreme gyro/accel values from each average?
+	whoAmI                byte                    // WHO_AM_I value identifying the part
+	clockSource           byte                    // PWR_MGMT_1 clock source
+	mcal1, mcal2, mcal3   float64                 // Hardware magnetometer calibration values, uT
+	m01, m02, m03         float64                 // Magnetometer hard-iron offsets, uT
+	ms1, ms2, ms3         float64                 // Magnetometer soft-iron scale factors
+	a01, a02, a03         float64                 // Hardware accelerometer calibration values, G
+	as1, as2, as3         float64                 // Accelerometer scale factors
+	g01, g02, g03         float64                 // Hardware gyro calibration values, °/s
+	gyroTemp              *GyroTempModel          // Temperature-dependent gyro bias, if set
+	C                     <-chan *MPUData         // Current instantaneous sensor values
+	CAvg                  <-chan *MPUData         // Average sensor values (since CAvg last read)
+	CBuf                  <-chan *MPUData         // Buffer of instantaneous sensor values
+	cC, cAvg, cBuf        chan *MPUData           // Sending sides of C, CAvg and CBuf
+	cClose                chan bool               // Turn off MPU polling
+	running               bool                    // Whether readSensors is running
+	resetMu               sync.Mutex              // Serializes stopping and restarting readSensors
+	cFIFO                 chan bool               // Switch between FIFO and register polling
+	cTick                 chan (<-chan time.Time) // Switch the source of read triggers (nil for internal clock)
+	cRaw                  chan *rawData           // Raw accumulated sensor counts (since CAvg or cRaw last read)
+	cAvgNew               chan *MPUData           // Like CAvg, but only ready once there are new accel/gyro values
+	cNow                  chan chan *MPUData      // Requests for an immediate reading, answered on the enclosed channel
+	cMagReset             chan chan error         // Requests for a magnetometer reset, answered on the enclosed channel
+	cErr                  chan error              // Sensor errors, if requested by Errors(); otherwise they're logged
+	intPin                embd.DigitalPin         // GPIO pin connected to the MPU9250 INT pin, if used
+	magContinuous         bool                    // Whether the AK8963 is in continuous measurement mode
+	womSaved              map[byte]byte           // Register values to restore after wake on motion mode
+	magRecovery           int                     // Consecutive magnetometer errors after which to reset it, 0 for never
+	frozenSamples         int                     // Identical gyro/accel samples taken as a frozen sensor, 0 for never
+	gyroBiasCal           bool                    // Whether the DMP's motion bias compensation is enabled
+	stats                 Stats                   // Reader statistics since the averages were last read
 }
 
 /*
 NewMPU9250 creates a new MPU9250 object according to the supplied parameters.  If there is no MPU9250 available or there
-is an error creating the object, an error is returned.
+is an error creating the object, an error is returned.  It is a shorthand for New with the corresponding Options.
 */
 func NewMPU9250(sensitivityGyro, sensitivityAccel, sampleRate int, enableMag bool, applyHWOffsets bool) (*MPU9250, error) {
+	return New(WithGyroRange(sensitivityGyro), WithAccelRange(sensitivityAccel), WithSampleRate(sampleRate),
+		WithMagnetometer(enableMag), WithHWOffsets(applyHWOffsets))
+}
+
+/*
+NewMPU9250SPI creates a new MPU9250 object communicating over SPI on the given channel (chip select) instead of I2C.
+SPI is more reliable than I2C at high sample rates and over longer wiring.  The parameters are otherwise the same
+as for NewMPU9250, except that enableMag must be false: the magnetometer isn't supported over SPI.
+*/
+func NewMPU9250SPI(channel byte, sensitivityGyro, sensitivityAccel, sampleRate int, enableMag bool, applyHWOffsets bool) (*MPU9250, error) {
+	return New(WithSPI(channel), WithGyroRange(sensitivityGyro), WithAccelRange(sensitivityAccel),
+		WithSampleRate(sampleRate), WithMagnetometer(enableMag), WithHWOffsets(applyHWOffsets))
+}
+
+/*
+NewMPU9250WithBus creates a new MPU9250 object communicating over the supplied I2C bus.  This allows a caller to
+provide its own bus implementation, e.g. a fake bus for testing off-hardware.  The parameters are otherwise the same
+as for NewMPU9250.
+*/
+func NewMPU9250WithBus(i2cbus embd.I2CBus, sensitivityGyro, sensitivityAccel, sampleRate int, enableMag bool, applyHWOffsets bool) (*MPU9250, error) {
+	return New(WithBus(i2cbus), WithGyroRange(sensitivityGyro), WithAccelRange(sensitivityAccel),
+		WithSampleRate(sampleRate), WithMagnetometer(enableMag), WithHWOffsets(applyHWOffsets))
+}
+
+/*
+NewMPU9250WithSPIBus creates a new MPU9250 object communicating over the supplied SPI bus.
+The parameters are otherwise the same as for NewMPU9250SPI.
+*/
+func NewMPU9250WithSPIBus(spibus embd.SPIBus, sensitivityGyro, sensitivityAccel, sampleRate int, enableMag bool, applyHWOffsets bool) (*MPU9250, error) {
+	return New(WithSPIBus(spibus), WithGyroRange(sensitivityGyro), WithAccelRange(sensitivityAccel),
+		WithSampleRate(sampleRate), WithMagnetometer(enableMag), WithHWOffsets(applyHWOffsets))
+}
+
+func newMPU9250(bus transport, o *options) (*MPU9250, error) {
+	if o.sampleRate < minSampleRate || o.sampleRate > maxSampleRate {
+		return nil, fmt.Errorf("%w: sample rate %dHz is not between %d and %dHz",
+			ErrInvalidSetting, o.sampleRate, minSampleRate, maxSampleRate)
+	}
+	if o.magBits != 14 && o.magBits != 16 {
+		return nil, fmt.Errorf("%w: magnetometer resolution must be 14 or 16 bits, not %d", ErrInvalidSetting, o.magBits)
+	}
+	if _, ok := bus.(*spiTransport); ok && o.enableMag {
+		return nil, fmt.Errorf("%w: the magnetometer can't be used over SPI, as reading its calibration needs the I2C bypass",
+			ErrInvalidSetting)
+	}
+
 	var mpu = new(MPU9250)
 
-	mpu.sampleRate = sampleRate
-	mpu.enableMag = enableMag
+	mpu.sampleRate = o.sampleRate
+	mpu.enableMag = o.enableMag
+	mpu.magBits = o.magBits
+	mpu.frozenSamples = o.frozenSamples
+	mpu.ms1, mpu.ms2, mpu.ms3 = 1, 1, 1
+	mpu.as1, mpu.as2, mpu.as3 = 1, 1, 1
+
+	mpu.bus = bus
+
+	mpu.clockSource = INV_CLK_PLL
+	if err := mpu.init(o.gyroRange, o.accelRange, o.applyHWOffsets); err != nil {
+		return nil, err
+	}
+
+	cC := make(chan *MPUData)
+	mpu.cC, mpu.C = cC, cC
+	cAvg := make(chan *MPUData)
+	mpu.cAvg, mpu.CAvg = cAvg, cAvg
+	cBuf := make(chan *MPUData, bufSize)
+	mpu.cBuf, mpu.CBuf = cBuf, cBuf
+	mpu.cClose = make(chan bool)
+	mpu.cFIFO = make(chan bool)
+	mpu.cTick = make(chan (<-chan time.Time))
+	mpu.cRaw = make(chan *rawData)
+	mpu.cAvgNew = make(chan *MPUData)
+	mpu.cNow = make(chan chan *MPUData)
+	mpu.cMagReset = make(chan chan error)
+	mpu.running = true
+	go mpu.readSensors()
+
+	// Give the IMU time to fully initialize and then clear out any bad values from the averages.
+	time.Sleep(500 * time.Millisecond) // Make sure it's ready
+	<-mpu.CAvg
 
-	mpu.i2cbus = embd.NewI2CBus(1)
+	return mpu, nil
+}
 
+// init runs the initialization sequence of the MPU9250 and, if enabled, its AK8963 magnetometer.
+func (mpu *MPU9250) init(sensitivityGyro, sensitivityAccel int, applyHWOffsets bool) error {
 	// Initialization of MPU
 	// Reset device.
 	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_1, BIT_H_RESET); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error resetting MPU9250: %s", err))
+		return fmt.Errorf("Error resetting MPU9250: %w", err)
 	}
 
 	// Note: the following is in inv_mpu.c, but doesn't appear to be necessary from the MPU-9250 register map.
 	// Wake up chip.
 	time.Sleep(100 * time.Millisecond)
 	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_1, 0x00); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error waking MPU9250: %s", err))
+		return fmt.Errorf("Error waking MPU9250: %w", err)
+	}
+
+	// Identify the part before configuring it; the MPU6500 has the same registers but no AK8963 magnetometer,
+	// and the MPU6050 has no magnetometer either, keeps its accel offsets elsewhere and has no ACCEL_CONFIG_2.
+	whoAmI, err := mpu.i2cRead(MPUREG_WHOAMI)
+	if err != nil {
+		return fmt.Errorf("Error reading MPU9250 WHO_AM_I: %w", err)
+	}
+	switch whoAmI {
+	case WHOAMI_MPU9250, WHOAMI_MPU9255:
+	case WHOAMI_MPU6500, WHOAMI_MPU6050:
+		if mpu.enableMag {
+			log.Printf("MPU9250 Info: part with WHO_AM_I %X has no magnetometer, disabling it\n", whoAmI)
+			mpu.enableMag = false
+		}
+	default:
+		return fmt.Errorf("%w: %X is not a supported MPU9250, MPU9255, MPU6500 or MPU6050", ErrWhoAmI, whoAmI)
+	}
+	mpu.whoAmI = whoAmI
+
+	// Using SPI, disable the I2C interface so it can't be confused by SPI traffic.
+	if _, ok := mpu.bus.(*spiTransport); ok {
+		if err := mpu.i2cWrite(MPUREG_USER_CTRL, BIT_I2C_IF_DIS); err != nil {
+			return fmt.Errorf("Error disabling MPU9250 I2C interface: %w", err)
+		}
 	}
 
 	// Note: inv_mpu.c sets some registers here to allocate 1kB to the FIFO buffer and 3kB to the DMP.
 	// It doesn't seem to be supported in the 1.6 version of the register map and we're not using FIFO anyway,
 	// so we skip this.
 	// Don't let FIFO overwrite DMP data
-	if err := mpu.i2cWrite(MPUREG_ACCEL_CONFIG_2, BIT_FIFO_SIZE_1024|0x8); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting up MPU9250: %s", err))
+	if mpu.whoAmI != WHOAMI_MPU6050 {
+		if err := mpu.i2cWrite(MPUREG_ACCEL_CONFIG_2, BIT_FIFO_SIZE_1024|0x8); err != nil {
+			return fmt.Errorf("Error setting MPU9250 FIFO size: %w", err)
+		}
 	}
 
 	// Set Gyro and Accel sensitivities
-	if err := mpu.SetGyroSensitivity(sensitivityGyro); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting MPU9250 gyro sensitivity: %s", err))
+	if err := mpu.SetGyroRange(sensitivityGyro); err != nil {
+		return fmt.Errorf("Error setting MPU9250 gyro sensitivity: %w", err)
 	}
 
-	if err := mpu.SetAccelSensitivity(sensitivityAccel); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting MPU9250 accel sensitivity: %s", err))
+	if err := mpu.SetAccelRange(sensitivityAccel); err != nil {
+		return fmt.Errorf("Error setting MPU9250 accel sensitivity: %w", err)
 	}
 
-	sampRate := byte(1000/mpu.sampleRate - 1)
-	// Default: Set Gyro LPF to half of sample rate
-	if err := mpu.SetGyroLPF(sampRate >> 1); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting MPU9250 Gyro LPF: %s", err))
+	div := 1000/mpu.sampleRate - 1
+	if div < 0 {
+		div = 0
+	} else if div > 255 {
+		div = 255
+	}
+	sampRate := byte(div)
+	// Default: Set Gyro LPF to half of sample rate; call SetGyroLPF afterwards to choose a different bandwidth.
+	lpf := byte(mpu.sampleRate >> 1)
+	if mpu.sampleRate > 511 {
+		lpf = 255
+	}
+	gyroLPF, accelLPF := lpf, lpf
+	if mpu.gyroLPF > 0 { // Keep the existing bandwidths when resetting
+		gyroLPF, accelLPF = byte(mpu.gyroLPF), byte(mpu.accelLPF)
+	}
+	if err := mpu.SetGyroLPF(gyroLPF); err != nil {
+		return fmt.Errorf("Error setting MPU9250 Gyro LPF: %w", err)
 	}
 
-	// Default: Set Accel LPF to half of sample rate
-	if err := mpu.SetAccelLPF(sampRate >> 1); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting MPU9250 Accel LPF: %s", err))
+	// Default: Set Accel LPF to half of sample rate; call SetAccelLPF afterwards to choose a different bandwidth.
+	// The MPU6050's accel shares the gyro's LPF.
+	if mpu.whoAmI != WHOAMI_MPU6050 {
+		if err := mpu.SetAccelLPF(accelLPF); err != nil {
+			return fmt.Errorf("Error setting MPU9250 Accel LPF: %w", err)
+		}
 	}
 
 	// Set sample rate to chosen
 	if err := mpu.SetSampleRate(sampRate); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting MPU9250 Sample Rate: %s", err))
+		return fmt.Errorf("Error setting MPU9250 Sample Rate: %w", err)
+	}
+	if r := mpu.EffectiveSampleRate(); math.Abs(r-float64(mpu.sampleRate)) > 0.03*float64(mpu.sampleRate) {
+		log.Printf("MPU9250 Warning: requested sample rate %dHz, chip is sampling at %.1fHz\n", mpu.sampleRate, r)
 	}
 
 	// Turn off FIFO buffer
 	if err := mpu.i2cWrite(MPUREG_FIFO_EN, 0x00); err != nil {
-		return nil, errors.New(fmt.Sprintf("MPU9250 Error: couldn't disable FIFO: %s", err))
+		return fmt.Errorf("MPU9250 Error: couldn't disable FIFO: %w", err)
 	}
 
 	// Turn off interrupts
 	if err := mpu.i2cWrite(MPUREG_INT_ENABLE, 0x00); err != nil {
-		return nil, errors.New(fmt.Sprintf("MPU9250 Error: couldn't disable interrupts: %s", err))
+		return fmt.Errorf("MPU9250 Error: couldn't disable interrupts: %w", err)
 	}
 
 	// Set up magnetometer
 	if mpu.enableMag {
-		if err := mpu.ReadMagCalibration(); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error reading calibration from magnetometer: %s", err))
+		if err := mpu.setupMag(); err != nil {
+			return err
 		}
+		time.Sleep(100 * time.Millisecond) // Make sure mag is ready
+	}
+
+	// Set clock source, normally PLL
+	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_1, mpu.clockSource); err != nil {
+		return fmt.Errorf("Error setting MPU9250 clock source: %w", err)
+	}
+	// Turn off all sensors -- Not sure if necessary, but it's in the InvenSense DMP driver
+	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_2, 0x63); err != nil {
+		return fmt.Errorf("Error turning off MPU9250 sensors: %w", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// Turn on all gyro, all accel
+	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_2, 0x00); err != nil {
+		return fmt.Errorf("Error turning on MPU9250 sensors: %w", err)
+	}
+	if err := mpu.waitDataReady(clockTimeout); err != nil {
+		log.Printf("MPU9250 Warning: %s, first readings may be bad\n", err)
+	}
 
-		// Set up AK8963 master mode, master clock and ES bit
-		if err := mpu.i2cWrite(MPUREG_I2C_MST_CTRL, 0x40); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+	if applyHWOffsets {
+		if err := mpu.ReadAccelBias(sensitivityAccel); err != nil {
+			return fmt.Errorf("Error reading MPU9250 accel bias: %w", err)
 		}
-		// Slave 0 reads from AK8963
-		if err := mpu.i2cWrite(MPUREG_I2C_SLV0_ADDR, BIT_I2C_READ|AK8963_I2C_ADDR); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+		if err := mpu.ReadGyroBias(sensitivityGyro); err != nil {
+			return fmt.Errorf("Error reading MPU9250 gyro bias: %w", err)
 		}
-		// Compass reads start at this register
-		if err := mpu.i2cWrite(MPUREG_I2C_SLV0_REG, AK8963_ST1); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+	}
+
+	// Usually we don't want the automatic gyro bias compensation - it pollutes the gyro in a non-inertial frame.
+	if err := mpu.EnableGyroBiasCal(false); err != nil {
+		return fmt.Errorf("Error disabling MPU9250 gyro bias compensation: %w", err)
+	}
+
+	return nil
+}
+
+// readSensors polls the gyro, accelerometer and magnetometer sensors as well as the die temperature.
+// Communication is via channels.
+func (mpu *MPU9250) readSensors() {
+	var (
+		g1, g2, g3, a1, a2, a3, m1, m2, m3, tmp   int16   // Current values
+		avg1, avg2, avg3, ava1, ava2, ava3, avtmp float64 // Accumulators for averages
+		avm1, avm2, avm3                          float64
+		rg1, rg2, rg3, ra1, ra2, ra3              int64 // Raw accumulators
+		rtmp                                      int64
+		n, nm                                     float64
+		gaError, magError                         error
+		t0, t, t0m, tm                            time.Time
+		tFirst                                    time.Time  // Time of first sample in current average
+		lo, hi                                    [6]float64 // Extreme gyro/accel values in current average
+		magSampleRate                             int
+		curdata                                   *MPUData
+		useFIFO                                   bool
+		tPrev                                     time.Time    // Time of the previous accel/gyro read trigger
+		magErrors                                 int          // Consecutive failed magnetometer reads
+		magReset                                  []busStep    // Remaining steps of a magnetometer reset under way
+		magResetDue                               time.Time    // When the next step of the reset may be taken
+		magResetReplies                           []chan error // ResetMag calls waiting on the reset
+		prevGA                                    [12]byte     // Previous raw accel and gyro registers
+		sameGA                                    int          // Consecutive gyro/accel samples identical to the previous
+	)
+
+	// The magnetometer is read on its own clock, no faster than the AK8963 can measure, so that fast gyro/accel
+	// reads aren't held up by it and only its fresh frames are averaged.
+	if mpu.sampleRate > AK8963_MAX_SAMPLE_RATE {
+		magSampleRate = AK8963_MAX_SAMPLE_RATE
+	} else {
+		magSampleRate = mpu.sampleRate
+	}
+
+	cC, cAvg, cBuf := mpu.cC, mpu.cAvg, mpu.cBuf
+
+	period := time.Duration(int(1000.0/float32(mpu.sampleRate)+0.5)) * time.Millisecond
+	clock := time.NewTicker(period)
+	//TODO westphae: use the clock to record actual time instead of a timer
+	defer clock.Stop()
+	tick := clock.C // Triggers accel/gyro reads, either the internal clock or the data ready interrupt
+
+	clockMag := time.NewTicker(time.Duration(int(1000.0/float32(magSampleRate)+0.5)) * time.Millisecond)
+	defer clockMag.Stop()
+	t0 = time.Now()
+	t0m = time.Now()
+
+	// finishMagReset ends a magnetometer reset, answering any ResetMag calls waiting on it.
+	finishMagReset := func(err error) {
+		if err != nil && len(magResetReplies) == 0 {
+			log.Println(err)
 		}
-		// Enable 8-byte reads on slave 0
-		if err := mpu.i2cWrite(MPUREG_I2C_SLV0_CTRL, BIT_SLAVE_EN|8); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+		for _, c := range magResetReplies {
+			c <- err
 		}
-		// Slave 1 can change AK8963 measurement mode
-		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_ADDR, AK8963_I2C_ADDR); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+		magReset, magResetReplies = nil, nil
+	}
+
+	makeMPUData := func() *MPUData {
+		mpu.mu.Lock()
+		defer mpu.mu.Unlock()
+		d := MPUData{
+			GAError: gaError, MagError: magError,
+			N: 1, NM: 1,
+			T: t, TM: tm, T0: t,
+			DT: time.Duration(0), DTM: time.Duration(0),
 		}
-		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_REG, AK8963_CNTL1); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+		mpu.correctGA(&d, g1, g2, g3, a1, a2, a3, tmp)
+		d.M1, d.M2, d.M3 = mpu.correctMag(m1, m2, m3)
+		if gaError != nil {
+			d.N = 0
 		}
-		// Enable 1-byte reads on slave 1
-		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_CTRL, BIT_SLAVE_EN|1); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+		if magError != nil {
+			d.NM = 0
 		}
-		// Set slave 1 data
-		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_DO, AKM_SINGLE_MEASUREMENT); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+		return &d
+	}
+
+	makeAvgMPUData := func() *MPUData {
+		mpu.mu.Lock()
+		defer mpu.mu.Unlock()
+		d := MPUData{}
+		if n > 0.5 {
+			d.G1 = avg1 / n
+			d.G2 = avg2 / n
+			d.G3 = avg3 / n
+			d.A1 = ava1 / n
+			d.A2 = ava2 / n
+			d.A3 = ava3 / n
+			if mpu.trimMean && n > 2.5 {
+				trim := func(sum float64, i int) float64 { return (sum - lo[i] - hi[i]) / (n - 2) }
+				d.G1, d.G2, d.G3 = trim(avg1, 0), trim(avg2, 1), trim(avg3, 2)
+				d.A1, d.A2, d.A3 = trim(ava1, 3), trim(ava2, 4), trim(ava3, 5)
+			}
+			d.Temp = (float64(avtmp)/n)/340 + 36.53
+			d.N = int(n + 0.5)
+			d.T = t
+			d.T0 = tFirst
+			d.DT = t.Sub(t0)
+		} else {
+			d.GAError = fmt.Errorf("%w: no new accel/gyro values", ErrNoData)
 		}
-		// Triggers slave 0 and 1 actions at each sample
-		if err := mpu.i2cWrite(MPUREG_I2C_MST_DELAY_CTRL, 0x03); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+		if nm > 0 {
+			d.M1 = avm1 / nm
+			d.M2 = avm2 / nm
+			d.M3 = avm3 / nm
+			d.NM = int(nm + 0.5)
+			d.TM = tm
+			d.DTM = t.Sub(t0m)
+		} else {
+			d.MagError = fmt.Errorf("%w: no new magnetometer values", ErrNoData)
 		}
+		return &d
+	}
 
-		// Set AK8963 sample rate to same as gyro/accel sample rate, up to max
-		var ak8963Rate byte
-		if mpu.sampleRate < AK8963_MAX_SAMPLE_RATE {
-			ak8963Rate = 0
-		} else {
-			ak8963Rate = byte(mpu.sampleRate/AK8963_MAX_SAMPLE_RATE - 1)
+	makeRawData := func() *rawData {
+		d := rawData{n: int(n + 0.5), g1: rg1, g2: rg2, g3: rg3, a1: ra1, a2: ra2, a3: ra3, t: rtmp}
+		if n < 0.5 {
+			d.err = fmt.Errorf("%w: no new accel/gyro values", ErrNoData)
 		}
+		return &d
+	}
 
-		// Not so sure of this one--I2C Slave 4??!
-		if err := mpu.i2cWrite(MPUREG_I2C_SLV4_CTRL, ak8963Rate); err != nil {
-			return nil, errors.New(fmt.Sprintf("Error setting up AK8963: %s", err))
+	// reset clears the accumulators whose values were just sent: those of the gyro/accel if ga, and those of the
+	// magnetometer if mag, so that an error from one sensor doesn't throw away the other's good samples.
+	reset := func(ga, mag bool) {
+		if ga {
+			avg1, avg2, avg3 = 0, 0, 0
+			ava1, ava2, ava3 = 0, 0, 0
+			rg1, rg2, rg3 = 0, 0, 0
+			ra1, ra2, ra3 = 0, 0, 0
+			avtmp, rtmp = 0, 0
+			n = 0
+			t0 = t
 		}
+		if mag {
+			avm1, avm2, avm3 = 0, 0, 0
+			nm = 0
+			t0m = tm
+		}
+		mpu.mu.Lock()
+		mpu.stats = Stats{}
+		mpu.mu.Unlock()
+	}
 
-		time.Sleep(100 * time.Millisecond) // Make sure mag is ready
+	accumulate := func() {
+		curdata = makeMPUData()
+		mpu.mu.Lock()
+		mpu.stats.Samples++
+		mpu.mu.Unlock()
+		v := [6]float64{curdata.G1, curdata.G2, curdata.G3, curdata.A1, curdata.A2, curdata.A3}
+		if n < 0.5 {
+			tFirst = t
+			lo, hi = v, v
+		}
+		for i := range v {
+			lo[i], hi[i] = math.Min(lo[i], v[i]), math.Max(hi[i], v[i])
+		}
+		// Update accumulated values and increment count of gyro/accel readings
+		// Gyro/accel values are accumulated already scaled since their ranges can change between averages.
+		avg1 += curdata.G1
+		avg2 += curdata.G2
+		avg3 += curdata.G3
+		ava1 += curdata.A1
+		ava2 += curdata.A2
+		ava3 += curdata.A3
+		avtmp += float64(tmp)
+		rg1 += int64(g1)
+		rg2 += int64(g2)
+		rg3 += int64(g3)
+		ra1 += int64(a1)
+		ra2 += int64(a2)
+		ra3 += int64(a3)
+		rtmp += int64(tmp)
+		n++
+		select {
+		case cBuf <- curdata: // We update the buffer every time we read a new value.
+		default: // If buffer is full, remove oldest value and put in newest.
+			<-cBuf
+			cBuf <- curdata
+		}
 	}
 
-	// Set clock source to PLL
-	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_1, INV_CLK_PLL); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting up MPU9250: %s", err))
+	accumulateMag := func() {
+		mpu.mu.Lock()
+		c1, c2, c3 := mpu.correctMag(m1, m2, m3)
+		mpu.stats.MagSamples++
+		mpu.mu.Unlock()
+		// Update values and increment count of magnetometer readings
+		avm1 += c1
+		avm2 += c2
+		avm3 += c3
+		nm++
 	}
-	// Turn off all sensors -- Not sure if necessary, but it's in the InvenSense DMP driver
-	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_2, 0x63); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting up MPU9250: %s", err))
+
+	for {
+		avg := makeAvgMPUData()
+		var cAvgNew chan *MPUData // Disabled until there are new values
+		if n > 0.5 {
+			cAvgNew = mpu.cAvgNew
+		}
+
+		select {
+		// Tick times carry a monotonic clock reading, so DT and T.Sub(T0) are unaffected by wall clock changes.
+		case t = <-tick: // Read accel/gyro data:
+			// Ticks that came while the previous read was still going on were dropped.
+			if !tPrev.IsZero() {
+				if missed := int((t.Sub(tPrev)+period/2)/period) - 1; missed > 0 {
+					mpu.mu.Lock()
+					mpu.stats.Overruns += missed
+					mpu.mu.Unlock()
+				}
+			}
+			tPrev = t
+			if useFIFO {
+				// Temperature isn't written to the FIFO, so read it directly.
+				if tmp, gaError = mpu.i2cRead2(MPUREG_TEMP_OUT_H); gaError != nil {
+					mpu.reportError(&SensorError{"temperature", gaError})
+				}
+				gaError = mpu.readFIFO(func(fa1, fa2, fa3, fg1, fg2, fg3 int16) {
+					a1, a2, a3, g1, g2, g3 = fa1, fa2, fa3, fg1, fg2, fg3
+					accumulate()
+				})
+				if gaError != nil {
+					mpu.reportError(&SensorError{"FIFO", gaError})
+				}
+				continue
+			}
+			// Accel, temp and gyro registers are contiguous, so read them all at once from the same sample.
+			var buf []byte
+			if buf, gaError = mpu.i2cReadBlock(MPUREG_ACCEL_XOUT_H, 14); gaError != nil {
+				mpu.reportError(&SensorError{"gyro/accel", gaError})
+				curdata = makeMPUData() // Report the error, but don't average in the stale values
+				continue
+			}
+			// A half-hung bus returns the same words over and over, which would look like a perfectly still sensor.
+			var ga [12]byte
+			copy(ga[:6], buf[0:6])
+			copy(ga[6:], buf[8:14])
+			if ga == prevGA {
+				sameGA++
+			} else {
+				prevGA, sameGA = ga, 0
+			}
+			if frozen := mpu.frozen(sameGA + 1); frozen > 0 {
+				gaError = fmt.Errorf("%w: %d identical gyro/accel samples", ErrFrozen, frozen)
+				mpu.reportError(&SensorError{"gyro/accel", gaError})
+				curdata = makeMPUData() // Report the error, but don't average in the stuck values
+				continue
+			}
+			a1, a2, a3 = toInt16(buf[0:]), toInt16(buf[2:]), toInt16(buf[4:])
+			tmp = toInt16(buf[6:])
+			g1, g2, g3 = toInt16(buf[8:]), toInt16(buf[10:]), toInt16(buf[12:])
+			accumulate()
+		case useFIFO = <-mpu.cFIFO: // Switch between FIFO and register polling
+		case c := <-mpu.cTick: // Switch between data ready interrupt and internal clock
+			tPrev = time.Time{}
+			if c == nil {
+				tick = clock.C
+			} else {
+				tick = c
+			}
+		case tm = <-clockMag.C: // Read magnetometer data, or take the next step of a reset instead
+			if magReset != nil {
+				// The gyro and accel are read between the steps, but the magnetometer isn't until the reset is done.
+				if tm.Before(magResetDue) {
+					continue
+				}
+				if len(magReset) == 0 {
+					finishMagReset(nil)
+					continue
+				}
+				step := magReset[0]
+				magReset = magReset[1:]
+				if err := step.do(); err != nil {
+					finishMagReset(err)
+				}
+				magResetDue = tm.Add(step.wait)
+			} else if mpu.enableMag {
+				// Slave 0 reads ST1..ST2 from the AK8963 each sample; reading ST2 clears its data ready latch.
+				var (
+					buf []byte
+					ok  bool
+				)
+				if buf, magError = mpu.i2cReadBlock(MPUREG_EXT_SENS_DATA_00, 8); magError == nil {
+					m1, m2, m3, ok, magError = decodeMag(buf)
+				}
+				if magError != nil {
+					mpu.reportError(&SensorError{"magnetometer", magError})
+					if magErrors++; mpu.recoverMag(magErrors) {
+						log.Printf("MPU9250 Warning: resetting magnetometer after %d errors\n", magErrors)
+						magErrors = 0
+						magReset, magResetDue = mpu.magResetSteps(), tm
+					}
+				}
+				if ok {
+					magErrors = 0
+					accumulateMag()
+				}
+			}
+		case cC <- curdata: // Send the latest values
+		case cAvg <- avg: // Send the averages
+			reset(true, true)
+		case cAvgNew <- avg: // Send the averages to ReadContext
+			reset(true, true)
+		case mpu.cRaw <- makeRawData(): // Send the raw accumulated counts, which don't include the magnetometer's
+			reset(true, false)
+		case c := <-mpu.cNow: // Take a reading outside of the averages
+			c <- mpu.readNow()
+		case c := <-mpu.cMagReset: // Reset the magnetometer, unless a reset is already under way
+			if magReset == nil {
+				magReset, magResetDue = mpu.magResetSteps(), tm
+			}
+			magResetReplies = append(magResetReplies, c)
+		case <-mpu.cClose: // Stop the goroutine, ease up on the CPU
+			finishMagReset(ErrNotRunning)
+			return
+		}
 	}
-	time.Sleep(100 * time.Millisecond)
-	// Turn on all gyro, all accel
-	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_2, 0x00); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error setting up MPU9250: %s", err))
+}
+
+// setupMag reads the AK8963 sensitivity adjustment and sets up the MPU9250's I2C master to read the AK8963 every
+// sample: slave 0 reads its measurements and slave 1 triggers each single measurement.
+func (mpu *MPU9250) setupMag() error {
+	if err := mpu.ReadMagCalibration(); err != nil {
+		return fmt.Errorf("Error reading calibration from magnetometer: %w", err)
 	}
 
-	if applyHWOffsets {
-		if err := mpu.ReadAccelBias(sensitivityAccel); err != nil {
-			return nil, err
+	// Set up AK8963 master mode, master clock and ES bit
+	if err := mpu.i2cWrite(MPUREG_I2C_MST_CTRL, 0x40); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	// Slave 0 reads from AK8963
+	if err := mpu.i2cWrite(MPUREG_I2C_SLV0_ADDR, BIT_I2C_READ|AK8963_I2C_ADDR); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	// Compass reads start at this register
+	if err := mpu.i2cWrite(MPUREG_I2C_SLV0_REG, AK8963_ST1); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	// Enable 8-byte reads on slave 0
+	if err := mpu.i2cWrite(MPUREG_I2C_SLV0_CTRL, BIT_SLAVE_EN|8); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	// Slave 1 can change AK8963 measurement mode
+	if err := mpu.i2cWrite(MPUREG_I2C_SLV1_ADDR, AK8963_I2C_ADDR); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	if err := mpu.i2cWrite(MPUREG_I2C_SLV1_REG, AK8963_CNTL1); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	// Enable 1-byte reads on slave 1
+	if err := mpu.i2cWrite(MPUREG_I2C_SLV1_CTRL, BIT_SLAVE_EN|1); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	// Set slave 1 data
+	if err := mpu.i2cWrite(MPUREG_I2C_SLV1_DO, mpu.magMode(AKM_SINGLE_MEASUREMENT)); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	// Triggers slave 0 and 1 actions at each sample
+	if err := mpu.i2cWrite(MPUREG_I2C_MST_DELAY_CTRL, 0x03); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+
+	// Set AK8963 sample rate to same as gyro/accel sample rate, up to max
+	var ak8963Rate byte
+	if mpu.sampleRate < AK8963_MAX_SAMPLE_RATE {
+		ak8963Rate = 0
+	} else {
+		ak8963Rate = byte(mpu.sampleRate/AK8963_MAX_SAMPLE_RATE - 1)
+	}
+
+	// Not so sure of this one--I2C Slave 4??!
+	if err := mpu.i2cWrite(MPUREG_I2C_SLV4_CTRL, ak8963Rate); err != nil {
+		return fmt.Errorf("Error setting up AK8963: %w", err)
+	}
+	return nil
+}
+
+/*
+ResetMag recovers a locked-up AK8963 magnetometer without disturbing the gyro and accel: it soft resets the AK8963
+through CNTL2, re-reads its sensitivity adjustment, sets up the MPU9250's I2C master to read it again, as when
+the MPU9250 was created, and puts it back in continuous mode if it was in use.  The background reader takes each
+step between its gyro and accel reads, so the two never interleave on the bus; magnetometer readings are unavailable
+meanwhile, for a few hundred ms.  ResetMag returns once the reset is done.
+*/
+func (mpu *MPU9250) ResetMag() error {
+	if !mpu.enableMag {
+		return errors.New("MPU9250 Error: magnetometer is not enabled")
+	}
+	c := make(chan error, 1)
+	mpu.resetMu.Lock()
+	running := mpu.running
+	if running {
+		mpu.cMagReset <- c
+	}
+	mpu.resetMu.Unlock()
+	if !running {
+		return ErrNotRunning
+	}
+	return <-c
+}
+
+// magResetSteps returns the steps of ResetMag for the background reader to take.
+func (mpu *MPU9250) magResetSteps() []busStep {
+	mpu.mu.Lock()
+	continuous := mpu.magContinuous
+	mpu.mu.Unlock()
+
+	steps := []busStep{
+		{func() error {
+			// Slave 1 writes CNTL2 instead of CNTL1 for a couple of samples.
+			if err := mpu.i2cWrite(MPUREG_I2C_SLV1_CTRL, BIT_SLAVE_EN|1); err != nil {
+				return fmt.Errorf("MPU9250 Error: couldn't reset AK8963: %w", err)
+			}
+			if err := mpu.i2cWrite(MPUREG_I2C_SLV1_REG, AK8963_CNTL2); err != nil {
+				return fmt.Errorf("MPU9250 Error: couldn't reset AK8963: %w", err)
+			}
+			if err := mpu.i2cWrite(MPUREG_I2C_SLV1_DO, AKM_SOFT_RESET); err != nil {
+				return fmt.Errorf("MPU9250 Error: couldn't reset AK8963: %w", err)
+			}
+			return nil
+		}, mpu.magModeWait()},
+		{func() error {
+			if err := mpu.setupMag(); err != nil {
+				return fmt.Errorf("MPU9250 Error: couldn't reset AK8963: %w", err)
+			}
+			return nil
+		}, 100 * time.Millisecond}, // Make sure mag is ready
+	}
+	if continuous {
+		steps = append(steps, mpu.magModeSteps(true)...)
+	}
+	return steps
+}
+
+// SetMagRecovery makes the background reader reset the magnetometer by itself, as ResetMag, whenever n consecutive
+// magnetometer reads fail.  n of 0, the default, turns this off.
+func (mpu *MPU9250) SetMagRecovery(n int) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.magRecovery = n
+}
+
+// recoverMag returns whether n consecutive magnetometer errors call for a reset.
+func (mpu *MPU9250) recoverMag(n int) bool {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.magRecovery > 0 && n >= mpu.magRecovery
+}
+
+// DefaultFrozenSamples is a conservative number of identical gyro/accel samples for SetFrozenDetection:
+// even a motionless sensor's noise changes some bit of its six axes far sooner.
+const DefaultFrozenSamples = 200
+
+// SetFrozenDetection makes the background reader report the gyro/accel as frozen, with an ErrFrozen error,
+// when n consecutive samples of all six axes are byte-for-byte identical, as when the bus half-hangs and keeps
+// returning the same words.  The frozen samples aren't averaged.  n of 0, the default, turns this off;
+// DefaultFrozenSamples is a safe choice.
+func (mpu *MPU9250) SetFrozenDetection(n int) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.frozenSamples = n
+}
+
+// frozen returns n if n identical gyro/accel samples mean the sensor is frozen, or else 0.
+func (mpu *MPU9250) frozen(n int) int {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if mpu.frozenSamples <= 0 || n < mpu.frozenSamples {
+		return 0
+	}
+	return n
+}
+
+// CloseMPU stops the driver from reading the MPU.  Reset starts it going again.
+func (mpu *MPU9250) CloseMPU() {
+	mpu.resetMu.Lock()
+	defer mpu.resetMu.Unlock()
+	// Nothing to do bitwise for the 9250?
+	if mpu.running {
+		mpu.cClose <- true
+		mpu.running = false
+	}
+}
+
+/*
+Reset stops reading the MPU9250, re-runs its initialization sequence and starts reading it again, for example to
+recover from a bus fault.  The full-scale ranges, sample rate, low pass filters, clock source and software
+calibrations are preserved, as are the C, CAvg and CBuf channels.  The chip's hardware offset registers are cleared
+and the FIFO, data ready interrupt, wake on motion and continuous magnetometer modes are turned off, so any of
+these in use must be set up again.
+The driver is restarted even if the initialization fails, so that errors are reported and Reset can be retried.
+*/
+func (mpu *MPU9250) Reset() (err error) {
+	mpu.resetMu.Lock()
+	defer mpu.resetMu.Unlock()
+
+	if mpu.running {
+		if mpu.intPin != nil {
+			if errInt := mpu.disableDataReadyInterrupt(); errInt != nil {
+				log.Printf("MPU9250 Warning: %s\n", errInt)
+			}
 		}
-		if err := mpu.ReadGyroBias(sensitivityGyro); err != nil {
-			return nil, err
+		mpu.cClose <- true
+		mpu.running = false
+	}
+	mpu.womSaved = nil
+
+	mpu.mu.Lock()
+	sensGyro, sensAccel := mpu.sensGyro, mpu.sensAccel
+	mpu.magContinuous = false
+	mpu.mu.Unlock()
+	if err = mpu.init(sensGyro, sensAccel, false); err != nil {
+		err = fmt.Errorf("MPU9250 Error: couldn't reset: %w", err)
+	}
+
+	mpu.running = true
+	go mpu.readSensors()
+	return
+}
+
+// Errors returns a channel on which the background reader publishes a *SensorError for each failed sensor read.
+// Errors are dropped if the channel isn't drained; until Errors is first called, they are logged instead.
+func (mpu *MPU9250) Errors() <-chan error {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if mpu.cErr == nil {
+		mpu.cErr = make(chan error, errBufSize)
+	}
+	return mpu.cErr
+}
+
+// Stats returns what the background reader has done since the averages were last read.
+func (mpu *MPU9250) Stats() Stats {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	s := mpu.stats
+	s.Errors = make(map[string]int, len(mpu.stats.Errors))
+	for k, v := range mpu.stats.Errors {
+		s.Errors[k] = v
+	}
+	return s
+}
+
+// reportError sends err to the Errors channel without blocking, or logs it if no channel has been requested.
+func (mpu *MPU9250) reportError(err error) {
+	mpu.mu.Lock()
+	c := mpu.cErr
+	if e, ok := err.(*SensorError); ok {
+		if mpu.stats.Errors == nil {
+			mpu.stats.Errors = make(map[string]int)
 		}
+		mpu.stats.Errors[e.Sensor]++
+	}
+	mpu.mu.Unlock()
+	if c == nil {
+		log.Println(err)
+		return
+	}
+	select {
+	case c <- err:
+	default:
 	}
+}
 
-	// Usually we don't want the automatic gyro bias compensation - it pollutes the gyro in a non-inertial frame.
-	if err := mpu.EnableGyroBiasCal(false); err != nil {
-		return nil, err
+/*
+ReadImmediate reads the accel, gyro and temperature registers, and the magnetometer if enabled, right now and returns
+the single calibrated sample rather than an average, e.g. to see the current pose during an interactive calibration.
+The background averages are unaffected.  The read is made by the background reader between its own reads, so the
+two never interleave on the bus.  The magnetometer values are its latest measurement, which may be up to one
+magnetometer sample old.  The returned error is the sample's GAError.
+*/
+func (mpu *MPU9250) ReadImmediate() (*MPUData, error) {
+	c := make(chan *MPUData, 1)
+	mpu.resetMu.Lock()
+	running := mpu.running
+	if running {
+		mpu.cNow <- c
+	}
+	mpu.resetMu.Unlock()
+	if !running {
+		return nil, ErrNotRunning
 	}
+	d := <-c
+	return d, d.GAError
+}
 
-	go mpu.readSensors()
+// readNow takes the reading for ReadImmediate.  It is only called by readSensors, so as not to interleave with it.
+func (mpu *MPU9250) readNow() *MPUData {
+	d := &MPUData{N: 1, NM: 1}
+	d.T = time.Now()
+	d.T0, d.TM = d.T, d.T
 
-	// Give the IMU time to fully initialize and then clear out any bad values from the averages.
-	time.Sleep(500 * time.Millisecond) // Make sure it's ready
-	<-mpu.CAvg
+	buf, err := mpu.i2cReadBlock(MPUREG_ACCEL_XOUT_H, 14)
+	if err != nil {
+		d.GAError, d.N = err, 0
+	}
+	var mbuf []byte
+	if !mpu.enableMag {
+		d.MagError, d.NM = errors.New("MPU9250 Error: magnetometer is not enabled"), 0
+	} else if mbuf, err = mpu.i2cReadBlock(MPUREG_EXT_SENS_DATA_00, 8); err != nil {
+		d.MagError, d.NM = err, 0
+	}
 
-	return mpu, nil
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if d.GAError == nil {
+		mpu.correctGA(d, toInt16(buf[8:]), toInt16(buf[10:]), toInt16(buf[12:]),
+			toInt16(buf[0:]), toInt16(buf[2:]), toInt16(buf[4:]), toInt16(buf[6:]))
+	}
+	if d.MagError == nil {
+		// The measurement registers hold the latest measurement even once the background reader has consumed it.
+		mbuf[0] |= AKM_DATA_READY
+		m1, m2, m3, _, err := decodeMag(mbuf)
+		if err != nil {
+			d.MagError, d.NM = err, 0
+		} else {
+			d.M1, d.M2, d.M3 = mpu.correctMag(m1, m2, m3)
+		}
+	}
+	return d
 }
 
-// readSensors polls the gyro, accelerometer and magnetometer sensors as well as the die temperature.
-// Communication is via channels.
-func (mpu *MPU9250) readSensors() {
-	var (
-		g1, g2, g3, a1, a2, a3, m1, m2, m3, m4, tmp int16   // Current values
-		avg1, avg2, avg3, ava1, ava2, ava3, avtmp   float64 // Accumulators for averages
-		avm1, avm2, avm3                            int32
-		n, nm                                       float64
-		gaError, magError                           error
-		t0, t, t0m, tm                              time.Time
-		magSampleRate                               int
-		curdata                                     *MPUData
-	)
+// ReadContext returns the average sensor values since the averages were last read, as from CAvg, but first waits
+// until at least one new accel/gyro sample has been taken.  If ctx is done first, it returns ctx's error.
+func (mpu *MPU9250) ReadContext(ctx context.Context) (*MPUData, error) {
+	select {
+	case d := <-mpu.cAvgNew:
+		return d, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ReadStruct returns the average sensor values since CAvg was last read, as from CAvg, in a Reading.
+func (mpu *MPU9250) ReadStruct() Reading {
+	d := <-mpu.CAvg
+	return Reading{
+		T:      d.T,
+		Gyro:   [3]float64{d.G1, d.G2, d.G3},
+		Accel:  [3]float64{d.A1, d.A2, d.A3},
+		Mag:    [3]float64{d.M1, d.M2, d.M3},
+		GAErr:  d.GAError,
+		MagErr: d.MagError,
+	}
+}
+
+// ReadRaw returns the raw gyro and accel counts summed over the n samples taken since the accumulators were last reset,
+// along with the summed raw temperature t, without scaling or removing any software bias.
+// Like reading CAvg, it resets the gyro/accel accumulators, but it leaves the magnetometer's for CAvg.
+// The sums are 64-bit, so they can't overflow however long it is between reads; reading at least every few seconds
+// just keeps the average meaningful.
+func (mpu *MPU9250) ReadRaw() (n int, g1, g2, g3, a1, a2, a3 int64, t int64, err error) {
+	d := <-mpu.cRaw
+	return d.n, d.g1, d.g2, d.g3, d.a1, d.a2, d.a3, d.t, d.err
+}
+
+// EnableMagContinuous switches the AK8963 magnetometer between continuous measurement mode 2 (100Hz),
+// in which the MPU9250 just streams each new measurement, and the default of triggering a single measurement
+// every sample.  Continuous mode gives steadier magnetometer timing.
+func (mpu *MPU9250) EnableMagContinuous(enable bool) error {
+	if !mpu.enableMag {
+		return errors.New("MPU9250 Error: magnetometer is not enabled")
+	}
+	return mpu.setMagContinuous(enable)
+}
+
+// busStep is one step of a register sequence that must then wait before the next, as when slave 1 passes a mode
+// change on to the AK8963.  The background reader takes such steps between its reads rather than sleeping.
+type busStep struct {
+	do   func() error
+	wait time.Duration
+}
+
+// runSteps takes the steps in turn, sleeping between them.
+func runSteps(steps []busStep) error {
+	for _, s := range steps {
+		if err := s.do(); err != nil {
+			return err
+		}
+		time.Sleep(s.wait)
+	}
+	return nil
+}
+
+// magModeWait is how long slave 1 takes to pass a write on to the AK8963: it writes each sample, so a couple of them.
+func (mpu *MPU9250) magModeWait() time.Duration {
+	return time.Duration(2000/mpu.sampleRate+1) * time.Millisecond
+}
+
+// setMagContinuous switches the AK8963 between continuous and single measurement modes for EnableMagContinuous,
+// remembering the mode so that it can be restored after wake on motion or a magnetometer reset.
+func (mpu *MPU9250) setMagContinuous(enable bool) error {
+	return runSteps(mpu.magModeSteps(enable))
+}
+
+// magModeSteps returns the steps of setMagContinuous.
+func (mpu *MPU9250) magModeSteps(enable bool) []busStep {
+	steps := []busStep{{func() error {
+		// The AK8963 must pass through power down mode when changing modes.
+		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_CTRL, BIT_SLAVE_EN|1); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't set AK8963 mode: %w", err)
+		}
+		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_DO, AKM_POWER_DOWN); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't set AK8963 mode: %w", err)
+		}
+		return nil
+	}, mpu.magModeWait()}}
+
+	if !enable {
+		return append(steps, busStep{func() error {
+			mpu.mu.Lock()
+			mpu.magContinuous = false
+			mpu.mu.Unlock()
+			if err := mpu.i2cWrite(MPUREG_I2C_SLV1_DO, mpu.magMode(AKM_SINGLE_MEASUREMENT)); err != nil {
+				return fmt.Errorf("MPU9250 Error: couldn't set AK8963 mode: %w", err)
+			}
+			return nil
+		}, 0})
+	}
+
+	return append(steps, busStep{func() error {
+		mpu.mu.Lock()
+		mpu.magContinuous = true
+		mpu.mu.Unlock()
+		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_DO, mpu.magMode(AKM_CONTINUOUS_100HZ)); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't set AK8963 mode: %w", err)
+		}
+		return nil
+	}, mpu.magModeWait()}, busStep{func() error {
+		// Stop rewriting CNTL1, which would restart the measurement each sample.
+		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_CTRL, 0); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't set AK8963 mode: %w", err)
+		}
+		return nil
+	}, 0})
+}
+
+// EnableTrimmedMean sets whether the averages sent on CAvg are trimmed means, dropping the highest and lowest value
+// of each gyro and accel axis before averaging, rather than plain means.  This rejects a single glitchy reading or
+// mechanical tap per averaging window at no cost in latency or memory, but each average then uses two fewer samples,
+// slightly increasing its noise, and it doesn't help if several outliers occur in the same window.
+// Averages of fewer than three samples are never trimmed.
+func (mpu *MPU9250) EnableTrimmedMean(enable bool) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.trimMean = enable
+}
 
-	acRegMap := map[*int16]byte{
-		&g1: MPUREG_GYRO_XOUT_H, &g2: MPUREG_GYRO_YOUT_H, &g3: MPUREG_GYRO_ZOUT_H,
-		&a1: MPUREG_ACCEL_XOUT_H, &a2: MPUREG_ACCEL_YOUT_H, &a3: MPUREG_ACCEL_ZOUT_H,
-		&tmp: MPUREG_TEMP_OUT_H,
+// EnableFIFO switches the driver between reading the accel/gyro values from the hardware FIFO buffer
+// and polling the individual sensor registers.  Using the FIFO, all samples taken since the last read are
+// transferred in a single bulk read, which greatly reduces I2C traffic and allows for higher sample rates
+// without losing samples.
+// It returns ErrNotRunning if the driver has been closed.
+func (mpu *MPU9250) EnableFIFO(enable bool) error {
+	mpu.resetMu.Lock()
+	defer mpu.resetMu.Unlock()
+	if !mpu.running {
+		return ErrNotRunning
 	}
-	magRegMap := map[*int16]byte{
-		&m1: MPUREG_EXT_SENS_DATA_00, &m2: MPUREG_EXT_SENS_DATA_02, &m3: MPUREG_EXT_SENS_DATA_04, &m4: MPUREG_EXT_SENS_DATA_06,
+
+	userCtrl, err := mpu.i2cRead(MPUREG_USER_CTRL)
+	if err != nil {
+		return fmt.Errorf("MPU9250 Error: couldn't read USER_CTRL: %w", err)
 	}
 
-	if mpu.sampleRate > 100 {
-		magSampleRate = 100
+	if enable {
+		if err := mpu.i2cWrite(MPUREG_USER_CTRL, userCtrl|BIT_FIFO_RST); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't reset FIFO: %w", err)
+		}
+		if err := mpu.i2cWrite(MPUREG_FIFO_EN, BITS_FIFO_ACCEL|BITS_FIFO_GYRO); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't configure FIFO: %w", err)
+		}
+		if err := mpu.i2cWrite(MPUREG_USER_CTRL, userCtrl|BIT_FIFO_EN); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't enable FIFO: %w", err)
+		}
 	} else {
-		magSampleRate = mpu.sampleRate
+		if err := mpu.i2cWrite(MPUREG_FIFO_EN, 0x00); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't disable FIFO: %w", err)
+		}
+		if err := mpu.i2cWrite(MPUREG_USER_CTRL, userCtrl & ^byte(BIT_FIFO_EN)); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't disable FIFO: %w", err)
+		}
+	}
+
+	mpu.cFIFO <- enable
+	return nil
+}
+
+// EnableDataReadyInterrupt configures the MPU9250 to pulse its INT pin whenever a new accel/gyro sample is ready
+// and watches the GPIO pin identified by key (as understood by embd.NewDigitalPin, e.g. 17 or "GPIO_17") to trigger
+// the sensor reads, rather than the internal clock.  This keeps the reads in step with the sensor's own sampling,
+// so that samples are neither read twice nor missed.
+// If no interrupt pin is used, the driver falls back to polling on its internal clock.
+// It returns ErrNotRunning if the driver has been closed.
+func (mpu *MPU9250) EnableDataReadyInterrupt(key interface{}) error {
+	mpu.resetMu.Lock()
+	defer mpu.resetMu.Unlock()
+	if !mpu.running {
+		return ErrNotRunning
+	}
+	if mpu.intPin != nil {
+		return errors.New("MPU9250 Error: data ready interrupt already enabled")
+	}
+
+	pin, err := embd.NewDigitalPin(key)
+	if err != nil {
+		return fmt.Errorf("MPU9250 Error: couldn't open interrupt pin %v: %w", key, err)
+	}
+	if err := pin.SetDirection(embd.In); err != nil {
+		pin.Close()
+		return fmt.Errorf("MPU9250 Error: couldn't set interrupt pin direction: %w", err)
+	}
+
+	// Interrupt is active high, push-pull, 50us pulse, cleared by any read
+	if err := mpu.i2cWrite(MPUREG_INT_PIN_CFG, BIT_INT_ANYRD_2CLEAR); err != nil {
+		pin.Close()
+		return fmt.Errorf("MPU9250 Error: couldn't configure interrupt pin: %w", err)
+	}
+	if err := mpu.i2cWrite(MPUREG_INT_ENABLE, BIT_RAW_RDY_EN); err != nil {
+		pin.Close()
+		return fmt.Errorf("MPU9250 Error: couldn't enable data ready interrupt: %w", err)
+	}
+
+	cInt := make(chan time.Time, 1)
+	err = pin.Watch(embd.EdgeRising, func(embd.DigitalPin) {
+		select {
+		case cInt <- time.Now():
+		default: // Previous sample hasn't been read yet
+		}
+	})
+	if err != nil {
+		mpu.i2cWrite(MPUREG_INT_ENABLE, 0x00)
+		pin.Close()
+		return fmt.Errorf("MPU9250 Error: couldn't watch interrupt pin: %w", err)
+	}
+
+	mpu.intPin = pin
+	mpu.cTick <- cInt
+	return nil
+}
+
+// DisableDataReadyInterrupt stops using the MPU9250 INT pin to trigger sensor reads
+// and reverts to polling on the internal clock.
+// It returns ErrNotRunning if the driver has been closed.
+func (mpu *MPU9250) DisableDataReadyInterrupt() error {
+	mpu.resetMu.Lock()
+	defer mpu.resetMu.Unlock()
+	if !mpu.running {
+		return ErrNotRunning
+	}
+	return mpu.disableDataReadyInterrupt()
+}
+
+// disableDataReadyInterrupt does the work of DisableDataReadyInterrupt for a running reader, with resetMu held.
+func (mpu *MPU9250) disableDataReadyInterrupt() error {
+	if mpu.intPin == nil {
+		return nil
+	}
+
+	mpu.cTick <- nil
+
+	if err := mpu.i2cWrite(MPUREG_INT_ENABLE, 0x00); err != nil {
+		return fmt.Errorf("MPU9250 Error: couldn't disable interrupts: %w", err)
+	}
+	if err := mpu.intPin.StopWatching(); err != nil {
+		return fmt.Errorf("MPU9250 Error: couldn't stop watching interrupt pin: %w", err)
 	}
+	err := mpu.intPin.Close()
+	mpu.intPin = nil
+	return err
+}
 
-	cC := make(chan *MPUData)
-	defer close(cC)
-	mpu.C = cC
-	cAvg := make(chan *MPUData)
-	defer close(cAvg)
-	mpu.CAvg = cAvg
-	cBuf := make(chan *MPUData, bufSize)
-	defer close(cBuf)
-	mpu.CBuf = cBuf
-	mpu.cClose = make(chan bool)
-	defer close(mpu.cClose)
-
-	clock := time.NewTicker(time.Duration(int(1000.0/float32(mpu.sampleRate)+0.5)) * time.Millisecond)
-	//TODO westphae: use the clock to record actual time instead of a timer
-	defer clock.Stop()
+// womRegs are the registers changed by EnableWakeOnMotion, in the order they must be restored.
+var womRegs = []byte{MPUREG_PWR_MGMT_1, MPUREG_PWR_MGMT_2, MPUREG_ACCEL_CONFIG_2, MPUREG_MOT_DETECT_CTRL, MPUREG_INT_ENABLE}
 
-	clockMag := time.NewTicker(time.Duration(int(1000.0/float32(magSampleRate)+0.5)) * time.Millisecond)
-	t0 = time.Now()
-	t0m = time.Now()
+/*
+EnableWakeOnMotion puts the MPU9250 into a low-power, accelerometer-only mode in which it raises an interrupt
+on its INT pin only when the acceleration changes by more than threshold on any axis.
+threshold is in units of 4mg/LSB, so it covers 0 to 1020mg.
+rate is the low-power accelerometer sample rate, as written to LP_ACCEL_ODR: 0 for 0.24Hz, doubling with each step
+up to 11 (LP_ACCEL_ODR_MAX) for 500Hz.
+The gyro and magnetometer are put to sleep.  Polling of the sensors is suspended, unless a data ready interrupt
+pin has been set up, in which case the sensors are read each time motion is detected.
+Call DisableWakeOnMotion to restore normal sampling.
+It returns ErrNotRunning if the driver has been closed, and ErrInvalidSetting on the MPU6050, which lacks LP_ACCEL_ODR.
+*/
+func (mpu *MPU9250) EnableWakeOnMotion(threshold byte, rate byte) error {
+	mpu.resetMu.Lock()
+	defer mpu.resetMu.Unlock()
+	if !mpu.running {
+		return ErrNotRunning
+	}
+	if mpu.womSaved != nil {
+		return errors.New("MPU9250 Error: wake on motion already enabled")
+	}
+	if mpu.whoAmI == WHOAMI_MPU6050 {
+		return fmt.Errorf("%w: wake on motion isn't supported on the MPU6050", ErrInvalidSetting)
+	}
+	if rate > LP_ACCEL_ODR_MAX {
+		return fmt.Errorf("%w: %d is not a valid low-power accel rate", ErrInvalidSetting, rate)
+	}
 
-	makeMPUData := func() *MPUData {
-		d := MPUData{
-			G1:      (float64(g1) - mpu.g01) * mpu.scaleGyro,
-			G2:      (float64(g2) - mpu.g02) * mpu.scaleGyro,
-			G3:      (float64(g3) - mpu.g03) * mpu.scaleGyro,
-			A1:      (float64(a1) - mpu.a01) * mpu.scaleAccel,
-			A2:      (float64(a2) - mpu.a02) * mpu.scaleAccel,
-			A3:      (float64(a3) - mpu.a03) * mpu.scaleAccel,
-			M1:      float64(m1) * mpu.mcal1,
-			M2:      float64(m2) * mpu.mcal2,
-			M3:      float64(m3) * mpu.mcal3,
-			Temp:    float64(tmp)/340 + 36.53,
-			GAError: gaError, MagError: magError,
-			N: 1, NM: 1,
-			T: t, TM: tm,
-			DT: time.Duration(0), DTM: time.Duration(0),
+	saved := make(map[byte]byte)
+	for _, reg := range womRegs {
+		v, err := mpu.i2cRead(reg)
+		if err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't save register %X: %w", reg, err)
 		}
-		if gaError != nil {
-			d.N = 0
+		saved[reg] = v
+	}
+
+	if mpu.enableMag { // Slave 1 writes this to AK8963 CNTL1 every sample, once enabled again if in continuous mode
+		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_CTRL, BIT_SLAVE_EN|1); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't power down magnetometer: %w", err)
 		}
-		if magError != nil {
-			d.NM = 0
+		if err := mpu.i2cWrite(MPUREG_I2C_SLV1_DO, AKM_POWER_DOWN); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't power down magnetometer: %w", err)
 		}
-		return &d
 	}
 
-	makeAvgMPUData := func() *MPUData {
-		d := MPUData{}
-		if n > 0.5 {
-			d.G1 = (avg1/n - mpu.g01) * mpu.scaleGyro
-			d.G2 = (avg2/n - mpu.g02) * mpu.scaleGyro
-			d.G3 = (avg3/n - mpu.g03) * mpu.scaleGyro
-			d.A1 = (ava1/n - mpu.a01) * mpu.scaleAccel
-			d.A2 = (ava2/n - mpu.a02) * mpu.scaleAccel
-			d.A3 = (ava3/n - mpu.a03) * mpu.scaleAccel
-			d.Temp = (float64(avtmp)/n)/340 + 36.53
-			d.N = int(n + 0.5)
-			d.T = t
-			d.DT = t.Sub(t0)
-		} else {
-			d.GAError = errors.New("MPU9250 Warning: No new accel/gyro values")
-		}
-		if nm > 0 {
-			d.M1 = float64(avm1) * mpu.mcal1 / nm
-			d.M2 = float64(avm2) * mpu.mcal2 / nm
-			d.M3 = float64(avm3) * mpu.mcal3 / nm
-			d.NM = int(nm + 0.5)
-			d.TM = tm
-			d.DTM = t.Sub(t0m)
-		} else {
-			d.MagError = errors.New("MPU9250 Warning: No new magnetometer values")
+	// Sequence from the MPU-9250 register map, "Wake-on-Motion Interrupt"
+	for _, w := range []struct{ reg, value byte }{
+		{MPUREG_PWR_MGMT_1, saved[MPUREG_PWR_MGMT_1] & ^byte(BIT_SLEEP|BIT_CYCLE)},
+		{MPUREG_PWR_MGMT_2, BITS_DISABLE_GYRO},
+		{MPUREG_ACCEL_CONFIG_2, BITS_A_DLPF_CFG_184HZ},
+		{MPUREG_INT_ENABLE, BIT_WOM_EN},
+		{MPUREG_MOT_DETECT_CTRL, BITS_ACCEL_INTEL},
+		{MPUREG_MOT_THR, threshold},
+		{MPUREG_LP_ACCEL_ODR, rate},
+		{MPUREG_PWR_MGMT_1, saved[MPUREG_PWR_MGMT_1]&^BIT_SLEEP | BIT_CYCLE},
+	} {
+		if err := mpu.i2cWrite(w.reg, w.value); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't enable wake on motion: %w", err)
 		}
-		return &d
 	}
+	mpu.womSaved = saved
 
-	for {
-		select {
-		case t = <-clock.C: // Read accel/gyro data:
-			for p, reg := range acRegMap {
-				*p, gaError = mpu.i2cRead2(reg)
-				if gaError != nil {
-					log.Println("MPU9250 Warning: error reading gyro/accel")
-				}
-			}
-			curdata = makeMPUData()
-			// Update accumulated values and increment count of gyro/accel readings
-			avg1 += float64(g1)
-			avg2 += float64(g2)
-			avg3 += float64(g3)
-			ava1 += float64(a1)
-			ava2 += float64(a2)
-			ava3 += float64(a3)
-			avtmp += float64(tmp)
-			avm1 += int32(m1)
-			avm2 += int32(m2)
-			avm3 += int32(m3)
-			n++
-			select {
-			case cBuf <- curdata: // We update the buffer every time we read a new value.
-			default: // If buffer is full, remove oldest value and put in newest.
-				<-cBuf
-				cBuf <- curdata
-			}
-		case tm = <-clockMag.C: // Read magnetometer data:
-			if mpu.enableMag {
-				// Set AK8963 to slave0 for reading
-				if err := mpu.i2cWrite(MPUREG_I2C_SLV0_ADDR, AK8963_I2C_ADDR|READ_FLAG); err != nil {
-					log.Printf("MPU9250 Warning: couldn't set AK8963 address for reading: %s", err)
-				}
-				//I2C slave 0 register address from where to begin data transfer
-				if err := mpu.i2cWrite(MPUREG_I2C_SLV0_REG, AK8963_HXL); err != nil {
-					log.Printf("MPU9250 Warning: couldn't set AK8963 read register: %s", err)
-				}
-				//Tell AK8963 that we will read 7 bytes
-				if err := mpu.i2cWrite(MPUREG_I2C_SLV0_CTRL, 0x87); err != nil {
-					log.Printf("MPU9250 Warning: couldn't communicate with AK8963: %s", err)
-				}
+	if mpu.intPin == nil {
+		mpu.cTick <- make(chan time.Time) // Never fires
+	}
+	return nil
+}
 
-				// Read the actual data
-				for p, reg := range magRegMap {
-					*p, magError = mpu.i2cRead2(reg)
-					if magError != nil {
-						log.Println("MPU9250 Warning: error reading magnetometer")
-					}
-				}
+// DisableWakeOnMotion takes the MPU9250 out of wake on motion mode and restores normal sampling,
+// including the magnetometer's measurement mode.
+// It returns ErrNotRunning if the driver has been closed.
+func (mpu *MPU9250) DisableWakeOnMotion() error {
+	mpu.resetMu.Lock()
+	defer mpu.resetMu.Unlock()
+	if !mpu.running {
+		return ErrNotRunning
+	}
+	if mpu.womSaved == nil {
+		return nil
+	}
 
-				// Test validity of magnetometer data
-				if (byte(m1&0xFF)&AKM_DATA_READY) == 0x00 && (byte(m1&0xFF)&AKM_DATA_OVERRUN) != 0x00 {
-					log.Println("MPU9250 Warning: mag data not ready or overflow")
-					log.Printf("MPU9250 Warning: m1 LSB: %X\n", byte(m1&0xFF))
-					continue // Don't update the accumulated values
-				}
+	for _, reg := range womRegs {
+		if err := mpu.i2cWrite(reg, mpu.womSaved[reg]); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't disable wake on motion: %w", err)
+		}
+	}
+	if mpu.enableMag {
+		mpu.mu.Lock()
+		continuous := mpu.magContinuous
+		mpu.mu.Unlock()
+		if err := mpu.setMagContinuous(continuous); err != nil {
+			return fmt.Errorf("MPU9250 Error: couldn't wake magnetometer: %w", err)
+		}
+	}
+	mpu.womSaved = nil
 
-				if (byte((m4>>8)&0xFF) & AKM_OVERFLOW) != 0x00 {
-					log.Println("MPU9250 Warning: mag data overflow")
-					log.Printf("MPU9250 Warning: m4 MSB: %X\n", byte((m1>>8)&0xFF))
-					continue // Don't update the accumulated values
-				}
+	if mpu.intPin == nil {
+		mpu.cTick <- nil
+	}
+	return nil
+}
 
-				// Update values and increment count of magnetometer readings
-				avm1 += int32(m1)
-				avm2 += int32(m2)
-				avm3 += int32(m3)
-				nm++
-			}
-		case cC <- curdata: // Send the latest values
-		case cAvg <- makeAvgMPUData(): // Send the averages
-			avg1, avg2, avg3 = 0, 0, 0
-			ava1, ava2, ava3 = 0, 0, 0
-			avm1, avm2, avm3 = 0, 0, 0
-			avtmp = 0
-			n, nm = 0, 0
-			t0, t0m = t, tm
-		case <-mpu.cClose: // Stop the goroutine, ease up on the CPU
-			break
+// readFIFO reads all complete accel/gyro frames currently in the FIFO buffer in a single transfer
+// and passes the values from each frame, in order, to f.
+func (mpu *MPU9250) readFIFO(f func(a1, a2, a3, g1, g2, g3 int16)) error {
+	status, err := mpu.i2cRead(MPUREG_INT_STATUS)
+	if err != nil {
+		return err
+	}
+	if status&BIT_FIFO_OFLOW_INT != 0 {
+		userCtrl, err := mpu.i2cRead(MPUREG_USER_CTRL)
+		if err != nil {
+			return err
+		}
+		if err := mpu.i2cWrite(MPUREG_USER_CTRL, userCtrl|BIT_FIFO_RST); err != nil {
+			return err
 		}
+		return fmt.Errorf("%w: FIFO overflowed, samples lost", ErrOverflow)
 	}
-}
 
-// CloseMPU stops the driver from reading the MPU.
-//TODO westphae: need a way to start it going again!
-func (mpu *MPU9250) CloseMPU() {
-	// Nothing to do bitwise for the 9250?
-	mpu.cClose <- true
+	cnt, err := mpu.i2cRead2(MPUREG_FIFO_COUNTH)
+	if err != nil {
+		return err
+	}
+	nFrames := int(uint16(cnt)&0x1FFF) / fifoFrameSize
+	if nFrames > fifoMaxCount/fifoFrameSize {
+		nFrames = fifoMaxCount / fifoFrameSize
+	}
+	if nFrames == 0 {
+		return nil
+	}
+
+	buf, err := mpu.i2cReadBlock(MPUREG_FIFO_R_W, nFrames*fifoFrameSize)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < nFrames; i++ {
+		fr := buf[i*fifoFrameSize : (i+1)*fifoFrameSize]
+		f(toInt16(fr[0:]), toInt16(fr[2:]), toInt16(fr[4:]), toInt16(fr[6:]), toInt16(fr[8:]), toInt16(fr[10:]))
+	}
+	return nil
 }
 
 // SetSampleRate changes the sampling rate of the MPU.
 func (mpu *MPU9250) SetSampleRate(rate byte) (err error) {
 	errWrite := mpu.i2cWrite(MPUREG_SMPLRT_DIV, byte(rate)) // Set sample rate to chosen
 	if errWrite != nil {
-		err = fmt.Errorf("MPU9250 Error: Couldn't set sample rate: %s", errWrite)
+		err = fmt.Errorf("MPU9250 Error: Couldn't set sample rate: %w", errWrite)
+	} else {
+		mpu.mu.Lock()
+		mpu.smplrtDiv = rate
+		mpu.mu.Unlock()
 	}
 	return
 }
 
-// SetGyroLPF sets the low pass filter for the gyro.
+// EffectiveSampleRate returns the rate in Hz at which the chip actually samples, 1kHz divided by 1 plus the
+// SMPLRT_DIV divider.  Because the divider is an integer, this may differ from the requested SampleRate.
+func (mpu *MPU9250) EffectiveSampleRate() float64 {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return 1000 / float64(1+int(mpu.smplrtDiv))
+}
+
+// SetGyroLPF sets the digital low pass filter for the gyro (and temperature) to the highest available bandwidth
+// not above rate, in Hz.  The available bandwidths are 188, 98, 42, 20, 10 and 5Hz (BITS_DLPF_CFG_*);
+// anything below 10Hz selects 5Hz.  It is independent of the sample rate and may be called at any time.
 func (mpu *MPU9250) SetGyroLPF(rate byte) (err error) {
-	var r byte
+	var (
+		r  byte
+		hz int
+	)
 	switch {
 	case rate >= 188:
-		r = BITS_DLPF_CFG_188HZ
+		r, hz = BITS_DLPF_CFG_188HZ, 188
 	case rate >= 98:
-		r = BITS_DLPF_CFG_98HZ
+		r, hz = BITS_DLPF_CFG_98HZ, 98
 	case rate >= 42:
-		r = BITS_DLPF_CFG_42HZ
+		r, hz = BITS_DLPF_CFG_42HZ, 42
 	case rate >= 20:
-		r = BITS_DLPF_CFG_20HZ
+		r, hz = BITS_DLPF_CFG_20HZ, 20
 	case rate >= 10:
-		r = BITS_DLPF_CFG_10HZ
+		r, hz = BITS_DLPF_CFG_10HZ, 10
 	default:
-		r = BITS_DLPF_CFG_5HZ
+		r, hz = BITS_DLPF_CFG_5HZ, 5
 	}
 
 	errWrite := mpu.i2cWrite(MPUREG_CONFIG, r)
 	if errWrite != nil {
-		err = fmt.Errorf("MPU9250 Error: couldn't set Gyro LPF: %s", errWrite)
+		err = fmt.Errorf("MPU9250 Error: couldn't set Gyro LPF: %w", errWrite)
+	} else {
+		mpu.mu.Lock()
+		mpu.gyroLPF = hz
+		mpu.mu.Unlock()
 	}
 	return
 }
 
-// SetAccelLPF sets the low pass filter for the accelerometer.
+// SetAccelLPF sets the digital low pass filter for the accelerometer, which is configured separately from the gyro
+// in ACCEL_CONFIG_2.  The available bandwidths are 218, 99, 45, 21, 10 and 5Hz; rate, in Hz, selects the highest
+// not above it, and anything below 10Hz selects 5Hz.  It is independent of the sample rate and may be called at any time.
+// The MPU6050 has no separate accel LPF, so it returns ErrInvalidSetting there; use SetGyroLPF instead.
 func (mpu *MPU9250) SetAccelLPF(rate byte) (err error) {
-	var r byte
+	var (
+		r  byte
+		hz int
+	)
+	if mpu.whoAmI == WHOAMI_MPU6050 {
+		return fmt.Errorf("%w: the MPU6050's accel LPF follows the gyro's", ErrInvalidSetting)
+	}
 	switch {
 	case rate >= 218:
-		r = BITS_DLPF_CFG_188HZ
+		r, hz = BITS_DLPF_CFG_188HZ, 218
 	case rate >= 99:
-		r = BITS_DLPF_CFG_98HZ
+		r, hz = BITS_DLPF_CFG_98HZ, 99
 	case rate >= 45:
-		r = BITS_DLPF_CFG_42HZ
+		r, hz = BITS_DLPF_CFG_42HZ, 45
 	case rate >= 21:
-		r = BITS_DLPF_CFG_20HZ
+		r, hz = BITS_DLPF_CFG_20HZ, 21
 	case rate >= 10:
-		r = BITS_DLPF_CFG_10HZ
+		r, hz = BITS_DLPF_CFG_10HZ, 10
 	default:
-		r = BITS_DLPF_CFG_5HZ
+		r, hz = BITS_DLPF_CFG_5HZ, 5
 	}
 
 	errWrite := mpu.i2cWrite(MPUREG_ACCEL_CONFIG_2, r)
 	if errWrite != nil {
-		err = fmt.Errorf("MPU9250 Error: couldn't set Accel LPF: %s", errWrite)
+		err = fmt.Errorf("MPU9250 Error: couldn't set Accel LPF: %w", errWrite)
+	} else {
+		mpu.mu.Lock()
+		mpu.accelLPF = hz
+		mpu.mu.Unlock()
 	}
 	return
 }
 
 // EnableGyroBiasCal enables or disables motion bias compensation for the gyro.
 // For flying we generally do not want this!
+// The DMP memory written is read back, and an error is returned if it doesn't match.
 func (mpu *MPU9250) EnableGyroBiasCal(enable bool) error {
 	enableRegs := []byte{0xb8, 0xaa, 0xb3, 0x8d, 0xb4, 0x98, 0x0d, 0x35, 0x5d}
 	disableRegs := []byte{0xb8, 0xaa, 0xaa, 0xaa, 0xb0, 0x88, 0xc3, 0xc5, 0xc7}
 
 	if enable {
-		if err := mpu.memWrite(CFG_MOTION_BIAS, &enableRegs); err != nil {
-			return errors.New("Unable to enable motion bias compensation")
+		if err := mpu.memWriteBlock(CFG_MOTION_BIAS, enableRegs, true); err != nil {
+			return fmt.Errorf("Unable to enable motion bias compensation: %w", err)
 		}
 	} else {
-		if err := mpu.memWrite(CFG_MOTION_BIAS, &disableRegs); err != nil {
-			return errors.New("Unable to disable motion bias compensation")
+		if err := mpu.memWriteBlock(CFG_MOTION_BIAS, disableRegs, true); err != nil {
+			return fmt.Errorf("Unable to disable motion bias compensation: %w", err)
 		}
 	}
 
+	mpu.mu.Lock()
+	mpu.gyroBiasCal = enable
+	mpu.mu.Unlock()
 	return nil
 }
 
+// IsGyroBiasCalEnabled returns whether motion bias compensation for the gyro was last successfully enabled.
+// It is disabled when the MPU9250 is created or reset.
+func (mpu *MPU9250) IsGyroBiasCalEnabled() bool {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.gyroBiasCal
+}
+
+/*
+SetClockSource sets the clock source of the MPU9250 to INV_CLK_PLL or INV_CLK_INTERNAL and waits for sensor data
+to be ready using the new clock.
+The default, INV_CLK_PLL, uses a PLL locked to the gyro's MEMS oscillator when it is ready, falling back to the
+internal 20MHz oscillator; the PLL is much more stable, particularly with temperature, which keeps the gyro's
+sample timing and so its integrated angles accurate.  The internal oscillator uses less power and is available
+immediately.
+*/
+func (mpu *MPU9250) SetClockSource(source byte) error {
+	if source != INV_CLK_PLL && source != INV_CLK_INTERNAL {
+		return fmt.Errorf("%w: %d is not a valid clock source", ErrInvalidSetting, source)
+	}
+
+	r, err := mpu.i2cRead(MPUREG_PWR_MGMT_1)
+	if err != nil {
+		return fmt.Errorf("MPU9250 Error: couldn't set clock source: %w", err)
+	}
+	if err := mpu.i2cWrite(MPUREG_PWR_MGMT_1, r&^BITS_CLKSEL|source); err != nil {
+		return fmt.Errorf("MPU9250 Error: couldn't set clock source: %w", err)
+	}
+	mpu.clockSource = source
+
+	return mpu.waitDataReady(clockTimeout)
+}
+
+// waitDataReady polls INT_STATUS until the chip reports new sensor data, which it only does once its clock is
+// running; the MPU9250 has no status bit showing that the PLL has locked.
+func (mpu *MPU9250) waitDataReady(timeout time.Duration) error {
+	for t0 := time.Now(); time.Since(t0) < timeout; time.Sleep(time.Millisecond) {
+		if r, err := mpu.i2cRead(MPUREG_INT_STATUS); err == nil && r&BIT_RAW_RDY_INT != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no sensor data ready after %s", ErrNoData, timeout)
+}
+
 // SampleRate returns the current sample rate of the MPU9250, in Hz.
 func (mpu *MPU9250) SampleRate() int {
 	return mpu.sampleRate
 }
 
+// Config returns the sensor settings currently in effect.
+func (mpu *MPU9250) Config() Config {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return Config{
+		WhoAmI:     mpu.whoAmI,
+		GyroRange:  mpu.sensGyro,
+		AccelRange: mpu.sensAccel,
+		SampleRate: mpu.sampleRate,
+		GyroLPF:    mpu.gyroLPF,
+		AccelLPF:   mpu.accelLPF,
+		MagEnabled: mpu.enableMag,
+		MagBits:    mpu.magBits,
+	}
+}
+
+// WhoAmI returns the WHO_AM_I value identifying the part, e.g. WHOAMI_MPU9250 or WHOAMI_MPU6500.
+func (mpu *MPU9250) WhoAmI() byte {
+	return mpu.whoAmI
+}
+
 // MagEnabled returns whether or not the magnetometer is being read.
 func (mpu *MPU9250) MagEnabled() bool {
 	return mpu.enableMag
 }
 
-// SetGyroSensitivity sets the gyro sensitivity of the MPU9250; it must be one of the following values:
-// 250, 500, 1000, 2000 (all in °/s).
-func (mpu *MPU9250) SetGyroSensitivity(sensitivityGyro int) (err error) {
-	var sensGyro byte
+// GyroScale returns the gyro scale in effect, in °/s per LSB of the raw readings.
+func (mpu *MPU9250) GyroScale() float64 {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.scaleGyro
+}
+
+// AccelScale returns the accelerometer scale in effect, in G per LSB of the raw readings.
+func (mpu *MPU9250) AccelScale() float64 {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return mpu.scaleAccel
+}
 
+// gyroRange returns the GYRO_CONFIG bits and the scale in °/s per LSB for a gyro full-scale range.
+func gyroRange(sensitivityGyro int) (bits byte, scale float64, err error) {
 	switch sensitivityGyro {
 	case 2000:
-		sensGyro = BITS_FS_2000DPS
-		mpu.scaleGyro = 2000.0 / float64(math.MaxInt16)
+		bits = BITS_FS_2000DPS
 	case 1000:
-		sensGyro = BITS_FS_1000DPS
-		mpu.scaleGyro = 1000.0 / float64(math.MaxInt16)
+		bits = BITS_FS_1000DPS
 	case 500:
-		sensGyro = BITS_FS_500DPS
-		mpu.scaleGyro = 500.0 / float64(math.MaxInt16)
+		bits = BITS_FS_500DPS
 	case 250:
-		sensGyro = BITS_FS_250DPS
-		mpu.scaleGyro = 250.0 / float64(math.MaxInt16)
+		bits = BITS_FS_250DPS
 	default:
-		err = fmt.Errorf("MPU9250 Error: %d is not a valid gyro sensitivity", sensitivityGyro)
+		return 0, 0, fmt.Errorf("%w: %d is not a valid gyro sensitivity", ErrInvalidSetting, sensitivityGyro)
+	}
+	return bits, float64(sensitivityGyro) / float64(math.MaxInt16), nil
+}
+
+// SetGyroRange sets the gyro full-scale range of the MPU9250; it must be one of the following values:
+// 250, 500, 1000, 2000 (all in °/s).
+// It is safe to call while the MPU9250 is being read.
+func (mpu *MPU9250) SetGyroRange(sensitivityGyro int) error {
+	bits, scale, err := gyroRange(sensitivityGyro)
+	if err != nil {
+		return err
 	}
 
-	if errWrite := mpu.i2cWrite(MPUREG_GYRO_CONFIG, sensGyro); errWrite != nil {
-		err = errors.New("MPU9250 Error: couldn't set gyro sensitivity")
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if err := mpu.i2cWrite(MPUREG_GYRO_CONFIG, bits); err != nil {
+		return fmt.Errorf("MPU9250 Error: couldn't set gyro sensitivity: %w", err)
 	}
+	// Software bias is in raw units, so rescale it to the new range.
+	if mpu.scaleGyro != 0 {
+		r := mpu.scaleGyro / scale
+		mpu.g01, mpu.g02, mpu.g03 = mpu.g01*r, mpu.g02*r, mpu.g03*r
+	}
+	mpu.scaleGyro = scale
+	mpu.sensGyro = sensitivityGyro
 
-	return
+	return nil
 }
 
-// SetAccelSensitivity sets the accelerometer sensitivity of the MPU9250; it must be one of the following values:
-// 2, 4, 8, 16, all in G (gravity).
-func (mpu *MPU9250) SetAccelSensitivity(sensitivityAccel int) (err error) {
-	var sensAccel byte
+// SetGyroSensitivity sets the gyro sensitivity of the MPU9250; it must be one of the following values:
+// 250, 500, 1000, 2000 (all in °/s).
+func (mpu *MPU9250) SetGyroSensitivity(sensitivityGyro int) error {
+	return mpu.SetGyroRange(sensitivityGyro)
+}
 
+// accelRange returns the ACCEL_CONFIG bits and the scale in G per LSB for an accelerometer full-scale range.
+func accelRange(sensitivityAccel int) (bits byte, scale float64, err error) {
 	switch sensitivityAccel {
 	case 16:
-		sensAccel = BITS_FS_16G
-		mpu.scaleAccel = 16.0 / float64(math.MaxInt16)
+		bits = BITS_FS_16G
 	case 8:
-		sensAccel = BITS_FS_8G
-		mpu.scaleAccel = 8.0 / float64(math.MaxInt16)
+		bits = BITS_FS_8G
 	case 4:
-		sensAccel = BITS_FS_4G
-		mpu.scaleAccel = 4.0 / float64(math.MaxInt16)
+		bits = BITS_FS_4G
 	case 2:
-		sensAccel = BITS_FS_2G
-		mpu.scaleAccel = 2.0 / float64(math.MaxInt16)
+		bits = BITS_FS_2G
 	default:
-		err = fmt.Errorf("MPU9250 Error: %d is not a valid accel sensitivity", sensitivityAccel)
+		return 0, 0, fmt.Errorf("%w: %d is not a valid accel sensitivity", ErrInvalidSetting, sensitivityAccel)
+	}
+	return bits, float64(sensitivityAccel) / float64(math.MaxInt16), nil
+}
+
+// SetAccelRange sets the accelerometer full-scale range of the MPU9250; it must be one of the following values:
+// 2, 4, 8, 16, all in G (gravity).
+// It is safe to call while the MPU9250 is being read.
+func (mpu *MPU9250) SetAccelRange(sensitivityAccel int) error {
+	bits, scale, err := accelRange(sensitivityAccel)
+	if err != nil {
+		return err
 	}
 
-	if errWrite := mpu.i2cWrite(MPUREG_ACCEL_CONFIG, sensAccel); errWrite != nil {
-		err = errors.New("MPU9250 Error: couldn't set accel sensitivity")
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if err := mpu.i2cWrite(MPUREG_ACCEL_CONFIG, bits); err != nil {
+		return fmt.Errorf("MPU9250 Error: couldn't set accel sensitivity: %w", err)
+	}
+	// The hardware offset registers are at a fixed scale independent of the range,
+	// but the software bias is in raw units, so rescale it to the new range.
+	if mpu.scaleAccel != 0 {
+		r := mpu.scaleAccel / scale
+		mpu.a01, mpu.a02, mpu.a03 = mpu.a01*r, mpu.a02*r, mpu.a03*r
 	}
+	mpu.scaleAccel = scale
+	mpu.sensAccel = sensitivityAccel
 
-	return
+	return nil
+}
+
+// SetAccelSensitivity sets the accelerometer sensitivity of the MPU9250; it must be one of the following values:
+// 2, 4, 8, 16, all in G (gravity).
+func (mpu *MPU9250) SetAccelSensitivity(sensitivityAccel int) error {
+	return mpu.SetAccelRange(sensitivityAccel)
+}
+
+// accelOffsetRegs returns the high bytes of the X, Y and Z accel offset registers, which the MPU6050 keeps elsewhere.
+func (mpu *MPU9250) accelOffsetRegs() []byte {
+	if mpu.whoAmI == WHOAMI_MPU6050 {
+		return []byte{MPUREG_XA_OFFS_H, MPUREG_YA_OFFS_H, MPUREG_ZA_OFFS_H}
+	}
+	return []byte{MPUREG_XA_OFFSET_H, MPUREG_YA_OFFSET_H, MPUREG_ZA_OFFSET_H}
 }
 
 // ReadAccelBias reads the bias accelerometer value stored on the chip.
 // These values are set at the factory.
 func (mpu *MPU9250) ReadAccelBias(sensitivityAccel int) error {
-	a0x, err := mpu.i2cRead2(MPUREG_XA_OFFSET_H)
+	regs := mpu.accelOffsetRegs()
+	a0x, err := mpu.i2cRead2(regs[0])
 	if err != nil {
-		return errors.New("MPU9250 Error: ReadAccelBias error reading chip")
+		return fmt.Errorf("MPU9250 Error: ReadAccelBias error reading chip: %w", err)
 	}
-	a0y, err := mpu.i2cRead2(MPUREG_YA_OFFSET_H)
+	a0y, err := mpu.i2cRead2(regs[1])
 	if err != nil {
-		return errors.New("MPU9250 Error: ReadAccelBias error reading chip")
+		return fmt.Errorf("MPU9250 Error: ReadAccelBias error reading chip: %w", err)
 	}
-	a0z, err := mpu.i2cRead2(MPUREG_ZA_OFFSET_H)
+	a0z, err := mpu.i2cRead2(regs[2])
 	if err != nil {
-		return errors.New("MPU9250 Error: ReadAccelBias error reading chip")
+		return fmt.Errorf("MPU9250 Error: ReadAccelBias error reading chip: %w", err)
 	}
 
 	switch sensitivityAccel {
@@ -588,7 +1747,7 @@ func (mpu *MPU9250) ReadAccelBias(sensitivityAccel int) error {
 		mpu.a02 = float64(a0y << 2)
 		mpu.a03 = float64(a0z << 2)
 	default:
-		return fmt.Errorf("MPU9250 Error: %d is not a valid acceleration sensitivity", sensitivityAccel)
+		return fmt.Errorf("%w: %d is not a valid acceleration sensitivity", ErrInvalidSetting, sensitivityAccel)
 	}
 
 	log.Printf("MPU9250 Info: accel hardware bias read: %6f %6f %6f\n", mpu.a01, mpu.a02, mpu.a03)
@@ -600,15 +1759,15 @@ func (mpu *MPU9250) ReadAccelBias(sensitivityAccel int) error {
 func (mpu *MPU9250) ReadGyroBias(sensitivityGyro int) error {
 	g0x, err := mpu.i2cRead2(MPUREG_XG_OFFS_USRH)
 	if err != nil {
-		return errors.New("MPU9250 Error: ReadGyroBias error reading chip")
+		return fmt.Errorf("MPU9250 Error: ReadGyroBias error reading chip: %w", err)
 	}
 	g0y, err := mpu.i2cRead2(MPUREG_YG_OFFS_USRH)
 	if err != nil {
-		return errors.New("MPU9250 Error: ReadGyroBias error reading chip")
+		return fmt.Errorf("MPU9250 Error: ReadGyroBias error reading chip: %w", err)
 	}
 	g0z, err := mpu.i2cRead2(MPUREG_ZG_OFFS_USRH)
 	if err != nil {
-		return errors.New("MPU9250 Error: ReadGyroBias error reading chip")
+		return fmt.Errorf("MPU9250 Error: ReadGyroBias error reading chip: %w", err)
 	}
 
 	switch sensitivityGyro {
@@ -629,13 +1788,183 @@ func (mpu *MPU9250) ReadGyroBias(sensitivityGyro int) error {
 		mpu.g02 = float64(g0y << 2)
 		mpu.g03 = float64(g0z << 2)
 	default:
-		return fmt.Errorf("MPU9250 Error: %d is not a valid gyro sensitivity", sensitivityGyro)
+		return fmt.Errorf("%w: %d is not a valid gyro sensitivity", ErrInvalidSetting, sensitivityGyro)
 	}
 
 	log.Printf("MPU9250 Info: Gyro hardware bias read: %6f %6f %6f\n", mpu.g01, mpu.g02, mpu.g03)
 	return nil
 }
 
+// WriteGyroBias writes the gyro bias values currently subtracted in software into the chip's gyro offset registers,
+// so that the raw gyro readings come out of the chip already corrected, and then zeroes the software bias.
+// Correcting a large bias in hardware preserves the full dynamic range of the sensor.
+func (mpu *MPU9250) WriteGyroBias() error {
+	// Offset registers are in units of the 1000°/s scale, the inverse of ReadGyroBias.
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+
+	var f float64
+	switch mpu.sensGyro {
+	case 2000:
+		f = 2
+	case 1000:
+		f = 1
+	case 500:
+		f = 0.5
+	case 250:
+		f = 0.25
+	default:
+		return fmt.Errorf("%w: %d is not a valid gyro sensitivity", ErrInvalidSetting, mpu.sensGyro)
+	}
+
+	regs := []byte{MPUREG_XG_OFFS_USRH, MPUREG_YG_OFFS_USRH, MPUREG_ZG_OFFS_USRH}
+	biases := []*float64{&mpu.g01, &mpu.g02, &mpu.g03}
+	for i, reg := range regs {
+		g0, err := mpu.i2cRead2(reg)
+		if err != nil {
+			return fmt.Errorf("MPU9250 Error: WriteGyroBias error reading chip: %w", err)
+		}
+		// The chip adds the offset register value to the raw reading.
+		if err := mpu.i2cWrite2(reg, clampInt16(float64(g0)-*biases[i]*f)); err != nil {
+			return fmt.Errorf("MPU9250 Error: WriteGyroBias error writing chip: %w", err)
+		}
+		*biases[i] = 0
+	}
+
+	log.Println("MPU9250 Info: Gyro bias written to hardware offset registers")
+	return nil
+}
+
+// WriteAccelBias writes the accelerometer bias values currently subtracted in software into the chip's accelerometer
+// offset registers, so that the raw accelerometer readings come out of the chip already corrected,
+// and then zeroes the software bias.
+// Correcting a large bias in hardware preserves the full dynamic range of the sensor.
+func (mpu *MPU9250) WriteAccelBias() error {
+	// Offset registers are in units of the 8G scale, the inverse of ReadAccelBias.
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+
+	var f float64
+	switch mpu.sensAccel {
+	case 16:
+		f = 2
+	case 8:
+		f = 1
+	case 4:
+		f = 0.5
+	case 2:
+		f = 0.25
+	default:
+		return fmt.Errorf("%w: %d is not a valid accel sensitivity", ErrInvalidSetting, mpu.sensAccel)
+	}
+
+	regs := mpu.accelOffsetRegs()
+	biases := []*float64{&mpu.a01, &mpu.a02, &mpu.a03}
+	for i, reg := range regs {
+		a0, err := mpu.i2cRead2(reg)
+		if err != nil {
+			return fmt.Errorf("MPU9250 Error: WriteAccelBias error reading chip: %w", err)
+		}
+		// The chip adds the offset register value to the raw reading.
+		// Bit 0 is reserved for temperature compensation and must be preserved.
+		v := clampInt16(float64(a0)-*biases[i]*f)&^1 | a0&1
+		if err := mpu.i2cWrite2(reg, v); err != nil {
+			return fmt.Errorf("MPU9250 Error: WriteAccelBias error writing chip: %w", err)
+		}
+		*biases[i] = 0
+	}
+
+	log.Println("MPU9250 Info: Accel bias written to hardware offset registers")
+	return nil
+}
+
+// GetBias returns the gyro and accelerometer biases currently subtracted in software from the raw readings,
+// in LSB at the current full-scale ranges.
+func (mpu *MPU9250) GetBias() (gyro, accel [3]int16) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	gyro = [3]int16{clampInt16(mpu.g01), clampInt16(mpu.g02), clampInt16(mpu.g03)}
+	accel = [3]int16{clampInt16(mpu.a01), clampInt16(mpu.a02), clampInt16(mpu.a03)}
+	return
+}
+
+// SetBias sets the gyro and accelerometer biases to subtract in software from the raw readings,
+// in LSB at the current full-scale ranges, e.g. to apply values measured once on a bench instead of
+// reading them from the chip.
+func (mpu *MPU9250) SetBias(gyro, accel [3]int16) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.g01, mpu.g02, mpu.g03 = float64(gyro[0]), float64(gyro[1]), float64(gyro[2])
+	mpu.a01, mpu.a02, mpu.a03 = float64(accel[0]), float64(accel[1]), float64(accel[2])
+}
+
+// SetAccelScale sets the per-axis accelerometer scale factors applied to each accelerometer reading after its bias
+// is subtracted, e.g. to apply values found once by CalibrateAccel.  By default the scale factors are 1.
+func (mpu *MPU9250) SetAccelScale(scale [3]float64) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.as1, mpu.as2, mpu.as3 = scale[0], scale[1], scale[2]
+}
+
+// GetAccelScale returns the per-axis accelerometer scale factors currently applied.
+func (mpu *MPU9250) GetAccelScale() (scale [3]float64) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	return [3]float64{mpu.as1, mpu.as2, mpu.as3}
+}
+
+// CalibrateAccel performs a six-position accelerometer calibration from readings taken with the MPU9250 held still
+// with each axis in turn pointing straight up and straight down, e.g. averages read from CAvg.  For each axis it
+// takes the largest and smallest readings as +1G and -1G and solves for the bias and scale factor that map them
+// there, folding them into the bias and scale currently applied.  It returns an error, leaving the calibration
+// unchanged, if the readings don't bracket +1G and -1G on every axis.
+func (mpu *MPU9250) CalibrateAccel(readings []*MPUData) error {
+	var hi, lo [3]float64
+	for i := range hi {
+		hi[i], lo[i] = math.Inf(-1), math.Inf(1)
+	}
+	for _, d := range readings {
+		if d == nil || d.GAError != nil {
+			continue
+		}
+		for i, a := range [3]float64{d.A1, d.A2, d.A3} {
+			hi[i] = math.Max(hi[i], a)
+			lo[i] = math.Min(lo[i], a)
+		}
+	}
+
+	for i := range hi {
+		if hi[i] < 1-accelCalTolerance || hi[i] > 1+accelCalTolerance ||
+			lo[i] > -1+accelCalTolerance || lo[i] < -1-accelCalTolerance {
+			return fmt.Errorf("%w: accel axis %d readings from %f to %f don't bracket +1G and -1G",
+				ErrCalibration, i+1, lo[i], hi[i])
+		}
+	}
+
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	biases := []*float64{&mpu.a01, &mpu.a02, &mpu.a03}
+	scales := []*float64{&mpu.as1, &mpu.as2, &mpu.as3}
+	for i := range hi {
+		// The readings are (raw-a0)*scaleAccel*as; shift a0 by the bias in G, then stretch as to span 2G.
+		*biases[i] += (hi[i] + lo[i]) / 2 / (mpu.scaleAccel * *scales[i])
+		*scales[i] *= 2 / (hi[i] - lo[i])
+	}
+
+	log.Printf("MPU9250 Info: accel calibrated: bias %6f %6f %6f, scale %6f %6f %6f\n",
+		mpu.a01, mpu.a02, mpu.a03, mpu.as1, mpu.as2, mpu.as3)
+	return nil
+}
+
+// SetMagCalibration sets the magnetometer hard-iron offsets, in uT, and soft-iron scale factors, which are applied
+// to each magnetometer reading before it is averaged.  By default the offsets are 0 and the scale factors are 1.
+func (mpu *MPU9250) SetMagCalibration(offset, scale [3]float64) {
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	mpu.m01, mpu.m02, mpu.m03 = offset[0], offset[1], offset[2]
+	mpu.ms1, mpu.ms2, mpu.ms3 = scale[0], scale[1], scale[2]
+}
+
 // ReadMagCalibration reads the magnetometer bias values stored on the chpi.
 // These values are set at the factory.
 func (mpu *MPU9250) ReadMagCalibration() error {
@@ -644,73 +1973,76 @@ func (mpu *MPU9250) ReadMagCalibration() error {
 	var err error
 	tmp, err = mpu.i2cRead(MPUREG_USER_CTRL)
 	if err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	if err = mpu.i2cWrite(MPUREG_USER_CTRL, tmp & ^BIT_AUX_IF_EN); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	time.Sleep(3 * time.Millisecond)
 	if err = mpu.i2cWrite(MPUREG_INT_PIN_CFG, BIT_BYPASS_EN); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 
 	// Prepare for getting sensitivity data from AK8963
 	//Set the I2C slave address of AK8963
 	if err = mpu.i2cWrite(MPUREG_I2C_SLV0_ADDR, AK8963_I2C_ADDR); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	// Power down the AK8963
 	if err = mpu.i2cWrite(MPUREG_I2C_SLV0_CTRL, AK8963_CNTL1); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	// Power down the AK8963
 	if err = mpu.i2cWrite(MPUREG_I2C_SLV0_DO, AKM_POWER_DOWN); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	time.Sleep(time.Millisecond)
 	// Fuse AK8963 ROM access
-	if mpu.i2cWrite(MPUREG_I2C_SLV0_DO, AK8963_I2CDIS); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+	if err = mpu.i2cWrite(MPUREG_I2C_SLV0_DO, AK8963_I2CDIS); err != nil {
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	time.Sleep(time.Millisecond)
 
 	// Get sensitivity data from AK8963 fuse ROM
 	mcal1, err := mpu.i2cRead(AK8963_ASAX)
 	if err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	mcal2, err := mpu.i2cRead(AK8963_ASAY)
 	if err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	mcal3, err := mpu.i2cRead(AK8963_ASAZ)
 	if err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 
 	log.Printf("MPU9250 Info: Raw mag calibrations: %d %d %d\n", mcal1, mcal2, mcal3)
-	mpu.mcal1 = float64(int16(mcal1)+128) / 256 * scaleMag
-	mpu.mcal2 = float64(int16(mcal2)+128) / 256 * scaleMag
-	mpu.mcal3 = float64(int16(mcal3)+128) / 256 * scaleMag
+	mpu.mu.Lock()
+	scale := mpu.magScale()
+	mpu.mcal1 = float64(int16(mcal1)+128) / 256 * scale
+	mpu.mcal2 = float64(int16(mcal2)+128) / 256 * scale
+	mpu.mcal3 = float64(int16(mcal3)+128) / 256 * scale
+	mpu.mu.Unlock()
 
 	// Clean up from getting sensitivity data from AK8963
 	// Fuse AK8963 ROM access
 	if err = mpu.i2cWrite(MPUREG_I2C_SLV0_DO, AK8963_I2CDIS); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	time.Sleep(time.Millisecond)
 
 	// Disable bypass mode now that we're done getting sensitivity data
 	tmp, err = mpu.i2cRead(MPUREG_USER_CTRL)
 	if err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	if err = mpu.i2cWrite(MPUREG_USER_CTRL, tmp|BIT_AUX_IF_EN); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	time.Sleep(3 * time.Millisecond)
 	if err = mpu.i2cWrite(MPUREG_INT_PIN_CFG, 0x00); err != nil {
-		return errors.New("ReadMagCalibration error reading chip")
+		return fmt.Errorf("ReadMagCalibration error reading chip: %w", err)
 	}
 	time.Sleep(3 * time.Millisecond)
 
@@ -720,30 +2052,47 @@ func (mpu *MPU9250) ReadMagCalibration() error {
 
 func (mpu *MPU9250) i2cWrite(register, value byte) (err error) {
 
-	if errWrite := mpu.i2cbus.WriteByteToReg(MPU_ADDRESS, register, value); errWrite != nil {
-		err = fmt.Errorf("MPU9250 Error writing %X to %X: %s\n",
-			value, register, errWrite)
+	if errWrite := mpu.bus.writeReg(register, value); errWrite != nil {
+		err = fmt.Errorf("%w: writing %X to %X: %w",
+			ErrBusWrite, value, register, errWrite)
 	} else {
 		time.Sleep(time.Millisecond)
 	}
 	return
 }
 
+func (mpu *MPU9250) i2cWrite2(register byte, value int16) (err error) {
+	if err = mpu.i2cWrite(register, byte(uint16(value)>>8)); err != nil {
+		return
+	}
+	return mpu.i2cWrite(register+1, byte(uint16(value)&0xFF))
+}
+
 func (mpu *MPU9250) i2cRead(register byte) (value uint8, err error) {
-	value, errWrite := mpu.i2cbus.ReadByteFromReg(MPU_ADDRESS, register)
+	value, errWrite := mpu.bus.readReg(register)
 	if errWrite != nil {
-		err = fmt.Errorf("i2cRead error: %s", errWrite)
+		err = fmt.Errorf("%w: reading %X: %w", ErrBusRead, register, errWrite)
 	}
 	return
 }
 
 func (mpu *MPU9250) i2cRead2(register byte) (value int16, err error) {
 
-	v, errWrite := mpu.i2cbus.ReadWordFromReg(MPU_ADDRESS, register)
+	v := make([]byte, 2)
+	errWrite := mpu.bus.readRegs(register, v)
 	if errWrite != nil {
-		err = fmt.Errorf("MPU9250 Error reading %x: %s\n", register, err)
+		err = fmt.Errorf("%w: reading %X: %w", ErrBusRead, register, errWrite)
 	} else {
-		value = int16(v)
+		value = toInt16(v)
+	}
+	return
+}
+
+// i2cReadBlock reads n consecutive bytes beginning at register in a single transaction.
+func (mpu *MPU9250) i2cReadBlock(register byte, n int) (values []byte, err error) {
+	values = make([]byte, n)
+	if errRead := mpu.bus.readRegs(register, values); errRead != nil {
+		err = fmt.Errorf("%w: reading %d bytes from %X: %w", ErrBusRead, n, register, errRead)
 	}
 	return
 }
@@ -756,19 +2105,141 @@ func (mpu *MPU9250) memWrite(addr uint16, data *[]byte) error {
 	tmp[1] = byte(addr & 0xFF)
 
 	// Check memory bank boundaries
-	if tmp[1]+byte(len(*data)) > MPU_BANK_SIZE {
-		return errors.New("Bad address: writing outside of memory bank boundaries")
+	if int(tmp[1])+len(*data) > MPU_BANK_SIZE {
+		return fmt.Errorf("%w: writing outside of memory bank boundaries", ErrInvalidSetting)
 	}
 
-	err = mpu.i2cbus.WriteToReg(MPU_ADDRESS, MPUREG_BANK_SEL, tmp)
+	err = mpu.bus.writeRegs(MPUREG_BANK_SEL, tmp)
 	if err != nil {
-		return fmt.Errorf("MPU9250 Error selecting memory bank: %s\n", err)
+		return fmt.Errorf("%w: selecting memory bank: %w", ErrBusWrite, err)
 	}
 
-	err = mpu.i2cbus.WriteToReg(MPU_ADDRESS, MPUREG_MEM_R_W, *data)
+	err = mpu.bus.writeRegs(MPUREG_MEM_R_W, *data)
 	if err != nil {
-		return fmt.Errorf("MPU9250 Error writing to the memory bank: %s\n", err)
+		return fmt.Errorf("%w: writing to the memory bank: %w", ErrBusWrite, err)
+	}
+
+	return nil
+}
+
+// memRead reads n bytes of DMP memory beginning at addr, which must all lie in one bank.
+func (mpu *MPU9250) memRead(addr uint16, n int) ([]byte, error) {
+	if int(addr&0xFF)+n > MPU_BANK_SIZE {
+		return nil, fmt.Errorf("%w: reading outside of memory bank boundaries", ErrInvalidSetting)
+	}
+	if err := mpu.bus.writeRegs(MPUREG_BANK_SEL, []byte{byte(addr >> 8), byte(addr & 0xFF)}); err != nil {
+		return nil, fmt.Errorf("%w: selecting memory bank: %w", ErrBusWrite, err)
 	}
+	data := make([]byte, n)
+	if err := mpu.bus.readRegs(MPUREG_MEM_R_W, data); err != nil {
+		return nil, fmt.Errorf("%w: reading from the memory bank: %w", ErrBusRead, err)
+	}
+	return data, nil
+}
 
+// memWriteBlock writes data to DMP memory beginning at addr, splitting it into chunks of at most MPU_MEM_CHUNK
+// bytes that don't cross a bank boundary, so that it may be as long as a whole DMP firmware image.
+// If verify is set, each chunk is read back and compared with what was written.
+func (mpu *MPU9250) memWriteBlock(addr uint16, data []byte, verify bool) error {
+	if int(addr)+len(data) > 0x10000 {
+		return fmt.Errorf("%w: writing past the end of memory", ErrInvalidSetting)
+	}
+	for len(data) > 0 {
+		n := MPU_BANK_SIZE - int(addr&0xFF)
+		if n > MPU_MEM_CHUNK {
+			n = MPU_MEM_CHUNK
+		}
+		if n > len(data) {
+			n = len(data)
+		}
+		chunk := data[:n]
+		if err := mpu.memWrite(addr, &chunk); err != nil {
+			return err
+		}
+		if verify {
+			got, err := mpu.memRead(addr, n)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, chunk) {
+				return fmt.Errorf("%w: memory at %X reads back % X, wrote % X", ErrBusWrite, addr, got, chunk)
+			}
+		}
+		addr += uint16(n)
+		data = data[n:]
+	}
 	return nil
 }
+
+// decodeMag decodes the AK8963 ST1, HXL..HZH, ST2 registers in buf.  ok is true only if ST1 shows new data is
+// ready (DRDY) and ST2 shows no magnetic sensor overflow (HOFL); an overflow is also returned as an error.
+func decodeMag(buf []byte) (m1, m2, m3 int16, ok bool, err error) {
+	if buf[0]&AKM_DATA_READY == 0 {
+		return // No new measurement since the last one
+	}
+	if buf[7]&AKM_ST2_HOFL != 0 {
+		err = fmt.Errorf("%w: magnetometer ST2 %X", ErrOverflow, buf[7])
+		return
+	}
+	// AK8963 data is little-endian
+	m1 = int16(uint16(buf[2])<<8 | uint16(buf[1]))
+	m2 = int16(uint16(buf[4])<<8 | uint16(buf[3]))
+	m3 = int16(uint16(buf[6])<<8 | uint16(buf[5]))
+	return m1, m2, m3, true, nil
+}
+
+// correctGA converts raw gyro, accel and temperature readings into d, removing the software biases and applying
+// the accel scale factors and any gyro temperature model.  mpu.mu must be held.
+func (mpu *MPU9250) correctGA(d *MPUData, g1, g2, g3, a1, a2, a3, tmp int16) {
+	d.G1 = (float64(g1) - mpu.g01) * mpu.scaleGyro
+	d.G2 = (float64(g2) - mpu.g02) * mpu.scaleGyro
+	d.G3 = (float64(g3) - mpu.g03) * mpu.scaleGyro
+	d.A1 = (float64(a1) - mpu.a01) * mpu.scaleAccel * mpu.as1
+	d.A2 = (float64(a2) - mpu.a02) * mpu.scaleAccel * mpu.as2
+	d.A3 = (float64(a3) - mpu.a03) * mpu.scaleAccel * mpu.as3
+	d.Temp = float64(tmp)/340 + 36.53
+	if mpu.gyroTemp != nil {
+		b := mpu.gyroTemp.At(d.Temp)
+		d.G1, d.G2, d.G3 = d.G1-b[0], d.G2-b[1], d.G3-b[2]
+	}
+}
+
+// magMode returns the AK8963 CNTL1 value selecting measurement mode at the configured output resolution.
+func (mpu *MPU9250) magMode(mode byte) byte {
+	if mpu.magBits == 16 {
+		return mode | AKM_BIT_16
+	}
+	return mode
+}
+
+// magScale returns the magnetometer sensitivity at the configured output resolution, uT per count.
+func (mpu *MPU9250) magScale() float64 {
+	if mpu.magBits == 16 {
+		return scaleMag
+	}
+	return 4 * scaleMag
+}
+
+// correctMag converts raw magnetometer readings to uT, applying the factory sensitivity adjustment
+// and then the hard- and soft-iron calibration.  mpu.mu must be held.
+func (mpu *MPU9250) correctMag(m1, m2, m3 int16) (c1, c2, c3 float64) {
+	c1 = (float64(m1)*mpu.mcal1 - mpu.m01) * mpu.ms1
+	c2 = (float64(m2)*mpu.mcal2 - mpu.m02) * mpu.ms2
+	c3 = (float64(m3)*mpu.mcal3 - mpu.m03) * mpu.ms3
+	return
+}
+
+// toInt16 decodes a big-endian 16-bit value as stored in the MPU9250 registers.
+func toInt16(b []byte) int16 {
+	return int16(uint16(b[0])<<8 | uint16(b[1]))
+}
+
+func clampInt16(x float64) int16 {
+	switch {
+	case x > math.MaxInt16:
+		return math.MaxInt16
+	case x < math.MinInt16:
+		return math.MinInt16
+	}
+	return int16(math.Floor(x + 0.5))
+}
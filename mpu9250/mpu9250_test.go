@@ -0,0 +1,1449 @@
+package mpu9250
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBus is an in-memory stand-in for an embd.I2CBus, holding a register map for the MPU9250
+// and recording every register write so that tests can inspect the init sequence.
+type fakeBus struct {
+	mu          sync.Mutex
+	regs        [256]byte
+	writes      []fakeWrite
+	fifo        []byte         // Contents of the hardware FIFO buffer
+	err         error          // If set, every bus operation fails with this error
+	failRegs    map[byte]error // Writes to these registers fail with the given error
+	addr        byte           // I2C address of the last register write
+	mem         [0x10000]byte  // DMP memory, accessed through BANK_SEL, MEM_START_ADDR and MEM_R_W
+	memAddr     uint16         // DMP memory address of the next MEM_R_W access
+	memReadOnly bool           // If set, writes to DMP memory are silently dropped
+	delay       time.Duration  // How long each block read takes
+}
+
+type fakeWrite struct {
+	reg, value byte
+}
+
+func newFakeBus() *fakeBus {
+	b := new(fakeBus)
+	b.regs[MPUREG_WHOAMI] = WHOAMI_MPU9250
+	b.regs[MPUREG_INT_STATUS] = BIT_RAW_RDY_INT
+	return b
+}
+
+func (b *fakeBus) setWord(reg byte, v int16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.regs[reg] = byte(uint16(v) >> 8)
+	b.regs[reg+1] = byte(uint16(v) & 0xFF)
+}
+
+func (b *fakeBus) pushFIFO(v ...int16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, x := range v {
+		b.fifo = append(b.fifo, byte(uint16(x)>>8), byte(uint16(x)&0xFF))
+	}
+}
+
+func (b *fakeBus) written(reg byte) (values []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, w := range b.writes {
+		if w.reg == reg {
+			values = append(values, w.value)
+		}
+	}
+	return
+}
+
+func (b *fakeBus) ReadByte(addr byte) (byte, error) {
+	return 0, errors.New("fakeBus: ReadByte not supported")
+}
+
+func (b *fakeBus) ReadBytes(addr byte, num int) ([]byte, error) {
+	return nil, errors.New("fakeBus: ReadBytes not supported")
+}
+
+func (b *fakeBus) WriteByte(addr, value byte) error {
+	return errors.New("fakeBus: WriteByte not supported")
+}
+
+func (b *fakeBus) WriteBytes(addr byte, value []byte) error {
+	return errors.New("fakeBus: WriteBytes not supported")
+}
+
+func (b *fakeBus) ReadFromReg(addr, reg byte, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	time.Sleep(b.delay)
+	if b.err != nil {
+		return b.err
+	}
+	if reg == MPUREG_FIFO_R_W {
+		n := copy(value, b.fifo)
+		b.fifo = b.fifo[n:]
+		return nil
+	}
+	if reg == MPUREG_FIFO_COUNTH {
+		value[0], value[1] = byte(len(b.fifo)>>8), byte(len(b.fifo)&0xFF)
+		return nil
+	}
+	if reg == MPUREG_MEM_R_W {
+		for i := range value {
+			value[i] = b.mem[b.memAddr]
+			b.memAddr++
+		}
+		return nil
+	}
+	for i := range value {
+		value[i] = b.regs[reg+byte(i)]
+	}
+	return nil
+}
+
+func (b *fakeBus) ReadByteFromReg(addr, reg byte) (byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.regs[reg], nil
+}
+
+func (b *fakeBus) ReadWordFromReg(addr, reg byte) (uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	return uint16(b.regs[reg])<<8 | uint16(b.regs[reg+1]), nil
+}
+
+func (b *fakeBus) WriteToReg(addr, reg byte, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if err := b.failRegs[reg]; err != nil {
+		return err
+	}
+	for _, v := range value {
+		b.writes = append(b.writes, fakeWrite{reg, v})
+	}
+	switch {
+	case reg == MPUREG_BANK_SEL && len(value) == 2:
+		b.memAddr = uint16(value[0])<<8 | uint16(value[1])
+	case reg == MPUREG_MEM_R_W:
+		for _, v := range value {
+			if !b.memReadOnly {
+				b.mem[b.memAddr] = v
+			}
+			b.memAddr++
+		}
+	}
+	b.addr = addr
+	return nil
+}
+
+func (b *fakeBus) WriteByteToReg(addr, reg, value byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if err := b.failRegs[reg]; err != nil {
+		return err
+	}
+	b.writes = append(b.writes, fakeWrite{reg, value})
+	b.regs[reg] = value
+	b.addr = addr
+	return nil
+}
+
+func (b *fakeBus) WriteWordToReg(addr, reg byte, value uint16) error {
+	if err := b.WriteByteToReg(addr, reg, byte(value>>8)); err != nil {
+		return err
+	}
+	return b.WriteByteToReg(addr, reg+1, byte(value&0xFF))
+}
+
+func (b *fakeBus) Close() error {
+	return nil
+}
+
+// fakeSPIBus is an embd.SPIBus in front of a fakeBus, decoding each transfer as the MPU9250 does:
+// the register address, with READ_FLAG set for a read, then the data.  It records every transfer as sent.
+type fakeSPIBus struct {
+	bus       *fakeBus
+	mu        sync.Mutex
+	transfers [][]byte
+}
+
+func newFakeSPIBus() *fakeSPIBus {
+	return &fakeSPIBus{bus: newFakeBus()}
+}
+
+func (b *fakeSPIBus) lastTransfer() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.transfers[len(b.transfers)-1]
+}
+
+func (b *fakeSPIBus) TransferAndReceiveData(buf []byte) error {
+	b.mu.Lock()
+	b.transfers = append(b.transfers, append([]byte(nil), buf...))
+	b.mu.Unlock()
+	if len(buf) < 2 {
+		return errors.New("fakeSPIBus: transfer too short")
+	}
+	if buf[0]&READ_FLAG != 0 {
+		return b.bus.ReadFromReg(0, buf[0]&^READ_FLAG, buf[1:])
+	}
+	if len(buf) == 2 {
+		return b.bus.WriteByteToReg(0, buf[0], buf[1])
+	}
+	return b.bus.WriteToReg(0, buf[0], buf[1:])
+}
+
+func (b *fakeSPIBus) Write(data []byte) (int, error) {
+	return 0, errors.New("fakeSPIBus: Write not supported")
+}
+
+func (b *fakeSPIBus) ReceiveData(len int) ([]byte, error) {
+	return nil, errors.New("fakeSPIBus: ReceiveData not supported")
+}
+
+func (b *fakeSPIBus) TransferAndReceiveByte(data byte) (byte, error) {
+	return 0, errors.New("fakeSPIBus: TransferAndReceiveByte not supported")
+}
+
+func (b *fakeSPIBus) ReceiveByte() (byte, error) {
+	return 0, errors.New("fakeSPIBus: ReceiveByte not supported")
+}
+
+func (b *fakeSPIBus) Close() error {
+	return nil
+}
+
+// newTestMPU creates an MPU9250 on bus, at 250°/s, 4G and 100Hz unless opts say otherwise,
+// and closes it when the test is done.
+func newTestMPU(t *testing.T, bus *fakeBus, opts ...Option) *MPU9250 {
+	t.Helper()
+	mpu, err := New(append([]Option{WithBus(bus)}, opts...)...)
+	if err != nil {
+		t.Fatalf("unexpected error creating MPU9250: %s", err)
+	}
+	t.Cleanup(mpu.CloseMPU)
+	return mpu
+}
+
+// skipSamples restarts the averages and discards the buffered samples.  The reader only sends CAvg between reads,
+// so any sample read before the call is left out of both.
+func skipSamples(mpu *MPU9250) {
+	<-mpu.CAvg
+	for {
+		select {
+		case <-mpu.CBuf:
+		default:
+			return
+		}
+	}
+}
+
+// waitSamples waits for the reader to take n more gyro/accel samples, failing the test if they take over a second.
+func waitSamples(t *testing.T, mpu *MPU9250, n int) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-mpu.CBuf:
+		case <-timeout:
+			t.Fatalf("only %d of %d samples taken in a second", i, n)
+		}
+	}
+}
+
+// freshAvg returns the average of at least n gyro/accel samples, all read after the call.
+func freshAvg(t *testing.T, mpu *MPU9250, n int) *MPUData {
+	t.Helper()
+	skipSamples(mpu)
+	waitSamples(t, mpu, n)
+	return <-mpu.CAvg
+}
+
+func TestNewMPU9250WithBus(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192) // 1G at 4G full scale
+
+	mpu, err := NewMPU9250WithBus(bus, 250, 4, 100, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating MPU9250: %s", err)
+	}
+	t.Cleanup(mpu.CloseMPU)
+
+	if v := bus.written(MPUREG_GYRO_CONFIG); len(v) == 0 || v[len(v)-1] != BITS_FS_250DPS {
+		t.Errorf("gyro sensitivity not written correctly: %v", v)
+	}
+	if v := bus.written(MPUREG_ACCEL_CONFIG); len(v) == 0 || v[len(v)-1] != BITS_FS_4G {
+		t.Errorf("accel sensitivity not written correctly: %v", v)
+	}
+	if v := bus.written(MPUREG_SMPLRT_DIV); len(v) == 0 || v[len(v)-1] != 9 {
+		t.Errorf("sample rate divider not written correctly: %v", v)
+	}
+
+	d := <-mpu.C
+	if d.GAError != nil {
+		t.Errorf("unexpected gyro/accel error: %s", d.GAError)
+	}
+	if d.A3 < 0.99 || d.A3 > 1.01 {
+		t.Errorf("expected A3 of 1G, got %f", d.A3)
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 4096) // 1G at 8G full scale
+
+	mpu := newTestMPU(t, bus, WithAddress(0x69), WithAccelRange(8), WithSampleRate(50), WithGyroLPF(20))
+
+	if bus.addr != 0x69 {
+		t.Errorf("expected writes to address 0x69, got 0x%02x", bus.addr)
+	}
+	if v := bus.written(MPUREG_GYRO_CONFIG); len(v) == 0 || v[len(v)-1] != BITS_FS_250DPS {
+		t.Errorf("default gyro sensitivity not written correctly: %v", v)
+	}
+	if v := bus.written(MPUREG_ACCEL_CONFIG); len(v) == 0 || v[len(v)-1] != BITS_FS_8G {
+		t.Errorf("accel sensitivity not written correctly: %v", v)
+	}
+	if v := bus.written(MPUREG_SMPLRT_DIV); len(v) == 0 || v[len(v)-1] != 19 {
+		t.Errorf("sample rate divider not written correctly: %v", v)
+	}
+	if v := bus.written(MPUREG_CONFIG); len(v) == 0 || v[len(v)-1] != BITS_DLPF_CFG_20HZ {
+		t.Errorf("gyro LPF not written correctly: %v", v)
+	}
+
+	if d := <-mpu.C; d.A3 < 0.99 || d.A3 > 1.01 {
+		t.Errorf("expected A3 of 1G, got %f", d.A3)
+	}
+
+	if _, err := New(WithBus(newFakeBus()), WithSampleRate(2000)); err == nil {
+		t.Error("expected an error for a sample rate of 2000Hz")
+	}
+}
+
+func TestNewMPU9250WithBusError(t *testing.T) {
+	bus := newFakeBus()
+	bus.err = errors.New("bus failure")
+
+	if _, err := NewMPU9250WithBus(bus, 250, 4, 100, false, false); err == nil {
+		t.Error("expected an error from a failing bus")
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	if err := mpu.EnableFIFO(true); err != nil {
+		t.Fatalf("unexpected error enabling FIFO: %s", err)
+	}
+	if v := bus.written(MPUREG_FIFO_EN); v[len(v)-1] != BITS_FIFO_ACCEL|BITS_FIFO_GYRO {
+		t.Errorf("FIFO_EN not configured correctly: %v", v)
+	}
+	skipSamples(mpu)
+
+	// Three frames of accel x, y, z, gyro x, y, z
+	bus.pushFIFO(
+		0, 0, 8192, 131, 0, 0,
+		0, 0, 8192, 393, 0, 0,
+		0, 0, 8192, 262, 0, 0,
+	)
+	waitSamples(t, mpu, 3)
+
+	d := <-mpu.CAvg
+	if d.N != 3 {
+		t.Fatalf("expected 3 FIFO samples, got %d", d.N)
+	}
+	if d.A3 < 0.99 || d.A3 > 1.01 {
+		t.Errorf("expected A3 of 1G, got %f", d.A3)
+	}
+	if d.G1 < 1.99 || d.G1 > 2.01 {
+		t.Errorf("expected G1 of 2°/s, got %f", d.G1)
+	}
+
+	// Once closed, there's no reader to switch over
+	mpu.CloseMPU()
+	if err := mpu.EnableFIFO(false); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("expected ErrNotRunning disabling the FIFO after closing, got %v", err)
+	}
+}
+
+func TestDataReadyInterruptNotRunning(t *testing.T) {
+	mpu := newTestMPU(t, newFakeBus())
+	mpu.CloseMPU()
+
+	if err := mpu.EnableDataReadyInterrupt(17); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("expected ErrNotRunning enabling the interrupt after closing, got %v", err)
+	}
+	if err := mpu.DisableDataReadyInterrupt(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("expected ErrNotRunning disabling the interrupt after closing, got %v", err)
+	}
+}
+
+func TestWakeOnMotionMagContinuous(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus, WithMagnetometer(true))
+	if err := mpu.EnableMagContinuous(true); err != nil {
+		t.Fatalf("unexpected error enabling continuous mag mode: %s", err)
+	}
+
+	// Slave 1 must be enabled for the power down to reach the AK8963
+	if err := mpu.EnableWakeOnMotion(10, 5); err != nil {
+		t.Fatalf("unexpected error enabling wake on motion: %s", err)
+	}
+	if v := bus.written(MPUREG_I2C_SLV1_CTRL); v[len(v)-1] != BIT_SLAVE_EN|1 {
+		t.Errorf("slave 1 not enabled to power down the AK8963: %v", v)
+	}
+	if v := bus.written(MPUREG_I2C_SLV1_DO); v[len(v)-1] != AKM_POWER_DOWN {
+		t.Errorf("AK8963 not powered down: %v", v)
+	}
+
+	// and continuous mode comes back afterwards
+	if err := mpu.DisableWakeOnMotion(); err != nil {
+		t.Fatalf("unexpected error disabling wake on motion: %s", err)
+	}
+	if v := bus.written(MPUREG_I2C_SLV1_DO); v[len(v)-1] != AKM_CONTINUOUS_100HZ|AKM_BIT_16 {
+		t.Errorf("AK8963 continuous mode not restored: %v", v)
+	}
+	if v := bus.written(MPUREG_I2C_SLV1_CTRL); v[len(v)-1] != 0 {
+		t.Errorf("slave 1 still rewriting CNTL1 in continuous mode: %v", v)
+	}
+
+	mpu.CloseMPU()
+	if err := mpu.EnableWakeOnMotion(10, 5); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("expected ErrNotRunning enabling wake on motion after closing, got %v", err)
+	}
+	if err := mpu.DisableWakeOnMotion(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("expected ErrNotRunning disabling wake on motion after closing, got %v", err)
+	}
+}
+
+func TestWriteGyroBias(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	bus.setWord(MPUREG_XG_OFFS_USRH, 10)
+	mpu.mu.Lock()
+	mpu.g01 = 8 // 2 LSB at the 1000°/s scale of the offset registers
+	mpu.mu.Unlock()
+	if err := mpu.WriteGyroBias(); err != nil {
+		t.Fatalf("unexpected error writing gyro bias: %s", err)
+	}
+
+	h, l := bus.written(MPUREG_XG_OFFS_USRH), bus.written(MPUREG_XG_OFFS_USRL)
+	if v := int16(uint16(h[len(h)-1])<<8 | uint16(l[len(l)-1])); v != 8 {
+		t.Errorf("expected gyro offset register 8, got %d", v)
+	}
+	mpu.mu.Lock()
+	defer mpu.mu.Unlock()
+	if mpu.g01 != 0 {
+		t.Errorf("software gyro bias not zeroed: %f", mpu.g01)
+	}
+}
+
+func TestSetGyroRange(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_GYRO_XOUT_H, 16384)
+	mpu := newTestMPU(t, bus)
+
+	if d := freshAvg(t, mpu, 1); d.G1 < 124.9 || d.G1 > 125.1 {
+		t.Errorf("expected G1 of 125°/s at 250°/s full scale, got %f", d.G1)
+	}
+
+	if err := mpu.SetGyroRange(2000); err != nil {
+		t.Fatalf("unexpected error setting gyro range: %s", err)
+	}
+	if v := bus.written(MPUREG_GYRO_CONFIG); v[len(v)-1] != BITS_FS_2000DPS {
+		t.Errorf("gyro range not written correctly: %v", v)
+	}
+	if d := freshAvg(t, mpu, 1); d.G1 < 999.9 || d.G1 > 1000.1 {
+		t.Errorf("expected G1 of 1000°/s at 2000°/s full scale, got %f", d.G1)
+	}
+
+	if s := mpu.GyroScale(); s != 2000.0/math.MaxInt16 {
+		t.Errorf("expected gyro scale for 2000°/s, got %g", s)
+	}
+
+	if err := mpu.SetGyroRange(300); err == nil {
+		t.Error("expected an error for an invalid gyro range")
+	}
+}
+
+func TestSetAccelRange(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192) // 1G at 4G full scale
+	mpu := newTestMPU(t, bus)
+	mpu.mu.Lock()
+	mpu.a03 = 100
+	mpu.mu.Unlock()
+
+	if err := mpu.SetAccelRange(16); err != nil {
+		t.Fatalf("unexpected error setting accel range: %s", err)
+	}
+	if v := bus.written(MPUREG_ACCEL_CONFIG); v[len(v)-1] != BITS_FS_16G {
+		t.Errorf("accel range not written correctly: %v", v)
+	}
+	mpu.mu.Lock()
+	if mpu.a03 != 25 {
+		t.Errorf("expected software accel bias rescaled to 25, got %f", mpu.a03)
+	}
+	mpu.mu.Unlock()
+
+	// The chip now reports the same static 1G at the 16G full scale.
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 2048+25)
+	if d := freshAvg(t, mpu, 1); d.A3 < 0.99 || d.A3 > 1.01 {
+		t.Errorf("expected A3 of 1G at 16G full scale, got %f", d.A3)
+	}
+
+	if s := mpu.AccelScale(); s != 16.0/math.MaxInt16 {
+		t.Errorf("expected accel scale for 16G, got %g", s)
+	}
+
+	if err := mpu.SetAccelRange(3); err == nil {
+		t.Error("expected an error for an invalid accel range")
+	}
+}
+
+func TestReadRaw(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192)
+	bus.setWord(MPUREG_GYRO_XOUT_H, -100)
+	mpu := newTestMPU(t, bus)
+
+	mpu.ReadRaw()
+	skipSamples(mpu)
+	waitSamples(t, mpu, 5)
+	n, g1, _, _, _, _, a3, _, err := mpu.ReadRaw()
+	if err != nil {
+		t.Fatalf("unexpected error reading raw values: %s", err)
+	}
+	if n == 0 {
+		t.Fatal("expected some raw samples")
+	}
+	if a3 != int64(n)*8192 || g1 != int64(n)*-100 {
+		t.Errorf("expected summed counts for %d samples, got a3=%d g1=%d", n, a3, g1)
+	}
+}
+
+func TestReadRawLongInterval(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_GYRO_XOUT_H, 32767)
+	bus.setWord(MPUREG_ACCEL_XOUT_H, -32768)
+	mpu := newTestMPU(t, bus, WithSampleRate(1000))
+
+	// Simulate more than a minute at 1kHz, enough full-scale samples to overflow 32-bit sums
+	const samples = 70000
+	tick := make(chan time.Time)
+	mpu.cTick <- tick
+	mpu.ReadRaw()
+	t0 := time.Now()
+	for i := 1; i <= samples; i++ {
+		tick <- t0.Add(time.Duration(i) * time.Millisecond)
+	}
+	n, g1, _, _, a1, _, _, _, err := mpu.ReadRaw()
+	if err != nil || n != samples {
+		t.Fatalf("expected %d samples, got %d, error %v", samples, n, err)
+	}
+	if g1 != samples*32767 || a1 != samples*-32768 {
+		t.Errorf("expected sums %d and %d, got %d and %d", samples*32767, samples*-32768, g1, a1)
+	}
+}
+
+func TestReadImmediate(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192)
+	bus.setWord(MPUREG_GYRO_XOUT_H, 131)
+	mpu := newTestMPU(t, bus, WithMagnetometer(true))
+	// Measurement already consumed: DRDY clear
+	bus.mu.Lock()
+	copy(bus.regs[MPUREG_EXT_SENS_DATA_00:], []byte{0, 0x10, 0x00, 0, 0, 0, 0, 0x10})
+	bus.mu.Unlock()
+
+	d, err := mpu.ReadImmediate()
+	if err != nil {
+		t.Fatalf("unexpected error reading immediately: %s", err)
+	}
+	if d.N != 1 || math.Abs(d.A3-1) > 0.01 || math.Abs(d.G1-1) > 0.01 {
+		t.Errorf("expected a single sample with A3 of 1G and G1 of 1°/s, got %d with %f, %f", d.N, d.A3, d.G1)
+	}
+	if d.MagError != nil || math.Abs(d.M1/mpu.mcal1-16) > 1e-6 {
+		t.Errorf("expected M1 of 16 counts, got %f, error %v", d.M1/mpu.mcal1, d.MagError)
+	}
+
+	mpu.CloseMPU()
+	if _, err := mpu.ReadImmediate(); err == nil {
+		t.Error("expected an error reading immediately from a closed MPU9250")
+	}
+}
+
+func TestSampleTimes(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	d := freshAvg(t, mpu, 5)
+	if d.N < 2 {
+		t.Fatalf("expected several samples, got %d", d.N)
+	}
+	if d.T0.IsZero() || !d.T0.Before(d.T) {
+		t.Errorf("expected first sample time %v before last sample time %v", d.T0, d.T)
+	}
+	if dt := d.T.Sub(d.T0); dt < time.Duration(d.N-2)*10*time.Millisecond {
+		t.Errorf("sample window %v too short for %d samples", dt, d.N)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	cErr := mpu.Errors()
+	bus.mu.Lock()
+	bus.err = errors.New("bus failure")
+	bus.mu.Unlock()
+
+	select {
+	case err := <-cErr:
+		if e, ok := err.(*SensorError); !ok || e.Sensor != "gyro/accel" || e.Err == nil {
+			t.Errorf("unexpected sensor error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("no sensor error received")
+	}
+}
+
+func TestFrozenDetection(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192)
+	mpu := newTestMPU(t, bus, WithFrozenDetection(5))
+
+	// The fake bus reads the same values every sample
+	cErr := mpu.Errors()
+	select {
+	case err := <-cErr:
+		if e, ok := err.(*SensorError); !ok || e.Sensor != "gyro/accel" || !errors.Is(err, ErrFrozen) {
+			t.Errorf("unexpected sensor error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("no frozen sensor error received")
+	}
+	if d := <-mpu.CAvg; !errors.Is(d.GAError, ErrNoData) {
+		t.Errorf("frozen samples were averaged: %v", d.GAError)
+	}
+
+	mpu.SetFrozenDetection(0)
+	if d := freshAvg(t, mpu, 2); d.GAError != nil || d.N == 0 {
+		t.Errorf("samples weren't averaged with frozen detection off: %v", d.GAError)
+	}
+}
+
+func TestMagCadence(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus, WithSampleRate(200), WithMagnetometer(true))
+
+	bus.mu.Lock()
+	copy(bus.regs[MPUREG_EXT_SENS_DATA_00:], []byte{AKM_DATA_READY, 0x10, 0x00, 0, 0, 0, 0, 0x10})
+	bus.mu.Unlock()
+
+	// The magnetometer is read at its own 100Hz, and only its frames are averaged
+	d := freshAvg(t, mpu, 40)
+	if d.NM == 0 || d.NM > d.N*2/3 {
+		t.Errorf("expected about half as many mag samples as gyro/accel, got %d and %d", d.NM, d.N)
+	}
+	if m := d.M1 / mpu.mcal1; math.Abs(m-16) > 1e-6 {
+		t.Errorf("expected average M1 of 16 counts, got %f", m)
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	bus := newFakeBus()
+	bus.regs[MPUREG_WHOAMI] = WHOAMI_MPU6500
+	mpu := newTestMPU(t, bus, WithMagnetometer(true))
+	if mpu.MagEnabled() {
+		t.Error("magnetometer should be disabled on an MPU6500")
+	}
+	if v := bus.written(MPUREG_I2C_SLV0_ADDR); len(v) != 0 {
+		t.Errorf("AK8963 should not be set up on an MPU6500: %v", v)
+	}
+	if d := <-mpu.CAvg; d.MagError == nil {
+		t.Error("expected no valid magnetometer values from an MPU6500")
+	}
+
+	// The MPU6050 has its accel offsets at XA_OFFS_H etc. and no ACCEL_CONFIG_2
+	bus = newFakeBus()
+	bus.regs[MPUREG_WHOAMI] = WHOAMI_MPU6050
+	bus.setWord(MPUREG_XA_OFFS_H, 100)
+	bus.setWord(MPUREG_XA_OFFSET_H, 200)
+	mpu = newTestMPU(t, bus, WithAccelRange(8), WithMagnetometer(true), WithHWOffsets(true))
+	if mpu.MagEnabled() {
+		t.Error("magnetometer should be disabled on an MPU6050")
+	}
+	if d := <-mpu.CAvg; d.MagError == nil {
+		t.Error("expected no valid magnetometer values from an MPU6050")
+	}
+	if v := bus.written(MPUREG_ACCEL_CONFIG_2); len(v) != 0 {
+		t.Errorf("ACCEL_CONFIG_2 should not be written on an MPU6050: %v", v)
+	}
+	mpu.mu.Lock()
+	if mpu.a01 != 100 {
+		t.Errorf("expected accel bias 100 from XA_OFFS_H, got %f", mpu.a01)
+	}
+	mpu.mu.Unlock()
+	if err := mpu.SetAccelLPF(5); !errors.Is(err, ErrInvalidSetting) {
+		t.Errorf("expected ErrInvalidSetting setting the accel LPF of an MPU6050, got %v", err)
+	}
+
+	// Unsupported parts are rejected before anything is configured
+	bus = newFakeBus()
+	bus.regs[MPUREG_WHOAMI] = 0x12
+	if _, err := NewMPU9250WithBus(bus, 250, 4, 100, false, false); !errors.Is(err, ErrWhoAmI) {
+		t.Errorf("expected ErrWhoAmI for an unsupported WHO_AM_I, got %v", err)
+	}
+	if v := bus.written(MPUREG_GYRO_CONFIG); len(v) != 0 {
+		t.Errorf("unsupported part was configured: %v", v)
+	}
+}
+
+func TestSPITransport(t *testing.T) {
+	bus := newFakeSPIBus()
+	tr := &spiTransport{bus}
+
+	if err := tr.writeReg(MPUREG_SMPLRT_DIV, 9); err != nil {
+		t.Fatalf("unexpected error writing a register: %s", err)
+	}
+	if b := bus.lastTransfer(); !bytes.Equal(b, []byte{MPUREG_SMPLRT_DIV, 9}) {
+		t.Errorf("register write sent %v", b)
+	}
+	if err := tr.writeRegs(MPUREG_XG_OFFS_USRH, []byte{1, 2}); err != nil {
+		t.Fatalf("unexpected error writing registers: %s", err)
+	}
+	if b := bus.lastTransfer(); !bytes.Equal(b, []byte{MPUREG_XG_OFFS_USRH, 1, 2}) {
+		t.Errorf("multi-byte register write sent %v", b)
+	}
+
+	bus.bus.setWord(MPUREG_ACCEL_XOUT_H, 0x1234)
+	bus.bus.setWord(MPUREG_ACCEL_YOUT_H, 0x5678)
+	v, err := tr.readReg(MPUREG_ACCEL_XOUT_H)
+	if err != nil {
+		t.Fatalf("unexpected error reading a register: %s", err)
+	}
+	if b := bus.lastTransfer(); !bytes.Equal(b, []byte{MPUREG_ACCEL_XOUT_H | READ_FLAG, 0}) {
+		t.Errorf("register read sent %v", b)
+	}
+	if v != 0x12 {
+		t.Errorf("read register value %X, expected 12", v)
+	}
+	buf := make([]byte, 4)
+	if err := tr.readRegs(MPUREG_ACCEL_XOUT_H, buf); err != nil {
+		t.Fatalf("unexpected error reading registers: %s", err)
+	}
+	if b := bus.lastTransfer(); len(b) != 5 || b[0] != MPUREG_ACCEL_XOUT_H|READ_FLAG {
+		t.Errorf("multi-byte register read sent %v", b)
+	}
+	if !bytes.Equal(buf, []byte{0x12, 0x34, 0x56, 0x78}) {
+		t.Errorf("read register values %v", buf)
+	}
+
+	// A whole MPU9250 comes up over SPI with its I2C interface disabled, but not with the magnetometer,
+	// whose calibration needs the I2C bypass
+	bus = newFakeSPIBus()
+	newTestMPU(t, bus.bus, WithSPIBus(bus))
+	if v := bus.bus.written(MPUREG_USER_CTRL); len(v) == 0 || v[0] != BIT_I2C_IF_DIS {
+		t.Errorf("expected the I2C interface to be disabled first, got USER_CTRL writes %v", v)
+	}
+	if _, err := New(WithSPIBus(newFakeSPIBus()), WithMagnetometer(true)); !errors.Is(err, ErrInvalidSetting) {
+		t.Errorf("expected ErrInvalidSetting enabling the magnetometer over SPI, got %v", err)
+	}
+}
+
+func TestLPF(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	// Defaults to half the 100Hz sample rate
+	if v := bus.written(MPUREG_CONFIG); len(v) == 0 || v[len(v)-1] != BITS_DLPF_CFG_42HZ {
+		t.Errorf("default gyro LPF not written correctly: %v", v)
+	}
+	if v := bus.written(MPUREG_ACCEL_CONFIG_2); len(v) == 0 || v[len(v)-1] != BITS_DLPF_CFG_42HZ {
+		t.Errorf("default accel LPF not written correctly: %v", v)
+	}
+
+	if err := mpu.SetGyroLPF(5); err != nil {
+		t.Fatalf("unexpected error setting gyro LPF: %s", err)
+	}
+	if err := mpu.SetAccelLPF(5); err != nil {
+		t.Fatalf("unexpected error setting accel LPF: %s", err)
+	}
+	if v := bus.written(MPUREG_CONFIG); v[len(v)-1] != BITS_DLPF_CFG_5HZ {
+		t.Errorf("gyro LPF not written correctly: %v", v)
+	}
+	if v := bus.written(MPUREG_ACCEL_CONFIG_2); v[len(v)-1] != BITS_DLPF_CFG_5HZ {
+		t.Errorf("accel LPF not written correctly: %v", v)
+	}
+}
+
+func TestI2CRead2Error(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	mpu.Errors() // Don't log the reader's errors
+	bus.mu.Lock()
+	busErr := errors.New("bus failure")
+	bus.err = busErr
+	bus.mu.Unlock()
+	if _, err := mpu.i2cRead2(MPUREG_TEMP_OUT_H); err == nil {
+		t.Error("expected an error from a failing bus")
+	} else if !strings.Contains(err.Error(), "bus failure") {
+		t.Errorf("expected the bus error to be reported, got %q", err)
+	} else if !errors.Is(err, ErrBusRead) || !errors.Is(err, busErr) {
+		t.Errorf("expected the error to wrap ErrBusRead and the bus error, got %q", err)
+	}
+	if err := mpu.SetGyroRange(500); !errors.Is(err, ErrBusWrite) {
+		t.Errorf("expected ErrBusWrite setting the gyro range, got %v", err)
+	}
+	if err := mpu.SetGyroRange(300); !errors.Is(err, ErrInvalidSetting) {
+		t.Errorf("expected ErrInvalidSetting for a gyro range of 300, got %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus, WithGyroRange(500), WithAccelRange(8))
+	mpu.SetGyroLPF(20)
+
+	exp := Config{WhoAmI: WHOAMI_MPU9250, GyroRange: 500, AccelRange: 8, SampleRate: 100,
+		GyroLPF: 20, AccelLPF: 45, MagEnabled: false, MagBits: 16}
+	if c := mpu.Config(); c != exp {
+		t.Errorf("expected config %+v, got %+v", exp, c)
+	}
+}
+
+func TestMagContinuous(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus, WithMagnetometer(true))
+
+	if err := mpu.EnableMagContinuous(true); err != nil {
+		t.Fatalf("unexpected error enabling continuous mag mode: %s", err)
+	}
+	if v := bus.written(MPUREG_I2C_SLV1_DO); v[len(v)-1] != AKM_CONTINUOUS_100HZ|AKM_BIT_16 {
+		t.Errorf("AK8963 mode not written correctly: %v", v)
+	}
+
+	// ST1 data ready, then little-endian x, y, z, then ST2
+	bus.mu.Lock()
+	copy(bus.regs[MPUREG_EXT_SENS_DATA_00:], []byte{AKM_DATA_READY, 0x10, 0x00, 0xF0, 0xFF, 0x00, 0x01, 0x10})
+	bus.mu.Unlock()
+
+	d := freshAvg(t, mpu, 5)
+	if d.MagError != nil {
+		t.Fatalf("unexpected mag error: %s", d.MagError)
+	}
+	if m := d.M1 / mpu.mcal1; m < 15.99 || m > 16.01 {
+		t.Errorf("expected raw M1 of 16, got %f", m)
+	}
+	if m := d.M2 / mpu.mcal2; m < -16.01 || m > -15.99 {
+		t.Errorf("expected raw M2 of -16, got %f", m)
+	}
+	if m := d.M3 / mpu.mcal3; m < 255.99 || m > 256.01 {
+		t.Errorf("expected raw M3 of 256, got %f", m)
+	}
+}
+
+func TestEffectiveSampleRate(t *testing.T) {
+	for _, c := range []struct {
+		rate int
+		exp  float64
+	}{{100, 100}, {75, 1000.0 / 13}, {300, 1000.0 / 3}} {
+		mpu := newTestMPU(t, newFakeBus(), WithSampleRate(c.rate))
+		if r := mpu.EffectiveSampleRate(); math.Abs(r-c.exp) > 1e-9 {
+			t.Errorf("requested %dHz: expected effective rate %f, got %f", c.rate, c.exp, r)
+		}
+	}
+}
+
+func TestTrimmedMean(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+	if err := mpu.EnableFIFO(true); err != nil {
+		t.Fatalf("unexpected error enabling FIFO: %s", err)
+	}
+	mpu.EnableTrimmedMean(true)
+	skipSamples(mpu)
+
+	// A glitch on accel z in one of four frames
+	bus.pushFIFO(
+		0, 0, 8192, 0, 0, 0,
+		0, 0, 8192, 0, 0, 0,
+		0, 0, 32767, 0, 0, 0,
+		0, 0, 8192, 0, 0, 0,
+	)
+	waitSamples(t, mpu, 4)
+
+	d := <-mpu.CAvg
+	if d.N != 4 {
+		t.Fatalf("expected 4 FIFO samples, got %d", d.N)
+	}
+	if d.A3 < 0.99 || d.A3 > 1.01 {
+		t.Errorf("expected trimmed A3 of 1G, got %f", d.A3)
+	}
+}
+
+func TestMagCalibration(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus, WithMagnetometer(true))
+	if err := mpu.EnableMagContinuous(true); err != nil {
+		t.Fatalf("unexpected error enabling continuous mag mode: %s", err)
+	}
+	mpu.SetMagCalibration([3]float64{16 * mpu.mcal1, 0, 0}, [3]float64{1, 1, 2})
+
+	bus.mu.Lock()
+	copy(bus.regs[MPUREG_EXT_SENS_DATA_00:], []byte{AKM_DATA_READY, 0x10, 0x00, 0xF0, 0xFF, 0x00, 0x01, 0x10})
+	bus.mu.Unlock()
+
+	d := freshAvg(t, mpu, 5)
+	if math.Abs(d.M1) > 1e-9 {
+		t.Errorf("expected M1 offset to 0, got %f", d.M1)
+	}
+	if m := d.M3 / mpu.mcal3; m < 511.99 || m > 512.01 {
+		t.Errorf("expected M3 scaled to 512, got %f", m)
+	}
+}
+
+func TestMagResolution(t *testing.T) {
+	bus16 := newFakeBus()
+	mpu16 := newTestMPU(t, bus16, WithMagnetometer(true))
+	bus14 := newFakeBus()
+	mpu14 := newTestMPU(t, bus14, WithMagnetometer(true), WithMagResolution(14))
+
+	if v := bus16.written(MPUREG_I2C_SLV1_DO); v[len(v)-1] != AKM_SINGLE_MEASUREMENT|AKM_BIT_16 {
+		t.Errorf("expected 16-bit single measurement mode, got %X", v[len(v)-1])
+	}
+	if v := bus14.written(MPUREG_I2C_SLV1_DO); v[len(v)-1] != AKM_SINGLE_MEASUREMENT {
+		t.Errorf("expected 14-bit single measurement mode, got %X", v[len(v)-1])
+	}
+	if c := mpu14.Config(); c.MagBits != 14 {
+		t.Errorf("expected Config to report 14-bit magnetometer, got %d", c.MagBits)
+	}
+	// A 14-bit count is 0.6uT, a 16-bit count 0.15uT
+	if r := mpu14.mcal1 / mpu16.mcal1; math.Abs(r-4) > 1e-9 {
+		t.Errorf("expected 14-bit counts to be 4 times 16-bit counts, got %f", r)
+	}
+	if m := mpu16.mcal1 / (float64(int16(bus16.regs[AK8963_ASAX])+128) / 256); math.Abs(m-0.15) > 0.001 {
+		t.Errorf("expected 0.15uT per 16-bit count, got %f", m)
+	}
+
+	if _, err := New(WithBus(newFakeBus()), WithMagnetometer(true), WithMagResolution(12)); !errors.Is(err, ErrInvalidSetting) {
+		t.Errorf("expected ErrInvalidSetting for a 12-bit magnetometer, got %v", err)
+	}
+}
+
+func TestReadStruct(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192)
+	bus.setWord(MPUREG_GYRO_YOUT_H, 131)
+	mpu := newTestMPU(t, bus)
+
+	skipSamples(mpu)
+	waitSamples(t, mpu, 2)
+	r := mpu.ReadStruct()
+	if r.GAErr != nil {
+		t.Fatalf("unexpected gyro/accel error: %s", r.GAErr)
+	}
+	if r.Accel[2] < 0.99 || r.Accel[2] > 1.01 {
+		t.Errorf("expected Accel[2] of 1G, got %f", r.Accel[2])
+	}
+	if r.Gyro[1] < 0.99 || r.Gyro[1] > 1.01 {
+		t.Errorf("expected Gyro[1] of 1°/s, got %f", r.Gyro[1])
+	}
+	if r.MagErr == nil {
+		t.Error("expected a mag error with the magnetometer disabled")
+	}
+}
+
+func TestDecodeMag(t *testing.T) {
+	for _, c := range []struct {
+		buf    []byte
+		m1     int16
+		ok     bool
+		hasErr bool
+	}{
+		{[]byte{AKM_DATA_READY, 0x10, 0x00, 0, 0, 0, 0, 0x10}, 16, true, false},
+		{[]byte{0, 0x10, 0x00, 0, 0, 0, 0, 0x10}, 0, false, false},                                 // Not ready
+		{[]byte{AKM_DATA_READY | AKM_DATA_OVERRUN, 0x10, 0x00, 0, 0, 0, 0, 0x10}, 16, true, false}, // Skipped data is fine
+		{[]byte{AKM_DATA_READY, 0x10, 0x00, 0, 0, 0, 0, 0x10 | AKM_ST2_HOFL}, 0, false, true},      // Overflow
+	} {
+		m1, _, _, ok, err := decodeMag(c.buf)
+		if ok != c.ok || (err != nil) != c.hasErr || m1 != c.m1 {
+			t.Errorf("decodeMag(%X): got m1=%d ok=%t err=%v", c.buf, m1, ok, err)
+		}
+	}
+}
+
+func TestMagOverflowRejected(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus, WithMagnetometer(true))
+	cErr := mpu.Errors()
+
+	bus.mu.Lock()
+	copy(bus.regs[MPUREG_EXT_SENS_DATA_00:], []byte{AKM_DATA_READY, 0x10, 0x00, 0, 0, 0, 0, 0x10 | AKM_ST2_HOFL})
+	bus.mu.Unlock()
+
+	if d := freshAvg(t, mpu, 5); d.NM != 0 || d.MagError == nil {
+		t.Errorf("overflowed mag frames should not be averaged, got NM=%d", d.NM)
+	}
+	select {
+	case err := <-cErr:
+		if e, ok := err.(*SensorError); !ok || e.Sensor != "magnetometer" {
+			t.Errorf("unexpected sensor error: %v", err)
+		}
+	default:
+		t.Error("expected a magnetometer overflow error")
+	}
+}
+
+func TestResetOnError(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus, WithMagnetometer(true))
+
+	// Reading the raw gyro/accel counts leaves the mag samples for CAvg
+	bus.mu.Lock()
+	copy(bus.regs[MPUREG_EXT_SENS_DATA_00:], []byte{AKM_DATA_READY, 0x10, 0x00, 0, 0, 0, 0, 0x10})
+	bus.mu.Unlock()
+	skipSamples(mpu)
+	waitSamples(t, mpu, 5)
+	if n, _, _, _, _, _, _, _, err := mpu.ReadRaw(); err != nil || n == 0 {
+		t.Errorf("expected raw gyro/accel counts, got n=%d, error %v", n, err)
+	}
+	if d := <-mpu.CAvg; d.MagError != nil || d.NM < 3 {
+		t.Errorf("mag samples were discarded by ReadRaw, got NM=%d, error %v", d.NM, d.MagError)
+	}
+}
+
+func TestMagRecovery(t *testing.T) {
+	for _, continuous := range []bool{false, true} {
+		bus := newFakeBus()
+		mpu := newTestMPU(t, bus, WithMagnetometer(true))
+		mpu.Errors() // Don't log the reader's errors
+		if err := mpu.EnableMagContinuous(continuous); err != nil {
+			t.Fatalf("unexpected error setting continuous mag mode: %s", err)
+		}
+		mode := byte(AKM_SINGLE_MEASUREMENT | AKM_BIT_16)
+		if continuous {
+			mode = AKM_CONTINUOUS_100HZ | AKM_BIT_16
+		}
+		mpu.SetMagRecovery(3)
+		nReg := len(bus.written(MPUREG_I2C_SLV1_REG))
+
+		bus.mu.Lock()
+		copy(bus.regs[MPUREG_EXT_SENS_DATA_00:], []byte{AKM_DATA_READY, 0x10, 0x00, 0, 0, 0, 0, 0x10 | AKM_ST2_HOFL})
+		bus.mu.Unlock()
+		for deadline := time.Now().Add(time.Second); len(bus.written(MPUREG_I2C_SLV1_REG)) == nReg; {
+			if time.Now().After(deadline) {
+				t.Fatalf("continuous=%t: no reset after magnetometer errors", continuous)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		mpu.SetMagRecovery(0)
+		bus.mu.Lock()
+		copy(bus.regs[MPUREG_EXT_SENS_DATA_00:], []byte{AKM_DATA_READY, 0x10, 0x00, 0, 0, 0, 0, 0x10})
+		bus.mu.Unlock()
+		// The reset takes well over a millisecond, so this joins the one under way rather than starting another.
+		if err := mpu.ResetMag(); err != nil {
+			t.Errorf("continuous=%t: unexpected error from the reset: %s", continuous, err)
+		}
+
+		regs := bus.written(MPUREG_I2C_SLV1_REG)[nReg:]
+		if len(regs) != 2 || regs[0] != AK8963_CNTL2 || regs[1] != AK8963_CNTL1 {
+			t.Fatalf("continuous=%t: expected one reset through CNTL2 and back to CNTL1, got slave 1 registers % X",
+				continuous, regs)
+		}
+		if v := bus.written(MPUREG_I2C_SLV1_DO); v[len(v)-1] != mode {
+			t.Errorf("continuous=%t: expected mode %X after reset, got %X", continuous, mode, v[len(v)-1])
+		}
+		if d := freshAvg(t, mpu, 5); d.NM == 0 || d.MagError != nil {
+			t.Errorf("continuous=%t: expected magnetometer readings after reset, got NM=%d, error %v",
+				continuous, d.NM, d.MagError)
+		}
+
+		if err := mpu.ResetMag(); err != nil {
+			t.Errorf("continuous=%t: unexpected error resetting magnetometer: %s", continuous, err)
+		}
+		if v := bus.written(MPUREG_I2C_SLV1_DO); v[len(v)-1] != mode {
+			t.Errorf("continuous=%t: expected mode %X after ResetMag, got %X", continuous, mode, v[len(v)-1])
+		}
+		mpu.CloseMPU()
+		if err := mpu.ResetMag(); !errors.Is(err, ErrNotRunning) {
+			t.Errorf("continuous=%t: expected ErrNotRunning resetting after closing, got %v", continuous, err)
+		}
+	}
+}
+
+func TestTiltCompensatedHeading(t *testing.T) {
+	// Field with 60° inclination: in the accel frame, x forward, y left and z up, when level facing north,
+	// it is (0.5, 0, -0.866).  In AK8963 axes that is (0, 0.5, 0.866).
+	for _, c := range []struct {
+		name                   string
+		a1, a2, a3, m1, m2, m3 float64
+		hdg                    float64
+	}{
+		{"level north", 0, 0, 1, 0, 0.5, 0.866, 0},
+		{"level east", 0, 0, 1, 0.5, 0, 0.866, 90},   // North is to the left, +y
+		{"level west", 0, 0, 1, -0.5, 0, 0.866, 270}, // North is to the right, -y
+		// Nose up 30° facing north: body x = (cos30, 0, sin30), z = (-sin30, 0, cos30) in north, left, up,
+		// so up is (0.5, 0, 0.866) and the field is (0, 0, -1) in the accel frame.
+		{"pitched north", 0.5, 0, 0.866, 0, 0, 1, 0},
+		// Rolled right 30° facing east: body x = (0, -1, 0), y = (0.866, 0, 0.5), z = (-0.5, 0, 0.866),
+		// so up is (0, 0.5, 0.866) and the field is again (0, 0, -1) in the accel frame.
+		{"rolled east", 0, 0.5, 0.866, 0, 0, 1, 90},
+	} {
+		if hdg := TiltCompensatedHeading(c.a1, c.a2, c.a3, c.m1, c.m2, c.m3); math.Abs(hdg-c.hdg) > 0.1 {
+			t.Errorf("%s: expected heading %f, got %f", c.name, c.hdg, hdg)
+		}
+	}
+}
+
+func TestMemWriteBlock(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	if got := bus.mem[CFG_MOTION_BIAS : CFG_MOTION_BIAS+9]; got[2] != 0xaa || got[8] != 0xc7 {
+		t.Errorf("expected gyro bias compensation disabled in DMP memory, got % X", got)
+	}
+
+	// Span three banks from partway through the first
+	data := make([]byte, 2*MPU_BANK_SIZE)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := mpu.memWriteBlock(0x1F0, data, true); err != nil {
+		t.Fatalf("unexpected error writing across banks: %s", err)
+	}
+	if !bytes.Equal(bus.mem[0x1F0:0x1F0+len(data)], data) {
+		t.Error("data written across banks doesn't match")
+	}
+}
+
+func TestMemRead(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	copy(bus.mem[0x2F8:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	if got, err := mpu.memRead(0x2F8, 8); err != nil || !bytes.Equal(got, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("expected to read back 1..8, got % X, error %v", got, err)
+	}
+	if _, err := mpu.memRead(0x2F8, 16); !errors.Is(err, ErrInvalidSetting) {
+		t.Errorf("expected ErrInvalidSetting reading across a bank boundary, got %v", err)
+	}
+
+	if mpu.IsGyroBiasCalEnabled() {
+		t.Error("expected gyro bias compensation to be disabled by default")
+	}
+	if err := mpu.EnableGyroBiasCal(true); err != nil || !mpu.IsGyroBiasCalEnabled() {
+		t.Errorf("expected gyro bias compensation enabled, got error %v", err)
+	}
+	if err := mpu.EnableGyroBiasCal(false); err != nil || mpu.IsGyroBiasCalEnabled() {
+		t.Errorf("expected gyro bias compensation disabled, got error %v", err)
+	}
+
+	// Writes that don't take are caught by the read back
+	bus.mu.Lock()
+	bus.memReadOnly = true
+	bus.mu.Unlock()
+	if err := mpu.EnableGyroBiasCal(true); !errors.Is(err, ErrBusWrite) {
+		t.Errorf("expected ErrBusWrite enabling gyro bias compensation on read-only memory, got %v", err)
+	}
+	if mpu.IsGyroBiasCalEnabled() {
+		t.Error("expected gyro bias compensation to stay disabled after a failed write")
+	}
+}
+
+func TestNewMPU9250WithBusStepErrors(t *testing.T) {
+	for reg, step := range map[byte]string{
+		MPUREG_GYRO_CONFIG: "gyro sensitivity",
+		MPUREG_CONFIG:      "Gyro LPF",
+		MPUREG_SMPLRT_DIV:  "Sample Rate",
+		MPUREG_PWR_MGMT_2:  "sensors",
+		MPUREG_BANK_SEL:    "gyro bias compensation",
+	} {
+		bus := newFakeBus()
+		bus.failRegs = map[byte]error{reg: errors.New("bus failure")}
+		_, err := NewMPU9250WithBus(bus, 250, 4, 100, false, false)
+		if err == nil {
+			t.Errorf("expected an error when writing register %X fails", reg)
+		} else if !strings.Contains(err.Error(), step) || !strings.Contains(err.Error(), "bus failure") {
+			t.Errorf("expected error for register %X to mention %q and the bus error, got %q", reg, step, err)
+		}
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192)
+	mpu := newTestMPU(t, bus)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	d, err := mpu.ReadContext(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %s", err)
+	}
+	if d.N < 1 || d.GAError != nil {
+		t.Errorf("expected new values, got N=%d, error %v", d.N, d.GAError)
+	}
+
+	// With the bus failing, no new values arrive and the read times out.
+	mpu.Errors()
+	bus.mu.Lock()
+	bus.err = errors.New("bus failure")
+	bus.mu.Unlock()
+	skipSamples(mpu) // Clear out anything read before the failure
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := mpu.ReadContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestSetBias(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192+100)
+	bus.setWord(MPUREG_GYRO_XOUT_H, -50)
+	mpu := newTestMPU(t, bus)
+
+	gyro, accel := [3]int16{-50, 0, 0}, [3]int16{0, 0, 100}
+	mpu.SetBias(gyro, accel)
+	if g, a := mpu.GetBias(); g != gyro || a != accel {
+		t.Errorf("expected biases %v, %v, got %v, %v", gyro, accel, g, a)
+	}
+
+	d := freshAvg(t, mpu, 1)
+	if d.A3 < 0.99 || d.A3 > 1.01 {
+		t.Errorf("expected corrected A3 of 1G, got %f", d.A3)
+	}
+	if math.Abs(d.G1) > 1e-9 {
+		t.Errorf("expected corrected G1 of 0, got %f", d.G1)
+	}
+}
+
+func TestCalibrateAccel(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	// Axis 1 reads 0.1G high, axis 2 reads 3% large, axis 3 reads 0.05G low and 2% small
+	readings := []*MPUData{
+		{A1: 1.1}, {A1: -0.9},
+		{A2: 1.03}, {A2: -1.03},
+		{A3: 0.93}, {A3: -1.03},
+	}
+	if err := mpu.CalibrateAccel(readings[:5]); !errors.Is(err, ErrCalibration) {
+		t.Errorf("expected ErrCalibration without a -1G reading on axis 3, got %v", err)
+	}
+	if s := mpu.GetAccelScale(); s != [3]float64{1, 1, 1} {
+		t.Errorf("expected failed calibration to leave scale 1, got %v", s)
+	}
+	if err := mpu.CalibrateAccel(readings); err != nil {
+		t.Fatalf("unexpected error calibrating: %s", err)
+	}
+	s := mpu.GetAccelScale()
+	if math.Abs(s[0]-1) > 1e-9 || math.Abs(s[1]-1/1.03) > 1e-9 || math.Abs(s[2]-2/1.96) > 1e-9 {
+		t.Errorf("expected scales 1, %f, %f, got %v", 1/1.03, 2/1.96, s)
+	}
+
+	// Raw 8192 is 1G at 4G full scale
+	bus.setWord(MPUREG_ACCEL_XOUT_H, 8192*11/10)
+	bus.setWord(MPUREG_ACCEL_YOUT_H, -8192*103/100)
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192*93/100)
+	d := freshAvg(t, mpu, 1)
+	if math.Abs(d.A1-1) > 1e-3 || math.Abs(d.A2+1) > 1e-3 || math.Abs(d.A3-1) > 1e-3 {
+		t.Errorf("expected calibrated 1G, -1G, 1G, got %f, %f, %f", d.A1, d.A2, d.A3)
+	}
+}
+
+func TestGyroTempModel(t *testing.T) {
+	// Bias of 1°/s at 30°C on axis 1, rising 0.05°/s per degree
+	var readings []*MPUData
+	for temp := 25.0; temp <= 35; temp++ {
+		readings = append(readings, &MPUData{G1: 1 + 0.05*(temp-30), G2: -0.5, Temp: temp})
+	}
+	if _, err := FitGyroTempModel(readings[:2]); err == nil {
+		t.Error("expected an error fitting over 1°C")
+	}
+	g, err := FitGyroTempModel(readings)
+	if err != nil {
+		t.Fatalf("unexpected error fitting: %s", err)
+	}
+	if b := g.At(30); math.Abs(b[0]-1) > 1e-9 || math.Abs(b[1]+0.5) > 1e-9 || math.Abs(b[2]) > 1e-9 {
+		t.Errorf("expected bias 1, -0.5, 0 at 30°C, got %v", b)
+	}
+	if math.Abs(g.Slope[0]-0.05) > 1e-9 || math.Abs(g.Slope[1]) > 1e-9 {
+		t.Errorf("expected slopes 0.05, 0, got %v", g.Slope)
+	}
+
+	var buf bytes.Buffer
+	if err := g.Save(&buf); err != nil {
+		t.Fatalf("unexpected error saving: %s", err)
+	}
+	g2, err := LoadGyroTempModel(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error loading: %s", err)
+	}
+	if *g2 != *g {
+		t.Errorf("expected loaded model %v, got %v", g, g2)
+	}
+
+	bus := newFakeBus()
+	bus.setWord(MPUREG_TEMP_OUT_H, -520) // 35°C
+	bus.setWord(MPUREG_GYRO_XOUT_H, 164) // 1.25°/s at 250°/s full scale
+	mpu := newTestMPU(t, bus)
+	mpu.SetGyroTempModel(g2)
+	if d := freshAvg(t, mpu, 1); math.Abs(d.G1) > 0.01 || math.Abs(d.G2-0.5) > 0.01 {
+		t.Errorf("expected compensated G1 of 0 and G2 of 0.5 at %f°C, got %f, %f", d.Temp, d.G1, d.G2)
+	}
+}
+
+func TestStats(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+	cErr := mpu.Errors()
+
+	skipSamples(mpu)
+	waitSamples(t, mpu, 10)
+	if s := mpu.Stats(); s.Samples < 10 || s.Samples > 12 || s.Overruns > 1 || len(s.Errors) > 0 {
+		t.Errorf("expected about 10 samples and no overruns or errors, got %+v", s)
+	}
+
+	// Reads taking 2.5 sample periods miss about 1.5 ticks each
+	bus.mu.Lock()
+	bus.delay = 25 * time.Millisecond
+	bus.mu.Unlock()
+	skipSamples(mpu)
+	waitSamples(t, mpu, 6)
+	if s := mpu.Stats(); s.Overruns < s.Samples {
+		t.Errorf("expected more overruns than samples with a slow bus, got %+v", s)
+	}
+
+	bus.mu.Lock()
+	bus.delay = 0
+	bus.err = errors.New("bus failure")
+	bus.mu.Unlock()
+	skipSamples(mpu)
+	for len(cErr) > 0 {
+		<-cErr
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-cErr:
+		case <-time.After(time.Second):
+			t.Fatal("no errors from a failing bus")
+		}
+	}
+	if s := mpu.Stats(); s.Errors["gyro/accel"] < 3 || s.Samples != 0 {
+		t.Errorf("expected gyro/accel errors and no samples from a failing bus, got %+v", s)
+	}
+}
+
+func TestSetClockSource(t *testing.T) {
+	bus := newFakeBus()
+	mpu := newTestMPU(t, bus)
+
+	if err := mpu.SetClockSource(INV_CLK_INTERNAL); err != nil {
+		t.Fatalf("unexpected error setting clock source: %s", err)
+	}
+	if v := bus.written(MPUREG_PWR_MGMT_1); v[len(v)-1]&BITS_CLKSEL != INV_CLK_INTERNAL {
+		t.Errorf("clock source not written correctly: %v", v)
+	}
+	if err := mpu.SetClockSource(7); err == nil {
+		t.Error("expected an error for an invalid clock source")
+	}
+
+	// Data never becomes ready
+	bus.mu.Lock()
+	bus.regs[MPUREG_INT_STATUS] = 0
+	bus.mu.Unlock()
+	if err := mpu.SetClockSource(INV_CLK_PLL); err == nil {
+		t.Error("expected an error when data never becomes ready")
+	}
+}
+
+func TestReset(t *testing.T) {
+	bus := newFakeBus()
+	bus.setWord(MPUREG_ACCEL_ZOUT_H, 8192+100)
+	mpu := newTestMPU(t, bus, WithGyroRange(500))
+	mpu.SetGyroLPF(10)
+	mpu.SetBias([3]int16{}, [3]int16{0, 0, 100})
+	cAvg := mpu.CAvg
+
+	bus.mu.Lock()
+	bus.writes = nil
+	bus.mu.Unlock()
+	if err := mpu.Reset(); err != nil {
+		t.Fatalf("unexpected error resetting: %s", err)
+	}
+
+	if v := bus.written(MPUREG_PWR_MGMT_1); len(v) == 0 || v[0] != BIT_H_RESET {
+		t.Errorf("chip not reset: %v", v)
+	}
+	if v := bus.written(MPUREG_GYRO_CONFIG); len(v) == 0 || v[len(v)-1] != BITS_FS_500DPS {
+		t.Errorf("gyro range not preserved: %v", v)
+	}
+	if v := bus.written(MPUREG_CONFIG); len(v) == 0 || v[len(v)-1] != BITS_DLPF_CFG_10HZ {
+		t.Errorf("gyro LPF not preserved: %v", v)
+	}
+
+	skipSamples(mpu)
+	waitSamples(t, mpu, 2)
+	if d := <-cAvg; d.N == 0 || d.A3 < 0.99 || d.A3 > 1.01 {
+		t.Errorf("expected calibrated A3 of 1G after reset, got %f from %d samples", d.A3, d.N)
+	}
+
+	// Reset also restarts a closed driver.
+	mpu.CloseMPU()
+	if err := mpu.Reset(); err != nil {
+		t.Fatalf("unexpected error resetting: %s", err)
+	}
+	select {
+	case <-mpu.C:
+	case <-time.After(time.Second):
+		t.Error("driver not restarted after CloseMPU")
+	}
+}
+
+func TestSampleRateBounds(t *testing.T) {
+	for rate, valid := range map[int]bool{0: false, 1: false, 4: true, 1000: true, 2000: false} {
+		bus := newFakeBus()
+		mpu, err := NewMPU9250WithBus(bus, 250, 4, rate, false, false)
+		if !valid {
+			if err == nil {
+				t.Errorf("expected an error for sample rate %d", rate)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for sample rate %d: %s", rate, err)
+			continue
+		}
+		t.Cleanup(mpu.CloseMPU)
+		if r := mpu.EffectiveSampleRate(); math.Abs(r-float64(rate)) > 0.1 {
+			t.Errorf("expected effective sample rate %d, got %f", rate, r)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package mpu9250
+
+import (
+	"../embd"
+)
+
+// Option configures an MPU9250 created by New.
+type Option func(*options)
+
+// options holds the settings gathered from the Options passed to New, starting from defaultOptions.
+type options struct {
+	gyroRange, accelRange int
+	sampleRate            int
+	gyroLPF, accelLPF     byte
+	enableMag             bool
+	magBits               int
+	applyHWOffsets        bool
+	frozenSamples         int
+	i2cbus                embd.I2CBus
+	spibus                embd.SPIBus
+	address               byte
+}
+
+func defaultOptions() *options {
+	return &options{
+		gyroRange:  250,
+		accelRange: 4,
+		sampleRate: 100,
+		magBits:    16,
+		address:    MPU_ADDRESS,
+	}
+}
+
+// WithGyroRange sets the gyro full-scale range, °/s: 250, 500, 1000 or 2000.  The default is 250.
+func WithGyroRange(sensitivityGyro int) Option {
+	return func(o *options) { o.gyroRange = sensitivityGyro }
+}
+
+// WithAccelRange sets the accelerometer full-scale range, G: 2, 4, 8 or 16.  The default is 4.
+func WithAccelRange(sensitivityAccel int) Option {
+	return func(o *options) { o.accelRange = sensitivityAccel }
+}
+
+// WithSampleRate sets the sample rate for sensor readings, Hz.  The default is 100.
+func WithSampleRate(sampleRate int) Option {
+	return func(o *options) { o.sampleRate = sampleRate }
+}
+
+// WithGyroLPF sets the gyro digital low pass filter bandwidth, Hz, as for SetGyroLPF.
+// By default it is chosen from the sample rate.
+func WithGyroLPF(rate byte) Option {
+	return func(o *options) { o.gyroLPF = rate }
+}
+
+// WithAccelLPF sets the accelerometer digital low pass filter bandwidth, Hz, as for SetAccelLPF.
+// By default it is chosen from the sample rate.
+func WithAccelLPF(rate byte) Option {
+	return func(o *options) { o.accelLPF = rate }
+}
+
+// WithMagnetometer sets whether the magnetometer is read.  By default it isn't.  It isn't supported over SPI.
+func WithMagnetometer(enable bool) Option {
+	return func(o *options) { o.enableMag = enable }
+}
+
+// WithMagResolution sets the magnetometer output resolution, 14 or 16 bits, which are 0.6 and 0.15uT per count.
+// The default is 16 bits.
+func WithMagResolution(bits int) Option {
+	return func(o *options) { o.magBits = bits }
+}
+
+// WithHWOffsets sets whether the factory gyro and accel offsets are read from the chip.  By default they aren't.
+func WithHWOffsets(apply bool) Option {
+	return func(o *options) { o.applyHWOffsets = apply }
+}
+
+// WithFrozenDetection reports the gyro/accel as frozen after n identical samples, as for SetFrozenDetection.
+// By default it isn't checked.
+func WithFrozenDetection(n int) Option {
+	return func(o *options) { o.frozenSamples = n }
+}
+
+// WithBus communicates over the supplied I2C bus, e.g. a fake bus for testing off-hardware.
+// The default is I2C bus 1.
+func WithBus(i2cbus embd.I2CBus) Option {
+	return func(o *options) { o.i2cbus, o.spibus = i2cbus, nil }
+}
+
+// WithSPIBus communicates over the supplied SPI bus instead of I2C.
+func WithSPIBus(spibus embd.SPIBus) Option {
+	return func(o *options) { o.spibus, o.i2cbus = spibus, nil }
+}
+
+// WithSPI communicates over SPI on the given channel (chip select) instead of I2C, as NewMPU9250SPI does.
+func WithSPI(channel byte) Option {
+	return func(o *options) {
+		o.spibus, o.i2cbus = embd.NewSPIBus(embd.SPIMode0, channel, spiSpeed, spiBPW, 0), nil
+	}
+}
+
+// WithAddress sets the I2C address of the MPU9250, e.g. 0x69 when its AD0 pin is pulled high.
+// The default is MPU_ADDRESS, 0x68.  It has no effect over SPI.
+func WithAddress(address byte) Option {
+	return func(o *options) { o.address = address }
+}
+
+/*
+New creates a new MPU9250 object configured by opts, which may be given in any order; later options override
+earlier ones.  With no options it reads a 250°/s gyro and 4G accelerometer at 100Hz over I2C bus 1, without the
+magnetometer.  If there is no MPU9250 available or there is an error creating the object, an error is returned.
+*/
+func New(opts ...Option) (*MPU9250, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var bus transport
+	switch {
+	case o.spibus != nil:
+		bus = &spiTransport{o.spibus}
+	case o.i2cbus != nil:
+		bus = &i2cTransport{o.i2cbus, o.address}
+	default:
+		bus = &i2cTransport{embd.NewI2CBus(1), o.address}
+	}
+
+	mpu, err := newMPU9250(bus, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.gyroLPF > 0 {
+		err = mpu.SetGyroLPF(o.gyroLPF)
+	}
+	if err == nil && o.accelLPF > 0 {
+		err = mpu.SetAccelLPF(o.accelLPF)
+	}
+	if err != nil {
+		mpu.CloseMPU()
+		return nil, err
+	}
+	return mpu, nil
+}
@@ -0,0 +1,73 @@
+package mpu9250
+
+import (
+	"../embd"
+)
+
+const (
+	spiSpeed = 1000000 // SPI clock speed, Hz; the MPU9250 allows up to 1MHz for all registers
+	spiBPW   = 8       // SPI bits per word
+)
+
+// transport abstracts the register-level communication with the MPU9250,
+// which may be connected either by I2C or by SPI.
+type transport interface {
+	writeReg(reg, value byte) error
+	writeRegs(reg byte, values []byte) error
+	readReg(reg byte) (byte, error)
+	readRegs(reg byte, values []byte) error
+}
+
+// i2cTransport communicates with the MPU9250 over an I2C bus.
+type i2cTransport struct {
+	bus  embd.I2CBus
+	addr byte // I2C address of the MPU9250
+}
+
+func (t *i2cTransport) writeReg(reg, value byte) error {
+	return t.bus.WriteByteToReg(t.addr, reg, value)
+}
+
+func (t *i2cTransport) writeRegs(reg byte, values []byte) error {
+	return t.bus.WriteToReg(t.addr, reg, values)
+}
+
+func (t *i2cTransport) readReg(reg byte) (byte, error) {
+	return t.bus.ReadByteFromReg(t.addr, reg)
+}
+
+func (t *i2cTransport) readRegs(reg byte, values []byte) error {
+	return t.bus.ReadFromReg(t.addr, reg, values)
+}
+
+// spiTransport communicates with the MPU9250 over an SPI bus.
+// Each transfer begins with the register address, with the high bit set for reads.
+type spiTransport struct {
+	bus embd.SPIBus
+}
+
+func (t *spiTransport) writeReg(reg, value byte) error {
+	return t.bus.TransferAndReceiveData([]byte{reg, value})
+}
+
+func (t *spiTransport) writeRegs(reg byte, values []byte) error {
+	return t.bus.TransferAndReceiveData(append([]byte{reg}, values...))
+}
+
+func (t *spiTransport) readReg(reg byte) (byte, error) {
+	buf := []byte{reg | READ_FLAG, 0}
+	if err := t.bus.TransferAndReceiveData(buf); err != nil {
+		return 0, err
+	}
+	return buf[1], nil
+}
+
+func (t *spiTransport) readRegs(reg byte, values []byte) error {
+	buf := make([]byte, len(values)+1)
+	buf[0] = reg | READ_FLAG
+	if err := t.bus.TransferAndReceiveData(buf); err != nil {
+		return err
+	}
+	copy(values, buf[1:])
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Package nmea turns the GPS velocity in a stream of NMEA 0183 sentences into ahrs.Measurement GPS vectors W.
+
+Groundspeed and track come from RMC or VTG sentences; vertical speed, which NMEA doesn't report,
+is estimated from the altitudes of consecutive GGA fixes.
+Reference: NMEA 0183 v4.10, and https://gpsd.gitlab.io/gpsd/NMEA.html
+*/
+package nmea
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"../ahrs"
+)
+
+const maxVSInterval = 5.0 // Longest time between GGA fixes to estimate vertical speed from, s
+
+// Parser reads NMEA sentences and updates the GPS part of ahrs Measurements.
+type Parser struct {
+	clock func() float64 // Current time on the IMU's clock, s, to timestamp the GPS measurements consistently
+
+	vs             float64 // Vertical speed from the last two GGA fixes, kt
+	vsValid        bool    // Whether vs is current
+	lastAlt, lastT float64 // Altitude of the last GGA fix, m, and its time on the IMU clock, s
+	lastAltValid   bool    // Whether there is a last GGA fix
+}
+
+// NewParser returns a Parser timestamping the measurements with clock, which gives the current time on the clock
+// used for the IMU measurements, in seconds.
+func NewParser(clock func() float64) (p *Parser) {
+	p = new(Parser)
+	p.clock = clock
+	return
+}
+
+// Update parses a single NMEA sentence and, if it is an RMC or VTG sentence, sets the GPS velocity W,
+// its time TW and WValid of m, reporting updated.  A void fix or a missing speed sets WValid false.
+// GGA sentences are used for the vertical speed W3 but don't update m.  Other sentences are ignored.
+// A sentence with a bad checksum is an error and leaves m unchanged.
+func (p *Parser) Update(sentence string, m *ahrs.Measurement) (updated bool, err error) {
+	fields, err := split(sentence)
+	if err != nil {
+		return false, err
+	}
+	if len(fields[0]) < 5 {
+		return false, fmt.Errorf("nmea: bad address %q", fields[0])
+	}
+
+	t := p.clock()
+	switch fields[0][len(fields[0])-3:] { // Any talker: GP, GN, GL, ...
+	case "RMC":
+		// $--RMC,time,status,lat,N/S,lon,E/W,speed kt,track °T,date,...
+		if len(fields) < 9 {
+			return false, errors.New("nmea: short RMC sentence")
+		}
+		p.setW(m, t, fields[2] == "A", fields[7], fields[8])
+		return true, nil
+	case "VTG":
+		// $--VTG,track °T,T,track °M,M,speed kt,N,speed km/h,K[,mode]
+		if len(fields) < 8 {
+			return false, errors.New("nmea: short VTG sentence")
+		}
+		valid := len(fields) < 10 || fields[9] != "N"
+		p.setW(m, t, valid, fields[5], fields[1])
+		return true, nil
+	case "GGA":
+		// $--GGA,time,lat,N/S,lon,E/W,quality,satellites,hdop,altitude,M,...
+		if len(fields) < 10 {
+			return false, errors.New("nmea: short GGA sentence")
+		}
+		p.updateVS(t, fields[6] != "" && fields[6] != "0", fields[9])
+	}
+	return false, nil
+}
+
+// setW sets the GPS velocity of m from the speed and track fields, if valid.
+func (p *Parser) setW(m *ahrs.Measurement, t float64, valid bool, speed, track string) {
+	m.TW = t
+	gs, err := strconv.ParseFloat(speed, 64)
+	if !valid || err != nil {
+		m.WValid = false
+		return
+	}
+	trk, err := strconv.ParseFloat(track, 64)
+	if err != nil { // No track when stationary
+		trk = 0
+	}
+	vs := p.vs
+	if !p.vsValid || t-p.lastT > maxVSInterval {
+		vs = 0
+	}
+	m.SetGPS(gs, trk, vs)
+}
+
+// updateVS estimates the vertical speed from the altitude of this GGA fix and the last.
+func (p *Parser) updateVS(t float64, valid bool, altitude string) {
+	alt, err := strconv.ParseFloat(altitude, 64)
+	if !valid || err != nil {
+		p.vsValid, p.lastAltValid = false, false
+		return
+	}
+	if dt := t - p.lastT; p.lastAltValid && dt > 0 && dt <= maxVSInterval {
+		p.vs = ahrs.MpsToKt((alt - p.lastAlt) / dt)
+		p.vsValid = true
+	}
+	p.lastAlt, p.lastT, p.lastAltValid = alt, t, true
+}
+
+// split checks the checksum of an NMEA sentence, if it has one, and splits it into its comma-separated fields,
+// the first being the address, without the leading $.
+func split(sentence string) (fields []string, err error) {
+	sentence = strings.TrimSpace(sentence)
+	if !strings.HasPrefix(sentence, "$") {
+		return nil, fmt.Errorf("nmea: sentence %q doesn't start with $", sentence)
+	}
+	sentence = sentence[1:]
+	if i := strings.LastIndex(sentence, "*"); i >= 0 {
+		want, err := strconv.ParseUint(sentence[i+1:], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("nmea: bad checksum %q", sentence[i+1:])
+		}
+		sentence = sentence[:i]
+		if sum := Checksum(sentence); sum != byte(want) {
+			return nil, fmt.Errorf("nmea: checksum %02X, expected %02X", sum, want)
+		}
+	}
+	return strings.Split(sentence, ","), nil
+}
+
+// Checksum returns the NMEA checksum of a sentence's contents between the $ and the *.
+func Checksum(s string) (sum byte) {
+	for i := 0; i < len(s); i++ {
+		sum ^= s[i]
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package nmea
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"../ahrs"
+)
+
+// sentence wraps s in $ and its checksum.
+func sentence(s string) string {
+	return fmt.Sprintf("$%s*%02X", s, Checksum(s))
+}
+
+func TestChecksum(t *testing.T) {
+	s := "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+	if _, err := split(s); err != nil {
+		t.Errorf("good sentence gave error %s", err)
+	}
+	if _, err := split(s[:len(s)-2] + "6B"); err == nil {
+		t.Error("bad checksum gave no error")
+	}
+	if _, err := split(s[1:]); err == nil {
+		t.Error("sentence without $ gave no error")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	var tNow float64
+	p := NewParser(func() float64 { return tNow })
+	m := ahrs.NewMeasurement()
+
+	tNow = 10
+	updated, err := p.Update(sentence("GPRMC,123519,A,4807.038,N,01131.000,E,100.0,090.0,230394,003.1,W"), m)
+	if err != nil || !updated {
+		t.Fatalf("RMC gave updated %t, error %v", updated, err)
+	}
+	if !m.WValid || m.TW != 10 || math.Abs(m.W1-100) > 1e-9 || math.Abs(m.W2) > 1e-9 || m.W3 != 0 {
+		t.Errorf("RMC gave W %f,%f,%f valid %t at %f", m.W1, m.W2, m.W3, m.WValid, m.TW)
+	}
+
+	// Climbing 1 m/s between GGA fixes
+	for i, alt := range []string{"545.4", "546.4"} {
+		tNow = 11 + float64(i)
+		updated, err = p.Update(sentence("GNGGA,123520,4807.038,N,01131.000,E,1,08,0.9,"+alt+",M,46.9,M,,"), m)
+		if err != nil || updated {
+			t.Fatalf("GGA gave updated %t, error %v", updated, err)
+		}
+	}
+	updated, err = p.Update(sentence("GNVTG,000.0,T,,M,050.0,N,092.6,K,A"), m)
+	if err != nil || !updated {
+		t.Fatalf("VTG gave updated %t, error %v", updated, err)
+	}
+	if !m.WValid || math.Abs(m.W1) > 1e-9 || math.Abs(m.W2-50) > 1e-9 || math.Abs(m.W3-ahrs.MpsToKt(1)) > 1e-9 {
+		t.Errorf("VTG gave W %f,%f,%f valid %t", m.W1, m.W2, m.W3, m.WValid)
+	}
+
+	tNow = 13
+	if _, err = p.Update(sentence("GPRMC,123521,V,,,,,,,230394,,"), m); err != nil {
+		t.Fatalf("void RMC gave error %s", err)
+	}
+	if m.WValid || m.TW != 13 {
+		t.Errorf("void RMC gave valid %t at %f", m.WValid, m.TW)
+	}
+
+	if _, err = p.Update(sentence("GPVTG,,T,,M,,N,,K,N"), m); err != nil || m.WValid {
+		t.Errorf("VTG without a fix gave valid %t, error %v", m.WValid, err)
+	}
+
+	if updated, err = p.Update(sentence("GPGSA,A,3,04,05,,09,12,,,24,,,,,2.5,1.3,2.1"), m); err != nil || updated {
+		t.Errorf("GSA gave updated %t, error %v", updated, err)
+	}
+}
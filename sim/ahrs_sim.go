@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -39,11 +40,19 @@ func main() {
 		asiBias                                             float64
 		gyroBias, accelBias, magBias                        []float64
 		gpsInop, magInop, asiInop                           bool
+		gpsDropoutStr                                       string
+		seed                                                int64
+		turbSigma, turbTau                                  float64
+		gyroDrift                                           float64
+		magField, magInclination, magDeclination            float64
+		smooth                                              bool
+		serve                                               bool
+		dropout                                             *gpsDropout
 		algo                                                string
 		ahrsConfigStr                                       string
 		ahrsConfig                                          map[string]float64
 		s                                                   ahrs.AHRSProvider
-		scenario                                            string
+		scenario, maneuver, replay                          string
 		sit                                                 Situation
 		err                                                 error
 	)
@@ -61,6 +70,8 @@ func main() {
 		gyroNoiseUsage    = "Amount of noise to add to gyro measurements, °/s"
 		defaultGyroBias   = "0,0,0"
 		gyroBiasUsage     = "Amount of bias to add to gyro measurements, \"x,y,z\" °/s"
+		defaultGyroDrift  = 0.0
+		gyroDriftUsage    = "Rate at which the gyro bias wanders from -gyro-bias as a random walk, °/s per √s"
 		defaultAccelNoise = 0.0
 		accelNoiseUsage   = "Amount of noise to add to accel measurements, G"
 		defaultAccelBias  = "0,0,0"
@@ -75,16 +86,37 @@ func main() {
 		magNoiseUsage     = "Amount of noise to add to magnetometer measurements, μT"
 		defaultMagBias    = "0,0,0"
 		magBiasUsage      = "Amount of bias to add to magnetometer measurements, \"x,y,z\" μT"
+		defaultMagField   = 0.0
+		magFieldUsage     = "Total strength of a steady magnetic field replacing the scenario's, μT; 0 to keep the scenario's"
+		defaultMagIncl    = 65.0
+		magInclUsage      = "Inclination (dip) of the -mag-field below the horizontal, °"
+		defaultMagDecl    = 0.0
+		magDeclUsage      = "Declination of the -mag-field, east of true north, °"
 		defaultGPSInop    = false
 		gpsInopUsage      = "Make the GPS inoperative"
+		defaultGPSDropout = ""
+		gpsDropoutUsage   = "Times when the GPS is lost: comma-separated \"start-end\" windows and/or a \"period/duration\" duty cycle, s"
 		defaultASIInop    = true
 		asiInopUsage      = "Make the Airspeed sensor inoperative"
 		defaultMagInop    = false
 		magInopUsage      = "Make the Magnetometer inoperative"
-		defaultScenario   = "takeoff"
-		scenarioUsage     = "Scenario to use: filename or \"takeoff\" or \"turn\""
+		defaultScenario   = ""
+		scenarioUsage     = "Scenario file to use: a JSON situation file or a CSV sensor log, instead of a maneuver"
+		defaultReplay     = ""
+		replayUsage       = "CSV log of recorded sensor data (T, A*, B*, M* and optionally TW, W*, WValid, Alt) to replay through the AHRS"
+		defaultManeuver   = "turn"
+		maneuverUsage     = "Built-in maneuver to use, if no scenario file is given: "
+		defaultTurbSigma  = 0.0
+		turbSigmaUsage    = "Intensity of turbulence gusts added to the simulated wind, kt rms"
+		defaultTurbTau    = 5.0
+		turbTauUsage      = "Correlation time of the turbulence gusts, s"
+		seedUsage         = "Seed for the random measurement noise, so that runs are reproducible"
+		defaultSmooth     = false
+		smoothUsage       = "Interpolate the scenario smoothly rather than piecewise-linearly, for continuous rates and accelerations"
+		defaultServe      = true
+		serveUsage        = "Serve the charts and the live state at :8080, and keep serving after the run; false to exit when done"
 		defaultAlgo       = "simple"
-		algoUsage         = "Algo to use for AHRS: simple (default), heuristic, kalman, kalman1, kalman2"
+		algoUsage         = "Algo to use for AHRS: simple (default), heuristic, kalman, kalman1, kalman2, mahony"
 		defaultConfig     = ""
 		configUsage       = "json-formatted map for AHRS Config"
 	)
@@ -95,6 +127,7 @@ func main() {
 	flag.Float64Var(&gyroNoise, "g", defaultGyroNoise, gyroNoiseUsage)
 	flag.StringVar(&gyroBiasStr, "gyro-bias", defaultGyroBias, gyroBiasUsage)
 	flag.StringVar(&gyroBiasStr, "h", defaultGyroBias, gyroBiasUsage)
+	flag.Float64Var(&gyroDrift, "gyro-drift", defaultGyroDrift, gyroDriftUsage)
 	flag.Float64Var(&accelNoise, "accel-noise", defaultAccelNoise, accelNoiseUsage)
 	flag.Float64Var(&accelNoise, "a", defaultAccelNoise, accelNoiseUsage)
 	flag.StringVar(&accelBiasStr, "accel-bias", defaultAccelBias, accelBiasUsage)
@@ -109,23 +142,47 @@ func main() {
 	flag.Float64Var(&magNoise, "b", defaultMagNoise, magNoiseUsage)
 	flag.StringVar(&magBiasStr, "mag-bias", defaultMagBias, magBiasUsage)
 	flag.StringVar(&magBiasStr, "k", defaultMagBias, magBiasUsage)
+	flag.Float64Var(&magField, "mag-field", defaultMagField, magFieldUsage)
+	flag.Float64Var(&magInclination, "mag-inclination", defaultMagIncl, magInclUsage)
+	flag.Float64Var(&magDeclination, "mag-declination", defaultMagDecl, magDeclUsage)
 	flag.BoolVar(&gpsInop, "w", defaultGPSInop, gpsInopUsage)
+	flag.StringVar(&gpsDropoutStr, "gps-dropout", defaultGPSDropout, gpsDropoutUsage)
 	flag.BoolVar(&asiInop, "u", defaultASIInop, asiInopUsage)
 	flag.BoolVar(&magInop, "m", defaultMagInop, magInopUsage)
 	flag.StringVar(&scenario, "scenario", defaultScenario, scenarioUsage)
 	flag.StringVar(&scenario, "s", defaultScenario, scenarioUsage)
+	flag.StringVar(&replay, "replay", defaultReplay, replayUsage)
+	flag.StringVar(&maneuver, "maneuver", defaultManeuver, maneuverUsage+maneuverNames())
+	flag.Float64Var(&turbSigma, "turbulence", defaultTurbSigma, turbSigmaUsage)
+	flag.Float64Var(&turbTau, "turbulence-tau", defaultTurbTau, turbTauUsage)
+	flag.Int64Var(&seed, "seed", defaultSeed, seedUsage)
+	flag.BoolVar(&smooth, "smooth", defaultSmooth, smoothUsage)
+	flag.BoolVar(&serve, "serve", defaultServe, serveUsage)
 	flag.StringVar(&algo, "algo", defaultAlgo, algoUsage)
 	flag.StringVar(&ahrsConfigStr, "config", defaultConfig, configUsage)
 	flag.StringVar(&ahrsConfigStr, "c", defaultConfig, configUsage)
 	flag.Parse()
 
-	switch scenario {
-	/*
-	case "takeoff":
-		sit = sitTakeoffDef
-	case "turn":
-		sit = sitTurnDef
-	*/
+	switch {
+	case replay != "":
+		log.Printf("Replaying recorded data from %s\n", replay)
+		sit, err = NewSituationFromFile(replay)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case scenario == "":
+		man, ok := maneuvers[strings.ToLower(maneuver)]
+		if !ok {
+			log.Fatalf("Unknown maneuver %s, choose from %s\n", maneuver, maneuverNames())
+		}
+		man.dt = udt
+		sit = man
+	case strings.HasSuffix(strings.ToLower(scenario), ".json"):
+		log.Printf("Loading situation from %s\n", scenario)
+		sit, err = NewSituationSimFromJSON(scenario, udt)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	default:
 		log.Printf("Loading data from %s\n", scenario)
 		sit, err = NewSituationFromFile(scenario)
@@ -145,6 +202,9 @@ func main() {
 		ioutil.WriteFile("config.json", []byte(ahrs.KalmanJSONConfig), 0644)
 		s = ahrs.InitializeKalman(m)
 	*/
+	case "mahony":
+		fmt.Println("Running Mahony AHRS")
+		s = ahrs.NewMahonyAHRS()
 	case "simple":
 		fallthrough // simple is the default.
 	default:
@@ -165,6 +225,10 @@ func main() {
 		fmt.Printf("Error %v parsing %s\n", err, magBiasStr)
 		return
 	}
+	if dropout, err = parseGPSDropout(gpsDropoutStr); err != nil {
+		fmt.Printf("Error %v parsing %s\n", err, gpsDropoutStr)
+		return
+	}
 
 	fmt.Println("Timing:")
 	fmt.Printf("\tPredict Freqency: %d Hz\n", int(1/pdt))
@@ -175,16 +239,24 @@ func main() {
 	fmt.Println("Gyro:")
 	fmt.Printf("\tNoise: %f °/s\n", gyroNoise)
 	fmt.Printf("\tBias: %f,%f,%f\n", gyroBias[0], gyroBias[1], gyroBias[2])
+	fmt.Printf("\tDrift: %f °/s/√s\n", gyroDrift)
 	fmt.Println("GPS:")
 	fmt.Printf("\tInop: %t\n", gpsInop)
 	fmt.Printf("\tNoise: %f kt\n", gpsNoise)
+	fmt.Printf("\tDropouts: %s\n", gpsDropoutStr)
 	fmt.Println("ASI:")
 	fmt.Printf("\tInop: %t\n", asiInop)
 	fmt.Printf("\tNoise: %f kt\n", asiNoise)
 	fmt.Println("Magnetometer:")
 	fmt.Printf("\tInop: %t\n", magInop)
-	fmt.Printf("\tNoise: %f G\n", magNoise)
-	fmt.Printf("\tBias: %f,%f,%f\n", magBias[0], magBias[1], magBias[2])
+	fmt.Printf("\tNoise: %f μT\n", magNoise)
+	fmt.Printf("\tBias: %f,%f,%f μT\n", magBias[0], magBias[1], magBias[2])
+	if magField > 0 {
+		fmt.Printf("\tField: %f μT, inclination %f°, declination %f°\n", magField, magInclination, magDeclination)
+	}
+	fmt.Println("Turbulence:")
+	fmt.Printf("\tIntensity: %f kt\n", turbSigma)
+	fmt.Printf("\tCorrelation time: %f s\n", turbTau)
 
 	uBias := []float64{asiBias, 0, 0}
 
@@ -203,8 +275,46 @@ func main() {
 		}
 	}
 	transferLogMap()
+	logMap["GPSValid"] = 0.0
+	// The injected biases, to compare with the algorithm's estimates C and D
+	for i, k := range []string{"1", "2", "3"} {
+		logMap["C"+k+"Injected"] = accelBias[i]
+		logMap["D"+k+"Injected"] = gyroBias[i]
+		logMap["L"+k+"Injected"] = magBias[i]
+	}
 	ahrsLogger := ahrs.NewAHRSLogger("ahrs.csv", logMap)
 
+	// Only a simulated situation knows the actual state to measure errors against
+	var metrics errorMetrics
+	var windLog *windLogger
+	sitSim, hasTruth := sit.(*SituationSim)
+	if hasTruth {
+		windLog = newWindLogger("k_wind.csv")
+		defer windLog.Close()
+		sitSim.Seed(seed)
+		sitSim.SetTurbulence(turbSigma, turbTau)
+		sitSim.SetGyroDrift(gyroDrift)
+		sitSim.SetMagField(magField, magInclination, magDeclination)
+		sitSim.SetSmooth(smooth)
+	}
+
+	// Serve the charts, and the latest state as it's computed.  Listen first, so that a busy port stops the run
+	// before it starts rather than leaving nothing to serve its results.
+	live := new(liveState)
+	var cServe chan error
+	if serve {
+		ln, err := net.Listen("tcp", ":8080")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		http.Handle("/state.json", live)
+		http.Handle("/", http.FileServer(http.Dir("./")))
+		cServe = make(chan error, 1)
+		go func() {
+			cServe <- http.Serve(ln, nil)
+		}()
+	}
+
 	// This is where it all happens
 	fmt.Println("Running Simulation")
 	sit.BeginTime()
@@ -219,6 +329,9 @@ func main() {
 			break
 		}
 		//TODO westphae: log actual state
+		if hasTruth { // The injected gyro bias drifts
+			logMap["D1Injected"], logMap["D2Injected"], logMap["D3Injected"] = s0.D1, s0.D2, s0.D3
+		}
 
 		// Take sensor measurements
 		if err := sit.UpdateMeasurement(m, !asiInop, !gpsInop, true, !magInop,
@@ -227,8 +340,20 @@ func main() {
 			log.Printf("Measurement error at time %f: %s\n", m.T, err)
 			break
 		}
+		if dropout.Active(m.T) {
+			m.WValid = false
+		}
+		logMap["GPSValid"] = 0.0
+		if m.WValid {
+			logMap["GPSValid"] = 1.0
+		}
 
 		s.Compute(m)
+		if hasTruth {
+			metrics.Add(s0, s)
+			windLog.Log(s0, s)
+		}
+		live.Update(s)
 
 		// Log to csv for serving
 		transferLogMap()
@@ -242,8 +367,16 @@ func main() {
 
 	}
 
-	// Run analysis web server
-	fmt.Println("Serving charts")
-	http.Handle("/", http.FileServer(http.Dir("./")))
-	http.ListenAndServe(":8080", nil)
+	if hasTruth {
+		metrics.Print()
+	}
+
+	if !serve {
+		ahrsLogger.Close()
+		return
+	}
+
+	// Keep serving for analysis
+	fmt.Println("Serving charts and final state at :8080")
+	log.Fatalln(<-cServe)
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// gpsDropout defines when the simulated GPS is lost: during any of the windows,
+// and for the first duration seconds of every period seconds.
+type gpsDropout struct {
+	windows          [][2]float64 // start and end times of dropouts, s
+	period, duration float64      // duty cycle of repeating dropouts, s
+}
+
+// parseGPSDropout parses a comma-separated dropout spec, each item being either a window "start-end"
+// or a duty cycle "period/duration", all in seconds, e.g. "0-20,100-130" or "60/10".
+func parseGPSDropout(str string) (d *gpsDropout, err error) {
+	d = new(gpsDropout)
+	if str == "" {
+		return
+	}
+	for _, item := range strings.Split(str, ",") {
+		var (
+			a, b float64
+			sep  string
+		)
+		switch {
+		case strings.Contains(item, "-"):
+			sep = "-"
+		case strings.Contains(item, "/"):
+			sep = "/"
+		default:
+			return nil, fmt.Errorf("gps dropout %q is neither start-end nor period/duration", item)
+		}
+		ab := strings.SplitN(item, sep, 2)
+		if a, err = strconv.ParseFloat(strings.TrimSpace(ab[0]), 64); err != nil {
+			return nil, err
+		}
+		if b, err = strconv.ParseFloat(strings.TrimSpace(ab[1]), 64); err != nil {
+			return nil, err
+		}
+		if sep == "-" {
+			if b < a {
+				return nil, fmt.Errorf("gps dropout %q ends before it starts", item)
+			}
+			d.windows = append(d.windows, [2]float64{a, b})
+		} else {
+			if a <= 0 || b < 0 || b > a {
+				return nil, fmt.Errorf("gps dropout %q needs 0 <= duration <= period", item)
+			}
+			d.period, d.duration = a, b
+		}
+	}
+	return
+}
+
+// Active reports whether the GPS is lost at time t.
+func (d *gpsDropout) Active(t float64) bool {
+	for _, w := range d.windows {
+		if t >= w[0] && t < w[1] {
+			return true
+		}
+	}
+	return d.period > 0 && math.Mod(t, d.period) < d.duration
+}
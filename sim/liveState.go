@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+
+	"../ahrs"
+)
+
+// stateSnapshot is the JSON served at /state.json: the AHRS algorithm's latest estimates.
+type stateSnapshot struct {
+	T                                      float64   // Time of the estimate, s
+	Roll, Pitch, Heading                   float64   // Attitude, °
+	RollStdDev, PitchStdDev, HeadingStdDev float64   // Attitude standard deviations, °
+	U1, U2, U3                             float64   // Airspeed, aircraft frame, kt
+	V1, V2, V3                             float64   // Wind, earth frame, kt
+	Altitude                               float64   // Pressure altitude, ft
+	VerticalSpeed                          float64   // Vertical speed, kt
+	StdDev                                 []float64 // Standard deviations of all the state variables, from the diagonal of M
+}
+
+// liveState holds the latest snapshot of the AHRS algorithm's state, safe to update while serving it over HTTP.
+type liveState struct {
+	mu   sync.Mutex
+	snap stateSnapshot
+}
+
+// Update takes a new snapshot of the AHRS algorithm s.
+func (l *liveState) Update(s ahrs.AHRSProvider) {
+	st := s.GetState()
+	snap := stateSnapshot{T: st.T, U1: st.U1, U2: st.U2, U3: st.U3, V1: st.V1, V2: st.V2, V3: st.V3,
+		Altitude: st.Altitude(), VerticalSpeed: st.VerticalSpeed()}
+	snap.Roll, snap.Pitch, snap.Heading = s.RollPitchHeading()
+	snap.Roll /= Deg
+	snap.Pitch /= Deg
+	if snap.Heading != ahrs.Invalid {
+		snap.Heading /= Deg
+	}
+	if st.M != nil {
+		snap.RollStdDev, snap.PitchStdDev, snap.HeadingStdDev = st.RollPitchHeadingStdDev()
+		snap.StdDev = make([]float64, st.M.Rows())
+		for i := range snap.StdDev {
+			snap.StdDev[i] = math.Sqrt(math.Abs(st.M.Get(i, i)))
+		}
+		// JSON has no NaN, which a degenerate covariance can give
+		for _, v := range []*float64{&snap.RollStdDev, &snap.PitchStdDev, &snap.HeadingStdDev} {
+			if math.IsNaN(*v) {
+				*v = ahrs.Invalid
+			}
+		}
+	}
+
+	l.mu.Lock()
+	l.snap = snap
+	l.mu.Unlock()
+}
+
+// ServeHTTP serves the latest snapshot as JSON.
+func (l *liveState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	data, err := json.Marshal(l.snap)
+	l.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
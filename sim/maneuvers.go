@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// maneuvers holds the built-in Situations, by the name used to select them with the -maneuver flag.
+// To add a maneuver, define its SituationSim (see newManeuver) and add it here.
+var maneuvers = map[string]*SituationSim{
+	"turn":      sitTurnDef,
+	"takeoff":   sitTakeoffDef,
+	"level":     sitLevelDef,
+	"climb":     sitClimbDef,
+	"descent":   sitDescentDef,
+	"figure8":   sitFigure8Def,
+	"dutchroll": sitDutchRollDef,
+	"landing":   sitLandingDef,
+}
+
+// maneuverNames returns the names of the built-in maneuvers, sorted and comma-separated.
+func maneuverNames() string {
+	names := make([]string, 0, len(maneuvers))
+	for k := range maneuvers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newManeuver returns a SituationSim at the times t with airspeed u1, kts, and attitude phi, theta, psi, degrees,
+// with the stratux mounted level facing forward, no wind, no sideslip or vertical airspeed
+// and the same magnetic field as the other built-in maneuvers.  Any of these can be changed after.
+func newManeuver(t, u1, phi, theta, psi []float64) *SituationSim {
+	n := len(t)
+	return &SituationSim{
+		t:      t,
+		u1:     u1,
+		u2:     constant(n, 0),
+		u3:     constant(n, 0),
+		phi:    phi,
+		theta:  theta,
+		psi:    psi,
+		phi0:   constant(n, 0),
+		theta0: constant(n, 0),
+		psi0:   constant(n, 90),
+		v1:     constant(n, 0),
+		v2:     constant(n, 0),
+		v3:     constant(n, 0),
+		m1:     constant(n, 0),
+		m2:     constant(n, 1),
+		m3:     constant(n, -1),
+	}
+}
+
+// constant returns a slice of n copies of v.
+func constant(n int, v float64) (x []float64) {
+	x = make([]float64, n)
+	for i := range x {
+		x[i] = v
+	}
+	return
+}
+
+// Five minutes straight and level
+var sitLevelDef = newManeuver(
+	[]float64{0, 300},
+	[]float64{airspeed, airspeed},
+	[]float64{0, 0},
+	[]float64{0, 0},
+	[]float64{0, 0},
+)
+
+// A steady climb at Vy, with pitch-up and level-off
+var sitClimbDef = func() (s *SituationSim) {
+	s = newManeuver(
+		[]float64{0, 10, 20, 200, 210, 220},
+		[]float64{airspeed, airspeed, 90, 90, airspeed, airspeed},
+		[]float64{0, 0, 0, 0, 0, 0},
+		[]float64{0, 0, 8, 8, 0, 0},
+		[]float64{0, 0, 0, 0, 0, 0},
+	)
+	s.u3 = []float64{0, 0, -2, -2, 0, 0} // Angle of attack at the lower airspeed
+	return
+}()
+
+// A cruise descent at 500 ft/min, with pitch-down and level-off
+var sitDescentDef = newManeuver(
+	[]float64{0, 10, 15, 195, 200, 210},
+	[]float64{airspeed, airspeed, 130, 130, airspeed, airspeed},
+	[]float64{0, 0, 0, 0, 0, 0},
+	[]float64{0, 0, -2.5, -2.5, 0, 0},
+	[]float64{0, 0, 0, 0, 0, 0},
+)
+
+// A standard-rate right 360 followed directly by a standard-rate left 360
+var sitFigure8Def = func() (s *SituationSim) {
+	s = newManeuver(
+		// start, roll into right turn, roll through level into left turn, roll out, end
+		[]float64{0, 10, 15, 135, 140, 145, 265, 270, 280},
+		constant(9, airspeed),
+		[]float64{0, 0, bank, bank, 0, -bank, -bank, 0, 0},
+		constant(9, 0),
+		[]float64{0, 0, 0, 360, 360, 360, 0, 0, 0},
+	)
+	s.u3 = []float64{0, 0, mush, mush, 0, mush, mush, 0, 0}
+	return
+}()
+
+// A lightly-damped Dutch roll: coupled roll and yaw oscillation with sideslip, period 3s
+var sitDutchRollDef = func() (s *SituationSim) {
+	const (
+		period = 3.0  // s
+		dt     = 0.25 // s, between definition points
+		tEnd   = 60.0 // s
+		decay  = 20.0 // s, e-folding time of the oscillation
+	)
+	n := int(tEnd/dt) + 1
+	t, phi, psi, u2 := make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+	for i := range t {
+		t[i] = float64(i) * dt
+		if t[i] < 10 { // Start level, then disturbed at 10s
+			continue
+		}
+		amp := math.Exp(-(t[i] - 10) / decay)
+		w := 2 * Pi * (t[i] - 10) / period
+		phi[i] = 10 * amp * math.Sin(w)
+		psi[i] = -5 * amp * math.Sin(w)          // The nose wags opposite to the roll
+		u2[i] = -airspeed * math.Sin(psi[i]*Deg) // Yawing the nose off the flight path is sideslip
+	}
+	s = newManeuver(t, constant(n, airspeed), phi, constant(n, 0), psi)
+	s.u2 = u2
+	return
+}()
+
+// An approach at 3°, flare, touchdown and rollout to a stop
+var sitLandingDef = func() (s *SituationSim) {
+	s = newManeuver(
+		// approach, begin flare, touchdown, nosewheel down, rollout, stopped
+		[]float64{0, 60, 65, 68, 90, 100},
+		[]float64{70, 70, 60, 55, 5, 0},
+		[]float64{0, 0, 0, 0, 0, 0},
+		[]float64{-1, -1, 4, 0, 0, 0},
+		[]float64{0, 0, 0, 0, 0, 0},
+	)
+	s.u3 = []float64{-2.5, -2.5, -2, 0, 0, 0} // Descent path below the nose on approach
+	return
+}()
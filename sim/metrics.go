@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"../ahrs"
+)
+
+// errorMetrics accumulates the errors of an AHRS algorithm's estimates against the actual situation,
+// for a summary at the end of a run.
+type errorMetrics struct {
+	n, nHeading               int     // Number of samples, and of those with a valid heading
+	roll, pitch, heading      float64 // Sums of squared attitude errors, °²
+	wind1, wind2, wind3       float64 // Sums of squared wind errors, kt²
+	maxRoll, maxPitch, maxHdg float64 // Largest absolute attitude errors, °
+}
+
+// Add accumulates the errors of the algorithm s against the actual state s0.
+func (e *errorMetrics) Add(s0 *ahrs.State, s ahrs.AHRSProvider) {
+	roll0, pitch0, heading0 := ahrs.FromQuaternion(s0.E0, s0.E1, s0.E2, s0.E3)
+	roll, pitch, heading := s.RollPitchHeading()
+
+	dr := ahrs.AngleDiff(roll, roll0) / Deg
+	dp := ahrs.AngleDiff(pitch, pitch0) / Deg
+	e.n++
+	e.roll += dr * dr
+	e.pitch += dp * dp
+	e.maxRoll = math.Max(e.maxRoll, math.Abs(dr))
+	e.maxPitch = math.Max(e.maxPitch, math.Abs(dp))
+	if heading != ahrs.Invalid {
+		dh := ahrs.AngleDiff(heading, heading0) / Deg
+		e.nHeading++
+		e.heading += dh * dh
+		e.maxHdg = math.Max(e.maxHdg, math.Abs(dh))
+	}
+
+	st := s.GetState()
+	e.wind1 += (st.V1 - s0.V1) * (st.V1 - s0.V1)
+	e.wind2 += (st.V2 - s0.V2) * (st.V2 - s0.V2)
+	e.wind3 += (st.V3 - s0.V3) * (st.V3 - s0.V3)
+}
+
+// Print prints a summary table of the RMS and maximum errors.
+func (e *errorMetrics) Print() {
+	if e.n == 0 {
+		fmt.Println("No samples for error metrics")
+		return
+	}
+	rms := func(ss float64, n int) float64 {
+		if n == 0 {
+			return math.NaN()
+		}
+		return math.Sqrt(ss / float64(n))
+	}
+	fmt.Printf("Errors over %d samples:\n", e.n)
+	fmt.Printf("\t%-8s %8s %8s\n", "", "RMS", "Max")
+	fmt.Printf("\t%-8s %8.3f %8.3f °\n", "Roll", rms(e.roll, e.n), e.maxRoll)
+	fmt.Printf("\t%-8s %8.3f %8.3f °\n", "Pitch", rms(e.pitch, e.n), e.maxPitch)
+	fmt.Printf("\t%-8s %8.3f %8.3f ° (%d valid)\n", "Heading", rms(e.heading, e.nHeading), e.maxHdg, e.nHeading)
+	fmt.Printf("\t%-8s %8.3f %8s kt\n", "Wind E/W", rms(e.wind1, e.n), "")
+	fmt.Printf("\t%-8s %8.3f %8s kt\n", "Wind N/S", rms(e.wind2, e.n), "")
+	fmt.Printf("\t%-8s %8.3f %8s kt\n", "Wind U/D", rms(e.wind3, e.n), "")
+}
@@ -31,6 +31,7 @@ type SituationFromFile struct {
 	w3     []float64
 	wvalid []float64
 	alt    []float64
+	hasAlt bool                  // Whether the log has a pressure altitude column
 	logMap map[string][]*float64 // Map only for analysis/debugging
 	logMapCurrent map[string]interface{}
 }
@@ -131,10 +132,25 @@ func NewSituationFromFile(fn string) (sit *SituationFromFile, err error) {
 				continue
 			}
 		}
-		sit.t[j] -= t0
-		sit.tw[j] -= t0
 		j += 1
 	}
+
+	// Logs straight from the sensors, such as those recorded by mpu9250/test/read_mpu9250.go,
+	// have no GPS or altitude columns: the GPS is then invalid, and its time follows the IMU's.
+	if len(sit.tw) == 0 {
+		sit.tw = append(sit.tw, sit.t...)
+	}
+	sit.hasAlt = len(sit.alt) > 0
+	for _, a := range []*[]float64{&sit.a1, &sit.a2, &sit.a3, &sit.h1, &sit.h2, &sit.h3, &sit.m1, &sit.m2, &sit.m3,
+		&sit.tw, &sit.w1, &sit.w2, &sit.w3, &sit.wvalid, &sit.alt} {
+		for len(*a) < j {
+			*a = append(*a, 0)
+		}
+	}
+	for i := range sit.t {
+		sit.t[i] -= t0
+		sit.tw[i] -= t0
+	}
 	err = nil
 	log.Printf("Records read: %d\n", j)
 	return
@@ -200,6 +216,8 @@ func (s *SituationFromFile) UpdateMeasurement(m *ahrs.Measurement,
 	m.M2 = s.m2[s.ix]
 	m.M3 = s.m3[s.ix]
 	m.MValid = m.M1 != 0 || m.M2 != 0 || m.M3 != 0
+	m.P = s.alt[s.ix]
+	m.PValid = s.hasAlt
 	m.T = s.t[s.ix]
 
 	m.M = matrix.Zeros(15, 15)
@@ -2,22 +2,26 @@ package main
 
 import (
 	"../ahrs"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/skelterjohn/go.matrix"
+	"io/ioutil"
 	"math"
 	"math/rand"
 	"sort"
 )
 
 const (
-	Pi    = math.Pi
-	Deg   = Pi / 180
-	Small = 1e-6
+	Pi          = math.Pi
+	Deg         = Pi / 180
+	Small       = 1e-6
+	defaultSeed = 1 // Seed for the measurement noise unless another is given
 )
 
 var TimeError = errors.New("requested time is outside of scenario")
 
-// Situation defines a scenario by piecewise-linear interpolation
+// Situation defines a scenario by piecewise-linear interpolation, or smooth interpolation, see SetSmooth
 type SituationSim struct {
 	t                  []float64 // times for situation, s
 	u1, u2, u3         []float64 // airspeed, kts, aircraft frame [F/B, R/L, and U/D]
@@ -25,83 +29,310 @@ type SituationSim struct {
 	phi0, theta0, psi0 []float64 // base attitude, rad [adjust for position of stratux on glareshield]
 	v1, v2, v3         []float64 // windspeed, kts, earth frame [N/S, E/W, and U/D]
 	m1, m2, m3         []float64 // magnetometer reading
+	tCur, dt           float64   // current time and time step for stepping through the situation, s
+	rng                *rand.Rand // source of the measurement noise, see Seed
+	turbSigma, turbTau float64    // turbulence intensity, kt rms, and correlation time, s, see SetTurbulence
+	gust               [3]float64 // current gust added to the wind, kts, earth frame
+	tGust              float64    // time of the current gust, s
+	gyroDrift          float64    // rate of the random walk of the gyro bias, °/s per √s, see SetGyroDrift
+	drift              [3]float64 // current gyro bias drift added to the bias, °/s, sensor frame
+	tDrift             float64    // time of the current gyro bias drift, s
+	magField           []float64  // earth-frame magnetic field replacing m1, m2, m3 if set, μT, see SetMagField
+	smooth             bool       // whether to interpolate smoothly, see SetSmooth
 	logMap             map[string]interface{} // Map only for analysis/debugging
 }
 
-// BeginTime returns the time stamp when the simulation begins
+// situationJSON is the layout of a Situation definition in a JSON scenario file:
+// each field is an array of values at the times in "t".
+type situationJSON struct {
+	T      []float64 `json:"t"`
+	U1     []float64 `json:"u1"`
+	U2     []float64 `json:"u2"`
+	U3     []float64 `json:"u3"`
+	Phi    []float64 `json:"phi"`
+	Theta  []float64 `json:"theta"`
+	Psi    []float64 `json:"psi"`
+	Phi0   []float64 `json:"phi0"`
+	Theta0 []float64 `json:"theta0"`
+	Psi0   []float64 `json:"psi0"`
+	V1     []float64 `json:"v1"`
+	V2     []float64 `json:"v2"`
+	V3     []float64 `json:"v3"`
+	M1     []float64 `json:"m1"`
+	M2     []float64 `json:"m2"`
+	M3     []float64 `json:"m3"`
+}
+
+// NewSituationSimFromJSON loads a Situation definition from the JSON file fn, stepping through it every dt seconds.
+// All the arrays must have the same length, at least two, and the times t must be increasing.
+func NewSituationSimFromJSON(fn string, dt float64) (s *SituationSim, err error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var d situationJSON
+	if err = json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("sim: can't parse scenario %s: %s", fn, err)
+	}
+
+	if len(d.T) < 2 {
+		return nil, fmt.Errorf("sim: scenario %s needs at least two times in t", fn)
+	}
+	for i := 1; i < len(d.T); i++ {
+		if d.T[i] <= d.T[i-1] {
+			return nil, fmt.Errorf("sim: scenario %s times t aren't increasing at index %d", fn, i)
+		}
+	}
+	names := []string{"u1", "u2", "u3", "phi", "theta", "psi", "phi0", "theta0", "psi0", "v1", "v2", "v3", "m1", "m2", "m3"}
+	for i, v := range [][]float64{
+		d.U1, d.U2, d.U3,
+		d.Phi, d.Theta, d.Psi,
+		d.Phi0, d.Theta0, d.Psi0,
+		d.V1, d.V2, d.V3,
+		d.M1, d.M2, d.M3,
+	} {
+		if len(v) != len(d.T) {
+			return nil, fmt.Errorf("sim: scenario %s has %d values for %s but %d times", fn, len(v), names[i], len(d.T))
+		}
+	}
+
+	s = &SituationSim{
+		t:  d.T,
+		u1: d.U1, u2: d.U2, u3: d.U3,
+		phi: d.Phi, theta: d.Theta, psi: d.Psi,
+		phi0: d.Phi0, theta0: d.Theta0, psi0: d.Psi0,
+		v1: d.V1, v2: d.V2, v3: d.V3,
+		m1: d.M1, m2: d.M2, m3: d.M3,
+		dt: dt,
+	}
+	return s, nil
+}
+
+// Seed makes the measurement noise a reproducible sequence determined by seed
+func (s *SituationSim) Seed(seed int64) {
+	s.rng = rand.New(rand.NewSource(seed))
+}
+
+// SetTurbulence adds gusts to the situation's wind, as a random walk in each component
+// with rms intensity sigma, kt, decorrelating over tau seconds (a first-order Gauss-Markov process).
+func (s *SituationSim) SetTurbulence(sigma, tau float64) {
+	s.turbSigma, s.turbTau = sigma, tau
+	s.gust = [3]float64{}
+	s.tGust = s.t[0]
+}
+
+// SetGyroDrift makes the gyro bias wander from the one given as a random walk in each component,
+// its standard deviation growing by rate °/s per √s, as real gyro biases do.
+// Unlike the white gyro noise, this is what the algorithms' gyro bias estimates D should track.
+func (s *SituationSim) SetGyroDrift(rate float64) {
+	s.gyroDrift = rate
+	s.drift = [3]float64{}
+	s.tDrift = s.t[0]
+}
+
+// SetMagField replaces the situation's magnetic field by a steady one of the given total strength, μT,
+// dipping below the horizontal by inclination, °, and pointing east of true north by declination, °,
+// as given by a geomagnetic model for the place.  A non-positive strength restores the situation's own field.
+func (s *SituationSim) SetMagField(strength, inclination, declination float64) {
+	if strength <= 0 {
+		s.magField = nil
+		return
+	}
+	h := strength * math.Cos(inclination*Deg)
+	s.magField = []float64{h * math.Sin(declination*Deg), h * math.Cos(declination*Deg), -strength * math.Sin(inclination*Deg)}
+}
+
+// SetSmooth chooses smooth interpolation between the situation's times instead of piecewise-linear.
+// Piecewise-linear interpolation has kinks at every time, so the rates and accelerations synthesized from it jump;
+// smooth interpolation is a monotone piecewise-cubic (PCHIP) through the same values, so they change continuously,
+// and holds between equal values stay flat, without overshoot.
+func (s *SituationSim) SetSmooth(smooth bool) {
+	s.smooth = smooth
+}
+
+// interp returns the value of y, and its rate of change, at time t in the interval from s.t[ix] to s.t[ix+1].
+// t may be a little outside the interval, to take derivatives, extrapolating its interpolant.
+func (s *SituationSim) interp(y []float64, ix int, t float64) (v, dv float64) {
+	h := s.t[ix+1] - s.t[ix]
+	d := (y[ix+1] - y[ix]) / h
+	if !s.smooth {
+		return y[ix] + (t-s.t[ix])*d, d
+	}
+
+	// Cubic Hermite between the ends with slopes m0, m1
+	m0, m1 := s.pchipSlope(y, ix), s.pchipSlope(y, ix+1)
+	x := (t - s.t[ix]) / h
+	h00, h10, h01, h11 := 2*x*x*x-3*x*x+1, x*x*x-2*x*x+x, -2*x*x*x+3*x*x, x*x*x-x*x
+	v = h00*y[ix] + h10*h*m0 + h01*y[ix+1] + h11*h*m1
+	dh00, dh10, dh01, dh11 := 6*x*x-6*x, 3*x*x-4*x+1, -6*x*x+6*x, 3*x*x-2*x
+	dv = (dh00*y[ix]+dh01*y[ix+1])/h + dh10*m0 + dh11*m1
+	return
+}
+
+// pchipSlope returns the slope of the monotone piecewise-cubic interpolant of y at s.t[k] (Fritsch-Butland):
+// zero at a local extremum or either side of a hold, else a weighted harmonic mean of the slopes either side.
+func (s *SituationSim) pchipSlope(y []float64, k int) float64 {
+	n := len(s.t)
+	if k == 0 || k == n-1 {
+		return 0 // The situation starts and ends steady
+	}
+	h0, h1 := s.t[k]-s.t[k-1], s.t[k+1]-s.t[k]
+	d0, d1 := (y[k]-y[k-1])/h0, (y[k+1]-y[k])/h1
+	if d0*d1 <= 0 {
+		return 0
+	}
+	return 3 * (h0 + h1) / ((2*h1+h0)/d0 + (h1+2*h0)/d1)
+}
+
+// gustAt returns the gust at time t, advancing the random walk to t if t is later than the current gust.
+func (s *SituationSim) gustAt(t float64) (g1, g2, g3 float64) {
+	if s.turbSigma <= 0 || s.turbTau <= 0 {
+		return
+	}
+	if t > s.tGust {
+		if s.rng == nil {
+			s.Seed(defaultSeed)
+		}
+		a := math.Exp(-(t - s.tGust) / s.turbTau)
+		b := s.turbSigma * math.Sqrt(1-a*a)
+		for i := range s.gust {
+			s.gust[i] = a*s.gust[i] + b*s.rng.NormFloat64()
+		}
+		s.tGust = t
+	}
+	return s.gust[0], s.gust[1], s.gust[2]
+}
+
+// driftAt returns the gyro bias drift at time t, advancing the random walk to t if t is later than the current drift.
+func (s *SituationSim) driftAt(t float64) (d1, d2, d3 float64) {
+	if s.gyroDrift <= 0 {
+		return
+	}
+	if t > s.tDrift {
+		if s.rng == nil {
+			s.Seed(defaultSeed)
+		}
+		b := s.gyroDrift * math.Sqrt(t-s.tDrift)
+		for i := range s.drift {
+			s.drift[i] += b * s.rng.NormFloat64()
+		}
+		s.tDrift = t
+	}
+	return s.drift[0], s.drift[1], s.drift[2]
+}
+
+// BeginTime returns the time stamp when the simulation begins, and starts stepping through it from there
 func (s *SituationSim) BeginTime() float64 {
+	s.tCur = s.t[0]
 	return s.t[0]
 }
 
-// Interpolate an ahrs.State from a Situation definition at a given time
-func (s *SituationSim) Interpolate(t float64, st *ahrs.State, aBias, bBias, mBias []float64) error {
-	if t < s.t[0] || t > s.t[len(s.t)-1] {
-		st = new(ahrs.State)
+// NextTime steps the simulation on by its time step
+func (s *SituationSim) NextTime() (err error) {
+	if s.tCur+s.dt > s.t[len(s.t)-1] {
 		return TimeError
 	}
+	s.tCur += s.dt
+	return nil
+}
+
+// clamp returns t limited to the times of the situation.
+func (s *SituationSim) clamp(t float64) float64 {
+	if t < s.t[0] {
+		return s.t[0]
+	}
+	if t > s.t[len(s.t)-1] {
+		return s.t[len(s.t)-1]
+	}
+	return t
+}
+
+// UpdateState sets st to the actual state at the current time
+func (s *SituationSim) UpdateState(st *ahrs.State, aBias, bBias, mBias []float64) error {
+	return s.Interpolate(s.tCur, st, aBias, bBias, mBias)
+}
+
+// UpdateMeasurement sets m to the measurements at the current time, as for Measurement
+func (s *SituationSim) UpdateMeasurement(m *ahrs.Measurement,
+	uValid, wValid, sValid, mValid bool,
+	uNoise, wNoise, aNoise, bNoise, mNoise float64,
+	uBias, aBias, bBias, mBias []float64,
+) error {
+	return s.Measurement(s.tCur, m, uValid, wValid, sValid, mValid,
+		uNoise, wNoise, aNoise, bNoise, mNoise, uBias, aBias, bBias, mBias)
+}
+
+// Interpolate an ahrs.State from a Situation definition at a given time.
+// Times outside the situation are clamped to its first or last time, holding the state there.
+func (s *SituationSim) Interpolate(t float64, st *ahrs.State, aBias, bBias, mBias []float64) error {
+	s.interpolate(t, st, aBias, bBias, mBias)
+	return nil
+}
+
+// interpolate sets st to the state at time t, as for Interpolate, and returns the rate of change of its
+// attitude quaternion E, found analytically from the rates of change of the interpolated angles.
+func (s *SituationSim) interpolate(t float64, st *ahrs.State, aBias, bBias, mBias []float64) (dE0, dE1, dE2, dE3 float64) {
+	t = s.clamp(t)
 	ix := 0
 	if t > s.t[0] {
 		ix = sort.SearchFloat64s(s.t, t) - 1
 	}
 
-	ddt := (s.t[ix+1] - s.t[ix])
-	f := (s.t[ix+1] - t) / ddt
-
 	// These are the fields we need to calculate:
 	// U, Z, E, H, N,
 	// V, C, F, D, L
 
-	st.U1 = f*s.u1[ix] + (1-f)*s.u1[ix+1]
-	st.U2 = f*s.u2[ix] + (1-f)*s.u2[ix+1]
-	st.U3 = f*s.u3[ix] + (1-f)*s.u3[ix+1]
-
-	st.Z1 = (s.u1[ix+1] - s.u1[ix]) / ddt / ahrs.G
-	st.Z2 = (s.u2[ix+1] - s.u2[ix]) / ddt / ahrs.G
-	st.Z3 = (s.u3[ix+1] - s.u3[ix]) / ddt / ahrs.G
-
-	st.E0, st.E1, st.E2, st.E3 = ahrs.ToQuaternion(
-		(f*s.phi[ix]+(1-f)*s.phi[ix+1])*Deg,
-		(f*s.theta[ix]+(1-f)*s.theta[ix+1])*Deg,
-		(f*s.psi[ix]+(1-f)*s.psi[ix+1])*Deg)
-
-	// For calculating the Hx, we need to calculate the Ex a small time from now to find their derivatives
-	tz := Small
-	fz := (s.t[ix+1] - (t + tz)) / ddt
-	ez0, ez1, ez2, ez3 := ahrs.ToQuaternion(
-		(fz*s.phi[ix]+(1-fz)*s.phi[ix+1])*Deg,
-		(fz*s.theta[ix]+(1-fz)*s.theta[ix+1])*Deg,
-		(fz*s.psi[ix]+(1-fz)*s.psi[ix+1])*Deg)
-
-	// dEx are Ex derivatives
-	dE0 := +(ez0 - st.E0) / tz
-	dE1 := -(ez1 - st.E1) / tz
-	dE2 := -(ez2 - st.E2) / tz
-	dE3 := -(ez3 - st.E3) / tz
-
-	st.H1 = -2 * (st.E0*dE1 + st.E1*dE0 + st.E2*dE3 - st.E3*dE2) / Deg
-	st.H2 = -2 * (st.E0*dE2 - st.E1*dE3 + st.E2*dE0 + st.E3*dE1) / Deg
-	st.H3 = -2 * (st.E0*dE3 + st.E1*dE2 - st.E2*dE1 + st.E3*dE0) / Deg
-
-	st.N1 = f*s.m1[ix] + (1-f)*s.m1[ix+1]
-	st.N2 = f*s.m2[ix] + (1-f)*s.m2[ix+1]
-	st.N3 = f*s.m3[ix] + (1-f)*s.m3[ix+1]
-
-	st.V1 = f*s.v1[ix] + (1-f)*s.v1[ix+1]
-	st.V2 = f*s.v2[ix] + (1-f)*s.v2[ix+1]
-	st.V3 = f*s.v3[ix] + (1-f)*s.v3[ix+1]
+	var dU1, dU2, dU3 float64
+	st.U1, dU1 = s.interp(s.u1, ix, t)
+	st.U2, dU2 = s.interp(s.u2, ix, t)
+	st.U3, dU3 = s.interp(s.u3, ix, t)
+
+	st.Z1 = dU1 / ahrs.G
+	st.Z2 = dU2 / ahrs.G
+	st.Z3 = dU3 / ahrs.G
+
+	phi, dphi := s.interp(s.phi, ix, t)
+	theta, dtheta := s.interp(s.theta, ix, t)
+	psi, dpsi := s.interp(s.psi, ix, t)
+	st.E0, st.E1, st.E2, st.E3 = ahrs.ToQuaternion(phi*Deg, theta*Deg, psi*Deg)
+	dE0, dE1, dE2, dE3 = ahrs.ToQuaternionRate(phi*Deg, theta*Deg, psi*Deg, dphi*Deg, dtheta*Deg, dpsi*Deg)
+
+	// The rates H follow from E and the conjugate of its derivative
+	dq0, dq1, dq2, dq3 := dE0, -dE1, -dE2, -dE3
+	st.H1 = -2 * (st.E0*dq1 + st.E1*dq0 + st.E2*dq3 - st.E3*dq2) / Deg
+	st.H2 = -2 * (st.E0*dq2 - st.E1*dq3 + st.E2*dq0 + st.E3*dq1) / Deg
+	st.H3 = -2 * (st.E0*dq3 + st.E1*dq2 - st.E2*dq1 + st.E3*dq0) / Deg
+
+	if s.magField != nil {
+		st.N1, st.N2, st.N3 = s.magField[0], s.magField[1], s.magField[2]
+	} else {
+		st.N1, _ = s.interp(s.m1, ix, t)
+		st.N2, _ = s.interp(s.m2, ix, t)
+		st.N3, _ = s.interp(s.m3, ix, t)
+	}
+
+	st.V1, _ = s.interp(s.v1, ix, t)
+	st.V2, _ = s.interp(s.v2, ix, t)
+	st.V3, _ = s.interp(s.v3, ix, t)
+
+	g1, g2, g3 := s.gustAt(t)
+	st.V1 += g1
+	st.V2 += g2
+	st.V3 += g3
 
 	st.C1 = aBias[0]
 	st.C2 = aBias[1]
 	st.C3 = aBias[2]
 
-	st.F0, st.F1, st.F2, st.F3 = ahrs.ToQuaternion(
-		(f*s.phi0[ix]+(1-f)*s.phi0[ix+1])*Deg,
-		(f*s.theta0[ix]+(1-f)*s.theta0[ix+1])*Deg,
-		(f*s.psi0[ix]+(1-f)*s.psi0[ix+1])*Deg)
+	phi0, _ := s.interp(s.phi0, ix, t)
+	theta0, _ := s.interp(s.theta0, ix, t)
+	psi0, _ := s.interp(s.psi0, ix, t)
+	st.F0, st.F1, st.F2, st.F3 = ahrs.ToQuaternion(phi0*Deg, theta0*Deg, psi0*Deg)
 
-	st.D1 = bBias[0]
-	st.D2 = bBias[1]
-	st.D3 = bBias[2]
+	d1, d2, d3 := s.driftAt(t)
+	st.D1 = bBias[0] + d1
+	st.D2 = bBias[1] + d2
+	st.D3 = bBias[2] + d3
 
 	st.L1 = mBias[0]
 	st.L2 = mBias[1]
@@ -112,37 +343,31 @@ func (s *SituationSim) Interpolate(t float64, st *ahrs.State, aBias, bBias, mBia
 	st.M = matrix.Zeros(32, 32)
 	st.N = matrix.Zeros(32, 32)
 
-	return nil
+	return
 }
 
 // Determine ahrs.Measurement variables from a Situation definition at a given time
 // gps noise (gaussian stdev) and bias are in kt
 // airspeed noise and bias are in kt
 // accelerometer noise and bias are in G
-// gyro noise and bias are in °/s
+// gyro noise and bias are in °/s, the bias drifting if SetGyroDrift was given a rate
 // magnetometer noise and bias are in μT
+// Times outside the situation are clamped as for Interpolate.
 func (s *SituationSim) Measurement(t float64, m *ahrs.Measurement,
 	uValid, wValid, sValid, mValid bool,
 	uNoise, wNoise, aNoise, bNoise, mNoise float64,
 	uBias, aBias, bBias, mBias []float64,
 ) error {
-	if t < s.t[0] || t > s.t[len(s.t)-1] {
-		m = new(ahrs.Measurement)
-		return TimeError
+	t = s.clamp(t)
+	if s.rng == nil {
+		s.Seed(defaultSeed)
 	}
 
-	var x, z ahrs.State
-	tz := Small
-	s.Interpolate(t, &x, aBias, bBias, mBias)
-	s.Interpolate(t+tz, &z, aBias, bBias, mBias)
-
-	dU1 := (z.U1 - x.U1) / tz
-	dU2 := (z.U2 - x.U2) / tz
-	dU3 := (z.U3 - x.U3) / tz
-	dE0 := (z.E0 - x.E0) / tz
-	dE1 := -(z.E1 - x.E1) / tz
-	dE2 := -(z.E2 - x.E2) / tz
-	dE3 := -(z.E3 - x.E3) / tz
+	// The derivatives of the airspeed and attitude come analytically from the interpolation
+	var x ahrs.State
+	dE0, dE1, dE2, dE3 := s.interpolate(t, &x, aBias, bBias, mBias)
+	dE1, dE2, dE3 = -dE1, -dE2, -dE3
+	dU1, dU2, dU3 := x.Z1*ahrs.G, x.Z2*ahrs.G, x.Z3*ahrs.G
 
 	// eij rotates between earth frame i component and aircraft frame j component
 	e11 := (+x.E0*x.E0 + x.E1*x.E1 - x.E2*x.E2 - x.E3*x.E3)
@@ -168,14 +393,14 @@ func (s *SituationSim) Measurement(t float64, m *ahrs.Measurement,
 
 	if uValid { // ASI doesn't read U2 or U3
 		m.UValid = true
-		m.U1 = x.U1 + uBias[0] + uNoise*rand.NormFloat64()
+		m.U1 = x.U1 + uBias[0] + uNoise*s.rng.NormFloat64()
 	}
 
 	if wValid {
 		m.WValid = true
-		m.W1 = e11*x.U1 + e12*x.U2 + e13*x.U3 + x.V1 + wNoise*rand.NormFloat64()
-		m.W2 = e21*x.U1 + e22*x.U2 + e23*x.U3 + x.V2 + wNoise*rand.NormFloat64()
-		m.W3 = e31*x.U1 + e32*x.U2 + e33*x.U3 + x.V3 + wNoise*rand.NormFloat64()
+		m.W1 = e11*x.U1 + e12*x.U2 + e13*x.U3 + x.V1 + wNoise*s.rng.NormFloat64()
+		m.W2 = e21*x.U1 + e22*x.U2 + e23*x.U3 + x.V2 + wNoise*s.rng.NormFloat64()
+		m.W3 = e31*x.U1 + e32*x.U2 + e33*x.U3 + x.V3 + wNoise*s.rng.NormFloat64()
 	}
 
 	if sValid {
@@ -190,13 +415,14 @@ func (s *SituationSim) Measurement(t float64, m *ahrs.Measurement,
 		y3 := (-dU3-h1*x.U2+h2*x.U1)/ahrs.G - e33
 
 		// Rotate into sensor frame
-		m.A1 = f11*y1 + f12*y2 + f13*y3 + aBias[0] + aNoise*rand.NormFloat64()
-		m.A2 = f21*y1 + f22*y2 + f23*y3 + aBias[1] + aNoise*rand.NormFloat64()
-		m.A3 = f31*y1 + f32*y2 + f33*y3 + aBias[2] + aNoise*rand.NormFloat64()
-
-		m.B1 = (f11*h1+f12*h2+f13*h3)/Deg + (bBias[0] + bNoise*rand.NormFloat64())
-		m.B2 = (f21*h1+f22*h2+f23*h3)/Deg + (bBias[1] + bNoise*rand.NormFloat64())
-		m.B3 = (f31*h1+f32*h2+f33*h3)/Deg + (bBias[2] + bNoise*rand.NormFloat64())
+		m.A1 = f11*y1 + f12*y2 + f13*y3 + aBias[0] + aNoise*s.rng.NormFloat64()
+		m.A2 = f21*y1 + f22*y2 + f23*y3 + aBias[1] + aNoise*s.rng.NormFloat64()
+		m.A3 = f31*y1 + f32*y2 + f33*y3 + aBias[2] + aNoise*s.rng.NormFloat64()
+
+		// The gyro bias D includes any drift
+		m.B1 = (f11*h1+f12*h2+f13*h3)/Deg + (x.D1 + bNoise*s.rng.NormFloat64())
+		m.B2 = (f21*h1+f22*h2+f23*h3)/Deg + (x.D2 + bNoise*s.rng.NormFloat64())
+		m.B3 = (f31*h1+f32*h2+f33*h3)/Deg + (x.D3 + bNoise*s.rng.NormFloat64())
 	}
 
 	if mValid {
@@ -204,9 +430,9 @@ func (s *SituationSim) Measurement(t float64, m *ahrs.Measurement,
 		m1 := x.N1*e11 + x.N2*e21 + x.N3*e31
 		m2 := x.N1*e12 + x.N2*e22 + x.N3*e32
 		m3 := x.N1*e13 + x.N2*e23 + x.N3*e33
-		m.M1 = f11*m1 + f12*m2 + f13*m3 + mBias[0] + mNoise*rand.NormFloat64()
-		m.M2 = f21*m1 + f22*m2 + f23*m3 + mBias[1] + mNoise*rand.NormFloat64()
-		m.M3 = f31*m1 + f32*m2 + f33*m3 + mBias[2] + mNoise*rand.NormFloat64()
+		m.M1 = f11*m1 + f12*m2 + f13*m3 + mBias[0] + mNoise*s.rng.NormFloat64()
+		m.M2 = f21*m1 + f22*m2 + f23*m3 + mBias[1] + mNoise*s.rng.NormFloat64()
+		m.M3 = f31*m1 + f32*m2 + f33*m3 + mBias[2] + mNoise*s.rng.NormFloat64()
 	}
 
 	m.T = t
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"../ahrs"
+)
+
+func TestInterpolateEndpoints(t *testing.T) {
+	s := sitTurnDef
+	zero := []float64{0, 0, 0}
+	tEnd := s.t[len(s.t)-1]
+
+	for _, c := range []struct {
+		t, tWant, heading float64 // s, s, °
+	}{
+		{s.t[0], s.t[0], 0},
+		{tEnd, tEnd, 0},     // 720° of turn
+		{-5, s.t[0], 0},     // Clamped to the start
+		{tEnd + 5, tEnd, 0}, // Clamped to the end
+	} {
+		var st ahrs.State
+		if err := s.Interpolate(c.t, &st, zero, zero, zero); err != nil {
+			t.Errorf("Interpolate at %f gave error %s", c.t, err)
+			continue
+		}
+		if st.T != c.tWant {
+			t.Errorf("Interpolate at %f gave time %f, expected %f", c.t, st.T, c.tWant)
+		}
+		_, _, heading := ahrs.FromQuaternion(st.E0, st.E1, st.E2, st.E3)
+		if math.Abs(ahrs.AngleDiff(heading, c.heading*Deg)) > 1e-6 {
+			t.Errorf("Interpolate at %f gave heading %f, expected %f", c.t, heading/Deg, c.heading)
+		}
+		if math.IsNaN(st.H1) || math.IsNaN(st.H2) || math.IsNaN(st.H3) {
+			t.Errorf("Interpolate at %f gave rates %f, %f, %f", c.t, st.H1, st.H2, st.H3)
+		}
+	}
+
+	// The accelerometer at the very end must still see level flight, not a spurious derivative
+	m := ahrs.NewMeasurement()
+	if err := s.Measurement(tEnd, m, true, true, true, true, 0, 0, 0, 0, 0, zero, zero, zero, zero); err != nil {
+		t.Fatalf("Measurement at the end gave error %s", err)
+	}
+	if math.Abs(m.A1) > 1e-3 || math.Abs(m.A2) > 1e-3 || math.Abs(m.A3+1) > 1e-3 {
+		t.Errorf("Measurement at the end gave accelerations %f, %f, %f", m.A1, m.A2, m.A3)
+	}
+}
+
+func TestInterpolateSmooth(t *testing.T) {
+	zero := []float64{0, 0, 0}
+	for _, smooth := range []bool{false, true} {
+		s := *sitTurnDef
+		s.SetSmooth(smooth)
+
+		// The values at the situation's times are the same either way
+		for i, ti := range s.t {
+			var st ahrs.State
+			s.Interpolate(ti, &st, zero, zero, zero)
+			if roll, _, _ := ahrs.FromQuaternion(st.E0, st.E1, st.E2, st.E3); math.Abs(roll/Deg-s.phi[i]) > 1e-6 {
+				t.Errorf("smooth %t: roll at %f was %f, expected %f", smooth, ti, roll/Deg, s.phi[i])
+			}
+		}
+
+		// Rolling into the turn: the roll rate jumps at the start of the roll unless smooth
+		var before, after ahrs.State
+		s.Interpolate(10-1e-3, &before, zero, zero, zero)
+		s.Interpolate(10+1e-3, &after, zero, zero, zero)
+		jump := math.Hypot(after.H1-before.H1, math.Hypot(after.H2-before.H2, after.H3-before.H3))
+		if smooth && jump > 0.1 {
+			t.Errorf("smooth interpolation made the rates jump by %f °/s", jump)
+		}
+		if !smooth && jump < 1 {
+			t.Errorf("linear interpolation made the rates jump by only %f °/s", jump)
+		}
+	}
+}
+
+func TestGyroDrift(t *testing.T) {
+	zero := []float64{0, 0, 0}
+	bias := []float64{1, 0, 0}
+	s := *sitTurnDef
+	s.Seed(1)
+	s.SetGyroDrift(0.01)
+
+	// Straight and level at first, so the gyros read just their bias
+	var st ahrs.State
+	m := ahrs.NewMeasurement()
+	var wandered bool
+	for ti := 1.0; ti < 10; ti++ {
+		s.Interpolate(ti, &st, zero, bias, zero)
+		s.Measurement(ti, m, false, false, true, false, 0, 0, 0, 0, 0, zero, zero, bias, zero)
+		if math.Abs(m.B1-st.D1)+math.Abs(m.B2-st.D2)+math.Abs(m.B3-st.D3) > 1e-6 {
+			t.Errorf("gyros read %f, %f, %f at %f, expected the drifting bias %f, %f, %f",
+				m.B1, m.B2, m.B3, ti, st.D1, st.D2, st.D3)
+		}
+		if st.D1 != bias[0] || st.D2 != 0 {
+			wandered = true
+		}
+	}
+	if !wandered {
+		t.Error("gyro bias didn't drift")
+	}
+	if math.Abs(st.D1-bias[0]) > 0.1 || math.Abs(st.D2) > 0.1 || math.Abs(st.D3) > 0.1 {
+		t.Errorf("gyro bias drifted to %f, %f, %f in 9 s", st.D1, st.D2, st.D3)
+	}
+}
+
+func TestMagField(t *testing.T) {
+	zero := []float64{0, 0, 0}
+	s := *sitTurnDef
+	s.SetMagField(50, 60, 10)
+
+	var st ahrs.State
+	s.Interpolate(5, &st, zero, zero, zero)
+	if b := math.Sqrt(st.N1*st.N1 + st.N2*st.N2 + st.N3*st.N3); math.Abs(b-50) > 1e-6 {
+		t.Errorf("field strength was %f μT, expected 50", b)
+	}
+	if dip := math.Atan2(-st.N3, math.Hypot(st.N1, st.N2)) / Deg; math.Abs(dip-60) > 1e-6 {
+		t.Errorf("inclination was %f°, expected 60", dip)
+	}
+	if decl := math.Atan2(st.N1, st.N2) / Deg; math.Abs(decl-10) > 1e-6 {
+		t.Errorf("declination was %f°, expected 10", decl)
+	}
+
+	// The situation's own field comes back without a strength
+	s.SetMagField(0, 60, 10)
+	s.Interpolate(5, &st, zero, zero, zero)
+	if st.N1 != s.m1[1] || st.N2 != s.m2[1] || st.N3 != s.m3[1] {
+		t.Errorf("field was %f, %f, %f, expected the situation's", st.N1, st.N2, st.N3)
+	}
+}
+
+func TestDivergenceRecovery(t *testing.T) {
+	zero := []float64{0, 0, 0}
+	s := *sitTurnDef
+	s.Seed(1)
+	measure := func(ti float64) *ahrs.Measurement {
+		m := ahrs.NewMeasurement()
+		s.Measurement(ti, m, false, true, true, true, 0, 0.5, 0.01, 0.1, 0.01, zero, zero, zero, zero)
+		return m
+	}
+
+	kf := ahrs.InitializeKalman(measure(0))
+	var tReinit []float64
+	kf.OnReinitialize = func(tr, nis float64) { tReinit = append(tReinit, tr) }
+
+	// Straight and level until the roll-in at 10 s; a large step disturbance rolls the estimate 90°
+	// and turns it 180° away at 2 s
+	const tUpset, tEnd = 2.0, 9.5
+	for ti := 0.05; ti <= tEnd; ti += 0.05 {
+		if ti >= tUpset && ti < tUpset+0.05 {
+			kf.E0, kf.E1, kf.E2, kf.E3 = ahrs.ToQuaternion(90*Deg, 0, 180*Deg)
+		}
+		kf.Compute(measure(ti))
+	}
+
+	if len(tReinit) == 0 || tReinit[0] < tUpset || tReinit[0] > tUpset+5 {
+		t.Fatalf("expected the filter to reinitialize soon after the disturbance at %f s, got %v", tUpset, tReinit)
+	}
+	var st ahrs.State
+	s.Interpolate(tEnd, &st, zero, zero, zero)
+	roll, pitch, heading := kf.RollPitchHeading()
+	roll0, pitch0, heading0 := st.RollPitchHeading()
+	if math.Abs(ahrs.AngleDiff(roll, roll0)) > 5*Deg || math.Abs(ahrs.AngleDiff(pitch, pitch0)) > 5*Deg ||
+		math.Abs(ahrs.AngleDiff(heading, heading0)) > 10*Deg {
+		t.Errorf("after recovery, attitude was %f, %f, %f, expected %f, %f, %f",
+			roll/Deg, pitch/Deg, heading/Deg, roll0/Deg, pitch0/Deg, heading0/Deg)
+	}
+}
+
+func TestTurnRate(t *testing.T) {
+	zero := []float64{0, 0, 0}
+	s := *sitTurnDef
+	s.Seed(1)
+	measure := func(ti float64) *ahrs.Measurement {
+		m := ahrs.NewMeasurement()
+		s.Measurement(ti, m, true, true, true, true, 0.5, 0.5, 0.01, 0.1, 0.01, zero, zero, zero, zero)
+		return m
+	}
+
+	// Two full turns at standard rate between the roll-in and the roll-out
+	kf := ahrs.InitializeKalman(measure(0))
+	var sum float64
+	var n int
+	for ti := 0.1; ti <= 250; ti += 0.1 {
+		kf.Compute(measure(ti))
+		if ti > 60 {
+			sum += kf.TurnRate()
+			n++
+		}
+	}
+	if rate := sum / float64(n); math.Abs(rate-ahrs.StandardRate) > 0.15 {
+		t.Errorf("average turn rate in the standard rate turn was %f °/s, expected %f", rate, ahrs.StandardRate)
+	}
+
+	var st ahrs.State
+	s.Interpolate(100, &st, zero, zero, zero)
+	if rate := st.TurnRate(); math.Abs(rate-ahrs.StandardRate) > 1e-3 {
+		t.Errorf("the situation's own turn rate was %f °/s, expected %f", rate, ahrs.StandardRate)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"../ahrs"
+)
+
+// windLogger writes the algorithm's wind estimate V alongside the actual wind to a CSV file,
+// with the standard deviations of the estimate from its covariance, to validate the wind estimation.
+type windLogger struct {
+	f *os.File
+}
+
+// newWindLogger creates the CSV file fn and writes its header.
+func newWindLogger(fn string) (l *windLogger) {
+	f, err := os.Create(fn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Fprintln(f, "T,V1Actual,V2Actual,V3Actual,V1,V2,V3,DV1,DV2,DV3")
+	return &windLogger{f: f}
+}
+
+// Log writes a line comparing the wind estimate of the algorithm s against the actual state s0.
+// The standard deviations are NaN for algorithms that don't keep a covariance of the wind.
+func (l *windLogger) Log(s0 *ahrs.State, s ahrs.AHRSProvider) {
+	st := s.GetState()
+	dv := st.Uncertainties().Wind
+	fmt.Fprintf(l.f, "%f,%f,%f,%f,%f,%f,%f,%f,%f,%f\n", s0.T, s0.V1, s0.V2, s0.V3,
+		st.V1, st.V2, st.V3, dv[0], dv[1], dv[2])
+}
+
+// Close closes the CSV file.
+func (l *windLogger) Close() {
+	l.f.Close()
+}